@@ -123,6 +123,10 @@ func parseAcceptPart(part string, order int) acceptCriterion {
 	}
 
 	splitType := strings.SplitN(finalType, "/", 2)
+	if len(splitType) < 2 {
+		// Not a valid media range, so make sure that it matches nothing
+		splitType = append(splitType, "")
+	}
 
 	return acceptCriterion{
 		major:      splitType[0],
@@ -160,6 +160,35 @@ var _ = Describe("Accept header tests", func() {
 		Expect(ap.minor).Should(Equal("plain;level=1;foo=bar"))
 		Expect(ap.precedence).Should(BeNumerically("~", 0.5))
 	})
+
+	It("Invalid media range", func() {
+		Expect(SelectMediaType(
+			makeRequest("garbage"),
+			[]string{"text/plain", "application/json"})).Should(Equal(""))
+		Expect(SelectMediaType(
+			makeRequest("garbage, application/json"),
+			[]string{"text/plain", "application/json"})).Should(Equal("application/json"))
+	})
+
+	It("Health media types", func() {
+		Expect(SelectMediaType(
+			makeRequest("*/*"), healthMediaTypes)).Should(Equal("text/plain"))
+		Expect(SelectMediaType(
+			makeRequest("application/yaml"), healthMediaTypes)).Should(Equal("application/yaml"))
+		Expect(SelectMediaType(
+			makeRequest("application/x-yaml"), healthMediaTypes)).Should(Equal("application/x-yaml"))
+		Expect(SelectMediaType(
+			makeRequest("application/yaml, application/json"),
+			healthMediaTypes)).Should(Equal("application/yaml"))
+		Expect(SelectMediaType(
+			makeRequest("application/json;q=0.5, application/yaml;q=0.9, */*;q=0.1"),
+			healthMediaTypes)).Should(Equal("application/yaml"))
+		Expect(SelectMediaType(
+			makeRequest("application/yaml;q=0.2, application/json"),
+			healthMediaTypes)).Should(Equal("application/json"))
+		Expect(SelectMediaType(
+			makeRequest("image/png"), healthMediaTypes)).Should(Equal(""))
+	})
 })
 
 func makeRequest(accept string) *http.Request {
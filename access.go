@@ -0,0 +1,163 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+/*
+AccessRecord describes an application request after it has completed,
+including requests that the scaffold rejected before they reached the
+application handler.
+*/
+type AccessRecord struct {
+	// Time is when the request started
+	Time time.Time
+	// Method and Path come from the request
+	Method string
+	Path   string
+	// Status is the HTTP status code that was returned
+	Status int
+	// Bytes is the number of bytes in the response body
+	Bytes int64
+	// CompressedBytes is the number of bytes in the body as it was sent,
+	// if "SetCompression" compressed it, and zero otherwise
+	CompressedBytes int64
+	// Duration is how long the request took
+	Duration time.Duration
+	// Uptime is how long the scaffold had been running when the request started
+	Uptime time.Duration
+	// ClientIP is the client address, resolved using any trusted proxies
+	ClientIP string
+	// Server is the name from "ServerIdentity"
+	Server string
+	// RequestID is the "X-Request-Id" header of the request, if any
+	RequestID string
+	// Rejection says why the scaffold rejected the request, and is
+	// "RejectionNone" if it reached the application handler
+	Rejection RejectionReason
+}
+
+// requestIDHeader is where "AccessRecord.RequestID" comes from
+const requestIDHeader = "X-Request-Id"
+
+/*
+AccessLogger is a function that is called once for every application
+request after it completes, whether or not the scaffold rejected it. It is called in the same goroutine as the
+request, so it should return quickly.
+*/
+type AccessLogger func(AccessRecord)
+
+/*
+SetAccessLogger sets a function that will be called after every
+application request, including those that the scaffold rejects itself
+because of markdown, shutdown, authentication, rate limits, body size,
+allowed methods, or load shedding. It is not called for the management
+paths.
+*/
+func (s *HTTPScaffold) SetAccessLogger(l AccessLogger) {
+	s.accessLogger = l
+}
+
+func (s *HTTPScaffold) logAccess(
+	req *http.Request, rw *recordingWriter, start time.Time,
+	reason RejectionReason, compressed int64) {
+
+	rec := AccessRecord{
+		Time:            start,
+		Method:          req.Method,
+		Path:            req.URL.Path,
+		Status:          rw.statusCode(),
+		Bytes:           rw.bytes,
+		CompressedBytes: compressed,
+		Duration:        s.since(start),
+		ClientIP:        ClientIP(req),
+		Server:          s.ServerIdentity(),
+		RequestID:       req.Header.Get(requestIDHeader),
+		Rejection:       reason,
+	}
+	if st := s.StartTime(); !st.IsZero() {
+		rec.Uptime = start.Sub(st)
+	}
+	s.accessLogger(rec)
+}
+
+/*
+recordingWriter is a ResponseWriter that records the status code and the
+size of the response.
+*/
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func newRecordingWriter(w http.ResponseWriter) *recordingWriter {
+	return &recordingWriter{
+		ResponseWriter: w,
+	}
+}
+
+/*
+statusCode returns the status that was sent to the client.
+*/
+func (w *recordingWriter) statusCode() int {
+	if w.status == 0 {
+		// Handler wrote nothing, so net/http will send a 200
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(buf []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(buf)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *recordingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("response does not support hijacking")
+}
+
+/*
+Unwrap lets http.ResponseController find the original writer.
+*/
+func (w *recordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
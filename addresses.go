@@ -0,0 +1,213 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/url"
+)
+
+/*
+Addresses describes where a scaffold is listening and which paths it
+serves. The URLs are nil for ports that are not open.
+*/
+type Addresses struct {
+	// Insecure is the URL of the plain HTTP port
+	Insecure *url.URL
+	// Secure is the URL of the HTTPS port
+	Secure *url.URL
+	// Management is the URL where the management paths are served. It is
+	// the same as one of the other URLs if there is no management port.
+	Management *url.URL
+	// TLS is true if the secure port is open
+	TLS          bool
+	HealthPath   string
+	ReadyPath    string
+	MarkdownPath string
+	InfoPath     string
+	StartupPath  string
+	// HealthPaths is the health path followed by its aliases
+	HealthPaths []string
+	// ReadyPaths is the ready path followed by its aliases
+	ReadyPaths []string
+}
+
+/*
+Names of the ports that are not added using "AddPort," for "LookupAddress."
+*/
+const (
+	InsecurePortName   = insecureRole
+	SecurePortName     = secureRole
+	ManagementPortName = managementRole
+)
+
+/*
+AddressesReady returns a channel that is closed once "StartListen" has
+bound all of the ports and started serving them, so that a test that
+calls "Listen" in another goroutine can wait for it before it reads the
+addresses, rather than polling. Once "WaitForShutdown" returns, a new
+channel is used for the next time that the scaffold is opened, so it
+should be called again after each stop.
+*/
+func (s *HTTPScaffold) AddressesReady() <-chan struct{} {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	return s.addrReady
+}
+
+/*
+signalAddressesReady closes the channel from "AddressesReady" if it is
+not closed already. The server lock must be held.
+*/
+func (s *HTTPScaffold) signalAddressesReady() {
+	select {
+	case <-s.addrReady:
+	default:
+		close(s.addrReady)
+	}
+}
+
+/*
+recordAddresses saves the ports that "Open" bound, and their addresses, so
+that "LookupAddress" and an upgrade can read them while another goroutine
+opens or stops the scaffold.
+*/
+func (s *HTTPScaffold) recordAddresses() {
+	addrs := make(map[string]string)
+	var listeners []net.Listener
+	add := func(name string, l net.Listener) {
+		if l != nil {
+			addrs[name] = l.Addr().String()
+			listeners = append(listeners, l)
+		}
+	}
+	add(InsecurePortName, s.insecureListener)
+	add(SecurePortName, s.secureListener)
+	add(ManagementPortName, s.managementListener)
+	for _, p := range s.ports {
+		add(p.name, p.listener)
+	}
+	s.serverLock.Lock()
+	s.addrIndex = addrs
+	s.openListeners = listeners
+	s.serverLock.Unlock()
+}
+
+/*
+clearAddresses forgets the addresses once the ports are closed, and
+replaces the channel from "AddressesReady" for the next "Open."
+*/
+func (s *HTTPScaffold) clearAddresses() {
+	s.serverLock.Lock()
+	s.addrIndex = nil
+	s.openListeners = nil
+	s.addrReady = make(chan struct{})
+	s.serverLock.Unlock()
+}
+
+/*
+LookupAddress returns the address where we are listening on a port, and
+whether that port is open. The port is one of "InsecurePortName,"
+"SecurePortName," and "ManagementPortName," or a name that was passed to
+"AddPort." The empty name means the insecure port, as for "Address."
+Unlike the other address methods, it says so explicitly if the port is
+not open yet, is not in use, or has been closed by "WaitForShutdown,"
+rather than returning an empty string. It is safe to call while another
+goroutine opens or stops the scaffold.
+*/
+func (s *HTTPScaffold) LookupAddress(name string) (string, bool) {
+	if name == "" {
+		name = InsecurePortName
+	}
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	addr, ok := s.addrIndex[name]
+	return addr, ok
+}
+
+/*
+InsecureURL returns the base URL of the plain HTTP port, with the port
+number that was actually bound. It returns nil if "Open" has not been
+called or if the port is not in use.
+*/
+func (s *HTTPScaffold) InsecureURL() *url.URL {
+	return listenerURL("http", s.insecureListener)
+}
+
+/*
+SecureURL returns the base URL of the HTTPS port, with the port number that
+was actually bound. It returns nil if "Open" has not been called or if the
+port is not in use.
+*/
+func (s *HTTPScaffold) SecureURL() *url.URL {
+	return listenerURL("https", s.secureListener)
+}
+
+/*
+ManagementURL returns the base URL where the management paths are served.
+That is the management port if "SetManagementPort" was called, and
+otherwise the insecure or secure port. It returns nil if "Open" has not
+been called.
+*/
+func (s *HTTPScaffold) ManagementURL() *url.URL {
+	if s.managementPort >= 0 {
+		return listenerURL("http", s.managementListener)
+	}
+	if u := s.InsecureURL(); u != nil {
+		return u
+	}
+	return s.SecureURL()
+}
+
+/*
+Addresses returns all the URLs and paths of the scaffold in one place.
+It returns nil if "Open" has not been called.
+*/
+func (s *HTTPScaffold) Addresses() *Addresses {
+	if !s.open {
+		return nil
+	}
+	return &Addresses{
+		Insecure:     s.InsecureURL(),
+		Secure:       s.SecureURL(),
+		Management:   s.ManagementURL(),
+		TLS:          s.secureListener != nil,
+		HealthPath:   s.healthPath,
+		ReadyPath:    s.readyPath,
+		MarkdownPath: s.markdownPath,
+		InfoPath:     s.infoPath,
+		StartupPath:  s.startupPath,
+		HealthPaths:  s.healthPaths(),
+		ReadyPaths:   s.readyPaths(),
+	}
+}
+
+/*
+listenerURL builds a URL from the listener's address. JoinHostPort puts
+brackets around IPv6 literals.
+*/
+func listenerURL(scheme string, l net.Listener) *url.URL {
+	if l == nil {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return nil
+	}
+	return &url.URL{
+		Scheme: scheme,
+		Host:   net.JoinHostPort(host, port),
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Address tests", func() {
+	It("Not open", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		Expect(s.InsecureURL()).Should(BeNil())
+		Expect(s.SecureURL()).Should(BeNil())
+		Expect(s.ManagementURL()).Should(BeNil())
+		Expect(s.Addresses()).Should(BeNil())
+	})
+
+	It("Open ports", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		defer closeScaffold(s)
+
+		u := s.InsecureURL()
+		Expect(u).ShouldNot(BeNil())
+		Expect(u.Scheme).Should(Equal("http"))
+		Expect(u.Host).Should(Equal(s.InsecureAddress()))
+		Expect(u.Port()).ShouldNot(Equal("0"))
+		Expect(s.SecureURL()).Should(BeNil())
+		Expect(s.ManagementURL().Host).Should(Equal(s.ManagementAddress()))
+
+		a := s.Addresses()
+		Expect(a).ShouldNot(BeNil())
+		Expect(a.Insecure).Should(Equal(u))
+		Expect(a.Secure).Should(BeNil())
+		Expect(a.Management).Should(Equal(s.ManagementURL()))
+		Expect(a.TLS).Should(BeFalse())
+		Expect(a.HealthPath).Should(Equal("/health"))
+		Expect(a.ReadyPath).Should(Equal("/ready"))
+	})
+
+	It("Secure and shared management", func() {
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetSecurePort(0)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		defer closeScaffold(s)
+
+		Expect(s.InsecureURL()).Should(BeNil())
+		Expect(s.SecureURL().Scheme).Should(Equal("https"))
+		Expect(s.ManagementURL()).Should(Equal(s.SecureURL()))
+		Expect(s.Addresses().TLS).Should(BeTrue())
+	})
+
+	It("IPv6", func() {
+		l, err := net.Listen("tcp", "[::1]:0")
+		if err != nil {
+			Skip("IPv6 is not available")
+		}
+		defer l.Close()
+		port := l.Addr().(*net.TCPAddr).Port
+
+		u := listenerURL("http", l)
+		Expect(u.Host).Should(Equal("[::1]:" + strconv.Itoa(port)))
+		Expect(u.Hostname()).Should(Equal("::1"))
+		Expect(u.String()).Should(Equal("http://[::1]:" + strconv.Itoa(port)))
+	})
+
+	It("Usable URL", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(func() int {
+			code, _ := getText(s.ManagementURL().String() + "/health")
+			return code
+		}, 5*time.Second).Should(Equal(200))
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Addresses ready", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		Expect(s.AddPort("private", 0)).Should(Succeed())
+		_, ok := s.LookupAddress(ManagementPortName)
+		Expect(ok).Should(BeFalse())
+		ready := s.AddressesReady()
+		Expect(ready).ShouldNot(BeClosed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.ListenRoutes(map[string]http.Handler{
+				"":        &testHandler{},
+				"private": &testHandler{},
+			})
+		}()
+		Eventually(ready, 5*time.Second).Should(BeClosed())
+
+		for _, name := range []string{"", InsecurePortName, ManagementPortName, "private"} {
+			addr, ok := s.LookupAddress(name)
+			Expect(ok).Should(BeTrue(), name)
+			Expect(addr).ShouldNot(BeEmpty(), name)
+		}
+		addr, _ := s.LookupAddress(InsecurePortName)
+		Expect(addr).Should(Equal(s.InsecureAddress()))
+		addr, _ = s.LookupAddress(ManagementPortName)
+		Expect(addr).Should(Equal(s.ManagementAddress()))
+		_, ok = s.LookupAddress(SecurePortName)
+		Expect(ok).Should(BeFalse())
+		_, ok = s.LookupAddress("other")
+		Expect(ok).Should(BeFalse())
+
+		// Serving has started, so the health path is ready right away
+		code, _ := getText(s.ManagementURL().String() + "/health")
+		Expect(code).Should(Equal(200))
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+
+		// There is a new channel as soon as we stop, before opening again
+		Expect(s.AddressesReady()).ShouldNot(BeClosed())
+		_, ok = s.LookupAddress(InsecurePortName)
+		Expect(ok).Should(BeFalse())
+		Expect(s.Open()).Should(Succeed())
+		Expect(s.AddressesReady()).ShouldNot(BeClosed())
+		closeScaffold(s)
+	})
+
+	It("Addresses while restarting", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		done := make(chan struct{})
+		lookups := make(chan struct{})
+		go func() {
+			defer close(lookups)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					s.LookupAddress("")
+					s.AddressesReady()
+				}
+			}
+		}()
+
+		for round := 0; round < 3; round++ {
+			ready := s.AddressesReady()
+			stopChan := make(chan error)
+			go func() {
+				stopChan <- s.Listen(&testHandler{})
+			}()
+			Eventually(ready, 5*time.Second).Should(BeClosed())
+			addr, ok := s.LookupAddress("")
+			Expect(ok).Should(BeTrue())
+			Expect(testGet(s, "/health")).Should(BeTrue())
+			s.Shutdown(nil)
+			Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+			Expect(addr).ShouldNot(BeEmpty())
+		}
+		close(done)
+		<-lookups
+	})
+
+	It("Reserved port names", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.AddPort(ManagementPortName, 0)).Should(MatchError(`port name "management" is reserved`))
+		Expect(s.AddPort(InsecurePortName, 0)).ShouldNot(Succeed())
+		Expect(s.AddPort(SecurePortName, 0)).ShouldNot(Succeed())
+	})
+})
+
+func closeScaffold(s *HTTPScaffold) {
+	s.Shutdown(nil)
+	s.WaitForShutdown()
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+)
+
+type claimsKey struct{}
+
+/*
+ErrInsufficientScope may be returned by a TokenValidator to indicate that
+the token is valid but does not grant access. The request will be rejected
+with 403 rather than 401.
+*/
+var ErrInsufficientScope = errors.New("insufficient scope")
+
+/*
+TokenClaims are the claims from a validated bearer token.
+*/
+type TokenClaims map[string]interface{}
+
+/*
+TokenValidator is a function that validates a bearer token. It returns the
+claims from the token if it is valid, and an error otherwise.
+*/
+type TokenValidator func(ctx context.Context, token string) (TokenClaims, error)
+
+/*
+SetTokenValidator sets the function that validates bearer tokens on
+requests to paths enabled using "EnableBearerAuth."
+*/
+func (s *HTTPScaffold) SetTokenValidator(v TokenValidator) {
+	s.tokenValidator = v
+}
+
+/*
+EnableBearerAuth directs the scaffold to require a valid bearer token in
+the "Authorization" header of application requests before they are passed
+to the handler. Requests without a token, or with one that the validator
+rejects, get 401 with a "WWW-Authenticate" header. If the validator returns
+"ErrInsufficientScope," then the request gets 403 instead. If no paths are
+specified, then every request is checked; otherwise only requests for
+one of the paths, or for a path below it, are checked. So "/admin" covers
+"/admin/users" but not "/administrator." The health, ready, and other
+management paths are never checked. "SetTokenValidator" must also be called.
+*/
+func (s *HTTPScaffold) EnableBearerAuth(paths ...string) {
+	s.bearerAuth = true
+	s.bearerPaths = paths
+}
+
+/*
+Claims returns the claims from the bearer token that was validated for
+the request, or nil if there were none.
+*/
+func Claims(req *http.Request) TokenClaims {
+	c, _ := req.Context().Value(claimsKey{}).(TokenClaims)
+	return c
+}
+
+func (s *HTTPScaffold) needsBearerAuth(req *http.Request) bool {
+	if !s.bearerAuth {
+		return false
+	}
+	if len(s.bearerPaths) == 0 {
+		return true
+	}
+	for _, p := range s.bearerPaths {
+		if req.URL.Path == p ||
+			strings.HasPrefix(req.URL.Path, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+checkBearerAuth validates the token on the request if necessary. It returns
+a new request with the claims in its context, or nil if it has already
+rejected the request.
+*/
+func (s *HTTPScaffold) checkBearerAuth(
+	resp http.ResponseWriter, req *http.Request) *http.Request {
+
+	if !s.needsBearerAuth(req) {
+		return req
+	}
+
+	token, ok := bearerToken(req)
+	if !ok {
+		s.discardBody(resp, req)
+		s.markRejected(resp)
+		resp.Header().Set("WWW-Authenticate", "Bearer")
+		WriteErrorResponse(http.StatusUnauthorized, "Bearer token required", resp)
+		return nil
+	}
+	if s.tokenValidator == nil {
+		s.discardBody(resp, req)
+		s.markRejected(resp)
+		resp.Header().Set("WWW-Authenticate", bearerChallenge("invalid_token", "no validator"))
+		WriteErrorResponse(http.StatusUnauthorized, "Token validation not configured", resp)
+		return nil
+	}
+
+	claims, err := s.tokenValidator(req.Context(), token)
+	if err != nil {
+		s.discardBody(resp, req)
+	}
+	// The validator's own message stays out of the response, since it
+	// may say more about the validator than a client should know
+	if errors.Is(err, ErrInsufficientScope) {
+		s.markRejected(resp)
+		resp.Header().Set("WWW-Authenticate",
+			bearerChallenge("insufficient_scope", "Token does not grant access"))
+		WriteErrorResponse(http.StatusForbidden, "Token does not grant access", resp)
+		return nil
+	}
+	if err != nil {
+		s.markRejected(resp)
+		resp.Header().Set("WWW-Authenticate", bearerChallenge("invalid_token", "Token is not valid"))
+		WriteErrorResponse(http.StatusUnauthorized, "Token is not valid", resp)
+		return nil
+	}
+
+	return req.WithContext(context.WithValue(req.Context(), claimsKey{}, claims))
+}
+
+/*
+bearerToken returns the token from the "Authorization" header, and false
+if there is no bearer token.
+*/
+func bearerToken(req *http.Request) (string, bool) {
+	hdr := req.Header.Get("Authorization")
+	if len(hdr) < 7 || !strings.EqualFold(hdr[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(hdr[7:]), true
+}
+
+/*
+hasValidToken returns true if the request has a bearer token that the
+validator accepts, whether or not its path needs one.
+*/
+func (s *HTTPScaffold) hasValidToken(req *http.Request) bool {
+	token, ok := bearerToken(req)
+	if !ok || s.tokenValidator == nil {
+		return false
+	}
+	_, err := s.tokenValidator(req.Context(), token)
+	return err == nil
+}
+
+func bearerChallenge(code, desc string) string {
+	return fmt.Sprintf(`Bearer error="%s", error_description="%s"`, code, desc)
+}
+
+/*
+NewRS256Validator returns a TokenValidator that accepts JWTs signed with
+RS256 using the specified key. The expiration and "not before" times of
+the token are also checked.
+*/
+func NewRS256Validator(key *rsa.PublicKey) TokenValidator {
+	return func(ctx context.Context, token string) (TokenClaims, error) {
+		jwt, err := jws.ParseJWT([]byte(token))
+		if err != nil {
+			return nil, err
+		}
+		err = jwt.Validate(key, crypto.SigningMethodRS256)
+		if err != nil {
+			return nil, err
+		}
+		return TokenClaims(jwt.Claims()), nil
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/SermoDigital/jose/crypto"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bearer auth tests", func() {
+	It("RS256 bearer auth", func() {
+		certBytes, err := ioutil.ReadFile("./testkeys/jwtcert.pem")
+		Expect(err).Should(Succeed())
+		cert, err := crypto.ParseRSAPublicKeyFromPEM(certBytes)
+		Expect(err).Should(Succeed())
+
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetTokenValidator(NewRS256Validator(cert))
+		s.EnableBearerAuth("/private")
+		stopChan := make(chan error)
+		err = s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&claimsHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		url := fmt.Sprintf("http://%s/private", s.InsecureAddress())
+		resp := getWithToken(url, "")
+		Expect(resp.StatusCode).Should(Equal(401))
+		Expect(resp.Header.Get("WWW-Authenticate")).Should(Equal("Bearer"))
+
+		resp = getWithToken(url, "DEADBEEF")
+		Expect(resp.StatusCode).Should(Equal(401))
+		Expect(resp.Header.Get("WWW-Authenticate")).Should(HavePrefix(`Bearer error="invalid_token"`))
+
+		resp = getWithToken(url, string(createJWT()))
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Header.Get("X-Subject")).Should(Equal("http://github.com/apid/goscaffold"))
+
+		// Unprotected paths and health checks need no token
+		resp = getWithToken(fmt.Sprintf("http://%s/public", s.InsecureAddress()), "")
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Header.Get("X-Subject")).Should(BeEmpty())
+		resp = getWithToken(fmt.Sprintf("http://%s/privateer", s.InsecureAddress()), "")
+		Expect(resp.StatusCode).Should(Equal(200))
+		resp = getWithToken(fmt.Sprintf("http://%s/private/stuff", s.InsecureAddress()), "")
+		Expect(resp.StatusCode).Should(Equal(401))
+		resp = getWithToken(fmt.Sprintf("http://%s/health", s.InsecureAddress()), "")
+		Expect(resp.StatusCode).Should(Equal(200))
+		resp = getWithToken(fmt.Sprintf("http://%s/ready", s.InsecureAddress()), "")
+		Expect(resp.StatusCode).Should(Equal(200))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Custom validator", func() {
+		s := CreateHTTPScaffold()
+		s.SetTokenValidator(func(ctx context.Context, tok string) (TokenClaims, error) {
+			switch tok {
+			case "good":
+				return TokenClaims{"sub": "good"}, nil
+			case "limited":
+				return nil, ErrInsufficientScope
+			case "wrapped":
+				return nil, fmt.Errorf("role check: %w", ErrInsufficientScope)
+			default:
+				return nil, fmt.Errorf("bad token %q", tok)
+			}
+		})
+		s.EnableBearerAuth()
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&claimsHandler{})
+		}()
+
+		url := fmt.Sprintf("http://%s/", s.InsecureAddress())
+		Eventually(func() int {
+			return getWithToken(url, "good").StatusCode
+		}, 5*time.Second).Should(Equal(200))
+
+		resp := getWithToken(url, "limited")
+		Expect(resp.StatusCode).Should(Equal(403))
+		Expect(resp.Header.Get("WWW-Authenticate")).Should(HavePrefix(`Bearer error="insufficient_scope"`))
+		resp = getWithToken(url, "wrapped")
+		Expect(resp.StatusCode).Should(Equal(403))
+
+		// The validator's message is not sent to the client
+		resp = getWithToken(url, "other")
+		Expect(resp.StatusCode).Should(Equal(401))
+		Expect(resp.Header.Get("WWW-Authenticate")).Should(
+			Equal(`Bearer error="invalid_token", error_description="Token is not valid"`))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
+
+func getWithToken(url, token string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	Expect(err).Should(Succeed())
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).Should(Succeed())
+	resp.Body.Close()
+	return resp
+}
+
+type claimsHandler struct {
+}
+
+func (h *claimsHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if c := Claims(req); c != nil {
+		resp.Header().Set("X-Subject", fmt.Sprint(c["sub"]))
+	}
+}
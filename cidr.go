@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+/*
+ipList is a list of networks that an address may be matched against.
+*/
+type ipList []*net.IPNet
+
+/*
+parseCIDRs parses a list of CIDRs. IPv4-mapped IPv6 networks are converted
+to plain IPv4 so that they match IPv4 addresses.
+*/
+func parseCIDRs(cidrs []string) (ipList, error) {
+	var l ipList
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %s", c, err)
+		}
+		ones, bits := n.Mask.Size()
+		if bits == 8*net.IPv6len && ones >= 96 && n.IP.To4() != nil {
+			n = &net.IPNet{
+				IP:   n.IP.To4(),
+				Mask: net.CIDRMask(ones-96, 8*net.IPv4len),
+			}
+		}
+		l = append(l, n)
+	}
+	return l, nil
+}
+
+func (l ipList) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+remoteIP returns the IP address of the peer that sent the request, or nil
+if it can't be parsed.
+*/
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+/*
+SetManagementAllowedCIDRs restricts the health, ready, diagnostic, and other
+management paths to clients whose address is in one of the networks in the
+list. Requests from other addresses get 403 before any handler runs. Both
+IPv4 and IPv6 networks are supported, and IPv4 clients that connect using
+IPv4-mapped IPv6 addresses match IPv4 networks. An empty list allows all
+clients, which is the default. An error is returned if any of the CIDRs
+is invalid, in which case the current list is not changed.
+*/
+func (s *HTTPScaffold) SetManagementAllowedCIDRs(cidrs []string) error {
+	l, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.managementAllowed = l
+	return nil
+}
+
+/*
+managementAllowedFrom returns true if the management paths may be called
+by the client that sent this request.
+*/
+func (s *HTTPScaffold) managementAllowedFrom(req *http.Request) bool {
+	if len(s.managementAllowed) == 0 {
+		return true
+	}
+	return s.managementAllowed.contains(clientIP(req))
+}
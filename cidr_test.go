@@ -0,0 +1,77 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CIDR tests", func() {
+	It("Parse errors", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.SetManagementAllowedCIDRs([]string{"10.0.0.0/8"})).Should(Succeed())
+		Expect(s.SetManagementAllowedCIDRs([]string{"10.0.0.0/8", "bogus"})).ShouldNot(Succeed())
+		Expect(s.SetManagementAllowedCIDRs([]string{"10.0.0.1"})).ShouldNot(Succeed())
+		Expect(s.managementAllowed).Should(HaveLen(1))
+	})
+
+	It("IPv4 and IPv6 matching", func() {
+		l, err := parseCIDRs([]string{"10.0.0.0/8", "fd00::/8", "::ffff:192.168.0.0/112"})
+		Expect(err).Should(Succeed())
+		Expect(l.contains(net.ParseIP("10.1.2.3"))).Should(BeTrue())
+		Expect(l.contains(net.ParseIP("11.1.2.3"))).Should(BeFalse())
+		Expect(l.contains(net.ParseIP("fd12::1"))).Should(BeTrue())
+		Expect(l.contains(net.ParseIP("fe80::1"))).Should(BeFalse())
+
+		// IPv4-mapped IPv6 clients match IPv4 networks, and vice versa
+		Expect(l.contains(net.ParseIP("::ffff:10.9.8.7"))).Should(BeTrue())
+		Expect(l.contains(net.ParseIP("::ffff:11.9.8.7"))).Should(BeFalse())
+		Expect(l.contains(net.ParseIP("192.168.4.5"))).Should(BeTrue())
+		Expect(l.contains(net.ParseIP("::ffff:192.168.4.5"))).Should(BeTrue())
+		Expect(l.contains(net.ParseIP("192.169.4.5"))).Should(BeFalse())
+		Expect(l.contains(nil)).Should(BeFalse())
+	})
+
+	It("Management allowlist", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		Expect(s.SetManagementAllowedCIDRs([]string{"127.0.0.0/8", "::1/128"})).Should(Succeed())
+		s.tracker = startRequestTracker(DefaultGraceTimeout)
+		mh := s.createManagementHandler()
+		mh.child = &testHandler{}
+
+		try := func(addr, path string) int {
+			req := httptest.NewRequest("GET", path, nil)
+			req.RemoteAddr = addr
+			rec := httptest.NewRecorder()
+			mh.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		Expect(try("127.0.0.1:1234", "/health")).Should(Equal(http.StatusOK))
+		Expect(try("[::1]:1234", "/health")).Should(Equal(http.StatusOK))
+		Expect(try("[::ffff:127.0.0.1]:1234", "/health")).Should(Equal(http.StatusOK))
+		Expect(try("10.0.0.1:1234", "/health")).Should(Equal(http.StatusForbidden))
+		Expect(try("[fd00::1]:1234", "/debug/pprof/")).Should(Equal(http.StatusForbidden))
+
+		// Application requests on the same port are not affected
+		Expect(try("10.0.0.1:1234", "/app")).Should(Equal(http.StatusOK))
+	})
+})
@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+/*
+SetTrustedProxies sets the networks of the proxies that sit in front of the
+server. When a request arrives directly from one of them, the scaffold walks
+the "X-Forwarded-For" header from right to left, skipping addresses that are
+also trusted proxies, and uses the first one that isn't as the client
+address. When a request arrives from anywhere else, "X-Forwarded-For" is
+ignored, so that clients can't spoof their address. The client address is
+used by the management allowlist, is placed in access records, and is
+returned by "ClientIP." An error is returned if any of the CIDRs is invalid.
+*/
+func (s *HTTPScaffold) SetTrustedProxies(cidrs []string) error {
+	l, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	s.trustedProxies = l
+	return nil
+}
+
+/*
+ClientIP returns the address of the client that sent the request, as
+resolved using the trusted proxies set by "SetTrustedProxies." If the
+request did not pass through the scaffold, it is the peer address.
+*/
+func ClientIP(req *http.Request) string {
+	ip := clientIP(req)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func clientIP(req *http.Request) net.IP {
+	if ip, ok := req.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(req)
+}
+
+/*
+resolveClient figures out the client address and stores it in the request
+context, unless that has already been done.
+*/
+func (s *HTTPScaffold) resolveClient(req *http.Request) *http.Request {
+	if _, ok := req.Context().Value(clientIPKey{}).(net.IP); ok {
+		return req
+	}
+	ip := resolveForwarded(remoteIP(req), req.Header["X-Forwarded-For"], s.trustedProxies)
+	return req.WithContext(context.WithValue(req.Context(), clientIPKey{}, ip))
+}
+
+/*
+resolveForwarded returns the first untrusted address in the forwarding
+chain, starting with the direct peer and working backwards.
+*/
+func resolveForwarded(peer net.IP, xff []string, trusted ipList) net.IP {
+	if len(trusted) == 0 || !trusted.contains(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, h := range xff {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// Can't trust anything to the left of garbage
+			break
+		}
+		client = ip
+		if !trusted.contains(ip) {
+			break
+		}
+	}
+	return client
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Client IP tests", func() {
+	var trusted ipList
+
+	BeforeEach(func() {
+		var err error
+		trusted, err = parseCIDRs([]string{"10.0.0.0/8", "fd00::/8"})
+		Expect(err).Should(Succeed())
+	})
+
+	resolve := func(peer string, xff ...string) string {
+		return resolveForwarded(net.ParseIP(peer), xff, trusted).String()
+	}
+
+	It("Untrusted peer", func() {
+		Expect(resolve("1.2.3.4")).Should(Equal("1.2.3.4"))
+		Expect(resolve("1.2.3.4", "5.6.7.8")).Should(Equal("1.2.3.4"))
+	})
+
+	It("Trusted peer", func() {
+		Expect(resolve("10.0.0.1")).Should(Equal("10.0.0.1"))
+		Expect(resolve("10.0.0.1", "5.6.7.8")).Should(Equal("5.6.7.8"))
+		Expect(resolve("10.0.0.1", "9.9.9.9, 5.6.7.8, 10.1.1.1")).Should(Equal("5.6.7.8"))
+		Expect(resolve("10.0.0.1", "9.9.9.9", "5.6.7.8, 10.1.1.1")).Should(Equal("5.6.7.8"))
+		Expect(resolve("fd00::1", "2001:db8::1")).Should(Equal("2001:db8::1"))
+	})
+
+	It("All hops trusted", func() {
+		Expect(resolve("10.0.0.1", "10.2.2.2, 10.1.1.1")).Should(Equal("10.2.2.2"))
+	})
+
+	It("Garbage in header", func() {
+		Expect(resolve("10.0.0.1", "5.6.7.8, garbage, 10.1.1.1")).Should(Equal("10.1.1.1"))
+	})
+
+	It("Used by allowlist", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		Expect(s.SetTrustedProxies([]string{"10.0.0.0/8"})).Should(Succeed())
+		Expect(s.SetManagementAllowedCIDRs([]string{"192.168.0.0/16"})).Should(Succeed())
+		s.tracker = startRequestTracker(DefaultGraceTimeout)
+		mh := s.createManagementHandler()
+
+		try := func(peer, xff string) int {
+			req := httptest.NewRequest("GET", "/health", nil)
+			req.RemoteAddr = peer
+			if xff != "" {
+				req.Header.Set("X-Forwarded-For", xff)
+			}
+			rec := httptest.NewRecorder()
+			mh.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		Expect(try("10.0.0.1:80", "192.168.1.1")).Should(Equal(http.StatusOK))
+		Expect(try("10.0.0.1:80", "")).Should(Equal(http.StatusForbidden))
+		// Spoofed header from an untrusted peer is ignored
+		Expect(try("1.2.3.4:80", "192.168.1.1")).Should(Equal(http.StatusForbidden))
+	})
+
+	It("ClientIP without scaffold", func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "1.2.3.4:5678"
+		Expect(ClientIP(req)).Should(Equal("1.2.3.4"))
+	})
+})
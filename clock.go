@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+)
+
+/*
+Clock is the source of time for the scaffold's timers, such as the grace
+timeout, drain logging, and the health cache. The default is the real
+clock. The "scaffoldtest" package has a fake clock that tests can advance
+by hand.
+*/
+type Clock = clock.Clock
+
+/*
+Timer is a timer created by a Clock.
+*/
+type Timer = clock.Timer
+
+/*
+SetClock replaces the clock that the scaffold uses for all of its timing.
+It must be called before "Open," "Listen," or "Handlers." It is meant for
+tests; the default real clock is right for everything else.
+*/
+func (s *HTTPScaffold) SetClock(c Clock) {
+	s.clock = c
+	s.appConns.clock = c
+	s.mgmtConns.clock = c
+}
+
+/*
+since returns the time that has passed since "t" according to our clock.
+*/
+func (s *HTTPScaffold) since(t time.Time) time.Duration {
+	return clock.Since(s.clock, t)
+}
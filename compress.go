@@ -0,0 +1,315 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+/*
+DefaultCompressionTypes are the content types that are compressed if
+"SetCompression" is not given a list. Types that end with a "/" match
+every subtype.
+*/
+var DefaultCompressionTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-ndjson",
+	"image/svg+xml",
+}
+
+/*
+SetCompression turns on gzip compression of application responses for
+clients that send "Accept-Encoding: gzip." Only responses of at least
+"minSize" bytes whose content type is in "types" are compressed, and
+never ones that the handler has already encoded by setting
+"Content-Encoding." If "types" is nil then "DefaultCompressionTypes" is
+used. Entries in "types" that end with a "/" match every subtype. Every
+response that is eligible for compression gets "Vary: Accept-Encoding"
+whether or not the client accepted it. Compression works with
+"http.Flusher," so streaming responses are compressed as they go, while
+upgrades such as WebSockets are never touched.
+*/
+func (s *HTTPScaffold) SetCompression(enabled bool, minSize int, types []string) {
+	s.compression = enabled
+	s.compressMin = minSize
+	if types == nil {
+		types = DefaultCompressionTypes
+	}
+	s.compressTypes = types
+}
+
+/*
+compressResponse returns a writer that compresses the response if it
+turns out to be eligible, or nil if compression is off for the request.
+*/
+func (s *HTTPScaffold) compressResponse(resp http.ResponseWriter, req *http.Request) *compressWriter {
+	if !s.compression || req.Method == http.MethodHead || isUpgrade(req) {
+		return nil
+	}
+	return &compressWriter{
+		ResponseWriter: resp,
+		s:              s,
+		accepted:       acceptsGzip(req),
+	}
+}
+
+/*
+acceptsGzip returns true if the "Accept-Encoding" header allows gzip.
+*/
+func acceptsGzip(req *http.Request) bool {
+	accepted := false
+	for _, v := range req.Header["Accept-Encoding"] {
+		for _, part := range strings.Split(v, ",") {
+			coding, q := parseCoding(part)
+			switch coding {
+			case "gzip":
+				return q > 0
+			case "*":
+				accepted = q > 0
+			}
+		}
+	}
+	return accepted
+}
+
+func parseCoding(part string) (string, float64) {
+	fields := strings.Split(part, ";")
+	coding := strings.ToLower(strings.TrimSpace(fields[0]))
+	q := 1.0
+	for _, f := range fields[1:] {
+		f = strings.TrimSpace(f)
+		if strings.HasPrefix(f, "q=") {
+			if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return coding, q
+}
+
+/*
+compressible returns true if the content type is in the list.
+*/
+func (s *HTTPScaffold) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range s.compressTypes {
+		t = strings.ToLower(t)
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(mt, t) {
+				return true
+			}
+		} else if mt == t {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+compressWriter holds on to the start of the response until it knows
+whether it is big enough to compress, and then either compresses it or
+passes it through unchanged.
+*/
+type compressWriter struct {
+	http.ResponseWriter
+	s        *HTTPScaffold
+	accepted bool
+	status   int
+	buf      []byte
+	decided  bool
+	gz       *gzip.Writer
+	hijacked bool
+	// written counts the compressed bytes that were sent
+	written int64
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.decided || w.status != 0 {
+		return
+	}
+	if code < 200 {
+		// Informational responses go straight through
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+	if !bodyAllowed(code) {
+		w.decide(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.s.compressMin {
+			return len(b), nil
+		}
+		w.decide(true)
+		if err := w.flushBuffer(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+/*
+decide looks at the headers and the start of the body to decide whether
+to compress, writes the headers, and leaves the buffered body for
+"flushBuffer." "big" is false if the body may be smaller than the minimum.
+*/
+func (w *compressWriter) decide(big bool) {
+	w.decided = true
+	hdr := w.Header()
+	if bodyAllowed(w.status) && hdr.Get("Content-Type") == "" && len(w.buf) > 0 {
+		// net/http would sniff the compressed bytes otherwise
+		hdr.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	eligible := bodyAllowed(w.status) &&
+		w.status != http.StatusPartialContent &&
+		hdr.Get("Content-Encoding") == "" &&
+		hdr.Get("Content-Range") == "" &&
+		w.s.compressible(hdr.Get("Content-Type"))
+	if eligible {
+		hdr.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && big && w.accepted {
+		hdr.Del("Content-Length")
+		hdr.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(&countingWriter{w: w.ResponseWriter, n: &w.written})
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *compressWriter) flushBuffer() error {
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (w *compressWriter) Flush() {
+	if w.hijacked {
+		return
+	}
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		// Streaming responses are worth compressing even if they start small
+		w.decide(true)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	c, rw, err := h.Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return c, rw, err
+}
+
+/*
+Unwrap lets http.ResponseController find the original writer.
+*/
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+/*
+finish sends whatever is still buffered once the handler returns. It is
+safe to call on a nil writer.
+*/
+func (w *compressWriter) finish() {
+	if w == nil || w.hijacked {
+		return
+	}
+	if !w.decided {
+		if w.status == 0 {
+			// Nothing was written, so leave it to net/http
+			return
+		}
+		w.decide(false)
+		w.flushBuffer()
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+/*
+compressedBytes returns the size of the compressed body, or zero if the
+response was not compressed. It is safe to call on a nil writer.
+*/
+func (w *compressWriter) compressedBytes() int64 {
+	if w == nil || w.gz == nil {
+		return 0
+	}
+	return w.written
+}
+
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	*c.n += int64(n)
+	return n, err
+}
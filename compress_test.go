@@ -0,0 +1,185 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Compression tests", func() {
+	bigJSON := "[" + strings.Repeat(`{"name":"value"},`, 200) + "{}]"
+
+	get := func(h http.Handler, path, encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if encoding != "" {
+			req.Header.Set("Accept-Encoding", encoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	gunzip := func(body string) string {
+		r, err := gzip.NewReader(strings.NewReader(body))
+		Expect(err).Should(Succeed())
+		bod, err := ioutil.ReadAll(r)
+		Expect(err).Should(Succeed())
+		return string(bod)
+	}
+
+	It("Compress eligible responses", func() {
+		s := CreateHTTPScaffold()
+		s.SetCompression(true, 1024, nil)
+		var records []AccessRecord
+		s.SetAccessLogger(func(r AccessRecord) {
+			records = append(records, r)
+		})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/png":
+				resp.Header().Set("Content-Type", "image/png")
+				resp.Write([]byte(bigJSON))
+			case "/encoded":
+				resp.Header().Set("Content-Type", "application/json")
+				resp.Header().Set("Content-Encoding", "br")
+				resp.Write([]byte(bigJSON))
+			case "/small":
+				resp.Header().Set("Content-Type", "application/json")
+				resp.Write([]byte("{}"))
+			case "/empty":
+				resp.WriteHeader(http.StatusNoContent)
+			default:
+				// Split the body across writes, and leave the type to be sniffed
+				resp.Header().Set("Content-Length", "9999")
+				resp.Write([]byte(bigJSON[:100]))
+				resp.Write([]byte(bigJSON[100:]))
+			}
+		}))
+
+		rec := get(h, "/", "deflate, gzip;q=0.5")
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Header().Get("Content-Encoding")).Should(Equal("gzip"))
+		Expect(rec.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+		Expect(rec.Header().Get("Content-Length")).Should(BeEmpty())
+		Expect(rec.Header().Get("Content-Type")).Should(HavePrefix("text/plain"))
+		Expect(gunzip(rec.Body.String())).Should(Equal(bigJSON))
+		Expect(records[0].Bytes).Should(BeEquivalentTo(len(bigJSON)))
+		Expect(records[0].CompressedBytes).Should(BeEquivalentTo(rec.Body.Len()))
+		Expect(records[0].CompressedBytes).Should(BeNumerically("<", records[0].Bytes))
+
+		rec = get(h, "/", "")
+		Expect(rec.Header().Get("Content-Encoding")).Should(BeEmpty())
+		Expect(rec.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+		Expect(rec.Body.String()).Should(Equal(bigJSON))
+		Expect(records[1].CompressedBytes).Should(BeZero())
+
+		rec = get(h, "/", "gzip;q=0")
+		Expect(rec.Header().Get("Content-Encoding")).Should(BeEmpty())
+
+		rec = get(h, "/png", "gzip")
+		Expect(rec.Header().Get("Content-Encoding")).Should(BeEmpty())
+		Expect(rec.Header().Get("Vary")).Should(BeEmpty())
+		Expect(rec.Body.String()).Should(Equal(bigJSON))
+
+		rec = get(h, "/encoded", "gzip")
+		Expect(rec.Header().Get("Content-Encoding")).Should(Equal("br"))
+		Expect(rec.Body.String()).Should(Equal(bigJSON))
+
+		rec = get(h, "/small", "*")
+		Expect(rec.Header().Get("Content-Encoding")).Should(BeEmpty())
+		Expect(rec.Header().Get("Vary")).Should(Equal("Accept-Encoding"))
+		Expect(rec.Body.String()).Should(Equal("{}"))
+
+		rec = get(h, "/empty", "gzip")
+		Expect(rec.Code).Should(Equal(http.StatusNoContent))
+		Expect(rec.Header().Get("Content-Encoding")).Should(BeEmpty())
+		Expect(rec.Body.Len()).Should(BeZero())
+	})
+
+	It("Compression types", func() {
+		s := CreateHTTPScaffold()
+		s.SetCompression(true, 0, []string{"application/x-custom", "text/"})
+		Expect(s.compressible("application/x-custom; charset=utf-8")).Should(BeTrue())
+		Expect(s.compressible("text/html")).Should(BeTrue())
+		Expect(s.compressible("application/json")).Should(BeFalse())
+		Expect(s.compressible("")).Should(BeFalse())
+	})
+
+	It("Compressed streaming", func() {
+		s := CreateHTTPScaffold()
+		s.SetCompression(true, 1024, nil)
+		next := make(chan struct{})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Header().Set("Content-Type", "text/event-stream")
+			resp.Write([]byte("data: one\n\n"))
+			resp.(http.Flusher).Flush()
+			<-next
+			resp.Write([]byte("data: two\n\n"))
+		}))
+		svr := httptest.NewServer(h)
+		defer svr.Close()
+
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Encoding")).Should(Equal("gzip"))
+
+		// The first event arrives before the handler is done
+		gz, err := gzip.NewReader(resp.Body)
+		Expect(err).Should(Succeed())
+		r := bufio.NewReader(gz)
+		line, err := r.ReadString('\n')
+		Expect(err).Should(Succeed())
+		Expect(line).Should(Equal("data: one\n"))
+		close(next)
+		rest, err := ioutil.ReadAll(r)
+		Expect(err).Should(Succeed())
+		Expect(string(rest)).Should(Equal("\ndata: two\n\n"))
+	})
+
+	It("Hijack with compression", func() {
+		s := CreateHTTPScaffold()
+		s.SetCompression(true, 0, nil)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			c, rw, err := resp.(http.Hijacker).Hijack()
+			Expect(err).Should(Succeed())
+			defer c.Close()
+			rw.WriteString("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\nConnection: close\r\n\r\nHello")
+			rw.Flush()
+		}))
+		svr := httptest.NewServer(h)
+		defer svr.Close()
+
+		req, _ := http.NewRequest("GET", svr.URL, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Encoding")).Should(BeEmpty())
+		bod, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(Succeed())
+		Expect(string(bod)).Should(Equal("Hello"))
+	})
+})
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+)
+
+/*
+ConnectionCounts describes the TCP connections of one kind of server.
+New, Active, and Idle are the number of connections currently in each
+state. Hijacked and Closed are totals since the scaffold was created,
+because connections in those states are no longer ours to count.
+*/
+type ConnectionCounts struct {
+	New      int64 `json:"new"`
+	Active   int64 `json:"active"`
+	Idle     int64 `json:"idle"`
+	Hijacked int64 `json:"hijacked"`
+	Closed   int64 `json:"closed"`
+}
+
+/*
+ConnectionStats describes the connections to the application ports
+(insecure and secure together) and to the management port. If the
+management port was not set then all connections count as application
+connections.
+*/
+type ConnectionStats struct {
+	Application ConnectionCounts `json:"application"`
+	Management  ConnectionCounts `json:"management"`
+}
+
+/*
+ConnectionStats returns the current connection counts.
+*/
+func (s *HTTPScaffold) ConnectionStats() ConnectionStats {
+	return ConnectionStats{
+		Application: s.appConns.counts(),
+		Management:  s.mgmtConns.counts(),
+	}
+}
+
+/*
+connTracker counts connections using the "ConnState" hook of http.Server.
+We remember the last state of each connection, so that every transition
+moves exactly one connection from one gauge to another. A callback for a
+connection that we have already seen close is ignored, so that a late or
+duplicate callback cannot leave a gauge off by one.
+*/
+type connTracker struct {
+	lock    sync.Mutex
+	conns   map[net.Conn]connInfo
+	current ConnectionCounts
+	clock   clock.Clock
+}
+
+type connInfo struct {
+	state http.ConnState
+	since time.Time
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns: make(map[net.Conn]connInfo),
+		clock: clock.Real{},
+	}
+}
+
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	prev, found := t.conns[c]
+	if !found && state != http.StateNew {
+		return
+	}
+	if found {
+		if prev.state == state {
+			return
+		}
+		*t.gauge(prev.state)--
+	}
+
+	switch state {
+	case http.StateHijacked:
+		t.current.Hijacked++
+		delete(t.conns, c)
+	case http.StateClosed:
+		t.current.Closed++
+		delete(t.conns, c)
+	default:
+		*t.gauge(state)++
+		t.conns[c] = connInfo{
+			state: state,
+			since: t.clock.Now(),
+		}
+	}
+}
+
+/*
+closeIdle closes every connection that has been idle, or has not sent a
+request yet, for at least the given amount of time. The server sees the
+connection close and reports it as usual.
+*/
+func (t *connTracker) closeIdle(idle time.Duration) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	closed := 0
+	now := t.clock.Now()
+	for c, info := range t.conns {
+		if info.state != http.StateActive && now.Sub(info.since) >= idle {
+			c.Close()
+			closed++
+		}
+	}
+	return closed
+}
+
+func (t *connTracker) gauge(state http.ConnState) *int64 {
+	switch state {
+	case http.StateNew:
+		return &t.current.New
+	case http.StateActive:
+		return &t.current.Active
+	default:
+		return &t.current.Idle
+	}
+}
+
+func (t *connTracker) counts() ConnectionCounts {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.current
+}
@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Connection stats", func() {
+	It("Out of order states", func() {
+		t := newConnTracker()
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+
+		t.connState(c1, http.StateNew)
+		t.connState(c1, http.StateActive)
+		t.connState(c1, http.StateIdle)
+		Expect(t.counts()).Should(Equal(ConnectionCounts{Idle: 1}))
+
+		t.connState(c1, http.StateClosed)
+		// Late and duplicate callbacks after the close are ignored
+		t.connState(c1, http.StateIdle)
+		t.connState(c1, http.StateClosed)
+		Expect(t.counts()).Should(Equal(ConnectionCounts{Closed: 1}))
+
+		t.connState(c2, http.StateNew)
+		t.connState(c2, http.StateActive)
+		t.connState(c2, http.StateActive)
+		t.connState(c2, http.StateHijacked)
+		t.connState(c2, http.StateClosed)
+		Expect(t.counts()).Should(Equal(ConnectionCounts{Closed: 1, Hijacked: 1}))
+	})
+
+	It("Many keep-alive clients", func() {
+		const clients = 50
+		const requests = 20
+
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetMetricsPath("/metrics")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		// testGet used the default client, so get rid of its connection
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		Eventually(func() ConnectionCounts {
+			return s.ConnectionStats().Application
+		}).Should(Equal(ConnectionCounts{Closed: 1}))
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		mgmt := s.ManagementURL().String()
+		transports := make([]*http.Transport, clients)
+		wg := &sync.WaitGroup{}
+		for i := range transports {
+			transports[i] = &http.Transport{}
+			wg.Add(1)
+			go func(tr *http.Transport) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				client := &http.Client{Transport: tr}
+				for r := 0; r < requests; r++ {
+					url := base + "/"
+					if r%2 == 1 {
+						url = mgmt + "/health"
+					}
+					resp, err := client.Get(url)
+					Expect(err).Should(Succeed())
+					io.Copy(ioutil.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			}(transports[i])
+		}
+		wg.Wait()
+
+		// Each client has one connection parked on each port
+		idle := ConnectionCounts{Idle: clients, Closed: 1}
+		Eventually(func() ConnectionCounts {
+			return s.ConnectionStats().Application
+		}).Should(Equal(idle))
+		Eventually(func() ConnectionCounts {
+			return s.ConnectionStats().Management
+		}).Should(Equal(ConnectionCounts{Idle: clients}))
+
+		code, doc := getJSON(mgmt + "/metrics")
+		Expect(code).Should(Equal(200))
+		conns := doc["connections"].(map[string]interface{})
+		app := conns["application"].(map[string]interface{})
+		Expect(app["idle"]).Should(BeEquivalentTo(clients))
+		Expect(app["active"]).Should(BeEquivalentTo(0))
+
+		for _, tr := range transports {
+			tr.CloseIdleConnections()
+		}
+		Eventually(func() ConnectionCounts {
+			return s.ConnectionStats().Application
+		}).Should(Equal(ConnectionCounts{Closed: clients + 1}))
+		Eventually(func() int64 {
+			return s.ConnectionStats().Management.Closed
+		}).Should(BeNumerically(">=", clients))
+		m := s.ConnectionStats().Management
+		Expect(m.New + m.Active + m.Idle).Should(BeNumerically("<=", 1))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+DefaultCORSMethods are the methods that a CORSPolicy allows if its list
+is empty.
+*/
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST"}
+
+/*
+CORSPolicy describes which browser applications may call the application
+port, and how.
+*/
+type CORSPolicy struct {
+	// AllowedOrigins lists the origins that may make requests. Each one is
+	// either an exact origin, such as "https://app.example.com," a
+	// wildcard subdomain, such as "https://*.example.com," which matches
+	// any subdomain but not "example.com" itself, or "*" for any origin.
+	AllowedOrigins []string
+	// AllowedMethods lists the methods that preflight requests may ask
+	// for. If it is empty then "DefaultCORSMethods" is used.
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers that preflight requests
+	// may ask for. "*" allows whatever headers were requested.
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies and other credentials.
+	// It cannot be used when "AllowedOrigins" contains "*," since any web
+	// site could then make requests with the user's credentials.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight.
+	// Zero leaves it up to the browser.
+	MaxAge time.Duration
+}
+
+/*
+SetManagementCORS allows browser applications from the listed origins to
+call the health, ready, info, and other management paths, including those
+added using "AddManagementHandler." Origins must match exactly, or "*" may
+be used to allow any origin. The scaffold answers CORS preflight requests
+itself and adds the CORS headers to actual responses. Requests from other
+origins get no CORS headers at all, so clients that are not browsers are
+unaffected.
+*/
+func (s *HTTPScaffold) SetManagementCORS(origins []string) {
+	s.managementCORS = origins
+}
+
+/*
+SetCORSPolicy allows browser applications to call the application port,
+separately from "SetManagementCORS." The scaffold answers CORS preflight
+requests from allowed origins itself, so the application handler never
+sees them, and adds the CORS headers to actual responses before passing
+them to the handler. Requests without an "Origin" header, or from origins
+that are not allowed, are passed on untouched. An error is returned if the
+policy allows credentials from any origin, in which case the current policy
+is not changed.
+*/
+func (s *HTTPScaffold) SetCORSPolicy(policy CORSPolicy) error {
+	if policy.AllowCredentials {
+		for _, a := range policy.AllowedOrigins {
+			if a == "*" {
+				return errors.New(`CORS credentials cannot be allowed for origin "*"`)
+			}
+		}
+	}
+	s.corsPolicy = &policy
+	return nil
+}
+
+/*
+allowedOrigin returns the value for "Access-Control-Allow-Origin," or an
+empty string if the origin is not allowed.
+*/
+func allowedOrigin(origin string, allowed []string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, a := range allowed {
+		if a == "*" {
+			return "*"
+		}
+		if a == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+/*
+handleManagementCORS adds CORS headers to a management response. It returns
+true if the request was a preflight that it has already answered.
+*/
+func (s *HTTPScaffold) handleManagementCORS(resp http.ResponseWriter, req *http.Request) bool {
+	if len(s.managementCORS) == 0 {
+		return false
+	}
+	origin := allowedOrigin(req.Header.Get("Origin"), s.managementCORS)
+	if origin == "" {
+		return false
+	}
+
+	hdr := resp.Header()
+	hdr.Set("Access-Control-Allow-Origin", origin)
+	hdr.Add("Vary", "Origin")
+
+	if req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != "" {
+		hdr.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+		if rh := req.Header.Get("Access-Control-Request-Headers"); rh != "" {
+			hdr.Set("Access-Control-Allow-Headers", rh)
+		}
+		hdr.Add("Vary", "Access-Control-Request-Method")
+		hdr.Add("Vary", "Access-Control-Request-Headers")
+		resp.WriteHeader(http.StatusNoContent)
+		return true
+	}
+	return false
+}
+
+/*
+matchOrigin returns true if "origin" matches "pattern," which may be a
+wildcard subdomain such as "https://*.example.com."
+*/
+func matchOrigin(origin, pattern string) bool {
+	if pattern == "*" || strings.EqualFold(origin, pattern) {
+		return true
+	}
+	star := strings.Index(pattern, "://*.")
+	if star < 0 {
+		return false
+	}
+	scheme := pattern[:star+3]
+	suffix := pattern[star+4:]
+	if len(origin) <= len(scheme)+len(suffix) {
+		return false
+	}
+	return strings.EqualFold(origin[:len(scheme)], scheme) &&
+		strings.EqualFold(origin[len(origin)-len(suffix):], suffix) &&
+		!strings.ContainsAny(origin[len(scheme):len(origin)-len(suffix)], "/:@")
+}
+
+/*
+handleCORS adds CORS headers to an application response. It returns true
+if the request was a preflight that it has already answered.
+*/
+func (s *HTTPScaffold) handleCORS(resp http.ResponseWriter, req *http.Request) bool {
+	p := s.corsPolicy
+	if p == nil {
+		return false
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	allowOrigin := ""
+	for _, a := range p.AllowedOrigins {
+		if matchOrigin(origin, a) {
+			allowOrigin = origin
+			if a == "*" {
+				allowOrigin = "*"
+			}
+			break
+		}
+	}
+	if allowOrigin == "" {
+		return false
+	}
+
+	hdr := resp.Header()
+	hdr.Set("Access-Control-Allow-Origin", allowOrigin)
+	hdr.Add("Vary", "Origin")
+	if p.AllowCredentials {
+		hdr.Set("Access-Control-Allow-Credentials", "true")
+	}
+
+	if req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	methods := p.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	hdr.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if rh := req.Header.Get("Access-Control-Request-Headers"); rh != "" {
+		if len(p.AllowedHeaders) == 1 && p.AllowedHeaders[0] == "*" {
+			hdr.Set("Access-Control-Allow-Headers", rh)
+		} else if len(p.AllowedHeaders) > 0 {
+			hdr.Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+		}
+	}
+	if p.MaxAge > 0 {
+		hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge/time.Second)))
+	}
+	hdr.Add("Vary", "Access-Control-Request-Method")
+	hdr.Add("Vary", "Access-Control-Request-Headers")
+	resp.WriteHeader(http.StatusNoContent)
+	return true
+}
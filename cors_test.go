@@ -0,0 +1,206 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CORS tests", func() {
+	var mh *managementHandler
+
+	serve := func(method, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "GET")
+			req.Header.Set("Access-Control-Request-Headers", "Accept")
+		}
+		rec := httptest.NewRecorder()
+		mh.ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetManagementCORS([]string{"https://dashboard.example.com"})
+		s.AddManagementHandler("/custom", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("custom"))
+		}))
+		s.tracker = startRequestTracker(DefaultGraceTimeout)
+		mh = s.createManagementHandler()
+		mh.child = &testHandler{}
+	})
+
+	It("Allowed origin", func() {
+		for _, path := range []string{"/health", "/ready", "/custom"} {
+			rec := serve("GET", path, "https://dashboard.example.com")
+			Expect(rec.Code).Should(Equal(http.StatusOK))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(
+				Equal("https://dashboard.example.com"))
+		}
+		Expect(serve("GET", "/custom", "").Body.String()).Should(Equal("custom"))
+	})
+
+	It("Preflight", func() {
+		rec := serve("OPTIONS", "/health", "https://dashboard.example.com")
+		Expect(rec.Code).Should(Equal(http.StatusNoContent))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(
+			Equal("https://dashboard.example.com"))
+		Expect(rec.Header().Get("Access-Control-Allow-Methods")).Should(Equal("GET"))
+		Expect(rec.Header().Get("Access-Control-Allow-Headers")).Should(Equal("Accept"))
+	})
+
+	It("Disallowed origin", func() {
+		rec := serve("GET", "/health", "https://evil.example.com")
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		rec = serve("OPTIONS", "/health", "https://evil.example.com")
+		Expect(rec.Code).Should(Equal(http.StatusMethodNotAllowed))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		rec = serve("GET", "/health", "")
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+	})
+
+	It("Application paths unaffected", func() {
+		rec := serve("GET", "/app", "https://dashboard.example.com")
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+	})
+
+	It("Wildcard", func() {
+		Expect(allowedOrigin("https://any.example.com", []string{"*"})).Should(Equal("*"))
+		Expect(allowedOrigin("", []string{"*"})).Should(BeEmpty())
+	})
+})
+
+var _ = Describe("Application CORS tests", func() {
+	var h http.Handler
+	var calls int
+
+	serve := func(method, path, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+			req.Header.Set("Access-Control-Request-Headers", "Content-Type, X-Trace")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		calls = 0
+		s := CreateHTTPScaffold()
+		Expect(s.SetCORSPolicy(CORSPolicy{
+			AllowedOrigins:   []string{"https://app.example.com", "https://*.example.org"},
+			AllowedMethods:   []string{"GET", "POST"},
+			AllowedHeaders:   []string{"Content-Type"},
+			AllowCredentials: true,
+			MaxAge:           10 * time.Minute,
+		})).Should(Succeed())
+		h, _ = s.Handlers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+
+	It("Application preflight", func() {
+		for _, origin := range []string{"https://app.example.com", "https://api.eu.example.org"} {
+			rec := serve("OPTIONS", "/things", origin)
+			Expect(rec.Code).Should(Equal(http.StatusNoContent))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(Equal(origin))
+			Expect(rec.Header().Get("Access-Control-Allow-Methods")).Should(Equal("GET, POST"))
+			Expect(rec.Header().Get("Access-Control-Allow-Headers")).Should(Equal("Content-Type"))
+			Expect(rec.Header().Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+			Expect(rec.Header().Get("Access-Control-Max-Age")).Should(Equal("600"))
+			Expect(rec.Header()["Vary"]).Should(ContainElement("Origin"))
+		}
+		Expect(calls).Should(BeZero())
+	})
+
+	It("Application actual request", func() {
+		rec := serve("POST", "/things", "https://app.example.com")
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(Equal("https://app.example.com"))
+		Expect(rec.Header().Get("Access-Control-Allow-Credentials")).Should(Equal("true"))
+		Expect(rec.Header().Get("Access-Control-Allow-Methods")).Should(BeEmpty())
+		Expect(calls).Should(Equal(1))
+	})
+
+	It("Application disallowed origin", func() {
+		for _, origin := range []string{"https://evil.com", "https://example.org", "http://x.example.org"} {
+			rec := serve("OPTIONS", "/things", origin)
+			Expect(rec.Code).Should(Equal(http.StatusNotFound))
+			Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		}
+		Expect(calls).Should(Equal(3))
+	})
+
+	It("Application request without origin", func() {
+		rec := serve("OPTIONS", "/things", "")
+		Expect(rec.Code).Should(Equal(http.StatusNotFound))
+		Expect(rec.Header()).ShouldNot(HaveKey("Vary"))
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(BeEmpty())
+		rec = serve("GET", "/things", "")
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		Expect(rec.Header()).ShouldNot(HaveKey("Vary"))
+		Expect(calls).Should(Equal(2))
+	})
+
+	It("Credentials for any origin", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.SetCORSPolicy(CORSPolicy{
+			AllowedOrigins:   []string{"https://app.example.com", "*"},
+			AllowCredentials: true,
+		})).ShouldNot(Succeed())
+		Expect(s.corsPolicy).Should(BeNil())
+
+		Expect(s.SetCORSPolicy(CORSPolicy{AllowedOrigins: []string{"*"}})).Should(Succeed())
+		h, _ := s.Handlers(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		req := httptest.NewRequest("GET", "/things", nil)
+		req.Header.Set("Origin", "https://evil.com")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		Expect(rec.Header().Get("Access-Control-Allow-Origin")).Should(Equal("*"))
+		Expect(rec.Header().Get("Access-Control-Allow-Credentials")).Should(BeEmpty())
+	})
+
+	It("Origin matching", func() {
+		Expect(matchOrigin("https://a.example.com", "https://*.example.com")).Should(BeTrue())
+		Expect(matchOrigin("https://a.b.example.com", "https://*.example.com")).Should(BeTrue())
+		Expect(matchOrigin("HTTPS://A.Example.com", "https://*.example.com")).Should(BeTrue())
+		Expect(matchOrigin("https://example.com", "https://*.example.com")).Should(BeFalse())
+		Expect(matchOrigin("https://.example.com", "https://*.example.com")).Should(BeFalse())
+		Expect(matchOrigin("https://evil.com/.example.com", "https://*.example.com")).Should(BeFalse())
+		Expect(matchOrigin("https://a.example.com:8443", "https://*.example.com")).Should(BeFalse())
+		Expect(matchOrigin("http://a.example.com", "https://*.example.com")).Should(BeFalse())
+		Expect(matchOrigin("https://anything", "*")).Should(BeTrue())
+	})
+})
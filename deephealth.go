@@ -0,0 +1,100 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+/*
+deepHealthMediaType is the media type of the health check response format
+from the IETF draft "Health Check Response Format for HTTP APIs."
+*/
+const deepHealthMediaType = "application/health+json"
+
+/*
+deepHealthDocument is the document returned by the deep health path.
+*/
+type deepHealthDocument struct {
+	Status string                       `json:"status"`
+	Output string                       `json:"output,omitempty"`
+	Checks map[string][]deepHealthCheck `json:"checks"`
+}
+
+type deepHealthCheck struct {
+	Status        string    `json:"status"`
+	Output        string    `json:"output,omitempty"`
+	ObservedValue float64   `json:"observedValue"`
+	ObservedUnit  string    `json:"observedUnit"`
+	Time          time.Time `json:"time"`
+}
+
+/*
+SetDeepHealthPath sets up a URI on the management port (if set) or
+otherwise the main port that returns the result of every health checker in
+the "application/health+json" format, for tools that collect health
+details from many services. Each checker appears under its name, with
+"OK" reported as "pass," "Degraded" as "warn," and "NotReady" and "Failed"
+as "fail," along with how long it took and when it ran. The overall status
+is the worst of them, and the response is 503 if that is "fail" and 200
+otherwise. The health checkers are called, or taken from the cache, just
+as they are for the health path, which is not affected.
+*/
+func (s *HTTPScaffold) SetDeepHealthPath(p string) {
+	s.deepHealthPath = p
+}
+
+func (s *HTTPScaffold) handleDeepHealth(resp http.ResponseWriter, req *http.Request) {
+	status, results, healthErr := s.evaluateHealth()
+
+	doc := &deepHealthDocument{
+		Status: deepHealthStatus(status),
+		Checks: make(map[string][]deepHealthCheck, len(results)),
+	}
+	if healthErr != nil {
+		doc.Output = healthErr.Error()
+	}
+	for _, r := range results {
+		doc.Checks[r.Name] = append(doc.Checks[r.Name], deepHealthCheck{
+			Status:        deepHealthStatus(r.status),
+			Output:        r.Reason,
+			ObservedValue: float64(r.latency) / float64(time.Millisecond),
+			ObservedUnit:  "ms",
+			Time:          r.LastEvaluated,
+		})
+	}
+
+	code := http.StatusOK
+	if doc.Status == "fail" {
+		code = http.StatusServiceUnavailable
+	}
+	buf, _ := json.Marshal(doc)
+	resp.Header().Set("Content-Type", deepHealthMediaType)
+	resp.WriteHeader(code)
+	resp.Write(buf)
+}
+
+func deepHealthStatus(status HealthStatus) string {
+	switch status {
+	case OK:
+		return "pass"
+	case Degraded:
+		return "warn"
+	default:
+		return "fail"
+	}
+}
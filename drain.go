@@ -0,0 +1,284 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultDrainLogInterval is the default amount of time between progress
+	// messages while the scaffold waits for requests to complete.
+	DefaultDrainLogInterval = 5 * time.Second
+	// DefaultDrainIdleTimeout is the default amount of time that a connection
+	// may sit idle during a graceful shutdown before it is closed.
+	DefaultDrainIdleTimeout = time.Second
+)
+
+/*
+DrainStatus describes the progress of a graceful shutdown.
+*/
+type DrainStatus struct {
+	// Draining is true once "Shutdown" has been called
+	Draining bool
+	// Complete is true once all requests have finished or been abandoned
+	Complete bool
+	// Elapsed is how long it has been since "Shutdown" was called
+	Elapsed time.Duration
+	// InFlight is the number of application requests still running
+	InFlight int
+	// Oldest is the longest-running request, or nil if there are none
+	Oldest *InFlightRequest
+	// ManagementInFlight is the number of requests to the scaffold's own
+	// paths, like health and ready, that are still running. Shutdown does
+	// not wait for them.
+	ManagementInFlight int
+	// HooksRunning is true while the shutdown hooks run, before the grace
+	// timeout starts to count down
+	HooksRunning bool
+	// HookTime is how long the shutdown hooks have run in total
+	HookTime time.Duration
+}
+
+/*
+InFlightRequest describes an application request that has not completed.
+*/
+type InFlightRequest struct {
+	Method string
+	Path   string
+	Age    time.Duration
+}
+
+/*
+inflightRequest is what we record for every running application request.
+*/
+type inflightRequest struct {
+	method string
+	path   string
+	start  time.Time
+	shard  uint32
+}
+
+/*
+inflightShards is the number of pieces that the inflight set is split
+into, so that concurrent requests rarely wait for the same lock.
+*/
+const inflightShards = 32
+
+/*
+inflightSet keeps track of the details of running requests so that we can
+report on them during shutdown.
+*/
+type inflightSet struct {
+	next   uint32
+	shards [inflightShards]inflightShard
+}
+
+type inflightShard struct {
+	lock     sync.Mutex
+	requests map[*inflightRequest]struct{}
+	// Keep each shard on its own cache line
+	_ [48]byte
+}
+
+func newInflightSet() *inflightSet {
+	i := &inflightSet{}
+	for n := range i.shards {
+		i.shards[n].requests = make(map[*inflightRequest]struct{})
+	}
+	return i
+}
+
+func (i *inflightSet) add(req *http.Request, now time.Time) *inflightRequest {
+	r := &inflightRequest{
+		method: req.Method,
+		path:   req.URL.Path,
+		start:  now,
+		shard:  atomic.AddUint32(&i.next, 1) % inflightShards,
+	}
+	sh := &i.shards[r.shard]
+	sh.lock.Lock()
+	sh.requests[r] = struct{}{}
+	sh.lock.Unlock()
+	return r
+}
+
+func (i *inflightSet) remove(r *inflightRequest) {
+	sh := &i.shards[r.shard]
+	sh.lock.Lock()
+	delete(sh.requests, r)
+	sh.lock.Unlock()
+}
+
+/*
+status returns the number of running requests and the oldest one, whose
+age is as of "now."
+*/
+func (i *inflightSet) status(now time.Time) (int, *InFlightRequest) {
+	var oldest *inflightRequest
+	count := 0
+	for n := range i.shards {
+		sh := &i.shards[n]
+		sh.lock.Lock()
+		count += len(sh.requests)
+		for r := range sh.requests {
+			if oldest == nil || r.start.Before(oldest.start) {
+				oldest = r
+			}
+		}
+		sh.lock.Unlock()
+	}
+	if oldest == nil {
+		return 0, nil
+	}
+	return count, &InFlightRequest{
+		Method: oldest.method,
+		Path:   oldest.path,
+		Age:    now.Sub(oldest.start),
+	}
+}
+
+/*
+SetDrainLogInterval sets how often the scaffold logs the progress of a
+graceful shutdown through the logger set by "SetLogger." Each message
+includes the number of requests still in flight, and the method, path,
+and age of the oldest one. Logging stops as soon as the drain completes.
+If set to zero, progress is not logged.
+*/
+func (s *HTTPScaffold) SetDrainLogInterval(d time.Duration) {
+	s.drainLogInterval = d
+}
+
+/*
+SetDrainIdleTimeout sets how long a connection to the insecure or secure
+port may be idle during a graceful shutdown before the scaffold closes it.
+This includes connections that were opened but never sent a request, and
+keep-alive connections that some clients and proxies keep open for a long
+time without noticing that the server is going away. Connections with a
+request in progress are never closed, and the management port is not
+affected. If set to zero, idle connections are left alone.
+*/
+func (s *HTTPScaffold) SetDrainIdleTimeout(d time.Duration) {
+	s.drainIdleTimeout = d
+}
+
+/*
+DrainStatus returns the current progress of a graceful shutdown. Before
+"Shutdown" is called, it reports the requests that are currently running.
+*/
+func (s *HTTPScaffold) DrainStatus() DrainStatus {
+	var st DrainStatus
+	tracker, inflight := s.requestState()
+	st.InFlight, st.Oldest = inflight.status(s.clock.Now())
+	st.ManagementInFlight = int(atomic.LoadInt32(&s.managementInFlight))
+
+	s.drainLock.Lock()
+	began := s.drainStart
+	st.HooksRunning = s.hookCancel != nil && !s.hooksDone
+	st.HookTime = s.hookTime
+	s.drainLock.Unlock()
+
+	if !began.IsZero() {
+		st.Draining = true
+		st.Elapsed = s.since(began)
+		if st.HooksRunning {
+			st.HookTime = st.Elapsed
+		}
+	}
+	if tracker != nil {
+		select {
+		case <-tracker.done:
+			st.Complete = true
+		default:
+		}
+	}
+	return st
+}
+
+/*
+beginDrain records the time that shutdown started and, the first time that
+it is called, starts logging the drain progress.
+*/
+func (s *HTTPScaffold) beginDrain() {
+	done := s.currentTracker().done
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	if !s.drainStart.IsZero() {
+		return
+	}
+	s.drainStart = s.clock.Now()
+	if s.logger != nil && s.drainLogInterval > 0 {
+		go s.logDrain(done)
+	}
+	if s.drainIdleTimeout > 0 {
+		go s.closeIdleConns(done)
+	}
+}
+
+/*
+closeIdleConns closes idle application connections until the drain is over.
+*/
+func (s *HTTPScaffold) closeIdleConns(done <-chan struct{}) {
+	interval := s.drainIdleTimeout / 4
+	if interval < 10*time.Millisecond {
+		interval = 10 * time.Millisecond
+	}
+	timer := s.clock.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C():
+			timer.Reset(interval)
+			if n := s.appConns.closeIdle(s.drainIdleTimeout); n > 0 {
+				s.logInfo("Closed %d idle connections", n)
+			}
+		}
+	}
+}
+
+func (s *HTTPScaffold) logDrain(done <-chan struct{}) {
+	timer := s.clock.NewTimer(s.drainLogInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C():
+			timer.Reset(s.drainLogInterval)
+			st := s.DrainStatus()
+			hooks := ""
+			if st.HooksRunning {
+				hooks = fmt.Sprintf(", shutdown hooks running for %s", st.HookTime)
+			} else if st.HookTime > 0 {
+				hooks = fmt.Sprintf(", %s spent in shutdown hooks", st.HookTime)
+			}
+			if st.Oldest == nil {
+				s.logInfo("Draining for %s: %d requests in flight%s",
+					st.Elapsed, st.InFlight, hooks)
+			} else {
+				s.logInfo("Draining for %s: %d requests in flight, oldest %s %s running for %s%s",
+					st.Elapsed, st.InFlight, st.Oldest.Method, st.Oldest.Path, st.Oldest.Age, hooks)
+			}
+		}
+	}
+}
@@ -0,0 +1,524 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Drain tests", func() {
+	It("Drain progress", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		s.SetDrainLogInterval(100 * time.Millisecond)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		Expect(s.DrainStatus().Draining).Should(BeFalse())
+
+		go getText(fmt.Sprintf("http://%s/slow?delay=1s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		stopErr := errors.New("Drain")
+		s.Shutdown(stopErr)
+
+		st := s.DrainStatus()
+		Expect(st.Draining).Should(BeTrue())
+		Expect(st.Complete).Should(BeFalse())
+		Expect(st.InFlight).Should(Equal(1))
+		Expect(st.Oldest).ShouldNot(BeNil())
+		Expect(st.Oldest.Method).Should(Equal("GET"))
+		Expect(st.Oldest.Path).Should(Equal("/slow"))
+
+		Eventually(logger.infoCount).Should(BeNumerically(">=", 2))
+		Expect(logger.lastInfo()).Should(ContainSubstring("1 requests in flight"))
+		Expect(logger.lastInfo()).Should(ContainSubstring("GET /slow"))
+
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+		st = s.DrainStatus()
+		Expect(st.Complete).Should(BeTrue())
+		Expect(st.InFlight).Should(BeZero())
+
+		// Logging stops once drain is done
+		count := logger.infoCount()
+		Consistently(logger.infoCount, 300*time.Millisecond).Should(Equal(count))
+	})
+
+	It("Drain timeout", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		go getText(base + "/stuck?delay=3s")
+		go getText(base + "/stuck?delay=3s")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(2))
+
+		s.Shutdown(nil)
+		clk.Advance(DefaultGraceTimeout - time.Second)
+		Expect(s.DrainStatus().Elapsed).Should(Equal(DefaultGraceTimeout - time.Second))
+		Consistently(stopChan, 50*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(time.Second)
+		var stopErr error
+		Eventually(stopChan).Should(Receive(&stopErr))
+		Expect(errors.Is(stopErr, ErrManualStop)).Should(BeTrue())
+		var timeout *ErrDrainTimeout
+		Expect(errors.As(stopErr, &timeout)).Should(BeTrue())
+		Expect(timeout.Abandoned).Should(Equal(2))
+		Expect(timeout.Reason).Should(Equal(ErrManualStop))
+		Expect(timeout.Elapsed).Should(Equal(DefaultGraceTimeout))
+	})
+
+	It("Drain closes idle connections", func() {
+		s := CreateHTTPScaffold()
+		s.SetDrainIdleTimeout(300 * time.Millisecond)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+		addr := s.InsecureAddress()
+		// closedWithin reports whether the server closes the connection
+		closedWithin := func(r *bufio.Reader, conn net.Conn, d time.Duration) bool {
+			conn.SetReadDeadline(time.Now().Add(d))
+			_, err := r.ReadByte()
+			return err == io.EOF
+		}
+
+		// A keep-alive connection that made a request and is now idle
+		idleConn, err := net.Dial("tcp", addr)
+		Expect(err).Should(Succeed())
+		defer idleConn.Close()
+		idle := bufio.NewReader(idleConn)
+		fmt.Fprintf(idleConn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		resp, err := http.ReadResponse(idle, nil)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(200))
+		resp.Body.Close()
+
+		// A connection that never sent anything
+		newConn, err := net.Dial("tcp", addr)
+		Expect(err).Should(Succeed())
+		defer newConn.Close()
+
+		// A connection with a request that is still running
+		busyConn, err := net.Dial("tcp", addr)
+		Expect(err).Should(Succeed())
+		defer busyConn.Close()
+		busy := bufio.NewReader(busyConn)
+		fmt.Fprintf(busyConn, "GET /?delay=1500ms HTTP/1.1\r\nHost: test\r\n\r\n")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		Eventually(func() int64 {
+			c := s.ConnectionStats().Application
+			return c.New + c.Idle + c.Active
+		}).Should(BeEquivalentTo(3))
+
+		s.Shutdown(nil)
+		began := time.Now()
+		Expect(closedWithin(idle, idleConn, time.Second)).Should(BeTrue())
+		Expect(closedWithin(bufio.NewReader(newConn), newConn, time.Second)).Should(BeTrue())
+		Expect(time.Since(began)).Should(BeNumerically("<", 800*time.Millisecond))
+
+		// The busy one gets its response
+		busyConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		resp, err = http.ReadResponse(busy, nil)
+		Expect(err).Should(Succeed())
+		Expect(resp.StatusCode).Should(Equal(200))
+		resp.Body.Close()
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Markdown exempt paths", func() {
+		s := CreateHTTPScaffold()
+		s.SetMarkdownExemptPaths("/oauth/token", "/webhooks/")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		slowDone := make(chan int, 2)
+		go func() {
+			code, _ := getText(base + "/oauth/token?delay=1s")
+			slowDone <- code
+		}()
+		go func() {
+			code, _ := getText(base + "/other?delay=1s")
+			slowDone <- code
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(2))
+
+		stopErr := errors.New("Exempt")
+		s.Shutdown(stopErr)
+
+		code, _ := getText(base + "/other")
+		Expect(code).Should(Equal(503))
+		code, _ = getText(base + "/oauth/token")
+		Expect(code).Should(Equal(200))
+		code, _ = getText(base + "/oauth/token/extra")
+		Expect(code).Should(Equal(503))
+		code, _ = getText(base + "/webhooks/ack")
+		Expect(code).Should(Equal(200))
+
+		// A new exempt request started during drain is also waited for
+		go func() {
+			code, _ := getText(base + "/webhooks/ack?delay=1500ms")
+			slowDone <- code
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(3))
+
+		Eventually(slowDone, 2*time.Second).Should(Receive(Equal(200)))
+		Eventually(slowDone, 2*time.Second).Should(Receive(Equal(200)))
+		Consistently(stopChan, 200*time.Millisecond).ShouldNot(Receive())
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+	})
+
+	It("Upgrades rejected during markdown", func() {
+		s := CreateHTTPScaffold()
+		s.SetMarkdownExemptPaths("/ws/")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		handshake := func(method, path string) *http.Response {
+			req, err := http.NewRequest(method, base+path, nil)
+			Expect(err).Should(Succeed())
+			if method == "GET" {
+				req.Header.Set("Connection", "keep-alive, Upgrade")
+				req.Header.Set("Upgrade", "websocket")
+				req.Header.Set("Sec-WebSocket-Version", "13")
+				req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			}
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			resp.Body.Close()
+			return resp
+		}
+
+		// Keep the drain going
+		go getText(base + "/slow?delay=1s")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		s.Shutdown(nil)
+
+		resp := handshake("GET", "/ws/chat")
+		Expect(resp.StatusCode).Should(Equal(503))
+		Expect(resp.Close).Should(BeTrue())
+		Expect(handshake("CONNECT", "/ws/chat").StatusCode).Should(Equal(503))
+		code, _ := getText(base + "/ws/chat")
+		Expect(code).Should(Equal(200))
+
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(ErrManualStop)))
+
+		// Unless upgrades are allowed
+		s = CreateHTTPScaffold()
+		s.SetMarkdownExemptPaths("/ws/")
+		s.SetMarkdownAllowUpgrades(true)
+		h, _ := s.Handlers(&testHandler{})
+		s.markDown()
+		req := httptest.NewRequest("GET", "/ws/chat", nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		Expect(rec.Code).Should(Equal(200))
+	})
+
+	It("Probes are not counted", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		slowDone := make(chan time.Time, 1)
+		go func() {
+			getText(base + "/slow?delay=500ms")
+			slowDone <- time.Now()
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		// Keep probing health for the whole drain
+		stopPolling := make(chan struct{})
+		pollDone := make(chan struct{})
+		go func() {
+			defer close(pollDone)
+			for {
+				select {
+				case <-stopPolling:
+					return
+				default:
+					go func() {
+						resp, err := http.Get(base + "/health")
+						if err == nil {
+							resp.Body.Close()
+						}
+					}()
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}()
+		defer func() {
+			close(stopPolling)
+			<-pollDone
+		}()
+
+		s.Shutdown(nil)
+		Expect(s.DrainStatus().InFlight).Should(Equal(1))
+
+		var finished time.Time
+		Eventually(slowDone, 2*time.Second).Should(Receive(&finished))
+		var stopped time.Time
+		Eventually(func() bool {
+			select {
+			case <-stopChan:
+				stopped = time.Now()
+				return true
+			default:
+				return false
+			}
+		}, time.Second, time.Millisecond).Should(BeTrue())
+		Expect(stopped.Sub(finished)).Should(BeNumerically("<", 100*time.Millisecond))
+	})
+
+	It("Management in flight", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		block := make(chan struct{})
+		s.AddManagementHandler("/block", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-block
+		}))
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		go getText(s.ManagementURL().String() + "/block")
+		Eventually(func() int {
+			return s.DrainStatus().ManagementInFlight
+		}).Should(Equal(1))
+		Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+		// Shutdown does not wait for management requests
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		close(block)
+		Eventually(func() int {
+			return s.DrainStatus().ManagementInFlight
+		}).Should(BeZero())
+	})
+
+	It("Management stops last", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetManagementStopsLast(true)
+		s.SetManagementLinger(500 * time.Millisecond)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := fmt.Sprintf("http://%s", s.InsecureAddress())
+		mgmt := s.ManagementURL().String()
+		go getText(base + "/slow?delay=2s")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		type scrape struct {
+			path string
+			code int
+			doc  map[string]interface{}
+		}
+		scrapes := make(chan scrape, 1000)
+		pollDone := make(chan struct{})
+		get := func(path string) bool {
+			req, _ := http.NewRequest("GET", mgmt+path, nil)
+			req.Header.Set("Accept", "application/json")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				return false
+			}
+			defer resp.Body.Close()
+			var doc map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&doc)
+			scrapes <- scrape{path: path, code: resp.StatusCode, doc: doc}
+			return true
+		}
+		s.Shutdown(nil)
+		drainStart := time.Now()
+		go func() {
+			defer close(pollDone)
+			for get("/health") && get("/ready") {
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+
+		Eventually(stopChan, 5*time.Second).Should(Receive(Equal(ErrManualStop)))
+		Expect(time.Since(drainStart)).Should(BeNumerically(">=", 2*time.Second))
+		Eventually(pollDone, time.Second).Should(BeClosed())
+		close(scrapes)
+
+		// The management port served for the whole drain, and afterwards
+		sawFinal := false
+		count := 0
+		for sc := range scrapes {
+			count++
+			Expect(sc.doc["draining"]).Should(Equal(true))
+			if sc.path == "/ready" {
+				Expect(sc.code).Should(Equal(503))
+				continue
+			}
+			Expect(sc.code).Should(Equal(200))
+			Expect(sc.doc["status"]).Should(Equal("OK"))
+			if sc.doc["inflight"] == float64(0) {
+				sawFinal = true
+			}
+		}
+		Expect(count).Should(BeNumerically(">", 40))
+		Expect(sawFinal).Should(BeTrue())
+		_, err = http.Get(mgmt + "/health")
+		Expect(err).ShouldNot(Succeed())
+	})
+})
+
+type testLogger struct {
+	lock   sync.Mutex
+	infos  []string
+	errors []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.infos = append(l.infos, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) infoCount() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.infos)
+}
+
+func (l *testLogger) lastInfo() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.infos) == 0 {
+		return ""
+	}
+	return l.infos[len(l.infos)-1]
+}
+
+func (l *testLogger) allErrors() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.errors...)
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http"
+)
+
+/*
+ScaffoldGroup ties together the shutdown of several scaffolds in the same
+process, such as one for a public API and one for an internal one. Once a
+scaffold is in a group, shutting it down for any reason, including a
+signal or a listener failure, shuts down every member of the group with
+the same reason, so they drain at the same time and under the same grace
+timeout. Marking one down, using the markdown path or signal, marks them
+all down, so that they all stop being ready together. A scaffold may only
+be in one group.
+*/
+type ScaffoldGroup struct {
+	members []*HTTPScaffold
+}
+
+/*
+NewGroup creates a group of scaffolds.
+*/
+func NewGroup(members ...*HTTPScaffold) *ScaffoldGroup {
+	g := &ScaffoldGroup{
+		members: members,
+	}
+	for _, m := range members {
+		m.group = g
+	}
+	return g
+}
+
+/*
+CatchSignals is like "CatchSignals" on a scaffold, but for the whole
+group. The signals are handled as they are set up on the first member,
+and since its shutdown and markdown are shared, they affect them all.
+*/
+func (g *ScaffoldGroup) CatchSignals() {
+	if len(g.members) > 0 {
+		g.members[0].CatchSignals()
+	}
+}
+
+/*
+ListenAll starts listening on every member of the group, each with its
+handler from "handlers," and then calls "Wait." If a member cannot start
+listening, the group is shut down with that error. There must be a
+handler for every member, and only for members.
+*/
+func (g *ScaffoldGroup) ListenAll(handlers map[*HTTPScaffold]http.Handler) error {
+	if len(handlers) != len(g.members) {
+		return errors.New("there must be exactly one handler per group member")
+	}
+	for _, m := range g.members {
+		if handlers[m] == nil {
+			return errors.New("there must be exactly one handler per group member")
+		}
+	}
+	for _, m := range g.members {
+		err := m.StartListen(handlers[m])
+		if err != nil {
+			g.Shutdown(err)
+			g.Wait()
+			return err
+		}
+	}
+	return g.Wait()
+}
+
+/*
+Shutdown shuts down every member of the group. It is the same as calling
+"Shutdown" on any one of them.
+*/
+func (g *ScaffoldGroup) Shutdown(reason error) {
+	for _, m := range g.members {
+		m.shutdownOne(reason)
+	}
+}
+
+/*
+ForceShutdown calls "ForceShutdown" on every member of the group.
+*/
+func (g *ScaffoldGroup) ForceShutdown(reason error) {
+	for _, m := range g.members {
+		m.forceShutdownOne(reason)
+	}
+}
+
+/*
+Wait calls "WaitForShutdown" on every member of the group, and returns
+once all of them have stopped. The result is the first error that any of
+them returned, in the order that they stopped, or nil if none did.
+*/
+func (g *ScaffoldGroup) Wait() error {
+	results := make(chan error, len(g.members))
+	for _, m := range g.members {
+		m.ensureTracker()
+		go func(m *HTTPScaffold) {
+			results <- m.WaitForShutdown()
+		}(m)
+	}
+	var first error
+	for range g.members {
+		if err := <-results; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (g *ScaffoldGroup) markDown() {
+	for _, m := range g.members {
+		m.markDownOne()
+	}
+}
+
+func (g *ScaffoldGroup) markUp() {
+	for _, m := range g.members {
+		m.markUpOne()
+	}
+}
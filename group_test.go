@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Group tests", func() {
+	It("Shutting down one drains both", func() {
+		s1 := CreateHTTPScaffold()
+		s1.SetReadyPath("/ready")
+		s2 := CreateHTTPScaffold()
+		s2.SetReadyPath("/ready")
+		g := NewGroup(s1, s2)
+		Expect(s1.Open()).Should(Succeed())
+		Expect(s2.Open()).Should(Succeed())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- g.ListenAll(map[*HTTPScaffold]http.Handler{
+				s1: &testHandler{},
+				s2: &testHandler{},
+			})
+		}()
+		Eventually(func() bool {
+			return testGet(s1, "") && testGet(s2, "")
+		}, 5*time.Second).Should(BeTrue())
+
+		// A slow request on the second one holds up the whole group
+		done := make(chan int)
+		go func() {
+			code, _ := getText(fmt.Sprintf("http://%s?delay=500ms", s2.InsecureAddress()))
+			done <- code
+		}()
+		Eventually(func() int {
+			return s2.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		stopErr := errors.New("Stop one")
+		s1.Shutdown(stopErr)
+		code, _ := getText(fmt.Sprintf("http://%s", s2.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		code, _ = getText(fmt.Sprintf("http://%s/ready", s2.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Consistently(stopChan, 250*time.Millisecond).ShouldNot(Receive())
+
+		Eventually(done).Should(Receive(Equal(200)))
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+		Eventually(func() bool {
+			return testGet(s1, "") || testGet(s2, "")
+		}, time.Second).Should(BeFalse())
+	})
+
+	It("Group markdown", func() {
+		s1 := CreateHTTPScaffold()
+		s2 := CreateHTTPScaffold()
+		marked := make(chan bool, 2)
+		s2.SetMarkdown("POST", "/markdown", func() {
+			marked <- true
+		})
+		g := NewGroup(s1, s2)
+		s1.Handlers(&testHandler{})
+		s2.Handlers(&testHandler{})
+		Expect(s1.IsReady()).Should(BeTrue())
+		Expect(s2.IsReady()).Should(BeTrue())
+
+		s1.markDown()
+		Expect(s1.IsReady()).Should(BeFalse())
+		Expect(s2.IsReady()).Should(BeFalse())
+		Eventually(marked).Should(Receive())
+
+		s2.markUp()
+		Expect(s1.IsReady()).Should(BeTrue())
+		Expect(s2.IsReady()).Should(BeTrue())
+
+		g.Shutdown(nil)
+		Expect(g.Wait()).Should(Equal(ErrManualStop))
+	})
+
+	It("Group members that never started", func() {
+		s1 := CreateHTTPScaffold()
+		s2 := CreateHTTPScaffold()
+		g := NewGroup(s1, s2)
+		Expect(g.ListenAll(map[*HTTPScaffold]http.Handler{
+			s1: &testHandler{},
+		})).ShouldNot(Succeed())
+
+		stopErr := errors.New("Stop early")
+		s2.Shutdown(stopErr)
+		Expect(g.Wait()).Should(Equal(stopErr))
+	})
+})
@@ -16,29 +16,222 @@ package goscaffold
 
 import (
 	"encoding/json"
-	"errors"
+	"expvar"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v2"
 )
 
+/*
+managementMethods are the only methods that the scaffold's own read-only
+endpoints will accept.
+*/
+var managementMethods = []string{"GET", "HEAD"}
+
 /*
 requestHandler handles all requests and stops them if we are marked down.
 */
 type requestHandler struct {
 	s     *HTTPScaffold
 	child http.Handler
+	// port is the name from "AddPort," or empty for the main ports
+	port string
 }
 
 func (h *requestHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	startErr := h.s.tracker.start()
-	if startErr == nil {
-		h.child.ServeHTTP(resp, req)
-		h.s.tracker.end()
+	tr, resp, req := h.s.startTrace(resp, req)
+	defer tr.finish()
+	req = h.s.resolveClient(req)
+	lw := h.s.limitResponse(resp, req)
+	if lw != nil {
+		resp = lw
+		defer lw.finish()
+	}
+	cw := h.s.compressResponse(resp, req)
+	if cw != nil {
+		resp = cw
+	}
+	start := h.s.clock.Now()
+	if h.s.accessLogger == nil {
+		reason := h.serve(resp, req)
+		tr.setRejection(reason)
+		cw.finish()
+		h.s.countRejection(reason)
+		h.s.requestMetrics.record(h.port, h.s.pathLabel(req), req.Method, h.s.since(start))
+		return
+	}
+	rw := newRecordingWriter(resp)
+	reason := h.serve(rw, req)
+	tr.setRejection(reason)
+	cw.finish()
+	h.s.countRejection(reason)
+	h.s.requestMetrics.record(h.port, h.s.pathLabel(req), req.Method, h.s.since(start))
+	h.s.logAccess(req, rw, start, reason, cw.compressedBytes())
+}
+
+/*
+serve passes the request to the application handler unless the scaffold
+rejects it first, in which case it says why.
+*/
+func (h *requestHandler) serve(resp http.ResponseWriter, req *http.Request) RejectionReason {
+	h.s.addSecurityHeaders(resp, req)
+	h.s.addInstanceHeaders(resp)
+	if !h.s.checkValid(resp, req) {
+		return RejectionInvalid
+	}
+	if req = h.s.normalizePath(resp, req); req == nil {
+		return RejectionNone
+	}
+	if h.s.handleCORS(resp, req) {
+		// Preflights are answered right away, even during markdown
+		return RejectionNone
+	}
+	if h.s.allowedMethods != nil && !methodAllowed(req, h.s.allowedMethods) {
+		h.s.discardBody(resp, req)
+		h.s.markRejected(resp)
+		writeMethodNotAllowed(resp, h.s.allowedMethods)
+		return RejectionMethodNotAllowed
+	}
+	if !h.s.checkRateLimit(resp, req) {
+		return RejectionRateLimited
+	}
+	if !h.s.checkBodySize(resp, req) {
+		return RejectionBodyTooLarge
+	}
+
+	// Another cycle may have started by the time this request ends, so it
+	// is counted by the tracker that it started with
+	tracker, inflight := h.s.requestState()
+	var startErr error
+	exempt := h.s.isMarkdownExempt(req)
+	limit := h.s.shedLimit(exempt)
+	if exempt && (h.s.markdownUpgrades || !isUpgrade(req)) {
+		startErr = tracker.startExemptLimited(limit)
 	} else {
-		writeUnavailable(resp, req, NotReady, startErr)
+		startErr = tracker.startLimited(limit)
+		if startErr != nil && startErr != ErrOverloaded && h.s.waitForMarkup(tracker, req) {
+			startErr = tracker.startLimited(limit)
+		}
+	}
+	if startErr == ErrOverloaded {
+		h.s.shed(resp, req)
+		return RejectionShed
+	}
+	if startErr != nil {
+		h.s.discardBody(resp, req)
+		resp.Header().Set("Connection", "close")
+		h.s.markRejected(resp)
+		if h.s.markdownResponse != nil {
+			h.s.markdownResponse.ServeHTTP(resp, withoutContinue(req))
+		} else {
+			writeUnavailable(resp, req, NotReady, startErr)
+		}
+		return RejectionMarkdown
+	}
+
+	ir := inflight.add(req, h.s.clock.Now())
+	defer func() {
+		inflight.remove(ir)
+		tracker.end()
+	}()
+
+	req = h.s.checkBearerAuth(resp, req)
+	if req == nil {
+		return RejectionUnauthorized
+	}
+	h.child.ServeHTTP(resp, req)
+	return RejectionNone
+}
+
+/*
+discardBody reads and throws away the body of a request that we are about
+to reject, up to the limit, so that the client sees our response. If there
+is more than that, we tell the client that we will close the connection.
+It must be called before the response is written. Bodies that the client
+is waiting for a "100 Continue" to send are left alone, because reading
+them would make net/http ask the client to send them. Instead the client
+gets the rejection in place of the "100 Continue," and the connection is
+closed since the body will never arrive.
+*/
+func (s *HTTPScaffold) discardBody(resp http.ResponseWriter, req *http.Request) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	if expectsContinue(req) {
+		resp.Header().Set("Connection", "close")
+		return
+	}
+	if s.rejectedBodyLimit <= 0 {
+		return
+	}
+	n, _ := io.CopyN(ioutil.Discard, req.Body, s.rejectedBodyLimit+1)
+	if n > s.rejectedBodyLimit {
+		resp.Header().Set("Connection", "close")
 	}
 }
 
+/*
+expectsContinue returns true if the client is waiting for a "100 Continue"
+before it sends the body.
+*/
+func expectsContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && req.ContentLength != 0 &&
+		strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+/*
+withoutContinue returns a copy of a rejected request whose body is empty if
+the client has not sent it yet, so that a handler that reads it does not
+make net/http send a "100 Continue."
+*/
+func withoutContinue(req *http.Request) *http.Request {
+	if !expectsContinue(req) {
+		return req
+	}
+	r := req.WithContext(req.Context())
+	r.Body = http.NoBody
+	r.ContentLength = 0
+	return r
+}
+
+/*
+isUpgrade returns true if the request would turn the connection into
+something other than HTTP, such as a WebSocket or a CONNECT tunnel, which
+might then stay open for longer than any drain.
+*/
+func isUpgrade(req *http.Request) bool {
+	if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, v := range req.Header["Connection"] {
+		for _, tok := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *HTTPScaffold) isMarkdownExempt(req *http.Request) bool {
+	for _, p := range s.markdownExempt {
+		if strings.HasSuffix(p, "/") {
+			if strings.HasPrefix(req.URL.Path, p) {
+				return true
+			}
+		} else if req.URL.Path == p {
+			return true
+		}
+	}
+	return false
+}
+
 /*
 managementHandler adds support for health checks and diagnostics.
 */
@@ -46,17 +239,71 @@ type managementHandler struct {
 	s     *HTTPScaffold
 	mux   *http.ServeMux
 	child http.Handler
+	// fallback handles unknown paths on a separate management port
+	fallback http.Handler
 }
 
 func (h *managementHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
-	handler, pattern := h.mux.Handler(req)
-	if pattern == "" && h.child != nil {
-		// Fall through for stuff that's not a management call
-		h.child.ServeHTTP(resp, req)
+	if h.s.fastProbe(resp, req) {
+		return
+	}
+	req = h.s.resolveClient(req)
+	// Match probes after normalization, but leave the rest of the requests
+	// for the application handler to normalize as it was told to.
+	nr := h.s.normalizedRequest(req)
+	handler, pattern := h.mux.Handler(nr)
+	if pattern != "" {
+		req = nr
 	} else {
-		// Handler may be one of ours, or a built-in not found handler
-		handler.ServeHTTP(resp, req)
+		if h.child != nil {
+			// Fall through for stuff that's not a management call
+			h.child.ServeHTTP(resp, req)
+			return
+		}
+		if h.fallback != nil {
+			handler = h.fallback
+		} else if h.s.mgmtNotFound != nil {
+			handler = h.s.mgmtNotFound
+		}
+	}
+
+	if h.s.traceManagement {
+		var tr *requestTrace
+		tr, resp, req = h.s.startTrace(resp, req)
+		defer tr.finish()
+	}
+	h.s.addInstanceHeaders(resp)
+	if !h.s.managementAllowedFrom(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
 	}
+	if h.s.handleManagementCORS(resp, req) {
+		return
+	}
+	// Management requests are counted separately from application
+	// requests so that shutdown does not wait for them.
+	atomic.AddInt32(&h.s.managementInFlight, 1)
+	defer atomic.AddInt32(&h.s.managementInFlight, -1)
+
+	// Handler may be one of ours, the management handler, or a built-in
+	// not found handler
+	handler.ServeHTTP(resp, req)
+}
+
+/*
+switchHandler passes requests to a handler that may be replaced while the
+server is running.
+*/
+type switchHandler struct {
+	h atomic.Value
+}
+
+func (w *switchHandler) set(h http.Handler) {
+	w.h.Store(&h)
+}
+
+func (w *switchHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	(*w.h.Load().(*http.Handler)).ServeHTTP(resp, req)
 }
 
 func (s *HTTPScaffold) createManagementHandler() *managementHandler {
@@ -67,54 +314,88 @@ func (s *HTTPScaffold) createManagementHandler() *managementHandler {
 
 	// Manually register paths from "pprof" package because we are
 	// not using a standard HTTP handler here.
-	h.mux.HandleFunc("/debug/pprof/", pprof.Index)
-	h.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-	h.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-	h.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-	h.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	h.handleFunc("/debug/pprof/", pprof.Index)
+	h.handleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	h.handleFunc("/debug/pprof/profile", pprof.Profile)
+	h.handleFunc("/debug/pprof/symbol", pprof.Symbol)
+	h.handleFunc("/debug/pprof/trace", pprof.Trace)
+	h.mux.Handle("/debug/vars", allowMethods(expvar.Handler(), managementMethods))
 
-	if s.healthPath != "" {
-		h.mux.HandleFunc(s.healthPath, s.handleHealth)
+	for _, p := range s.healthPaths() {
+		h.handleFunc(p, s.handleHealth)
+	}
+	for _, p := range s.readyPaths() {
+		h.handleFunc(p, s.handleReady)
+	}
+	if s.startupPath != "" {
+		h.handleFunc(s.startupPath, s.handleStartup)
+	}
+	if s.infoPath != "" {
+		h.handleFunc(s.infoPath, s.handleInfo)
 	}
-	if s.readyPath != "" {
-		h.mux.HandleFunc(s.readyPath, s.handleReady)
+	if s.metricsPath != "" {
+		h.handleFunc(s.metricsPath, s.handleMetrics)
+	}
+	if s.deepHealthPath != "" {
+		h.handleFunc(s.deepHealthPath, s.handleDeepHealth)
 	}
 	if s.markdownPath != "" {
-		h.mux.HandleFunc(s.markdownPath, s.handleMarkdown)
+		h.mux.Handle(s.markdownPath,
+			allowMethods(http.HandlerFunc(s.handleMarkdown), []string{s.markdownMethod}))
+	}
+	for _, mh := range s.managementHandlers {
+		h.mux.Handle(mh.path, mh.handler)
 	}
 	return h
 }
 
-func (s *HTTPScaffold) callHealthCheck() (HealthStatus, error) {
-	if s.healthCheck == nil {
-		return OK, nil
-	}
-	status, err := s.healthCheck()
-	if status == OK {
-		return OK, nil
-	}
-	if err == nil {
-		return status, errors.New(status.String())
+/*
+handleFunc registers a read-only management handler that only accepts
+GET and HEAD.
+*/
+func (h *managementHandler) handleFunc(path string, f http.HandlerFunc) {
+	h.mux.Handle(path, allowMethods(f, managementMethods))
+}
+
+/*
+allowMethods wraps a handler so that it returns 405 for any method
+that is not in the list.
+*/
+func allowMethods(h http.Handler, methods []string) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if !methodAllowed(req, methods) {
+			writeMethodNotAllowed(resp, methods)
+			return
+		}
+		h.ServeHTTP(resp, req)
+	})
+}
+
+func methodAllowed(req *http.Request, methods []string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
 	}
-	return status, err
+	return false
+}
+
+func writeMethodNotAllowed(resp http.ResponseWriter, methods []string) {
+	resp.Header().Set("Allow", strings.Join(methods, ", "))
+	resp.WriteHeader(http.StatusMethodNotAllowed)
 }
 
 /*
 handleHealth only fails if the user's health check function tells us.
 */
 func (s *HTTPScaffold) handleHealth(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
-	status, healthErr := s.callHealthCheck()
+	status, results, healthErr := s.evaluateHealth()
 
+	code := http.StatusOK
 	if status == Failed {
-		writeUnavailable(resp, req, status, healthErr)
-	} else {
-		resp.WriteHeader(http.StatusOK)
+		code = http.StatusServiceUnavailable
 	}
+	s.writeHealthResponse(resp, req, code, s.newHealthResponse(status, healthErr), results)
 }
 
 /*
@@ -122,23 +403,45 @@ handleReady fails if we are marked down and also if the user's health function
 tells us.
 */
 func (s *HTTPScaffold) handleReady(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != "GET" {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	status, results, healthErr := s.evaluateHealth()
+	status, healthErr, override := s.readiness(status, healthErr)
+
+	code := http.StatusOK
+	if !status.ready() {
+		code = http.StatusServiceUnavailable
 	}
+	doc := s.newHealthResponse(status, healthErr)
+	doc.Override = override
+	s.writeHealthResponse(resp, req, code, doc, results)
+}
 
-	status, healthErr := s.callHealthCheck()
-	if status == OK {
-		healthErr = s.tracker.markedDown()
-		if healthErr != nil {
-			status = NotReady
-		}
+/*
+newHealthResponse creates the document for the health and ready paths,
+which includes how long we have been up.
+*/
+func (s *HTTPScaffold) newHealthResponse(stat HealthStatus, err error) *healthDocument {
+	doc := newHealthDocument(stat, err)
+	doc.Started = s.startedFlag()
+	if start := s.StartTime(); !start.IsZero() {
+		doc.StartTime = &start
+		doc.UptimeSeconds = s.Uptime().Seconds()
 	}
+	if st := s.DrainStatus(); st.Draining {
+		doc.Draining = true
+		doc.InFlight = &st.InFlight
+	}
+	return doc
+}
 
-	if status == OK {
-		resp.WriteHeader(http.StatusOK)
+func (s *HTTPScaffold) writeHealthResponse(
+	resp http.ResponseWriter, req *http.Request,
+	code int, doc *healthDocument, results []checkResult) {
+
+	if isVerbose(req) && s.verboseAllowed(req) {
+		doc.Checks = results
+		writeVerboseHealth(resp, req, code, doc)
 	} else {
-		writeUnavailable(resp, req, status, healthErr)
+		writeHealth(resp, req, code, doc)
 	}
 }
 
@@ -146,36 +449,111 @@ func (s *HTTPScaffold) handleReady(resp http.ResponseWriter, req *http.Request)
 handleMarkdown handles a request to mark down the server.
 */
 func (s *HTTPScaffold) handleMarkdown(resp http.ResponseWriter, req *http.Request) {
-	if req.Method != s.markdownMethod {
-		resp.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-
 	req.Body.Close()
-	s.tracker.markDown()
-	if s.markdownHandler != nil {
-		s.markdownHandler()
+	s.markDown()
+}
+
+/*
+healthMediaTypes are the media types that the health and ready paths
+know how to produce, in order of preference when the client doesn't care.
+*/
+var healthMediaTypes = []string{
+	"text/plain",
+	"application/json",
+	"application/yaml",
+	"application/x-yaml",
+}
+
+/*
+healthDocument is the structured body returned by the health and ready
+paths, and by rejected requests, when the client asks for JSON or YAML.
+The list of checks is only filled in for verbose requests.
+*/
+type healthDocument struct {
+	Status        string        `json:"status" yaml:"status"`
+	Reason        string        `json:"reason,omitempty" yaml:"reason,omitempty"`
+	StartTime     *time.Time    `json:"startTime,omitempty" yaml:"startTime,omitempty"`
+	UptimeSeconds float64       `json:"uptimeSeconds,omitempty" yaml:"uptimeSeconds,omitempty"`
+	Override      bool          `json:"override,omitempty" yaml:"override,omitempty"`
+	Started       *bool         `json:"started,omitempty" yaml:"started,omitempty"`
+	Draining      bool          `json:"draining,omitempty" yaml:"draining,omitempty"`
+	InFlight      *int          `json:"inflight,omitempty" yaml:"inflight,omitempty"`
+	Checks        []checkResult `json:"checks,omitempty" yaml:"checks,omitempty"`
+}
+
+func newHealthDocument(stat HealthStatus, err error) *healthDocument {
+	doc := &healthDocument{
+		Status: stat.String(),
+	}
+	if err != nil {
+		doc.Reason = err.Error()
 	}
+	return doc
 }
 
 func writeUnavailable(
 	resp http.ResponseWriter, req *http.Request,
 	stat HealthStatus, err error) {
+	writeHealth(resp, req, http.StatusServiceUnavailable, newHealthDocument(stat, err))
+}
+
+/*
+writeHealth writes a health status using the media type negotiated from
+the "Accept" header. Unrecognized types fall back to text/plain.
+*/
+func writeHealth(
+	resp http.ResponseWriter, req *http.Request,
+	code int, doc *healthDocument) {
+
+	mt := SelectMediaType(req, healthMediaTypes)
+	if !writeHealthDocument(resp, mt, code, doc) {
+		resp.Header().Set("Content-Type", "text/plain")
+		resp.WriteHeader(code)
+		resp.Write([]byte(doc.Reason))
+	}
+}
+
+/*
+writeVerboseHealth writes the full document, including every check. Since
+there is no sensible plain-text form, it is JSON unless YAML was requested.
+*/
+func writeVerboseHealth(
+	resp http.ResponseWriter, req *http.Request,
+	code int, doc *healthDocument) {
+
+	mt := SelectMediaType(req, healthMediaTypes)
+	if !writeHealthDocument(resp, mt, code, doc) {
+		writeHealthDocument(resp, "application/json", code, doc)
+	}
+}
 
-	mt := SelectMediaType(req, []string{"text/plain", "application/json"})
+/*
+writeHealthDocument writes the document in a structured media type and
+returns false if "mt" is not one that it knows.
+*/
+func writeHealthDocument(
+	resp http.ResponseWriter, mt string, code int, doc *healthDocument) bool {
+	return writeStructured(resp, mt, code, doc)
+}
 
-	resp.WriteHeader(http.StatusServiceUnavailable)
+/*
+writeStructured writes any document as JSON or YAML and returns false if
+"mt" is neither.
+*/
+func writeStructured(
+	resp http.ResponseWriter, mt string, code int, doc interface{}) bool {
+
+	var buf []byte
 	switch mt {
 	case "application/json":
-		re := map[string]string{
-			"status": stat.String(),
-			"reason": err.Error(),
-		}
-		buf, _ := json.Marshal(&re)
-		resp.Header().Set("Content-Type", mt)
-		resp.Write(buf)
+		buf, _ = json.Marshal(doc)
+	case "application/yaml", "application/x-yaml":
+		buf, _ = yaml.Marshal(doc)
 	default:
-		resp.Header().Set("Content-Type", "text/plain")
-		resp.Write([]byte(err.Error()))
+		return false
 	}
+	resp.Header().Set("Content-Type", mt)
+	resp.WriteHeader(code)
+	resp.Write(buf)
+	return true
 }
@@ -0,0 +1,73 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const hstsHeader = "Strict-Transport-Security"
+
+/*
+SetSecurityHeaders sets headers, such as "X-Content-Type-Options" and
+"X-Frame-Options," that the scaffold adds to every application response.
+They are set before the handler is called, so the handler may replace them
+or delete them. "Strict-Transport-Security" is only ever sent over TLS,
+even if it is included here.
+*/
+func (s *HTTPScaffold) SetSecurityHeaders(hdrs map[string]string) {
+	s.securityHeaders = make(http.Header, len(hdrs))
+	for k, v := range hdrs {
+		s.securityHeaders.Set(k, v)
+	}
+}
+
+/*
+SetHSTS makes the scaffold add a "Strict-Transport-Security" header to every
+application response that is sent over TLS, and never to plaintext ones.
+Like the headers from "SetSecurityHeaders," the handler may replace it.
+A "maxAge" of zero turns it off.
+*/
+func (s *HTTPScaffold) SetHSTS(maxAge time.Duration, includeSubdomains bool) {
+	if maxAge <= 0 {
+		s.hsts = ""
+		return
+	}
+	s.hsts = fmt.Sprintf("max-age=%d", int64(maxAge/time.Second))
+	if includeSubdomains {
+		s.hsts += "; includeSubDomains"
+	}
+}
+
+/*
+addSecurityHeaders sets the default headers on the response.
+*/
+func (s *HTTPScaffold) addSecurityHeaders(resp http.ResponseWriter, req *http.Request) {
+	if s.securityHeaders == nil && s.hsts == "" {
+		return
+	}
+	h := resp.Header()
+	for k, v := range s.securityHeaders {
+		if k == hstsHeader && req.TLS == nil {
+			continue
+		}
+		h[k] = append([]string(nil), v...)
+	}
+	if s.hsts != "" && req.TLS != nil {
+		h.Set(hstsHeader, s.hsts)
+	}
+}
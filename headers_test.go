@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Security header tests", func() {
+	It("HSTS and security headers", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetHSTS(365*24*time.Hour, true)
+		s.SetSecurityHeaders(map[string]string{
+			"X-Content-Type-Options": "nosniff",
+			"X-Frame-Options":        "DENY",
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/frame" {
+					w.Header().Set("X-Frame-Options", "SAMEORIGIN")
+					w.Header().Set("Strict-Transport-Security", "max-age=60")
+				}
+			}))
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		resp, err := insecureClient.Get(s.SecureURL().String() + "/")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.Header.Get("Strict-Transport-Security")).Should(Equal("max-age=31536000; includeSubDomains"))
+		Expect(resp.Header.Get("X-Content-Type-Options")).Should(Equal("nosniff"))
+		Expect(resp.Header.Get("X-Frame-Options")).Should(Equal("DENY"))
+
+		// Never on plaintext
+		resp, err = http.Get(s.InsecureURL().String() + "/")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.Header).ShouldNot(HaveKey("Strict-Transport-Security"))
+		Expect(resp.Header.Get("X-Content-Type-Options")).Should(Equal("nosniff"))
+
+		// The handler wins
+		resp, err = insecureClient.Get(s.SecureURL().String() + "/frame")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.Header.Get("X-Frame-Options")).Should(Equal("SAMEORIGIN"))
+		Expect(resp.Header.Get("Strict-Transport-Security")).Should(Equal("max-age=60"))
+		Expect(resp.Header["X-Frame-Options"]).Should(HaveLen(1))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("HSTS in security headers is TLS only", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurityHeaders(map[string]string{
+			"strict-transport-security": "max-age=10",
+		})
+		hdrs := newHeaderRecorder(s, false)
+		Expect(hdrs).ShouldNot(HaveKey("Strict-Transport-Security"))
+		hdrs = newHeaderRecorder(s, true)
+		Expect(hdrs.Get("Strict-Transport-Security")).Should(Equal("max-age=10"))
+
+		s.SetSecurityHeaders(nil)
+		s.SetHSTS(0, false)
+		Expect(newHeaderRecorder(s, true)).Should(BeEmpty())
+	})
+})
+
+func newHeaderRecorder(s *HTTPScaffold, secure bool) http.Header {
+	req := httptest.NewRequest("GET", "/", nil)
+	if secure {
+		req.TLS = &tls.ConnectionState{}
+	}
+	resp := httptest.NewRecorder()
+	s.addSecurityHeaders(resp, req)
+	return resp.Header()
+}
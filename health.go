@@ -0,0 +1,464 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+defaultCheckName is the name reported in verbose output for the checker
+set using "SetHealthChecker."
+*/
+const defaultCheckName = "default"
+
+/*
+namedCheck is a health checker that was registered with a name.
+*/
+type namedCheck struct {
+	name    string
+	checker HealthChecker
+	// If this is set, it is used instead of "checker," and also returns
+	// the detail for the verbose output.
+	detailed func() (HealthStatus, interface{}, error)
+}
+
+/*
+checkResult is the outcome of a single health check, as reported in the
+verbose health document.
+*/
+type checkResult struct {
+	Name          string      `json:"name" yaml:"name"`
+	Status        string      `json:"status" yaml:"status"`
+	Reason        string      `json:"reason,omitempty" yaml:"reason,omitempty"`
+	Latency       string      `json:"latency" yaml:"latency"`
+	LastEvaluated time.Time   `json:"lastEvaluated" yaml:"lastEvaluated"`
+	Detail        interface{} `json:"detail,omitempty" yaml:"detail,omitempty"`
+	status        HealthStatus
+	latency       time.Duration
+	panicked      bool
+}
+
+/*
+AddHealthCheck registers an additional health checker under a name. Every
+registered checker is called whenever the "health" and "ready" URLs are
+invoked, along with the one set using "SetHealthChecker," and the worst
+result wins. The names only appear in the verbose health output, which is
+returned when the URL is invoked with "?verbose=true". If
+"EnableBearerAuth" is in use, the verbose output also needs a valid bearer
+token, even though the health paths do not. Other requests get the plain
+status.
+*/
+func (s *HTTPScaffold) AddHealthCheck(name string, c HealthChecker) {
+	s.healthChecks = append(s.healthChecks, namedCheck{
+		name:    name,
+		checker: c,
+	})
+}
+
+func (s *HTTPScaffold) allHealthChecks() []namedCheck {
+	var checks []namedCheck
+	if s.healthCheck != nil {
+		checks = append(checks, namedCheck{
+			name:    defaultCheckName,
+			checker: s.healthCheck,
+		})
+	}
+	return append(checks, s.healthChecks...)
+}
+
+/*
+SetHealthCacheInterval makes the scaffold reuse the result of the health
+checkers for up to the given amount of time, rather than calling them for
+every request to the health and ready paths. While the checkers are
+running, other requests wait for that result rather than calling them
+again. If set to zero, which is the default, the checkers are called for
+every request.
+*/
+func (s *HTTPScaffold) SetHealthCacheInterval(d time.Duration) {
+	s.healthCacheInterval = d
+}
+
+/*
+healthEvaluation is the result of calling all the health checkers once.
+*/
+type healthEvaluation struct {
+	status  HealthStatus
+	results []checkResult
+	reason  error
+	at      time.Time
+	// panicked is the first checker panic, if there was one
+	panicked error
+}
+
+/*
+evaluateHealth returns the worst status of all the health checkers along
+with its reason, plus the individual results for verbose output. The
+result may come from the cache.
+*/
+func (s *HTTPScaffold) evaluateHealth() (HealthStatus, []checkResult, error) {
+	if atomic.LoadInt32(&s.notListening) != 0 {
+		return NotReady, nil, ErrNotListening
+	}
+	ev := s.currentHealth()
+	if lf := s.listenerFailed(); lf != nil {
+		return Failed, ev.results, lf
+	}
+	return ev.status, ev.results, ev.reason
+}
+
+/*
+currentHealth returns a cached evaluation if there is a fresh one, waits
+for one that is already running, or else calls the checkers.
+*/
+func (s *HTTPScaffold) currentHealth() *healthEvaluation {
+	s.healthLock.Lock()
+	if s.healthCacheInterval > 0 {
+		if s.lastHealth != nil && s.since(s.lastHealth.at) < s.healthCacheInterval {
+			ev := s.lastHealth
+			s.recordCachedHealth(ev)
+			s.healthLock.Unlock()
+			return ev
+		}
+		if wait := s.healthWait; wait != nil {
+			s.healthLock.Unlock()
+			<-wait
+			s.healthLock.Lock()
+			ev := s.lastHealth
+			s.recordCachedHealth(ev)
+			s.healthLock.Unlock()
+			return ev
+		}
+		s.healthWait = make(chan struct{})
+	}
+	s.healthLock.Unlock()
+
+	ev := s.runHealthChecks()
+
+	s.healthLock.Lock()
+	s.lastHealth = ev
+	s.latestHealth.Store(ev)
+	s.recordHealth(ev)
+	if s.healthWait != nil {
+		close(s.healthWait)
+		s.healthWait = nil
+	}
+	s.healthLock.Unlock()
+	if s.listenerFailed() == nil {
+		s.reportHealth(ev.status, ev.reason)
+	}
+	if ev.panicked != nil && s.healthPanicPolicy == ShutdownOnPanic {
+		s.Shutdown(ev.panicked)
+	}
+	return ev
+}
+
+/*
+HealthChangeFunc is called when the health that the scaffold reports
+changes from one status to another.
+*/
+type HealthChangeFunc func(from, to HealthStatus, reason error)
+
+/*
+OnHealthChange sets a function that is called every time that the health
+status changes, such as when the health checkers start returning a
+different status, or when one of the listeners stops. Changes in the
+checkers are only seen when the health or ready path is called. Calls are
+never made at the same time, and they are made in the goroutine that saw
+the change, so the function should return quickly. The status starts out
+as "OK."
+*/
+func (s *HTTPScaffold) OnHealthChange(f HealthChangeFunc) {
+	s.healthChange = f
+}
+
+/*
+reportHealth calls the function set by "OnHealthChange" if the status is
+not the same as the last time.
+*/
+func (s *HTTPScaffold) reportHealth(status HealthStatus, reason error) {
+	s.notifyLock.Lock()
+	defer s.notifyLock.Unlock()
+	prev := s.reportedHealth
+	s.reportedHealth = status
+	if prev != status && s.healthChange != nil {
+		s.healthChange(prev, status, reason)
+	}
+}
+
+/*
+HealthStatus returns the status and reason that the health path reported
+the last time that it, or the ready path, called the health checkers. It
+never calls the checkers itself, so it is cheap enough to call for every
+unit of work. A probe that runs at the same time may see a newer result,
+and once it completes, "HealthStatus" returns that one. If the health
+cache is used, this is the cached result even after it has expired, until
+the next probe refreshes it. If there are health checkers but no probe has
+called them yet, it returns "NotReady" and "ErrHealthUnknown." Between
+"Open" and "StartListen" it returns "NotReady" and "ErrNotListening."
+If a listener has stopped, it returns "Failed" and an "ErrListenerFailed."
+*/
+func (s *HTTPScaffold) HealthStatus() (HealthStatus, error) {
+	if atomic.LoadInt32(&s.notListening) != 0 {
+		return NotReady, ErrNotListening
+	}
+	if lf := s.listenerFailed(); lf != nil {
+		return Failed, lf
+	}
+	if ev, ok := s.latestHealth.Load().(*healthEvaluation); ok && ev != nil {
+		return ev.status, ev.reason
+	}
+	if s.healthCheck == nil && len(s.healthChecks) == 0 {
+		return OK, nil
+	}
+	return NotReady, ErrHealthUnknown
+}
+
+/*
+ReadyStatus is like "HealthStatus," but returns what the ready path would
+report. The markdown, shutdown, and "SetNotReady" state is always current,
+so only the health checker part of the result may lag behind a probe.
+*/
+func (s *HTTPScaffold) ReadyStatus() (HealthStatus, error) {
+	status, reason := s.HealthStatus()
+	status, reason, _ = s.readiness(status, reason)
+	return status, reason
+}
+
+/*
+IsReady returns true if "ReadyStatus" is OK or Degraded, which is when the
+ready path would return 200.
+*/
+func (s *HTTPScaffold) IsReady() bool {
+	status, _ := s.ReadyStatus()
+	return status.ready()
+}
+
+/*
+readiness adds the markdown, startup, and "SetNotReady" state to the
+result of the health checkers. It also returns whether the override was applied.
+*/
+func (s *HTTPScaffold) readiness(status HealthStatus, reason error) (HealthStatus, error, bool) {
+	var markedDown error
+	if t := s.currentTracker(); t != nil {
+		markedDown = t.markedDown()
+	}
+	if status.ready() && markedDown != nil {
+		status = NotReady
+		reason = markedDown
+	} else if ns := s.notStarted(); status.ready() && ns != nil {
+		status = NotReady
+		reason = ns
+	}
+	// Markdown always wins over the override, but the override wins over
+	// the health checkers.
+	if ov := s.notReadyOverride(); ov != nil && markedDown == nil {
+		if status.ready() {
+			status = NotReady
+		}
+		return status, ov, true
+	}
+	return status, reason, false
+}
+
+/*
+runHealthChecks calls every health checker.
+*/
+func (s *HTTPScaffold) runHealthChecks() *healthEvaluation {
+	checks := s.allHealthChecks()
+	ev := &healthEvaluation{
+		status:  OK,
+		results: make([]checkResult, len(checks)),
+		at:      s.clock.Now(),
+	}
+
+	for i, c := range checks {
+		start := s.clock.Now()
+		cs, detail, err := s.callCheck(c)
+		latency := s.since(start)
+		pe, panicked := err.(*ErrCheckerPanicked)
+		if panicked && ev.panicked == nil {
+			ev.panicked = pe
+		}
+
+		if cs == OK {
+			err = nil
+		} else if err == nil {
+			err = errors.New(cs.String())
+		}
+		ev.results[i] = checkResult{
+			Name:          c.name,
+			Status:        cs.String(),
+			Latency:       latency.String(),
+			LastEvaluated: start,
+			Detail:        detail,
+			status:        cs,
+			latency:       latency,
+			panicked:      panicked,
+		}
+		if err != nil {
+			ev.results[i].Reason = err.Error()
+		}
+		if cs.worseThan(ev.status) {
+			ev.status = cs
+			ev.reason = err
+		}
+	}
+	return ev
+}
+
+/*
+CheckStats counts the results of a health checker, or of all of them
+together. "Evaluations" counts the times that the checker was called, and
+"Cached" counts the times that its result was reused from the cache or
+shared with a concurrent request instead. The other counts are for the
+live evaluations only, so that one failure is not counted many times.
+*/
+type CheckStats struct {
+	Evaluations int64 `json:"evaluations"`
+	Cached      int64 `json:"cached"`
+	OK          int64 `json:"ok"`
+	Degraded    int64 `json:"degraded"`
+	NotReady    int64 `json:"notReady"`
+	Failed      int64 `json:"failed"`
+	// ConsecutiveFailures is the number of evaluations in a row that were
+	// not OK, up to and including the latest one
+	ConsecutiveFailures int64 `json:"consecutiveFailures"`
+	// Flaps is the number of times that the status went from OK to not OK
+	Flaps             int64     `json:"flaps"`
+	LastFailure       time.Time `json:"lastFailure"`
+	LastFailureReason string    `json:"lastFailureReason,omitempty"`
+	// Panics is the number of times that the checker panicked
+	Panics     int64 `json:"panics"`
+	lastStatus HealthStatus
+}
+
+/*
+HealthStats describes how the health checkers have behaved since the
+scaffold was created.
+*/
+type HealthStats struct {
+	// Overall counts the combined status of all the checkers
+	Overall CheckStats `json:"overall"`
+	// Checks has the counts for each checker by name
+	Checks map[string]CheckStats `json:"checks"`
+}
+
+/*
+HealthStats returns counts of health checker results. They may be used to
+spot a checker that fails intermittently, even if no probe happens to see
+it fail.
+*/
+func (s *HTTPScaffold) HealthStats() HealthStats {
+	s.healthLock.Lock()
+	defer s.healthLock.Unlock()
+	st := HealthStats{
+		Overall: s.healthStats.Overall,
+		Checks:  make(map[string]CheckStats, len(s.healthStats.Checks)),
+	}
+	for n, cs := range s.healthStats.Checks {
+		st.Checks[n] = cs
+	}
+	return st
+}
+
+/*
+recordHealth updates the stats after an evaluation. The lock must be held.
+*/
+func (s *HTTPScaffold) recordHealth(ev *healthEvaluation) {
+	var overallReason string
+	if ev.reason != nil {
+		overallReason = ev.reason.Error()
+	}
+	s.healthStats.Overall.record(ev.status, overallReason, ev.at)
+	if s.healthStats.Checks == nil {
+		s.healthStats.Checks = make(map[string]CheckStats)
+	}
+	for _, r := range ev.results {
+		cs := s.healthStats.Checks[r.Name]
+		cs.record(r.status, r.Reason, r.LastEvaluated)
+		if r.panicked {
+			cs.Panics++
+			s.healthStats.Overall.Panics++
+		}
+		s.healthStats.Checks[r.Name] = cs
+	}
+}
+
+/*
+recordCachedHealth counts an evaluation that was used again. The lock must
+be held.
+*/
+func (s *HTTPScaffold) recordCachedHealth(ev *healthEvaluation) {
+	s.healthStats.Overall.Cached++
+	if ev == nil {
+		return
+	}
+	for _, r := range ev.results {
+		cs := s.healthStats.Checks[r.Name]
+		cs.Cached++
+		s.healthStats.Checks[r.Name] = cs
+	}
+}
+
+func (c *CheckStats) record(stat HealthStatus, reason string, at time.Time) {
+	c.Evaluations++
+	switch stat {
+	case OK:
+		c.OK++
+	case Degraded:
+		c.Degraded++
+	case NotReady:
+		c.NotReady++
+	default:
+		c.Failed++
+	}
+	if stat == OK {
+		c.ConsecutiveFailures = 0
+	} else {
+		if c.Evaluations > 1 && c.lastStatus == OK {
+			c.Flaps++
+		}
+		c.ConsecutiveFailures++
+		c.LastFailure = at
+		c.LastFailureReason = reason
+	}
+	c.lastStatus = stat
+}
+
+/*
+isVerbose returns true if the client asked for the full health document.
+*/
+func isVerbose(req *http.Request) bool {
+	v, err := strconv.ParseBool(req.URL.Query().Get("verbose"))
+	return err == nil && v
+}
+
+/*
+verboseAllowed returns true if the client may see the full health
+document, which says more about the server than the status does. It must
+pass the management allowlist, and have a valid token if bearer auth is
+in use.
+*/
+func (s *HTTPScaffold) verboseAllowed(req *http.Request) bool {
+	if !s.managementAllowedFrom(req) {
+		return false
+	}
+	return !s.bearerAuth || s.hasValidToken(req)
+}
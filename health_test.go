@@ -0,0 +1,653 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Health tests", func() {
+	It("Verbose health", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			return OK, nil
+		})
+		s.AddHealthCheck("database", func() (HealthStatus, error) {
+			return NotReady, errors.New("connecting")
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// Non-verbose output has no detail about individual checks
+		code, bod := getText(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(Equal("connecting"))
+		code, bod = getWithAccept(fmt.Sprintf("http://%s/health", s.ManagementAddress()),
+			"application/json")
+		Expect(code).Should(Equal(200))
+		Expect(bod).ShouldNot(ContainSubstring("database"))
+		Expect(bod).ShouldNot(ContainSubstring(defaultCheckName))
+		Expect(bod).ShouldNot(ContainSubstring("checks"))
+
+		// Verbose output is JSON even if text was requested
+		code, bod = getText(fmt.Sprintf("http://%s/health?verbose=true", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+		var doc healthDocument
+		err = json.Unmarshal([]byte(bod), &doc)
+		Expect(err).Should(Succeed())
+		Expect(doc.Status).Should(Equal("NotReady"))
+		Expect(doc.Reason).Should(Equal("connecting"))
+		Expect(doc.Checks).Should(HaveLen(2))
+		Expect(doc.Checks[0].Name).Should(Equal(defaultCheckName))
+		Expect(doc.Checks[0].Status).Should(Equal("OK"))
+		Expect(doc.Checks[1].Name).Should(Equal("database"))
+		Expect(doc.Checks[1].Status).Should(Equal("NotReady"))
+		Expect(doc.Checks[1].Reason).Should(Equal("connecting"))
+		Expect(doc.Checks[1].Latency).ShouldNot(BeEmpty())
+		Expect(doc.Checks[1].LastEvaluated).Should(BeTemporally("~", time.Now(), time.Minute))
+
+		code, bod = getText(fmt.Sprintf("http://%s/ready?verbose=1", s.ManagementAddress()))
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(ContainSubstring("database"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Verbose health needs a token with bearer auth", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.AddHealthCheck("database", func() (HealthStatus, error) {
+			return OK, nil
+		})
+		s.EnableBearerAuth("/private")
+		s.SetTokenValidator(func(ctx context.Context, token string) (TokenClaims, error) {
+			if token != "good" {
+				return nil, errors.New("bad token")
+			}
+			return TokenClaims{}, nil
+		})
+		h, _ := s.Handlers(&testHandler{})
+		get := func(auth string) (int, string) {
+			req := httptest.NewRequest("GET", "/health?verbose=true", nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code, rec.Body.String()
+		}
+
+		// The plain status still needs no token
+		for _, auth := range []string{"", "Bearer bad", "Basic good"} {
+			code, bod := get(auth)
+			Expect(code).Should(Equal(200))
+			Expect(bod).ShouldNot(ContainSubstring("database"))
+		}
+		code, bod := get("Bearer good")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(ContainSubstring("database"))
+	})
+
+	It("Health aliases", func() {
+		for _, mgmt := range []bool{true, false} {
+			s := CreateHTTPScaffold()
+			if mgmt {
+				s.SetManagementPort(0)
+			}
+			s.SetHealthPath("/health")
+			s.SetReadyPath("/ready")
+			s.SetInfoPath("/info")
+			Expect(s.AddHealthAlias("/healthz")).Should(Succeed())
+			Expect(s.AddHealthAlias("/livez")).Should(Succeed())
+			Expect(s.AddHealthAlias("/health")).Should(Succeed())
+			Expect(s.AddReadyAlias("/readyz")).Should(Succeed())
+			Expect(s.AddReadyAlias("/healthz")).ShouldNot(Succeed())
+			Expect(s.AddHealthAlias("/readyz")).ShouldNot(Succeed())
+			stopChan := make(chan error)
+			err := s.Open()
+			Expect(err).Should(Succeed())
+
+			go func() {
+				stopChan <- s.Listen(&testHandler{})
+			}()
+
+			Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+			Expect(testGet(s, "")).Should(BeTrue())
+
+			base := s.ManagementURL().String()
+			for _, p := range []string{"/health", "/healthz", "/livez", "/ready", "/readyz"} {
+				code, _ := getText(base + p)
+				Expect(code).Should(Equal(200))
+			}
+
+			a := s.Addresses()
+			Expect(a.HealthPaths).Should(Equal([]string{"/health", "/healthz", "/livez"}))
+			Expect(a.ReadyPaths).Should(Equal([]string{"/ready", "/readyz"}))
+
+			code, bod := getWithAccept(base+"/info", "application/json")
+			Expect(code).Should(Equal(200))
+			var info infoDocument
+			err = json.Unmarshal([]byte(bod), &info)
+			Expect(err).Should(Succeed())
+			Expect(info.HealthAliases).Should(Equal([]string{"/healthz", "/livez"}))
+			Expect(info.ReadyAliases).Should(Equal([]string{"/readyz"}))
+
+			// Aliases follow markdown just like the ready path
+			s.markDown()
+			code, _ = getText(base + "/readyz")
+			Expect(code).Should(Equal(503))
+			code, _ = getText(base + "/livez")
+			Expect(code).Should(Equal(200))
+
+			s.Shutdown(nil)
+			Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		}
+	})
+
+	It("Conflicting health and ready paths", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/probe")
+		s.SetReadyPath("/probe")
+		Expect(s.Open()).Should(MatchError(ContainSubstring("/probe")))
+
+		s = CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		Expect(s.AddHealthAlias("/healthz")).Should(Succeed())
+		s.SetReadyPath("/healthz")
+		Expect(s.Open()).ShouldNot(Succeed())
+	})
+
+	It("Health stats", func() {
+		s := CreateHTTPScaffold()
+		var results []HealthStatus
+		s.AddHealthCheck("flaky", func() (HealthStatus, error) {
+			st := results[0]
+			results = results[1:]
+			if st != OK {
+				return st, errors.New("flaked")
+			}
+			return OK, nil
+		})
+		s.AddHealthCheck("steady", func() (HealthStatus, error) {
+			return OK, nil
+		})
+
+		results = []HealthStatus{OK, NotReady, Failed, OK, Failed}
+		for range results {
+			s.evaluateHealth()
+		}
+
+		st := s.HealthStats()
+		Expect(st.Overall.Cached).Should(BeZero())
+		Expect(st.Overall.Evaluations).Should(BeEquivalentTo(5))
+		Expect(st.Overall.Failed).Should(BeEquivalentTo(2))
+		Expect(st.Overall.Flaps).Should(BeEquivalentTo(2))
+		Expect(st.Overall.ConsecutiveFailures).Should(BeEquivalentTo(1))
+
+		flaky := st.Checks["flaky"]
+		Expect(flaky.Evaluations).Should(BeEquivalentTo(5))
+		Expect(flaky.Cached).Should(BeZero())
+		Expect(flaky.OK).Should(BeEquivalentTo(2))
+		Expect(flaky.NotReady).Should(BeEquivalentTo(1))
+		Expect(flaky.Failed).Should(BeEquivalentTo(2))
+		Expect(flaky.ConsecutiveFailures).Should(BeEquivalentTo(1))
+		Expect(flaky.Flaps).Should(BeEquivalentTo(2))
+		Expect(flaky.LastFailureReason).Should(Equal("flaked"))
+		Expect(flaky.LastFailure).Should(BeTemporally("~", time.Now(), time.Second))
+
+		steady := st.Checks["steady"]
+		Expect(steady.OK).Should(BeEquivalentTo(5))
+		Expect(steady.Flaps).Should(BeZero())
+		Expect(steady.LastFailure.IsZero()).Should(BeTrue())
+	})
+
+	It("Health cache", func() {
+		s := CreateHTTPScaffold()
+		var calls int32
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			atomic.AddInt32(&calls, 1)
+			time.Sleep(100 * time.Millisecond)
+			return OK, nil
+		})
+		s.SetHealthCacheInterval(time.Hour)
+
+		// Concurrent requests share one evaluation
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				st, _, _ := s.evaluateHealth()
+				Expect(st).Should(Equal(OK))
+			}()
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(1))
+
+		s.evaluateHealth()
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(1))
+		st := s.HealthStats()
+		Expect(st.Overall.Evaluations).Should(BeEquivalentTo(1))
+		Expect(st.Overall.Cached).Should(BeEquivalentTo(10))
+
+		// Without the cache every call evaluates
+		s.SetHealthCacheInterval(0)
+		s.evaluateHealth()
+		s.evaluateHealth()
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(3))
+	})
+
+	It("Status values and ranking", func() {
+		// The values from before "Degraded" was added stay the same
+		Expect(int(OK)).Should(Equal(0))
+		Expect(int(NotReady)).Should(Equal(1))
+		Expect(int(Failed)).Should(Equal(2))
+		Expect(Degraded.String()).Should(Equal("Degraded"))
+
+		s := CreateHTTPScaffold()
+		s.AddHealthCheck("slow", func() (HealthStatus, error) {
+			return Degraded, nil
+		})
+		st, _, _ := s.evaluateHealth()
+		Expect(st).Should(Equal(Degraded))
+		Expect(s.IsReady()).Should(BeTrue())
+		s.AddHealthCheck("starting", func() (HealthStatus, error) {
+			return NotReady, nil
+		})
+		st, _, _ = s.evaluateHealth()
+		Expect(st).Should(Equal(NotReady))
+		Expect(s.IsReady()).Should(BeFalse())
+	})
+
+	It("Health stats for cached results", func() {
+		s := CreateHTTPScaffold()
+		s.AddHealthCheck("up", func() (HealthStatus, error) {
+			return OK, nil
+		})
+		s.AddHealthCheck("down", func() (HealthStatus, error) {
+			return Failed, errors.New("down")
+		})
+		s.SetHealthCacheInterval(time.Hour)
+
+		for i := 0; i < 4; i++ {
+			s.evaluateHealth()
+		}
+		s.SetHealthCacheInterval(0)
+		s.evaluateHealth()
+
+		st := s.HealthStats()
+		Expect(st.Overall.Evaluations).Should(BeEquivalentTo(2))
+		Expect(st.Overall.Cached).Should(BeEquivalentTo(3))
+		for _, name := range []string{"up", "down"} {
+			Expect(st.Checks[name].Evaluations).Should(BeEquivalentTo(2))
+			Expect(st.Checks[name].Cached).Should(BeEquivalentTo(3))
+		}
+		// A cached failure is not counted again
+		down := st.Checks["down"]
+		Expect(down.Failed).Should(BeEquivalentTo(2))
+		Expect(down.ConsecutiveFailures).Should(BeEquivalentTo(2))
+		Expect(st.Checks["up"].OK).Should(BeEquivalentTo(2))
+	})
+
+	It("Metrics and expvar", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetMetricsPath("/metrics")
+		s.PublishExpvar("goscaffoldHealthTest")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		mgmt := s.ManagementURL().String()
+		code, _ := getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+
+		code, doc := getJSON(mgmt + "/metrics")
+		Expect(code).Should(Equal(200))
+		health := doc["health"].(map[string]interface{})
+		overall := health["overall"].(map[string]interface{})
+		Expect(overall["evaluations"]).Should(BeEquivalentTo(1))
+
+		code, doc = getJSON(mgmt + "/debug/vars")
+		Expect(code).Should(Equal(200))
+		Expect(doc).Should(HaveKey("goscaffoldHealthTest"))
+		Expect(doc).Should(HaveKey("memstats"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Ready override", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		var failing int32
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			if atomic.LoadInt32(&failing) != 0 {
+				return NotReady, errors.New("checker says no")
+			}
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := s.InsecureURL().String()
+		code, doc := getJSON(base + "/ready")
+		Expect(code).Should(Equal(200))
+		Expect(doc).ShouldNot(HaveKey("override"))
+
+		s.SetNotReady(errors.New("migration lock held"))
+		code, doc = getJSON(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal("migration lock held"))
+		Expect(doc["override"]).Should(Equal(true))
+		// Health and the application are not affected
+		code, _ = getText(base + "/health")
+		Expect(code).Should(Equal(200))
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// The override wins over the checker
+		atomic.StoreInt32(&failing, 1)
+		code, doc = getJSON(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal("migration lock held"))
+
+		s.SetReady()
+		code, doc = getJSON(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal("checker says no"))
+		Expect(doc).ShouldNot(HaveKey("override"))
+		atomic.StoreInt32(&failing, 0)
+		code, _ = getText(base + "/ready")
+		Expect(code).Should(Equal(200))
+
+		s.SetNotReady(nil)
+		code, bod := getText(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(Equal(ErrNotReady.Error()))
+
+		// Markdown wins over the override
+		s.markDown()
+		code, doc = getJSON(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal(ErrMarkedDown.Error()))
+		Expect(doc).ShouldNot(HaveKey("override"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Programmatic health status", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		var failing int32
+		var calls int32
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			atomic.AddInt32(&calls, 1)
+			if atomic.LoadInt32(&failing) != 0 {
+				return Failed, errors.New("disk full")
+			}
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// Nothing has called the checker yet
+		stat, reason := s.HealthStatus()
+		Expect(stat).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(ErrHealthUnknown))
+		Expect(s.IsReady()).Should(BeFalse())
+		Expect(atomic.LoadInt32(&calls)).Should(BeZero())
+
+		base := s.InsecureURL().String()
+		code, _ := getText(base + "/health")
+		Expect(code).Should(Equal(200))
+		stat, reason = s.HealthStatus()
+		Expect(stat).Should(Equal(OK))
+		Expect(reason).Should(BeNil())
+		Expect(s.IsReady()).Should(BeTrue())
+
+		// The change is only seen once a probe sees it
+		atomic.StoreInt32(&failing, 1)
+		Expect(s.IsReady()).Should(BeTrue())
+		code, _ = getText(base + "/ready")
+		Expect(code).Should(Equal(503))
+		stat, reason = s.HealthStatus()
+		Expect(stat).Should(Equal(Failed))
+		Expect(reason).Should(MatchError("disk full"))
+		Expect(s.IsReady()).Should(BeFalse())
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(2))
+
+		atomic.StoreInt32(&failing, 0)
+		getText(base + "/health")
+		Expect(s.IsReady()).Should(BeTrue())
+
+		// Markdown and the override take effect right away
+		s.SetNotReady(nil)
+		stat, reason = s.ReadyStatus()
+		Expect(stat).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(ErrNotReady))
+		stat, _ = s.HealthStatus()
+		Expect(stat).Should(Equal(OK))
+		s.SetReady()
+		Expect(s.IsReady()).Should(BeTrue())
+
+		s.Shutdown(nil)
+		stat, reason = s.ReadyStatus()
+		Expect(stat).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(ErrManualStop))
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(3))
+	})
+
+	It("Management served before Listen", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		var calls int32
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			atomic.AddInt32(&calls, 1)
+			return OK, nil
+		})
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		// The probes answer as soon as the ports are open
+		mgmt := s.ManagementURL().String()
+		code, doc := getJSON(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+		Expect(doc["status"]).Should(Equal("NotReady"))
+		Expect(doc["reason"]).Should(Equal(ErrNotListening.Error()))
+		code, _ = getText(mgmt + "/ready")
+		Expect(code).Should(Equal(503))
+		stat, reason := s.HealthStatus()
+		Expect(stat).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(ErrNotListening))
+		Expect(s.IsReady()).Should(BeFalse())
+		Expect(atomic.LoadInt32(&calls)).Should(BeZero())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		code, _ = getText(mgmt + "/ready")
+		Expect(code).Should(Equal(200))
+		code, doc = getJSON(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+		Expect(doc["status"]).Should(Equal("OK"))
+		Expect(atomic.LoadInt32(&calls)).Should(BeNumerically(">", 0))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive())
+	})
+
+	It("Shutdown before Listen", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		addr := s.ManagementAddress()
+		code, _ := getText(s.ManagementURL().String() + "/health")
+		Expect(code).Should(Equal(200))
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+
+		s.Shutdown(nil)
+		Eventually(func() error {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			return err
+		}).ShouldNot(Succeed())
+	})
+
+	It("Deep health", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetDeepHealthPath("/health/deep")
+		var failing int32
+		s.AddHealthCheck("database", func() (HealthStatus, error) {
+			return OK, nil
+		})
+		s.AddHealthCheck("cache", func() (HealthStatus, error) {
+			time.Sleep(5 * time.Millisecond)
+			return Degraded, errors.New("one replica down")
+		})
+		s.AddHealthCheck("queue", func() (HealthStatus, error) {
+			if atomic.LoadInt32(&failing) != 0 {
+				return Failed, errors.New("unreachable")
+			}
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		mgmt := s.ManagementURL().String()
+		deep := func() (int, map[string]interface{}) {
+			resp, err := http.Get(mgmt + "/health/deep")
+			Expect(err).Should(Succeed())
+			defer resp.Body.Close()
+			Expect(resp.Header.Get("Content-Type")).Should(Equal("application/health+json"))
+			var doc map[string]interface{}
+			Expect(json.NewDecoder(resp.Body).Decode(&doc)).Should(Succeed())
+			return resp.StatusCode, doc
+		}
+		check := func(doc map[string]interface{}, name string) map[string]interface{} {
+			checks := doc["checks"].(map[string]interface{})
+			list := checks[name].([]interface{})
+			Expect(list).Should(HaveLen(1))
+			return list[0].(map[string]interface{})
+		}
+
+		code, doc := deep()
+		Expect(code).Should(Equal(200))
+		Expect(doc["status"]).Should(Equal("warn"))
+		Expect(doc["output"]).Should(Equal("one replica down"))
+		Expect(check(doc, "database")["status"]).Should(Equal("pass"))
+		Expect(check(doc, "database")).ShouldNot(HaveKey("output"))
+		cache := check(doc, "cache")
+		Expect(cache["status"]).Should(Equal("warn"))
+		Expect(cache["output"]).Should(Equal("one replica down"))
+		Expect(cache["observedUnit"]).Should(Equal("ms"))
+		Expect(cache["observedValue"]).Should(BeNumerically(">=", 5))
+		when, err := time.Parse(time.RFC3339Nano, cache["time"].(string))
+		Expect(err).Should(Succeed())
+		Expect(when).Should(BeTemporally("~", time.Now(), 5*time.Second))
+
+		// Degraded passes both probes
+		code, _ = getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+		code, bod := getText(mgmt + "/ready")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("one replica down"))
+		Expect(s.IsReady()).Should(BeTrue())
+
+		atomic.StoreInt32(&failing, 1)
+		code, doc = deep()
+		Expect(code).Should(Equal(503))
+		Expect(doc["status"]).Should(Equal("fail"))
+		Expect(check(doc, "queue")["status"]).Should(Equal("fail"))
+		Expect(check(doc, "queue")["output"]).Should(Equal("unreachable"))
+		Expect(s.HealthStats().Checks["cache"].Degraded).Should(BeEquivalentTo(4))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
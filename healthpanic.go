@@ -0,0 +1,86 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+/*
+HealthPanicPolicy says what the scaffold does when a health checker
+panics.
+*/
+type HealthPanicPolicy int
+
+const (
+	// ReportPanicAsFailed reports the checker as "Failed," which is the
+	// default
+	ReportPanicAsFailed HealthPanicPolicy = iota
+	// ShutdownOnPanic also calls "Shutdown" with the panic as the reason
+	ShutdownOnPanic
+)
+
+/*
+ErrCheckerPanicked is the reason that a health checker is reported as
+"Failed" when it panicked.
+*/
+type ErrCheckerPanicked struct {
+	// Check is the name of the checker
+	Check string
+	// Value is what it panicked with
+	Value interface{}
+}
+
+func (e *ErrCheckerPanicked) Error() string {
+	return fmt.Sprintf("health checker panicked: %v", e.Value)
+}
+
+/*
+SetHealthPanicPolicy sets what happens when a health checker panics. The
+panic is always recovered, logged with its stack, and counted in
+"HealthStats," and the checker is reported as "Failed" with an
+"ErrCheckerPanicked" for that evaluation, so the health and ready paths
+keep working and the next evaluation calls the checker again as usual.
+With "ShutdownOnPanic," the scaffold is also shut down, for programs that
+would rather exit and be restarted than keep running with a broken
+checker.
+*/
+func (s *HTTPScaffold) SetHealthPanicPolicy(p HealthPanicPolicy) {
+	s.healthPanicPolicy = p
+}
+
+/*
+callCheck calls one health checker, and turns a panic into a "Failed"
+result.
+*/
+func (s *HTTPScaffold) callCheck(c namedCheck) (st HealthStatus, detail interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			st = Failed
+			detail = nil
+			err = &ErrCheckerPanicked{
+				Check: c.name,
+				Value: r,
+			}
+			s.logError("Health check %q panicked: %v\n%s", c.name, r, debug.Stack())
+		}
+	}()
+	if c.detailed != nil {
+		return c.detailed()
+	}
+	st, err = c.checker()
+	return st, nil, err
+}
@@ -0,0 +1,104 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+panicOnce returns a checker that panics on its first call and is fine
+after that.
+*/
+func panicOnce() HealthChecker {
+	calls := 0
+	return func() (HealthStatus, error) {
+		calls++
+		if calls == 1 {
+			var m map[string]int
+			m["boom"] = 1
+		}
+		return OK, nil
+	}
+}
+
+var _ = Describe("Health checker panic tests", func() {
+	It("Reports a panic as failed", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		s.SetHealthPath("/health")
+		s.SetHealthCacheInterval(time.Minute)
+		s.AddHealthCheck("flaky", panicOnce())
+
+		rec := httptest.NewRecorder()
+		s.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+		Expect(rec.Code).Should(Equal(503))
+		Expect(rec.Body.String()).Should(HavePrefix("health checker panicked: assignment to entry in nil map"))
+
+		status, reason := s.HealthStatus()
+		Expect(status).Should(Equal(Failed))
+		var pe *ErrCheckerPanicked
+		Expect(errors.As(reason, &pe)).Should(BeTrue())
+		Expect(pe.Check).Should(Equal("flaky"))
+
+		logger.lock.Lock()
+		Expect(logger.errors).Should(HaveLen(1))
+		Expect(logger.errors[0]).Should(HavePrefix(`Health check "flaky" panicked`))
+		Expect(strings.Contains(logger.errors[0], "panicOnce")).Should(BeTrue())
+		logger.lock.Unlock()
+
+		// The cache still works, and the next evaluation is fine
+		rec = httptest.NewRecorder()
+		s.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+		Expect(rec.Code).Should(Equal(503))
+		s.SetHealthCacheInterval(0)
+		rec = httptest.NewRecorder()
+		s.handleHealth(rec, httptest.NewRequest("GET", "/health", nil))
+		Expect(rec.Code).Should(Equal(200))
+
+		stats := s.HealthStats()
+		Expect(stats.Checks["flaky"].Panics).Should(BeEquivalentTo(1))
+		Expect(stats.Checks["flaky"].Failed).Should(BeEquivalentTo(1))
+		Expect(stats.Checks["flaky"].OK).Should(BeEquivalentTo(1))
+		Expect(stats.Overall.Panics).Should(BeEquivalentTo(1))
+		Expect(s.tracker).Should(BeNil())
+	})
+
+	It("Shuts down on panic", func() {
+		s := CreateHTTPScaffold()
+		s.SetLogger(&testLogger{})
+		s.SetReadyPath("/ready")
+		s.SetHealthPanicPolicy(ShutdownOnPanic)
+		s.SetHealthChecker(panicOnce())
+		s.Handlers(&testHandler{})
+
+		rec := httptest.NewRecorder()
+		s.handleReady(rec, httptest.NewRequest("GET", "/ready", nil))
+		Expect(rec.Code).Should(Equal(503))
+
+		var err error
+		Eventually(s.tracker.C).Should(Receive(&err))
+		var pe *ErrCheckerPanicked
+		Expect(errors.As(err, &pe)).Should(BeTrue())
+		Expect(pe.Check).Should(Equal(defaultCheckName))
+	})
+})
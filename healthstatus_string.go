@@ -18,9 +18,9 @@ package goscaffold
 
 import "fmt"
 
-const _HealthStatus_name = "OKNotReadyFailed"
+const _HealthStatus_name = "OKNotReadyFailedDegraded"
 
-var _HealthStatus_index = [...]uint8{0, 2, 10, 16}
+var _HealthStatus_index = [...]uint8{0, 2, 10, 16, 24}
 
 func (i HealthStatus) String() string {
 	if i < 0 || i >= HealthStatus(len(_HealthStatus_index)-1) {
@@ -0,0 +1,80 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+/*
+SetServerIdentity sets the name of this instance of the server, which
+appears in the header from "EnableInstanceHeader," in access records,
+and on the info path. The default is the host name.
+*/
+func (s *HTTPScaffold) SetServerIdentity(name string) {
+	s.serverIdentity = name
+}
+
+/*
+ServerIdentity returns the name set by "SetServerIdentity," or the host
+name if it was not set.
+*/
+func (s *HTTPScaffold) ServerIdentity() string {
+	if s.serverIdentity != "" {
+		return s.serverIdentity
+	}
+	return s.hostname
+}
+
+/*
+EnableInstanceHeader makes the scaffold set a header with the name
+"headerName" to "ServerIdentity" on every response, including the
+responses for requests that it rejects itself and those on the
+management port, so that it is possible to tell which instance served
+it. A handler that sets the header itself keeps its own value.
+*/
+func (s *HTTPScaffold) EnableInstanceHeader(headerName string) {
+	s.instanceHeader = http.CanonicalHeaderKey(headerName)
+}
+
+/*
+SetUptimeHeader is like "EnableInstanceHeader," but the header is the
+number of seconds that the scaffold had been up when the request
+arrived, as in "Uptime."
+*/
+func (s *HTTPScaffold) SetUptimeHeader(headerName string) {
+	s.uptimeHeader = http.CanonicalHeaderKey(headerName)
+}
+
+/*
+addInstanceHeaders is called before the request is handled, so a handler
+that sets the same headers replaces them.
+*/
+func (s *HTTPScaffold) addInstanceHeaders(resp http.ResponseWriter) {
+	if s.instanceHeader != "" {
+		resp.Header().Set(s.instanceHeader, s.ServerIdentity())
+	}
+	if s.uptimeHeader != "" {
+		resp.Header().Set(s.uptimeHeader,
+			strconv.FormatFloat(s.Uptime().Seconds(), 'f', 3, 64))
+	}
+}
+
+func defaultHostname() string {
+	name, _ := os.Hostname()
+	return name
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Instance identity tests", func() {
+	It("Default identity", func() {
+		s := CreateHTTPScaffold()
+		host, _ := os.Hostname()
+		Expect(s.ServerIdentity()).Should(Equal(host))
+		s.SetServerIdentity("pod-1")
+		Expect(s.ServerIdentity()).Should(Equal("pod-1"))
+	})
+
+	It("Instance headers", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetServerIdentity("pod-1")
+		s.EnableInstanceHeader("x-served-by")
+		s.SetUptimeHeader("X-Uptime")
+		s.SetHealthPath("/health")
+		s.SetInfoPath("/info")
+		s.SetAllowedMethods([]string{"GET"})
+		var records []AccessRecord
+		s.SetAccessLogger(func(r AccessRecord) {
+			records = append(records, r)
+		})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/own" {
+				resp.Header().Set("X-Served-By", "handler")
+			}
+		}))
+		s.serverLock.Lock()
+		s.startTime = clk.Now()
+		s.serverLock.Unlock()
+		clk.Advance(90 * time.Second)
+
+		do := func(method, path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			return rec
+		}
+
+		rec := do("GET", "/")
+		Expect(rec.Header().Get("X-Served-By")).Should(Equal("pod-1"))
+		Expect(rec.Header().Get("X-Uptime")).Should(Equal("90.000"))
+		Expect(records[0].Server).Should(Equal("pod-1"))
+
+		rec = do("GET", "/own")
+		Expect(rec.Header().Get("X-Served-By")).Should(Equal("handler"))
+
+		// Rejections and management paths are stamped too
+		rec = do("POST", "/")
+		Expect(rec.Code).Should(Equal(405))
+		Expect(rec.Header().Get("X-Served-By")).Should(Equal("pod-1"))
+		s.markDown()
+		rec = do("GET", "/")
+		Expect(rec.Code).Should(Equal(503))
+		Expect(rec.Header().Get("X-Served-By")).Should(Equal("pod-1"))
+		rec = do("GET", "/health")
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Header().Get("X-Served-By")).Should(Equal("pod-1"))
+		Expect(rec.Header()["X-Served-By"]).Should(HaveLen(1))
+
+		rec = do("GET", "/info")
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &doc)).Should(Succeed())
+		Expect(doc["server"]).Should(Equal("pod-1"))
+		up, err := strconv.ParseFloat(rec.Header().Get("X-Uptime"), 64)
+		Expect(err).Should(Succeed())
+		Expect(up).Should(Equal(90.0))
+	})
+})
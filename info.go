@@ -0,0 +1,108 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"time"
+)
+
+/*
+infoDocument is returned by the info path.
+*/
+type infoDocument struct {
+	Server             string          `json:"server,omitempty" yaml:"server,omitempty"`
+	StartTime          *time.Time      `json:"startTime,omitempty" yaml:"startTime,omitempty"`
+	UptimeSeconds      float64         `json:"uptimeSeconds" yaml:"uptimeSeconds"`
+	InsecureAddress    string          `json:"insecureAddress,omitempty" yaml:"insecureAddress,omitempty"`
+	SecureAddress      string          `json:"secureAddress,omitempty" yaml:"secureAddress,omitempty"`
+	ManagementAddress  string          `json:"managementAddress,omitempty" yaml:"managementAddress,omitempty"`
+	HealthPath         string          `json:"healthPath,omitempty" yaml:"healthPath,omitempty"`
+	ReadyPath          string          `json:"readyPath,omitempty" yaml:"readyPath,omitempty"`
+	HealthAliases      []string        `json:"healthAliases,omitempty" yaml:"healthAliases,omitempty"`
+	ReadyAliases       []string        `json:"readyAliases,omitempty" yaml:"readyAliases,omitempty"`
+	StartupPath        string          `json:"startupPath,omitempty" yaml:"startupPath,omitempty"`
+	Started            bool            `json:"started" yaml:"started"`
+	MarkedDown         bool            `json:"markedDown" yaml:"markedDown"`
+	InFlightRequests   int             `json:"inFlightRequests" yaml:"inFlightRequests"`
+	ManagementInFlight int             `json:"managementInFlight" yaml:"managementInFlight"`
+	PreviousShutdown   *ShutdownRecord `json:"previousShutdown,omitempty" yaml:"previousShutdown,omitempty"`
+}
+
+/*
+SetInfoPath sets up a URI on the management port (if set) or otherwise the
+main port that returns a JSON document describing the running server: its
+"ServerIdentity," when it started, how long it has been up, where it is
+listening, whether it has been marked down, and how the previous run shut
+down if "SetShutdownStateFile" was used. YAML is returned instead if the
+client asks for it.
+*/
+func (s *HTTPScaffold) SetInfoPath(p string) {
+	s.infoPath = p
+}
+
+/*
+StartTime returns the time at which the scaffold started serving requests
+on all of its listeners. It returns the zero time if "Listen" has not yet
+been called.
+*/
+func (s *HTTPScaffold) StartTime() time.Time {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	return s.startTime
+}
+
+/*
+Uptime returns how long it has been since "StartTime." It is based on the
+monotonic clock, so it is not affected by changes to the system time.
+It returns zero if "Listen" has not yet been called.
+*/
+func (s *HTTPScaffold) Uptime() time.Duration {
+	start := s.StartTime()
+	if start.IsZero() {
+		return 0
+	}
+	return s.since(start)
+}
+
+func (s *HTTPScaffold) handleInfo(resp http.ResponseWriter, req *http.Request) {
+	doc := &infoDocument{
+		Server:            s.ServerIdentity(),
+		InsecureAddress:   s.InsecureAddress(),
+		SecureAddress:     s.SecureAddress(),
+		ManagementAddress: s.ManagementAddress(),
+		HealthPath:        s.healthPath,
+		ReadyPath:         s.readyPath,
+		HealthAliases:     s.healthAliases,
+		ReadyAliases:      s.readyAliases,
+		StartupPath:       s.startupPath,
+		Started:           s.Started(),
+		MarkedDown:        s.currentTracker().markedDown() != nil,
+		UptimeSeconds:     s.Uptime().Seconds(),
+		PreviousShutdown:  s.prevShutdown,
+	}
+	if start := s.StartTime(); !start.IsZero() {
+		doc.StartTime = &start
+	}
+	st := s.DrainStatus()
+	doc.InFlightRequests = st.InFlight
+	doc.ManagementInFlight = st.ManagementInFlight
+
+	mt := SelectMediaType(req, []string{"application/json", "application/yaml", "application/x-yaml"})
+	if mt == "" {
+		mt = "application/json"
+	}
+	writeStructured(resp, mt, http.StatusOK, doc)
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Info tests", func() {
+	It("Start time and uptime", func() {
+		var records []AccessRecord
+		var recLock sync.Mutex
+
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetInfoPath("/info")
+		s.SetAccessLogger(func(r AccessRecord) {
+			recLock.Lock()
+			records = append(records, r)
+			recLock.Unlock()
+		})
+		Expect(s.StartTime().IsZero()).Should(BeTrue())
+		Expect(s.Uptime()).Should(BeZero())
+
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.StartTime().IsZero()).Should(BeTrue())
+
+		before := time.Now()
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		Expect(s.StartTime()).Should(BeTemporally(">=", before))
+		Expect(s.Uptime()).Should(BeNumerically(">", 0))
+
+		code, bod := getWithAccept(fmt.Sprintf("http://%s/health", s.ManagementAddress()),
+			"application/json")
+		Expect(code).Should(Equal(200))
+		var doc healthDocument
+		err = json.Unmarshal([]byte(bod), &doc)
+		Expect(err).Should(Succeed())
+		Expect(doc.StartTime).ShouldNot(BeNil())
+		Expect(*doc.StartTime).Should(BeTemporally("==", s.StartTime()))
+		Expect(doc.UptimeSeconds).Should(BeNumerically(">", 0))
+
+		code, bod = getWithAccept(fmt.Sprintf("http://%s/info", s.ManagementAddress()), "")
+		Expect(code).Should(Equal(200))
+		var info infoDocument
+		err = json.Unmarshal([]byte(bod), &info)
+		Expect(err).Should(Succeed())
+		Expect(info.StartTime).ShouldNot(BeNil())
+		Expect(info.UptimeSeconds).Should(BeNumerically(">", 0))
+		Expect(info.InsecureAddress).Should(Equal(s.InsecureAddress()))
+		Expect(info.ManagementAddress).Should(Equal(s.ManagementAddress()))
+		Expect(info.HealthPath).Should(Equal("/health"))
+		Expect(info.MarkedDown).Should(BeFalse())
+
+		code, _ = getText(fmt.Sprintf("http://%s/foo?delay=10ms", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+		recLock.Lock()
+		Expect(records).ShouldNot(BeEmpty())
+		rec := records[len(records)-1]
+		recLock.Unlock()
+		Expect(rec.Method).Should(Equal("GET"))
+		Expect(rec.Path).Should(Equal("/foo"))
+		Expect(rec.Status).Should(Equal(200))
+		Expect(rec.Duration).Should(BeNumerically(">=", 10*time.Millisecond))
+		Expect(rec.Uptime).Should(BeNumerically(">", 0))
+		Expect(rec.ClientIP).ShouldNot(BeEmpty())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
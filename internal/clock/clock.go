@@ -0,0 +1,190 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package clock lets the scaffold's timing logic run on either the real clock
+or a fake one that tests advance by hand.
+*/
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+A Clock tells the time and creates timers.
+*/
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+/*
+A Timer is like a "time.Timer," except that its channel is returned by a
+method so that fake timers can implement it.
+*/
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+/*
+Since returns the time that has passed on "c" since "t."
+*/
+func Since(c Clock, t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+/*
+Real is the Clock from the "time" package.
+*/
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+/*
+Fake is a Clock whose time only moves when "Advance" is called.
+*/
+type Fake struct {
+	lock   *sync.Mutex
+	now    time.Time
+	timers map[*fakeTimer]struct{}
+}
+
+/*
+NewFake returns a fake clock that starts at "start."
+*/
+func NewFake(start time.Time) *Fake {
+	return &Fake{
+		lock:   &sync.Mutex{},
+		now:    start,
+		timers: make(map[*fakeTimer]struct{}),
+	}
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	t := &fakeTimer{
+		f: f,
+		c: make(chan time.Time, 1),
+	}
+	t.Reset(d)
+	return t
+}
+
+/*
+Advance moves the time forward by "d" and fires every timer that is due,
+in the order that they are due.
+*/
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	f.now = f.now.Add(d)
+	var due []*fakeTimer
+	for t := range f.timers {
+		if !t.when.After(f.now) {
+			due = append(due, t)
+			delete(f.timers, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].when.Before(due[j].when)
+	})
+	f.lock.Unlock()
+
+	for _, t := range due {
+		select {
+		case t.c <- t.when:
+		default:
+		}
+	}
+}
+
+/*
+Timers returns the number of timers that have not fired or been stopped.
+Tests use it to wait until the code under test is waiting for the clock
+before they advance it.
+*/
+func (f *Fake) Timers() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.timers)
+}
+
+type fakeTimer struct {
+	f    *Fake
+	c    chan time.Time
+	when time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.f.lock.Lock()
+	defer t.f.lock.Unlock()
+	_, active := t.f.timers[t]
+	delete(t.f.timers, t)
+	return active
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.f.lock.Lock()
+	_, active := t.f.timers[t]
+	t.when = t.f.now.Add(d)
+	if d > 0 {
+		t.f.timers[t] = struct{}{}
+		t.f.lock.Unlock()
+		return active
+	}
+	delete(t.f.timers, t)
+	when := t.when
+	t.f.lock.Unlock()
+	select {
+	case t.c <- when:
+	default:
+	}
+	return active
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clock
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Clock tests", func() {
+	It("Fake timers", func() {
+		start := time.Now()
+		f := NewFake(start)
+		first := f.NewTimer(time.Second)
+		second := f.NewTimer(2 * time.Second)
+		Expect(f.Timers()).Should(Equal(2))
+
+		f.Advance(999 * time.Millisecond)
+		Expect(Since(f, start)).Should(Equal(999 * time.Millisecond))
+		Expect(first.C()).ShouldNot(Receive())
+
+		f.Advance(time.Millisecond)
+		Expect(first.C()).Should(Receive(Equal(start.Add(time.Second))))
+		Expect(f.Timers()).Should(Equal(1))
+		Expect(first.Stop()).Should(BeFalse())
+
+		Expect(second.Stop()).Should(BeTrue())
+		f.Advance(time.Hour)
+		Expect(second.C()).ShouldNot(Receive())
+
+		Expect(second.Reset(time.Second)).Should(BeFalse())
+		f.Advance(time.Second)
+		Expect(second.C()).Should(Receive())
+		Expect(f.After(0)).Should(Receive())
+		Expect(f.Timers()).Should(BeZero())
+	})
+
+	It("Real timers", func() {
+		t := Real{}.NewTimer(time.Millisecond)
+		Eventually(t.C()).Should(Receive())
+		Expect(Since(Real{}, time.Now())).Should(BeNumerically("<", time.Second))
+	})
+})
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultJSONLogFlushInterval is how long log lines may sit in the buffer
+const DefaultJSONLogFlushInterval = time.Second
+
+/*
+JSONAccessOption changes how "NewJSONAccessLogger" logs.
+*/
+type JSONAccessOption func(*jsonAccessLogger)
+
+/*
+JSONLogSampleRate logs only a fraction, between zero and one, of the
+requests that succeeded with a 2xx status. Other statuses and requests
+that the scaffold rejected are always logged. The default is to log
+everything.
+*/
+func JSONLogSampleRate(rate float64) JSONAccessOption {
+	return func(l *jsonAccessLogger) {
+		l.sampleRate = rate
+	}
+}
+
+/*
+JSONLogFlushInterval sets how long lines may be buffered before they are
+written. The default is "DefaultJSONLogFlushInterval."
+*/
+func JSONLogFlushInterval(d time.Duration) JSONAccessOption {
+	return func(l *jsonAccessLogger) {
+		l.flushInterval = d
+	}
+}
+
+/*
+jsonAccessLine is one line of the JSON access log. The names of the fields
+must not change, since log parsers depend on them.
+*/
+type jsonAccessLine struct {
+	Time      string  `json:"ts"`
+	Method    string  `json:"method"`
+	Path      string  `json:"path"`
+	Status    int     `json:"status"`
+	Duration  float64 `json:"dur_ms"`
+	Bytes     int64   `json:"bytes"`
+	ClientIP  string  `json:"client_ip"`
+	RequestID string  `json:"request_id"`
+	Rejection string  `json:"rejection"`
+	Server    string  `json:"server"`
+}
+
+type jsonAccessLogger struct {
+	lock          *sync.Mutex
+	out           *bufio.Writer
+	enc           *json.Encoder
+	sampleRate    float64
+	flushInterval time.Duration
+	flushPending  bool
+	random        *rand.Rand
+}
+
+/*
+NewJSONAccessLogger returns an "AccessLogger" that writes each record to
+"w" as a line of JSON. It may be called from many requests at once. The
+lines are buffered, and are written no later than the flush interval after
+they were logged. The fields of each line are:
+
+	ts          the time that the request started, in RFC 3339 format, in UTC
+	method      the request method
+	path        the request path
+	status      the HTTP status of the response
+	dur_ms      how long the request took, in milliseconds
+	bytes       the size of the response body
+	client_ip   the client address, as in "ClientIP"
+	request_id  the "X-Request-Id" header of the request, or empty
+	rejection   why the scaffold rejected the request, as in
+	            "RejectionReason," or empty if it did not
+	server      the name from "ServerIdentity"
+*/
+func NewJSONAccessLogger(w io.Writer, opts ...JSONAccessOption) AccessLogger {
+	l := &jsonAccessLogger{
+		lock:          &sync.Mutex{},
+		out:           bufio.NewWriter(w),
+		sampleRate:    1.0,
+		flushInterval: DefaultJSONLogFlushInterval,
+		random:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	l.enc = json.NewEncoder(l.out)
+	l.enc.SetEscapeHTML(false)
+	for _, o := range opts {
+		o(l)
+	}
+	return l.log
+}
+
+func (l *jsonAccessLogger) log(r AccessRecord) {
+	line := &jsonAccessLine{
+		Time:      r.Time.UTC().Format(time.RFC3339Nano),
+		Method:    r.Method,
+		Path:      r.Path,
+		Status:    r.Status,
+		Duration:  float64(r.Duration) / float64(time.Millisecond),
+		Bytes:     r.Bytes,
+		ClientIP:  r.ClientIP,
+		RequestID: r.RequestID,
+		Server:    r.Server,
+	}
+	if r.Rejection != RejectionNone {
+		line.Rejection = r.Rejection.String()
+	}
+	sampled := r.Rejection == RejectionNone && r.Status >= 200 && r.Status < 300
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if sampled && l.sampleRate < 1 && l.random.Float64() >= l.sampleRate {
+		return
+	}
+	l.enc.Encode(line)
+	if l.flushInterval <= 0 {
+		l.out.Flush()
+	} else if !l.flushPending {
+		l.flushPending = true
+		time.AfterFunc(l.flushInterval, l.flush)
+	}
+}
+
+func (l *jsonAccessLogger) flush() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.flushPending = false
+	l.out.Flush()
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var updateGolden = flag.Bool("update-golden", false, "rewrite the golden files in testdata")
+
+/*
+lockedBuffer is a buffer that the flush timer may write to while we read.
+*/
+type lockedBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func (b *lockedBuffer) lines() []string {
+	s := strings.TrimSpace(b.String())
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+var _ = Describe("JSON access log tests", func() {
+	start := time.Date(2017, 6, 1, 12, 30, 15, 123000000, time.UTC)
+
+	It("Golden JSON access log", func() {
+		out := &lockedBuffer{}
+		log := NewJSONAccessLogger(out, JSONLogFlushInterval(0))
+		log(AccessRecord{
+			Time:      start,
+			Method:    "GET",
+			Path:      "/v1/users/<id>",
+			Status:    200,
+			Bytes:     1234,
+			Duration:  1500 * time.Microsecond,
+			ClientIP:  "10.1.2.3",
+			RequestID: "abc-123",
+			Server:    "pod-1",
+		})
+		log(AccessRecord{
+			Time:      start.Add(time.Second),
+			Method:    "POST",
+			Path:      "/v1/users",
+			Status:    503,
+			Bytes:     11,
+			Duration:  250 * time.Microsecond,
+			ClientIP:  "10.1.2.4",
+			Rejection: RejectionMarkdown,
+			Server:    "pod-1",
+		})
+
+		golden := "testdata/jsonaccess.golden"
+		if *updateGolden {
+			Expect(ioutil.WriteFile(golden, []byte(out.String()), 0644)).Should(Succeed())
+		}
+		expected, err := ioutil.ReadFile(golden)
+		Expect(err).Should(Succeed())
+		Expect(out.String()).Should(Equal(string(expected)))
+	})
+
+	It("JSON access log sampling", func() {
+		out := &lockedBuffer{}
+		log := NewJSONAccessLogger(out, JSONLogFlushInterval(0), JSONLogSampleRate(0))
+		log(AccessRecord{Path: "/ok", Status: 200})
+		log(AccessRecord{Path: "/redirect", Status: 301})
+		log(AccessRecord{Path: "/missing", Status: 404})
+		log(AccessRecord{Path: "/error", Status: 500})
+		log(AccessRecord{Path: "/shed", Status: 503, Rejection: RejectionShed})
+		lines := out.lines()
+		Expect(lines).Should(HaveLen(4))
+		Expect(out.String()).ShouldNot(ContainSubstring(`"/ok"`))
+
+		out = &lockedBuffer{}
+		log = NewJSONAccessLogger(out, JSONLogFlushInterval(0), JSONLogSampleRate(0.5))
+		for i := 0; i < 1000; i++ {
+			log(AccessRecord{Path: "/ok", Status: 200})
+		}
+		Expect(len(out.lines())).Should(BeNumerically("~", 500, 100))
+	})
+
+	It("JSON access log buffering", func() {
+		out := &lockedBuffer{}
+		log := NewJSONAccessLogger(out, JSONLogFlushInterval(50*time.Millisecond))
+		log(AccessRecord{Path: "/", Status: 200})
+		Expect(out.String()).Should(BeEmpty())
+		Eventually(out.lines).Should(HaveLen(1))
+		log(AccessRecord{Path: "/", Status: 200})
+		Eventually(out.lines).Should(HaveLen(2))
+	})
+
+	It("JSON access log with scaffold", func() {
+		out := &lockedBuffer{}
+		s := CreateHTTPScaffold()
+		s.SetServerIdentity("pod-2")
+		s.SetAccessLogger(NewJSONAccessLogger(out, JSONLogFlushInterval(time.Millisecond)))
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/x", nil)
+				req.Header.Set("X-Request-Id", "req-1")
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}()
+		}
+		wg.Wait()
+		Eventually(out.lines).Should(HaveLen(20))
+		Expect(out.lines()[0]).Should(ContainSubstring(`"request_id":"req-1"`))
+		Expect(out.lines()[0]).Should(ContainSubstring(`"server":"pod-2"`))
+		Expect(out.lines()[0]).Should(ContainSubstring(`"rejection":""`))
+	})
+})
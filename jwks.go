@@ -0,0 +1,384 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SermoDigital/jose/crypto"
+	"github.com/SermoDigital/jose/jws"
+	"github.com/SermoDigital/jose/jwt"
+)
+
+const (
+	// DefaultJWKSRefreshInterval is how often keys are re-fetched by default.
+	DefaultJWKSRefreshInterval = time.Hour
+	// DefaultJWKSRefreshCooldown is the minimum time between fetches that
+	// are caused by tokens with unknown key IDs.
+	DefaultJWKSRefreshCooldown = 30 * time.Second
+	// DefaultJWKSFetchTimeout is how long the default HTTP client waits for
+	// the key set.
+	DefaultJWKSFetchTimeout = 10 * time.Second
+)
+
+/*
+maxJWKSSize is the largest key set that we will read.
+*/
+const maxJWKSSize = 1 << 20
+
+/*
+ErrUnknownKey is returned by a JWKSValidator when a token was signed with
+a key that is not in the key set, even after re-fetching it.
+*/
+var ErrUnknownKey = errors.New("token signed with unknown key")
+
+/*
+A JWKSValidator validates RS256 JWTs using keys fetched from a JWKS
+(JSON Web Key Set) URL. Keys are cached by their key ID ("kid"). The set
+is fetched again periodically, and also when a token arrives that was
+signed with a key that is not in the cache, so that key rotation works
+without a restart. If a fetch fails, then the cached keys continue to be
+used, as they are if the new set has no usable keys. Pass the "Validate"
+method to "SetTokenValidator."
+*/
+type JWKSValidator struct {
+	url             string
+	client          *http.Client
+	refreshInterval time.Duration
+	refreshCooldown time.Duration
+	issuer          string
+	audience        string
+	leeway          time.Duration
+	logger          Logger
+
+	lock        sync.RWMutex
+	keys        map[string]*rsa.PublicKey
+	lastFetch   time.Time
+	lastAttempt time.Time
+	fetchLock   sync.Mutex
+	refreshing  int32
+}
+
+/*
+A JWKSOption changes the way that a JWKSValidator works.
+*/
+type JWKSOption func(*JWKSValidator)
+
+/*
+JWKSRefreshInterval sets how often the key set is re-fetched. The refresh
+happens in the background the first time a token is validated after the
+interval has passed.
+*/
+func JWKSRefreshInterval(d time.Duration) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.refreshInterval = d
+	}
+}
+
+/*
+JWKSRefreshCooldown sets the minimum amount of time between fetches of the
+key set. This prevents a flood of tokens with bogus key IDs from causing a
+flood of fetches.
+*/
+func JWKSRefreshCooldown(d time.Duration) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.refreshCooldown = d
+	}
+}
+
+/*
+JWKSIssuer requires that the "iss" claim of every token match.
+*/
+func JWKSIssuer(iss string) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.issuer = iss
+	}
+}
+
+/*
+JWKSAudience requires that the "aud" claim of every token include "aud".
+*/
+func JWKSAudience(aud string) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.audience = aud
+	}
+}
+
+/*
+JWKSLeeway sets the amount of clock skew that is allowed when checking the
+"exp" and "nbf" claims.
+*/
+func JWKSLeeway(d time.Duration) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.leeway = d
+	}
+}
+
+/*
+JWKSHTTPClient sets the HTTP client used to fetch the key set. The default
+client gives up after "DefaultJWKSFetchTimeout."
+*/
+func JWKSHTTPClient(c *http.Client) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.client = c
+	}
+}
+
+/*
+JWKSLogger sets a logger for failures to fetch the key set, such as the
+one passed to the scaffold's "SetLogger." Otherwise they are not logged.
+*/
+func JWKSLogger(l Logger) JWKSOption {
+	return func(v *JWKSValidator) {
+		v.logger = l
+	}
+}
+
+/*
+NewJWKSValidator creates a validator and fetches the key set for the first
+time. If that fetch fails, then it will be tried again when a token is
+validated.
+*/
+func NewJWKSValidator(jwksURL string, opts ...JWKSOption) *JWKSValidator {
+	v := &JWKSValidator{
+		url:             jwksURL,
+		client:          &http.Client{Timeout: DefaultJWKSFetchTimeout},
+		refreshInterval: DefaultJWKSRefreshInterval,
+		refreshCooldown: DefaultJWKSRefreshCooldown,
+		keys:            make(map[string]*rsa.PublicKey),
+	}
+	for _, o := range opts {
+		o(v)
+	}
+	v.refresh(context.Background(), true)
+	return v
+}
+
+/*
+Validate validates a token and returns its claims. It has the signature of
+a TokenValidator.
+*/
+func (v *JWKSValidator) Validate(ctx context.Context, token string) (TokenClaims, error) {
+	kid, err := tokenKeyID(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, stale := v.getKey(kid)
+	if key == nil {
+		// Perhaps the keys were rotated. The fetch gives up if the request
+		// does.
+		v.refresh(ctx, false)
+		key, _ = v.getKey(kid)
+		if key == nil {
+			return nil, ErrUnknownKey
+		}
+	} else if stale && atomic.CompareAndSwapInt32(&v.refreshing, 0, 1) {
+		go func() {
+			v.refresh(context.Background(), false)
+			atomic.StoreInt32(&v.refreshing, 0)
+		}()
+	}
+
+	parsed, err := jws.ParseJWT([]byte(token))
+	if err != nil {
+		return nil, err
+	}
+	err = parsed.Validate(key, crypto.SigningMethodRS256, &jwt.Validator{
+		EXP: v.leeway,
+		NBF: v.leeway,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := TokenClaims(parsed.Claims())
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, fmt.Errorf("invalid issuer %v", claims["iss"])
+	}
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return nil, fmt.Errorf("invalid audience %v", claims["aud"])
+	}
+	return claims, nil
+}
+
+func (v *JWKSValidator) getKey(kid string) (*rsa.PublicKey, bool) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.keys[kid], time.Since(v.lastFetch) > v.refreshInterval
+}
+
+/*
+refresh fetches the key set unless the cooldown period has not passed
+since the last attempt. Only one refresh runs at a time. If the fetch
+fails, or finds no keys, the existing keys are kept.
+*/
+func (v *JWKSValidator) refresh(ctx context.Context, force bool) {
+	v.fetchLock.Lock()
+	defer v.fetchLock.Unlock()
+
+	v.lock.RLock()
+	last := v.lastAttempt
+	v.lock.RUnlock()
+	if !force && time.Since(last) < v.refreshCooldown {
+		return
+	}
+
+	v.lock.Lock()
+	v.lastAttempt = time.Now()
+	v.lock.Unlock()
+
+	keys, err := fetchJWKS(ctx, v.client, v.url)
+	if err == nil && len(keys) == 0 {
+		err = fmt.Errorf("no usable keys in %s", v.url)
+	}
+	if err != nil {
+		if v.logger != nil {
+			v.logger.Errorf("Error fetching JWKS: %s", err)
+		}
+		return
+	}
+
+	v.lock.Lock()
+	v.keys = keys
+	v.lastFetch = time.Now()
+	v.lock.Unlock()
+}
+
+type jwksDocument struct {
+	Keys []jwksKey `json:"keys"`
+}
+
+type jwksKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+func fetchJWKS(
+	ctx context.Context, client *http.Client, url string) (map[string]*rsa.PublicKey, error) {
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: status %d", url, resp.StatusCode)
+	}
+
+	var doc jwksDocument
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %s", url, err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range doc.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		pk, err := parseJWK(k)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+func parseJWK(k jwksKey) (*rsa.PublicKey, error) {
+	nb, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.N, "="))
+	if err != nil {
+		return nil, err
+	}
+	eb, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(k.E, "="))
+	if err != nil {
+		return nil, err
+	}
+	e := new(big.Int).SetBytes(eb)
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid RSA exponent")
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(nb),
+		E: int(e.Int64()),
+	}, nil
+}
+
+/*
+tokenKeyID extracts the key ID from the header of a compact JWS.
+*/
+func tokenKeyID(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", jws.ErrNotCompact
+	}
+	hb, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", err
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	err = json.Unmarshal(hb, &hdr)
+	if err != nil {
+		return "", err
+	}
+	if hdr.Alg != "RS256" {
+		return "", fmt.Errorf("unsupported algorithm %q", hdr.Alg)
+	}
+	return hdr.Kid, nil
+}
+
+func hasAudience(claim interface{}, aud string) bool {
+	switch a := claim.(type) {
+	case string:
+		return a == aud
+	case []interface{}:
+		for _, e := range a {
+			if e == aud {
+				return true
+			}
+		}
+	case []string:
+		for _, e := range a {
+			if e == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
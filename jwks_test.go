@@ -0,0 +1,244 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("JWKS tests", func() {
+	var server *httptest.Server
+	var keySet atomic.Value
+	var fetches int32
+	var failing int32
+	var key1, key2 *rsa.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		key1, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).Should(Succeed())
+		key2, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).Should(Succeed())
+		keySet.Store(makeJWKS(map[string]*rsa.PrivateKey{"k1": key1}))
+		atomic.StoreInt32(&fetches, 0)
+		atomic.StoreInt32(&failing, 0)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&fetches, 1)
+			if atomic.LoadInt32(&failing) != 0 {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(keySet.Load().([]byte))
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("Key rotation", func() {
+		v := NewJWKSValidator(server.URL, JWKSRefreshCooldown(0))
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+
+		claims, err := v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(Succeed())
+		Expect(claims["sub"]).Should(Equal("tester"))
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+
+		// Rotate to the new key. Old tokens fail, new ones work after one refresh.
+		keySet.Store(makeJWKS(map[string]*rsa.PrivateKey{"k2": key2}))
+		_, err = v.Validate(context.Background(), signJWT(key2, "k2", validClaims()))
+		Expect(err).Should(Succeed())
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(2))
+		_, err = v.Validate(context.Background(), signJWT(key2, "k2", validClaims()))
+		Expect(err).Should(Succeed())
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(2))
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(MatchError(ErrUnknownKey))
+	})
+
+	It("Refresh cooldown", func() {
+		v := NewJWKSValidator(server.URL, JWKSRefreshCooldown(time.Hour))
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				_, err := v.Validate(context.Background(), signJWT(key2, "bogus", validClaims()))
+				Expect(err).Should(MatchError(ErrUnknownKey))
+			}()
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&fetches)).Should(BeEquivalentTo(1))
+	})
+
+	It("Fetch failures keep old keys", func() {
+		v := NewJWKSValidator(server.URL,
+			JWKSRefreshCooldown(0), JWKSRefreshInterval(time.Millisecond))
+		atomic.StoreInt32(&failing, 1)
+		time.Sleep(5 * time.Millisecond)
+
+		_, err := v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(Succeed())
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&fetches)
+		}).Should(BeNumerically(">=", 2))
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(Succeed())
+		_, err = v.Validate(context.Background(), signJWT(key2, "k2", validClaims()))
+		Expect(err).Should(MatchError(ErrUnknownKey))
+	})
+
+	It("Empty or broken key sets keep old keys", func() {
+		logger := &testLogger{}
+		v := NewJWKSValidator(server.URL, JWKSRefreshCooldown(0), JWKSLogger(logger))
+
+		for _, bad := range []string{
+			`{"keys":[]}`,
+			`{"keys":[{"kty":"EC","kid":"k2"}]}`,
+			`not json`,
+			`{"keys":[` + strings.Repeat(" ", 2<<20) + `]}`,
+		} {
+			keySet.Store([]byte(bad))
+			_, err := v.Validate(context.Background(), signJWT(key2, "k2", validClaims()))
+			Expect(err).Should(MatchError(ErrUnknownKey))
+			_, err = v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+			Expect(err).Should(Succeed())
+		}
+		errs := logger.allErrors()
+		Expect(errs).Should(HaveLen(4))
+		Expect(errs[0]).Should(HavePrefix("Error fetching JWKS: no usable keys"))
+		Expect(errs[2]).Should(HavePrefix("Error fetching JWKS: reading"))
+	})
+
+	It("Key fetches give up with the request", func() {
+		release := make(chan struct{})
+		hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}))
+		defer hung.Close()
+		defer close(release)
+
+		logger := &testLogger{}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		v := NewJWKSValidator(hung.URL, JWKSRefreshCooldown(0), JWKSLogger(logger),
+			JWKSHTTPClient(&http.Client{Timeout: 50 * time.Millisecond}))
+		Expect(logger.allErrors()).Should(HaveLen(1))
+
+		v.client = http.DefaultClient
+		start := time.Now()
+		_, err := v.Validate(ctx, signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(MatchError(ErrUnknownKey))
+		Expect(time.Since(start)).Should(BeNumerically("<", time.Second))
+		Expect(logger.allErrors()).Should(HaveLen(2))
+	})
+
+	It("Claim validation", func() {
+		v := NewJWKSValidator(server.URL,
+			JWKSIssuer("http://issuer"), JWKSAudience("api"))
+
+		_, err := v.Validate(context.Background(), signJWT(key1, "k1", validClaims()))
+		Expect(err).Should(Succeed())
+
+		c := validClaims()
+		c["iss"] = "http://other"
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", c))
+		Expect(err).ShouldNot(Succeed())
+
+		c = validClaims()
+		c["aud"] = []string{"other", "api"}
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", c))
+		Expect(err).Should(Succeed())
+		c["aud"] = "other"
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", c))
+		Expect(err).ShouldNot(Succeed())
+
+		c = validClaims()
+		c["exp"] = time.Now().Add(-time.Hour).Unix()
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", c))
+		Expect(err).ShouldNot(Succeed())
+
+		c = validClaims()
+		c["nbf"] = time.Now().Add(time.Hour).Unix()
+		_, err = v.Validate(context.Background(), signJWT(key1, "k1", c))
+		Expect(err).ShouldNot(Succeed())
+
+		// Signed by the wrong key
+		_, err = v.Validate(context.Background(), signJWT(key2, "k1", validClaims()))
+		Expect(err).ShouldNot(Succeed())
+	})
+})
+
+func validClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"sub": "tester",
+		"iss": "http://issuer",
+		"aud": "api",
+		"iat": now.Unix(),
+		"nbf": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func signJWT(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	body, _ := json.Marshal(claims)
+	in := base64.RawURLEncoding.EncodeToString(hdr) + "." +
+		base64.RawURLEncoding.EncodeToString(body)
+	sum := sha256.Sum256([]byte(in))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	Expect(err).Should(Succeed())
+	return in + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func makeJWKS(keys map[string]*rsa.PrivateKey) []byte {
+	var doc jwksDocument
+	for kid, k := range keys {
+		doc.Keys = append(doc.Keys, jwksKey{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: "RS256",
+			N:   base64.RawURLEncoding.EncodeToString(k.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.PublicKey.E)).Bytes()),
+		})
+	}
+	buf, _ := json.Marshal(&doc)
+	return buf
+}
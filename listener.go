@@ -0,0 +1,125 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ErrListenerFailed is the reason that health is reported as "Failed" once
+the accept loop of one of the listeners has stopped while the scaffold is
+still running.
+*/
+type ErrListenerFailed struct {
+	// Listener is "insecure," "secure," or "management"
+	Listener string
+	// Err is the error that stopped the accept loop
+	Err error
+}
+
+func (e *ErrListenerFailed) Error() string {
+	return fmt.Sprintf("%s listener stopped: %s", e.Listener, e.Err)
+}
+
+func (e *ErrListenerFailed) Unwrap() error {
+	return e.Err
+}
+
+/*
+SetFailFastOnListenerError causes the scaffold to call "Shutdown" with an
+"ErrListenerFailed" as the reason if one of its listeners stops accepting
+connections. Otherwise, the scaffold keeps serving on the rest of them and
+reports that it has failed on the health path, so that it can be replaced.
+*/
+func (s *HTTPScaffold) SetFailFastOnListenerError(failFast bool) {
+	s.failFastListener = failFast
+}
+
+/*
+listenerFailed returns the first listener failure, or nil if all of the
+listeners are still accepting connections.
+*/
+func (s *HTTPScaffold) listenerFailed() error {
+	if err, ok := s.listenerFailure.Load().(*ErrListenerFailed); ok && err != nil {
+		return err
+	}
+	return nil
+}
+
+/*
+stopAccepting records that we are about to close the listeners on
+purpose, so that their accept loops stopping is not a failure.
+*/
+func (s *HTTPScaffold) stopAccepting() {
+	atomic.StoreInt32(&s.acceptStopped, 1)
+}
+
+/*
+acceptLoopExited is called when the accept loop for a listener returns.
+Temporary errors are retried before they get here, so unless we closed the
+listener ourselves, it is not coming back.
+*/
+func (s *HTTPScaffold) acceptLoopExited(role string, err error) {
+	if role == "" || err == nil || err == http.ErrServerClosed {
+		return
+	}
+	if atomic.LoadInt32(&s.acceptStopped) != 0 ||
+		atomic.LoadInt32(&s.currentTracker().shutdownState) == shutDown {
+		return
+	}
+
+	failure := &ErrListenerFailed{Listener: role, Err: err}
+	s.healthLock.Lock()
+	if s.listenerFailed() == nil {
+		s.listenerFailure.Store(failure)
+	}
+	s.healthLock.Unlock()
+	s.logError("%s", failure)
+	s.reportHealth(Failed, failure)
+	if s.failFastListener {
+		s.Shutdown(failure)
+	}
+}
+
+/*
+acceptRetrying is like "l.Accept," but retries temporary errors, such as
+running out of file descriptors, with the same backoff as net/http.
+*/
+func acceptRetrying(l net.Listener) (net.Conn, error) {
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if err == nil {
+			return c, nil
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+			return nil, err
+		}
+		if delay == 0 {
+			delay = 5 * time.Millisecond
+		} else {
+			delay *= 2
+		}
+		if delay > time.Second {
+			delay = time.Second
+		}
+		time.Sleep(delay)
+	}
+}
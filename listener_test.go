@@ -0,0 +1,165 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Listener tests", func() {
+	It("Listener failure", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		type change struct {
+			from, to HealthStatus
+			reason   error
+		}
+		changes := make(chan change, 10)
+		s.OnHealthChange(func(from, to HealthStatus, reason error) {
+			changes <- change{from, to, reason}
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		mgmt := s.ManagementURL().String()
+		code, _ := getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+		Expect(changes).ShouldNot(Receive())
+
+		// Pull the listener out from under the server
+		s.insecureListener.Close()
+
+		var c change
+		Eventually(changes).Should(Receive(&c))
+		Expect(c.from).Should(Equal(OK))
+		Expect(c.to).Should(Equal(Failed))
+		var failure *ErrListenerFailed
+		Expect(errors.As(c.reason, &failure)).Should(BeTrue())
+		Expect(failure.Listener).Should(Equal("insecure"))
+
+		stat, reason := s.HealthStatus()
+		Expect(stat).Should(Equal(Failed))
+		Expect(reason).Should(Equal(c.reason))
+		code, doc := getJSON(mgmt + "/health")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(ContainSubstring("insecure listener stopped"))
+		code, _ = getText(mgmt + "/ready")
+		Expect(code).Should(Equal(503))
+
+		// It keeps running without fail fast
+		Consistently(stopChan, 100*time.Millisecond).ShouldNot(Receive())
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(changes).ShouldNot(Receive())
+	})
+
+	It("Fail fast on listener failure", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetFailFastOnListenerError(true)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		s.managementListener.Close()
+		var stopErr error
+		Eventually(stopChan).Should(Receive(&stopErr))
+		var failure *ErrListenerFailed
+		Expect(errors.As(stopErr, &failure)).Should(BeTrue())
+		Expect(failure.Listener).Should(Equal("management"))
+	})
+
+	It("Shutdown is not a listener failure", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		var changes int32
+		s.OnHealthChange(func(from, to HealthStatus, reason error) {
+			atomic.AddInt32(&changes, 1)
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Consistently(func() int32 {
+			return atomic.LoadInt32(&changes)
+		}, 100*time.Millisecond).Should(BeZero())
+		Expect(s.listenerFailed()).Should(BeNil())
+	})
+
+	It("Temporary accept errors are retried", func() {
+		l := &flakyListener{
+			errs: []error{syscall.EMFILE, syscall.EMFILE, errors.New("closed")},
+		}
+		_, err := acceptRetrying(l)
+		Expect(err).Should(MatchError("closed"))
+		Expect(l.accepts).Should(Equal(3))
+	})
+})
+
+/*
+flakyListener returns its errors from Accept in order.
+*/
+type flakyListener struct {
+	lock    sync.Mutex
+	errs    []error
+	accepts int
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	err := l.errs[l.accepts]
+	l.accepts++
+	return nil, err
+}
+
+func (l *flakyListener) Close() error {
+	return nil
+}
+
+func (l *flakyListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"log"
+	"strings"
+)
+
+/*
+Logger is an interface that the scaffold uses to report on what it is
+doing. It is satisfied by most logging packages, or it may be implemented
+by a small adapter.
+*/
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+/*
+SetLogger sets the logger that the scaffold will use. Internal errors from
+the HTTP servers, such as TLS handshake failures and recovered panics, are
+also logged to it. If it is not set, then the scaffold does not log anything,
+and those errors go to the standard logger as usual.
+*/
+func (s *HTTPScaffold) SetLogger(l Logger) {
+	s.logger = l
+}
+
+func (s *HTTPScaffold) logInfo(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Infof(format, args...)
+	}
+}
+
+func (s *HTTPScaffold) logError(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Errorf(format, args...)
+	}
+}
+
+/*
+serverErrorLog returns a logger for the "ErrorLog" of the HTTP servers that
+we create, so that their errors go to our logger. It returns nil if no
+logger was set, so that they keep going to the standard logger.
+*/
+func (s *HTTPScaffold) serverErrorLog() *log.Logger {
+	if s.logger == nil {
+		return nil
+	}
+	return log.New(&serverErrorWriter{s: s}, "", 0)
+}
+
+/*
+serverErrorWriter receives messages from the standard HTTP server and
+passes them on as errors, prefixed with a rough classification so that
+the different kinds may be counted separately.
+*/
+type serverErrorWriter struct {
+	s *HTTPScaffold
+}
+
+func (w *serverErrorWriter) Write(buf []byte) (int, error) {
+	msg := strings.TrimRight(string(buf), "\n")
+	w.s.logError("HTTP server error [%s]: %s", classifyServerError(msg), msg)
+	return len(buf), nil
+}
+
+/*
+classifyServerError makes a best-effort guess at what kind of error the HTTP
+server logged, based on the text that the standard library uses.
+*/
+func classifyServerError(msg string) string {
+	switch {
+	case strings.Contains(msg, "TLS handshake error"):
+		return "tls-handshake"
+	case strings.Contains(msg, "panic serving"):
+		return "panic"
+	case strings.Contains(msg, "error reading preface"),
+		strings.Contains(msg, "URL query contains semicolon"),
+		strings.Contains(msg, "malformed"),
+		strings.Contains(msg, "invalid"):
+		return "bad-request"
+	default:
+		return "server"
+	}
+}
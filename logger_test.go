@@ -0,0 +1,96 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Logger tests", func() {
+	It("Classify server errors", func() {
+		Expect(classifyServerError(
+			"http: TLS handshake error from 127.0.0.1:1234: EOF")).Should(Equal("tls-handshake"))
+		Expect(classifyServerError(
+			"http: panic serving 127.0.0.1:1234: oops")).Should(Equal("panic"))
+		Expect(classifyServerError(
+			"http2: server: error reading preface from client 127.0.0.1:1234")).Should(Equal("bad-request"))
+		Expect(classifyServerError(
+			"http: Accept error: too many open files")).Should(Equal("server"))
+	})
+
+	It("TLS handshake errors", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetLogger(logger)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		conn, err := net.Dial("tcp", s.SecureAddress())
+		Expect(err).Should(Succeed())
+		conn.Write([]byte("GET / HTTP/1.1\r\nHost: nothing\r\n\r\n"))
+		conn.Close()
+
+		Eventually(logger.allErrors).Should(ContainElement(
+			ContainSubstring("HTTP server error [tls-handshake]: http: TLS handshake error")))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Recovered panics", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/panic" {
+					panic("oops")
+				}
+			}))
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		_, err = http.Get(s.InsecureURL().String() + "/panic")
+		Expect(err).ShouldNot(Succeed())
+		Eventually(logger.allErrors).Should(ContainElement(
+			ContainSubstring("HTTP server error [panic]: http: panic serving")))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
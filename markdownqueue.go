@@ -0,0 +1,97 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+/*
+MarkdownMode says what happens to application requests that arrive while
+the server is marked down.
+*/
+type MarkdownMode int
+
+const (
+	// RejectImmediately rejects them with a 503, which is the default
+	RejectImmediately MarkdownMode = iota
+	// QueueBriefly holds them for a while in case the server is marked up
+	QueueBriefly
+)
+
+// DefaultMarkdownQueueLimit is how many requests "QueueBriefly" holds at once
+const DefaultMarkdownQueueLimit = 100
+
+/*
+SetMarkdownMode sets what happens to application requests that arrive
+while the server is marked down, using the markdown path or signal, but
+not yet shutting down. With "QueueBriefly," rather than being rejected
+right away, each one waits for up to "maxWait" for the server to be marked
+up again, as the markup signal or a second markdown signal does, and then
+proceeds as usual. That is only useful when the markdown may be undone,
+because otherwise the requests just wait for nothing. If the wait runs
+out, or if "Shutdown" is called while they wait, they get the usual 503,
+so the grace period only ever waits for requests that were let in.
+Waiting requests are not counted as in flight, and there may be at most
+"SetMarkdownQueueLimit" of them; any more are rejected right away.
+*/
+func (s *HTTPScaffold) SetMarkdownMode(mode MarkdownMode, maxWait time.Duration) {
+	s.markdownMode = mode
+	s.markdownMaxWait = maxWait
+}
+
+/*
+SetMarkdownQueueLimit sets how many requests "QueueBriefly" may hold at
+once. The default is "DefaultMarkdownQueueLimit."
+*/
+func (s *HTTPScaffold) SetMarkdownQueueLimit(n int) {
+	s.markdownQueueLimit = int32(n)
+}
+
+/*
+waitForMarkup holds a request that was rejected because of markdown, if
+the markdown mode says to, and returns true if the server was marked up
+while it waited, in which case the request should try again. "t" is the
+tracker that the request started with.
+*/
+func (s *HTTPScaffold) waitForMarkup(t *requestTracker, req *http.Request) bool {
+	if s.markdownMode != QueueBriefly || !t.isMarkedDown() {
+		return false
+	}
+	if atomic.AddInt32(&s.markdownQueued, 1) > s.markdownQueueLimit {
+		atomic.AddInt32(&s.markdownQueued, -1)
+		return false
+	}
+	defer atomic.AddInt32(&s.markdownQueued, -1)
+
+	timer := s.clock.NewTimer(s.markdownMaxWait)
+	defer timer.Stop()
+	for {
+		changed := t.stateChanged()
+		if !t.isMarkedDown() {
+			// Marked up, or shutting down
+			return t.markedDown() == nil
+		}
+		select {
+		case <-changed:
+		case <-timer.C():
+			return false
+		case <-req.Context().Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Markdown queue tests", func() {
+	var s *HTTPScaffold
+	var clk *clock.Fake
+	var h http.Handler
+
+	BeforeEach(func() {
+		clk = clock.NewFake(time.Now())
+		s = CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetMarkdownMode(QueueBriefly, 2*time.Second)
+		h, _ = s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	})
+
+	send := func() chan int {
+		codes := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			codes <- rec.Code
+		}()
+		return codes
+	}
+	queued := func() int32 {
+		return atomic.LoadInt32(&s.markdownQueued)
+	}
+
+	It("Queued requests proceed after markup", func() {
+		s.markDown()
+		codes := send()
+		Eventually(queued).Should(BeEquivalentTo(1))
+		Consistently(codes, 50*time.Millisecond).ShouldNot(Receive())
+		// Waiting requests are not in flight
+		Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+		s.markUp()
+		Eventually(codes).Should(Receive(Equal(200)))
+		Expect(queued()).Should(BeZero())
+	})
+
+	It("Markdown signal undoes markdown", func() {
+		s.SetMarkdownSignal(syscall.SIGUSR1)
+		sigChan := make(chan os.Signal, 1)
+		go s.handleSignals(sigChan, ioutil.Discard)
+
+		sigChan <- syscall.SIGUSR1
+		Eventually(s.tracker.isMarkedDown).Should(BeTrue())
+		codes := send()
+		Eventually(queued).Should(BeEquivalentTo(1))
+		sigChan <- syscall.SIGUSR1
+		Eventually(codes).Should(Receive(Equal(200)))
+	})
+
+	It("Queued requests time out", func() {
+		s.markDown()
+		codes := send()
+		Eventually(clk.Timers).Should(Equal(1))
+		clk.Advance(1999 * time.Millisecond)
+		Consistently(codes, 50*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(time.Millisecond)
+		Eventually(codes).Should(Receive(Equal(503)))
+		Expect(queued()).Should(BeZero())
+	})
+
+	It("Shutdown rejects queued requests", func() {
+		s.markDown()
+		codes := send()
+		Eventually(queued).Should(BeEquivalentTo(1))
+		s.Shutdown(nil)
+		Eventually(codes).Should(Receive(Equal(503)))
+		// Nothing was let in, so the grace period does not wait
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+	})
+
+	It("Queue limit", func() {
+		s.SetMarkdownQueueLimit(1)
+		s.markDown()
+		first := send()
+		Eventually(queued).Should(BeEquivalentTo(1))
+		Eventually(send()).Should(Receive(Equal(503)))
+		s.markUp()
+		Eventually(first).Should(Receive(Equal(200)))
+	})
+
+	It("Reject immediately by default", func() {
+		s = CreateHTTPScaffold()
+		h, _ = s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+		s.markDown()
+		Eventually(send()).Should(Receive(Equal(503)))
+	})
+})
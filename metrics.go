@@ -0,0 +1,77 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"expvar"
+	"net/http"
+	"sync/atomic"
+)
+
+/*
+metricsDocument is returned by the metrics path and published to expvar.
+*/
+type metricsDocument struct {
+	Health             HealthStats      `json:"health"`
+	InFlightRequests   int              `json:"inFlightRequests"`
+	ManagementInFlight int              `json:"managementInFlight"`
+	Connections        ConnectionStats  `json:"connections"`
+	RateLimited        int64            `json:"rateLimited"`
+	Shed               int64            `json:"shed"`
+	ThrottledResponses int32            `json:"throttledResponses"`
+	Rejected           map[string]int64 `json:"rejected"`
+	Requests           []RequestMetrics `json:"requests"`
+}
+
+/*
+SetMetricsPath sets up a URI on the management port (if set) or otherwise
+the main port that returns the scaffold's metrics as JSON, including the
+counts from "HealthStats," "ConnectionStats," and "RequestMetrics."
+*/
+func (s *HTTPScaffold) SetMetricsPath(p string) {
+	s.metricsPath = p
+}
+
+/*
+PublishExpvar publishes the scaffold's metrics using the "expvar" package
+under the given name, so that they appear at "/debug/vars" alongside any
+other variables. That path is served on the management port (if set) or
+otherwise the main port. Like "expvar.Publish," it panics if the name is
+already in use, so each scaffold in a process needs its own name.
+*/
+func (s *HTTPScaffold) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return s.metrics()
+	}))
+}
+
+func (s *HTTPScaffold) metrics() *metricsDocument {
+	st := s.DrainStatus()
+	return &metricsDocument{
+		Health:             s.HealthStats(),
+		InFlightRequests:   st.InFlight,
+		ManagementInFlight: st.ManagementInFlight,
+		Connections:        s.ConnectionStats(),
+		RateLimited:        atomic.LoadInt64(&s.rejections[RejectionRateLimited]),
+		Shed:               atomic.LoadInt64(&s.rejections[RejectionShed]),
+		ThrottledResponses: s.throttledResponses(),
+		Rejected:           s.RejectionCounts(),
+		Requests:           s.RequestMetrics(),
+	}
+}
+
+func (s *HTTPScaffold) handleMetrics(resp http.ResponseWriter, req *http.Request) {
+	writeStructured(resp, "application/json", http.StatusOK, s.metrics())
+}
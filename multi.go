@@ -0,0 +1,424 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	// DefaultSniffTimeout is how long a new connection to a port shared
+	// with gRPC has to send enough data for us to tell what it is.
+	DefaultSniffTimeout = 10 * time.Second
+)
+
+var errMuxClosed = errors.New("listener closed")
+
+/*
+GRPCServer is the part of a gRPC server that the scaffold uses. It is
+satisfied by "*grpc.Server" from "google.golang.org/grpc," without this
+package having to depend on it.
+*/
+type GRPCServer interface {
+	Serve(l net.Listener) error
+	GracefulStop()
+	Stop()
+}
+
+/*
+ListenMulti is like "Listen," but serves gRPC on the insecure and secure
+ports as well as HTTP. Each new connection is examined: HTTP/2
+connections (negotiated using ALPN on the secure port, or with prior
+knowledge on the insecure port) whose first request has a content type of
+"application/grpc" are passed to "grpcServer," and everything else goes
+to "httpHandler" as usual. The health, ready, and other management paths
+stay on HTTP. When the scaffold shuts down, "GracefulStop" is called on
+the gRPC server at the same time as the HTTP requests drain. If the gRPC
+calls have not completed by the time the grace timeout expires, "Stop" is
+called. "ListenMulti" returns once both are done.
+*/
+func (s *HTTPScaffold) ListenMulti(httpHandler http.Handler, grpcServer GRPCServer) error {
+	err := s.StartListenMulti(httpHandler, grpcServer)
+	if err != nil {
+		return err
+	}
+
+	return s.WaitForShutdown()
+}
+
+/*
+StartListenMulti is like "StartListen," but serves gRPC as described
+for "ListenMulti."
+*/
+func (s *HTTPScaffold) StartListenMulti(httpHandler http.Handler, grpcServer GRPCServer) error {
+	if grpcServer == nil {
+		return errors.New("a gRPC server is required")
+	}
+	s.grpcServer = grpcServer
+	s.grpcStopOnce = &sync.Once{}
+	s.grpcStopped = make(chan struct{})
+	return s.StartListen(httpHandler)
+}
+
+/*
+stopGRPC starts a graceful stop of the gRPC server, which is forced once
+the grace timeout runs out, or right away if "force" is set. The grace
+timeout counts from the start of the shutdown, so time spent in shutdown
+hooks is taken out of it.
+*/
+func (s *HTTPScaffold) stopGRPC(force bool) {
+	if s.grpcServer == nil {
+		return
+	}
+	s.grpcStopOnce.Do(func() {
+		s.drainLock.Lock()
+		began := s.drainStart
+		s.drainLock.Unlock()
+		timeout := s.currentTracker().shutdownWait
+		if !began.IsZero() {
+			timeout -= s.since(began)
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+		go s.gracefulStopGRPC(timeout)
+	})
+	if force {
+		go s.grpcServer.Stop()
+	}
+}
+
+func (s *HTTPScaffold) gracefulStopGRPC(timeout time.Duration) {
+	defer close(s.grpcStopped)
+
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	timer := s.clock.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C():
+		s.logInfo("gRPC calls still running after %s, stopping", timeout)
+		s.grpcServer.Stop()
+		<-done
+	}
+}
+
+/*
+serveMulti splits the connections to a listener between an HTTP server
+and the gRPC server.
+*/
+func (s *HTTPScaffold) serveMulti(role string, l net.Listener, h http.Handler) {
+	m := &protocolMux{
+		http:    newMuxListener(l.Addr()),
+		grpc:    newMuxListener(l.Addr()),
+		h2:      &http2.Server{},
+		goAway:  &http.Server{},
+		h2Conns: make(map[net.Conn]struct{}),
+	}
+	// This only fails for a TLS config that HTTP/2 does not allow, and
+	// "goAway" does not have one
+	http2.ConfigureServer(m.goAway, m.h2)
+	m.srv = s.serve("", m.http, h, s.appConns)
+	s.serverLock.Lock()
+	s.muxes = append(s.muxes, m)
+	m.setKeepAlives(!s.keepAlivesDisabled)
+	s.serverLock.Unlock()
+	go s.grpcServer.Serve(m.grpc)
+
+	s.serveGroup.Add(1)
+	go func() {
+		defer s.serveGroup.Done()
+		defer m.http.Close()
+		defer m.grpc.Close()
+		for {
+			c, err := acceptRetrying(l)
+			if err != nil {
+				s.acceptLoopExited(role, err)
+				return
+			}
+			go m.route(c)
+		}
+	}()
+}
+
+/*
+protocolMux hands each connection to the HTTP server or the gRPC server.
+HTTP/2 connections that are not gRPC are served by "h2" directly, so the
+mux does for them what "srv" does for its own connections.
+*/
+type protocolMux struct {
+	http *muxListener
+	grpc *muxListener
+	srv  *http.Server
+	h2   *http2.Server
+	// goAway is never served. Shutting it down tells every connection that
+	// "h2" is serving to finish its requests and close.
+	goAway        *http.Server
+	keepAlivesOff int32
+	lock          sync.Mutex
+	h2Conns       map[net.Conn]struct{}
+	closed        bool
+}
+
+type connProtocol int
+
+const (
+	http1Protocol connProtocol = iota
+	http2Protocol
+	grpcProtocol
+)
+
+/*
+route figures out what protocol the connection speaks and passes it on.
+Connections that send garbage, or nothing at all, go to the HTTP server,
+which knows how to reject them.
+*/
+func (m *protocolMux) route(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(DefaultSniffTimeout))
+
+	tc, isTLS := c.(*tls.Conn)
+	if isTLS {
+		if err := tc.Handshake(); err != nil {
+			c.Close()
+			return
+		}
+		if tc.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+			c.SetReadDeadline(time.Time{})
+			m.http.deliver(c)
+			return
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	proto := sniffProtocol(io.TeeReader(c, buf))
+	c.SetReadDeadline(time.Time{})
+	replay := io.MultiReader(buf, c)
+
+	var sc net.Conn
+	if isTLS {
+		sc = &sniffedTLSConn{Conn: tc, r: replay}
+	} else {
+		sc = &sniffedConn{Conn: c, r: replay}
+	}
+
+	switch {
+	case proto == grpcProtocol:
+		m.grpc.deliver(sc)
+	case proto == http2Protocol || isTLS:
+		// TLS connections that negotiated HTTP/2 can only be served that way
+		m.serveHTTP2(sc)
+	default:
+		m.http.deliver(sc)
+	}
+}
+
+/*
+serveHTTP2 serves a connection that speaks HTTP/2 but not gRPC. Like the
+connections that "srv" serves, its state is reported to the "ConnState"
+hook, it is asked to close once keep-alives are off, and it is closed
+when the scaffold is reset.
+*/
+func (m *protocolMux) serveHTTP2(c net.Conn) {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		c.Close()
+		return
+	}
+	m.h2Conns[c] = struct{}{}
+	m.lock.Unlock()
+	defer func() {
+		m.lock.Lock()
+		delete(m.h2Conns, c)
+		m.lock.Unlock()
+	}()
+
+	// "h2" reports the changes between active and idle itself
+	m.srv.ConnState(c, http.StateNew)
+	defer m.srv.ConnState(c, http.StateClosed)
+	m.h2.ServeConn(c, &http2.ServeConnOpts{
+		BaseConfig: m.srv,
+		Handler:    http.HandlerFunc(m.serveHTTP2Request),
+	})
+}
+
+func (m *protocolMux) serveHTTP2Request(resp http.ResponseWriter, req *http.Request) {
+	if atomic.LoadInt32(&m.keepAlivesOff) != 0 {
+		// "h2" sends a GOAWAY after the response instead of the header
+		resp.Header().Set("Connection", "close")
+	}
+	m.srv.Handler.ServeHTTP(resp, req)
+}
+
+/*
+setKeepAlives is "SetKeepAlivesEnabled" for the HTTP/2 connections. When
+keep-alives are turned off, the connections that are already open are
+told to close once their requests are done.
+*/
+func (m *protocolMux) setKeepAlives(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&m.keepAlivesOff, 0)
+		return
+	}
+	if atomic.SwapInt32(&m.keepAlivesOff, 1) == 0 {
+		m.goAway.Shutdown(context.Background())
+	}
+}
+
+/*
+close closes the HTTP/2 connections, like "Close" on "srv" does for the
+rest.
+*/
+func (m *protocolMux) close() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.closed = true
+	for c := range m.h2Conns {
+		c.Close()
+	}
+}
+
+/*
+sniffProtocol reads the start of a connection. If it is the HTTP/2 client
+preface, it reads frames up to the first HEADERS frame to find the content
+type of the first request.
+*/
+func sniffProtocol(r io.Reader) connProtocol {
+	preface := http2.ClientPreface
+	got := make([]byte, 0, len(preface))
+	b := make([]byte, len(preface))
+	for len(got) < len(preface) {
+		n, err := r.Read(b[:len(preface)-len(got)])
+		got = append(got, b[:n]...)
+		if !strings.HasPrefix(preface, string(got)) || err != nil {
+			return http1Protocol
+		}
+	}
+
+	fr := http2.NewFramer(ioutil.Discard, r)
+	fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			return http2Protocol
+		}
+		if mh, ok := f.(*http2.MetaHeadersFrame); ok {
+			if strings.HasPrefix(headerValue(mh, "content-type"), "application/grpc") {
+				return grpcProtocol
+			}
+			return http2Protocol
+		}
+	}
+}
+
+func headerValue(mh *http2.MetaHeadersFrame, name string) string {
+	for _, hf := range mh.RegularFields() {
+		if hf.Name == name {
+			return hf.Value
+		}
+	}
+	return ""
+}
+
+/*
+sniffedConn replays the data that we read while sniffing.
+*/
+type sniffedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/*
+sniffedTLSConn is the same, but keeps "ConnectionState" so that requests
+still see the TLS details.
+*/
+type sniffedTLSConn struct {
+	*tls.Conn
+	r io.Reader
+}
+
+func (c *sniffedTLSConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+/*
+muxListener is a listener that returns the connections that are passed to
+"deliver."
+*/
+type muxListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newMuxListener(addr net.Addr) *muxListener {
+	return &muxListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errMuxClosed
+	}
+}
+
+func (l *muxListener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *muxListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.addr
+}
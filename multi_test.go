@@ -0,0 +1,445 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/http2"
+)
+
+var _ = Describe("gRPC multiplexing", func() {
+	var s *HTTPScaffold
+	var g *fakeGRPCServer
+	var stopChan chan error
+
+	protoHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "http %d tls=%t", r.ProtoMajor, r.TLS != nil)
+	})
+
+	// Connections are sorted by their first request, so like a real gRPC
+	// client, each kind of call needs its own client
+	newH2C := func() *http.Client {
+		return &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					return net.Dial(network, addr)
+				},
+			},
+		}
+	}
+
+	call := func(c *http.Client, method, url, contentType string) (int, string) {
+		req, err := http.NewRequest(method, url, nil)
+		Expect(err).Should(Succeed())
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		resp, err := c.Do(req)
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		bod, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(Succeed())
+		return resp.StatusCode, string(bod)
+	}
+
+	start := func() {
+		s.SetHealthPath("/health")
+		g = newFakeGRPCServer()
+		stopChan = make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		go func() {
+			stopChan <- s.ListenMulti(protoHandler, g)
+		}()
+		Eventually(func() bool {
+			return testGet(s, "/health")
+		}, 5*time.Second).Should(BeTrue())
+	}
+
+	It("Insecure port", func() {
+		s = CreateHTTPScaffold()
+		start()
+		base := s.InsecureURL().String()
+
+		code, bod := getText(base + "/")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("http 1 tls=false"))
+
+		code, bod = call(newH2C(), "GET", base+"/", "")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("http 2 tls=false"))
+
+		code, bod = call(newH2C(), "POST", base+"/pkg.Service/Method", "application/grpc+proto")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("grpc /pkg.Service/Method"))
+
+		code, _ = getText(base + "/health")
+		Expect(code).Should(Equal(200))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(atomic.LoadInt32(&g.graceful)).Should(BeEquivalentTo(1))
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeZero())
+	})
+
+	It("Secure port", func() {
+		s = CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetSecurePort(0)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		g = newFakeGRPCServer()
+		stopChan = make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		go func() {
+			stopChan <- s.ListenMulti(protoHandler, g)
+		}()
+		base := s.SecureURL().String()
+
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		h1 := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		h2 := &http.Client{
+			Transport: &http2.Transport{TLSClientConfig: tlsConfig},
+		}
+		Eventually(func() error {
+			_, err := h1.Get(base + "/")
+			return err
+		}, 5*time.Second).Should(Succeed())
+
+		code, bod := call(h1, "GET", base+"/", "")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("http 1 tls=true"))
+
+		code, bod = call(h2, "GET", base+"/", "")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("http 2 tls=true"))
+
+		grpcClient := &http.Client{
+			Transport: &http2.Transport{TLSClientConfig: tlsConfig},
+		}
+		code, bod = call(grpcClient, "POST", base+"/pkg.Service/Method", "application/grpc")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("grpc /pkg.Service/Method"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Graceful stop waits for calls", func() {
+		s = CreateHTTPScaffold()
+		start()
+		base := s.InsecureURL().String()
+
+		done := make(chan string, 1)
+		go func() {
+			_, bod := call(newH2C(), "POST", base+"/slow?delay=500ms", "application/grpc")
+			done <- bod
+		}()
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&g.active)
+		}).Should(BeEquivalentTo(1))
+
+		s.Shutdown(nil)
+		Consistently(stopChan, 200*time.Millisecond).ShouldNot(Receive())
+		Eventually(done, 2*time.Second).Should(Receive(Equal("grpc /slow")))
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeZero())
+	})
+
+	It("Grace timeout stops gRPC", func() {
+		clk := clock.NewFake(time.Now())
+		s = CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetDrainIdleTimeout(0)
+		start()
+		base := s.InsecureURL().String()
+
+		go func() {
+			req, _ := http.NewRequest("POST", base+"/slow?delay=10s", nil)
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := newH2C().Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&g.active)
+		}).Should(BeEquivalentTo(1))
+
+		s.Shutdown(nil)
+		// The HTTP drain is over right away, which leaves the gRPC timer
+		Eventually(clk.Timers).Should(Equal(1))
+		clk.Advance(DefaultGraceTimeout - time.Millisecond)
+		Consistently(stopChan, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeZero())
+		clk.Advance(time.Millisecond)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeEquivalentTo(1))
+	})
+
+	It("Shutdown hooks come out of the gRPC grace timeout", func() {
+		clk := clock.NewFake(time.Now())
+		s = CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetDrainIdleTimeout(0)
+		release := make(chan struct{})
+		defer close(release)
+		s.OnShutdownWithTimeout(func(ctx context.Context) error {
+			<-release
+			return nil
+		}, 10*time.Second)
+		start()
+		base := s.InsecureURL().String()
+
+		go func() {
+			req, _ := http.NewRequest("POST", base+"/slow?delay=10s", nil)
+			req.Header.Set("Content-Type", "application/grpc")
+			resp, err := newH2C().Do(req)
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&g.active)
+		}).Should(BeEquivalentTo(1))
+
+		s.Shutdown(nil)
+		Eventually(clk.Timers).Should(Equal(1))
+		clk.Advance(10 * time.Second)
+		Eventually(func() bool {
+			return s.DrainStatus().HooksRunning
+		}).Should(BeFalse())
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&g.graceful)
+		}).Should(BeEquivalentTo(1))
+
+		// Only what is left of the grace timeout is spent on gRPC
+		Eventually(clk.Timers).Should(Equal(1))
+		clk.Advance(DefaultGraceTimeout - 10*time.Second - time.Millisecond)
+		Consistently(stopChan, 50*time.Millisecond).ShouldNot(Receive())
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeZero())
+		clk.Advance(time.Millisecond)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(atomic.LoadInt32(&g.stopped)).Should(BeEquivalentTo(1))
+	})
+
+	// An HTTP/2 client that counts the connections it makes
+	countingH2C := func(dials *int32) *http.Client {
+		return &http.Client{
+			Transport: &http2.Transport{
+				AllowHTTP: true,
+				DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+					atomic.AddInt32(dials, 1)
+					return net.Dial(network, addr)
+				},
+			},
+		}
+	}
+	openConns := func() int64 {
+		c := s.ConnectionStats().Application
+		return c.New + c.Active + c.Idle
+	}
+
+	It("Plain HTTP/2 connections are tracked", func() {
+		s = CreateHTTPScaffold()
+		g = newFakeGRPCServer()
+		stopChan = make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.ListenMulti(protoHandler, g)
+		}()
+		Eventually(s.AddressesReady()).Should(BeClosed())
+		base := s.InsecureURL().String()
+
+		var dials int32
+		client := countingH2C(&dials)
+		code, bod := call(client, "GET", base+"/", "")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("http 2 tls=false"))
+		Eventually(func() int64 {
+			return s.ConnectionStats().Application.Idle
+		}).Should(BeEquivalentTo(1))
+
+		// Turning off keep-alives sends a GOAWAY, and the connection closes
+		// soon after
+		s.markDown()
+		Eventually(openConns, 5*time.Second).Should(BeZero())
+		Expect(s.ConnectionStats().Application.Closed).Should(BeEquivalentTo(1))
+		s.markUp()
+		code, _ = call(client, "GET", base+"/", "")
+		Expect(code).Should(Equal(200))
+		Expect(atomic.LoadInt32(&dials)).Should(BeEquivalentTo(2))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Eventually(openConns, 5*time.Second).Should(BeZero())
+	})
+
+	It("Plain HTTP/2 connections close on reopen", func() {
+		release := make(chan struct{})
+		defer close(release)
+		blocking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			<-release
+		})
+		s = CreateHTTPScaffold()
+		g = newFakeGRPCServer()
+		stopChan = make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.ListenMulti(blocking, g)
+		}()
+		Eventually(s.AddressesReady()).Should(BeClosed())
+
+		var dials int32
+		resp, err := countingH2C(&dials).Get(s.InsecureURL().String())
+		Expect(err).Should(Succeed())
+		defer resp.Body.Close()
+		read := make(chan error, 1)
+		go func() {
+			_, err := ioutil.ReadAll(resp.Body)
+			read <- err
+		}()
+
+		// The request is abandoned, and its connection stays open until
+		// the scaffold is opened again, as it would for HTTP/1
+		s.ForceShutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrForcedShutdown)))
+		Expect(openConns()).Should(BeEquivalentTo(1))
+		Consistently(read).ShouldNot(Receive())
+		Expect(s.Open()).Should(Succeed())
+		Eventually(read).Should(Receive(HaveOccurred()))
+		Eventually(openConns).Should(BeZero())
+
+		s.Shutdown(nil)
+		go s.WaitForShutdown()
+	})
+})
+
+/*
+fakeGRPCServer stands in for "*grpc.Server." Like it, it serves HTTP/2
+on the connections from its listener, and it tracks calls so that
+"GracefulStop" can wait for them.
+*/
+type fakeGRPCServer struct {
+	lock     sync.Mutex
+	lis      []net.Listener
+	conns    map[net.Conn]struct{}
+	calls    sync.WaitGroup
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	active   int32
+	graceful int32
+	stopped  int32
+}
+
+func newFakeGRPCServer() *fakeGRPCServer {
+	return &fakeGRPCServer{
+		conns:  make(map[net.Conn]struct{}),
+		stopCh: make(chan struct{}),
+	}
+}
+
+func (g *fakeGRPCServer) Serve(l net.Listener) error {
+	g.lock.Lock()
+	g.lis = append(g.lis, l)
+	g.lock.Unlock()
+
+	h2 := &http2.Server{}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		atomic.AddInt32(&g.active, 1)
+		defer atomic.AddInt32(&g.active, -1)
+		if d, err := time.ParseDuration(r.URL.Query().Get("delay")); err == nil {
+			select {
+			case <-time.After(d):
+			case <-g.stopCh:
+				return
+			}
+		}
+		fmt.Fprintf(w, "grpc %s", r.URL.Path)
+	})
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		g.lock.Lock()
+		g.conns[c] = struct{}{}
+		g.calls.Add(1)
+		g.lock.Unlock()
+		go func() {
+			defer g.calls.Done()
+			h2.ServeConn(c, &http2.ServeConnOpts{Handler: handler})
+		}()
+	}
+}
+
+func (g *fakeGRPCServer) closeListeners() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, l := range g.lis {
+		l.Close()
+	}
+}
+
+func (g *fakeGRPCServer) GracefulStop() {
+	atomic.AddInt32(&g.graceful, 1)
+	g.closeListeners()
+	// Wait for the calls, rather than the connections, to finish
+	for atomic.LoadInt32(&g.active) > 0 {
+		select {
+		case <-g.stopCh:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (g *fakeGRPCServer) Stop() {
+	atomic.AddInt32(&g.stopped, 1)
+	g.closeListeners()
+	g.stopOnce.Do(func() {
+		close(g.stopCh)
+	})
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for c := range g.conns {
+		c.Close()
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package otelscaffold traces the requests that goscaffold handles using
+OpenTelemetry. It is kept separate so that the scaffold itself does not
+depend on OpenTelemetry. The spans look like the server spans from the
+"otelhttp" package, but they also cover the requests that the scaffold
+rejects itself, and say why:
+
+	s := goscaffold.CreateHTTPScaffold()
+	s.SetTracer(otelscaffold.NewTracer())
+*/
+package otelscaffold
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/apid/goscaffold"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+ScopeName is the instrumentation scope of the spans.
+*/
+const ScopeName = "github.com/apid/goscaffold/otelscaffold"
+
+/*
+RejectionKey is the attribute that says why the scaffold rejected a
+request. It is not set on requests that reached the application handler.
+*/
+const RejectionKey = attribute.Key("goscaffold.rejection")
+
+/*
+An Option changes how a Tracer works.
+*/
+type Option func(*Tracer)
+
+/*
+WithTracerProvider sets where the spans come from. The default is the
+global provider.
+*/
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(t *Tracer) {
+		t.provider = tp
+	}
+}
+
+/*
+WithPropagators sets how the parent span is read from the request headers.
+The default is the global propagator.
+*/
+func WithPropagators(p propagation.TextMapPropagator) Option {
+	return func(t *Tracer) {
+		t.propagators = p
+	}
+}
+
+/*
+WithSpanNameFormatter sets how spans are named. The default is just the
+method, as OpenTelemetry recommends when the route is not known.
+*/
+func WithSpanNameFormatter(f func(r *http.Request) string) Option {
+	return func(t *Tracer) {
+		t.spanName = f
+	}
+}
+
+/*
+A Tracer is a goscaffold.ScaffoldTracer that starts an OpenTelemetry
+server span for every request.
+*/
+type Tracer struct {
+	provider    trace.TracerProvider
+	propagators propagation.TextMapPropagator
+	spanName    func(r *http.Request) string
+	tracer      trace.Tracer
+}
+
+/*
+NewTracer creates a Tracer.
+*/
+func NewTracer(opts ...Option) *Tracer {
+	t := &Tracer{
+		provider:    otel.GetTracerProvider(),
+		propagators: otel.GetTextMapPropagator(),
+		spanName:    func(r *http.Request) string { return r.Method },
+	}
+	for _, o := range opts {
+		o(t)
+	}
+	t.tracer = t.provider.Tracer(ScopeName,
+		trace.WithSchemaURL(semconv.SchemaURL))
+	return t
+}
+
+/*
+StartRequest starts a span for the request, as a child of the span in its
+headers if there is one.
+*/
+func (t *Tracer) StartRequest(r *http.Request) (context.Context, goscaffold.EndFunc) {
+	ctx := t.propagators.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := t.tracer.Start(ctx, t.spanName(r),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(requestAttributes(r)...))
+	return ctx, func(status int, rejection goscaffold.RejectionReason) {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if rejection != goscaffold.RejectionNone {
+			span.SetAttributes(RejectionKey.String(rejection.String()))
+		}
+		// Only server errors are errors for a server span
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		span.End()
+	}
+}
+
+func requestAttributes(r *http.Request) []attribute.KeyValue {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	attrs := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(r.Method),
+		semconv.URLScheme(scheme),
+		semconv.URLPath(r.URL.Path),
+		semconv.ServerAddress(host),
+		semconv.NetworkProtocolVersion(protocolVersion(r)),
+	}
+	if ua := r.UserAgent(); ua != "" {
+		attrs = append(attrs, semconv.UserAgentOriginal(ua))
+	}
+	return attrs
+}
+
+/*
+protocolVersion formats the HTTP version the way OpenTelemetry does, such
+as "1.1" or "2".
+*/
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMajor >= 2 && r.ProtoMinor == 0 {
+		return strconv.Itoa(r.ProtoMajor)
+	}
+	return strconv.Itoa(r.ProtoMajor) + "." + strconv.Itoa(r.ProtoMinor)
+}
@@ -0,0 +1,103 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package otelscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/apid/goscaffold"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+func attributeMap(attrs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, a := range attrs {
+		m[a.Key] = a.Value
+	}
+	return m
+}
+
+var _ = Describe("OpenTelemetry tracer", func() {
+	var recorder *tracetest.SpanRecorder
+	var h http.Handler
+	var s *goscaffold.HTTPScaffold
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+		s = goscaffold.CreateHTTPScaffold()
+		s.SetTracer(NewTracer(
+			WithTracerProvider(provider),
+			WithPropagators(propagation.TraceContext{})))
+		h, _ = s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			// The handler can make child spans
+			Expect(trace.SpanContextFromContext(req.Context()).IsValid()).Should(BeTrue())
+			if req.URL.Path == "/fail" {
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		}))
+	})
+
+	It("Records a server span", func() {
+		req := httptest.NewRequest("GET", "http://example.com:8080/ok", nil)
+		req.Header.Set("User-Agent", "test")
+		req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := recorder.Ended()
+		Expect(spans).Should(HaveLen(1))
+		span := spans[0]
+		Expect(span.Name()).Should(Equal("GET"))
+		Expect(span.SpanKind()).Should(Equal(trace.SpanKindServer))
+		Expect(span.Parent().TraceID().String()).Should(Equal("4bf92f3577b34da6a3ce929d0e0e4736"))
+		Expect(span.Status().Code).Should(Equal(codes.Unset))
+		attrs := attributeMap(span.Attributes())
+		Expect(attrs["http.request.method"].AsString()).Should(Equal("GET"))
+		Expect(attrs["url.path"].AsString()).Should(Equal("/ok"))
+		Expect(attrs["server.address"].AsString()).Should(Equal("example.com"))
+		Expect(attrs["network.protocol.version"].AsString()).Should(Equal("1.1"))
+		Expect(attrs["user_agent.original"].AsString()).Should(Equal("test"))
+		Expect(attrs["http.response.status_code"].AsInt64()).Should(Equal(int64(200)))
+		Expect(attrs).ShouldNot(HaveKey(RejectionKey))
+	})
+
+	It("Records server errors", func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/fail", nil))
+		spans := recorder.Ended()
+		Expect(spans).Should(HaveLen(1))
+		Expect(spans[0].Status().Code).Should(Equal(codes.Error))
+	})
+
+	It("Records rejections", func() {
+		s.SetAllowedMethods([]string{"GET"})
+		h, _ = s.Handlers(http.NotFoundHandler())
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", nil))
+		spans := recorder.Ended()
+		Expect(spans).Should(HaveLen(1))
+		attrs := attributeMap(spans[0].Attributes())
+		Expect(attrs["http.response.status_code"].AsInt64()).Should(Equal(int64(405)))
+		Expect(attrs[RejectionKey].AsString()).Should(Equal("MethodNotAllowed"))
+		Expect(spans[0].Status().Code).Should(Equal(codes.Unset))
+	})
+})
@@ -0,0 +1,254 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMetricsPathLimit is the default number of distinct paths that
+	// request metrics are kept for.
+	DefaultMetricsPathLimit = 100
+	// AllPathsLabel is the path label used for every request if
+	// "SetMetricsPathNormalizer" was not called.
+	AllPathsLabel = "*"
+	// OtherPathLabel is the path label used for requests once the limit
+	// on distinct paths is reached, or if the normalizer panics.
+	OtherPathLabel = "other"
+)
+
+/*
+DefaultLatencyBuckets are the upper bounds of the request latency
+histogram.
+*/
+var DefaultLatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+/*
+metricsMethods are the methods that get their own label. Anything else
+that a client sends is counted as "OTHER."
+*/
+var metricsMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+/*
+RequestMetrics counts application requests for one path label and method.
+"Port" is the name of the port from "AddPort," and is empty for the main
+ports.
+*/
+type RequestMetrics struct {
+	Port    string           `json:"port,omitempty"`
+	Path    string           `json:"path"`
+	Method  string           `json:"method"`
+	Count   int64            `json:"count"`
+	Latency LatencyHistogram `json:"latency"`
+}
+
+/*
+LatencyHistogram is a histogram of request latency. As in Prometheus, the
+count in each bucket includes every request that was no slower than its
+upper bound, and the last bucket has no upper bound at all.
+*/
+type LatencyHistogram struct {
+	SumSeconds float64           `json:"sumSeconds"`
+	Buckets    []HistogramBucket `json:"buckets"`
+}
+
+/*
+HistogramBucket is one bucket of a histogram. "UpperBound" is in seconds,
+and is zero for the last bucket, which has no bound.
+*/
+type HistogramBucket struct {
+	UpperBound float64 `json:"le,omitempty"`
+	Count      int64   `json:"count"`
+}
+
+/*
+SetMetricsPathNormalizer sets a function that turns a request into the
+path label for request metrics. It should return something with a small
+number of possible values, such as the route template from the router,
+rather than the actual path, which may contain IDs. It is called after
+the request is complete. If it is not set then all requests are counted
+together under "AllPathsLabel." A normalizer that panics does not affect
+the request, which is counted under "OtherPathLabel."
+*/
+func (s *HTTPScaffold) SetMetricsPathNormalizer(f func(r *http.Request) string) {
+	s.pathNormalizer = f
+}
+
+/*
+SetMetricsPathLimit sets the number of distinct path labels that request
+metrics are kept for. Once it is reached, requests for new labels are
+counted under "OtherPathLabel." The default is "DefaultMetricsPathLimit."
+*/
+func (s *HTTPScaffold) SetMetricsPathLimit(n int) {
+	s.requestMetrics.maxPaths = n
+}
+
+/*
+RequestMetrics returns the metrics for application requests, sorted by
+port, path label, and method. They are also part of the metrics path
+and of the variable published by "PublishExpvar."
+*/
+func (s *HTTPScaffold) RequestMetrics() []RequestMetrics {
+	return s.requestMetrics.snapshot()
+}
+
+/*
+pathLabel returns the path label for a request, recovering if the
+normalizer panics.
+*/
+func (s *HTTPScaffold) pathLabel(req *http.Request) (label string) {
+	if s.pathNormalizer == nil {
+		return AllPathsLabel
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			s.logError("Metrics path normalizer panicked: %v", r)
+			label = OtherPathLabel
+		}
+	}()
+	return s.pathNormalizer(req)
+}
+
+type seriesKey struct {
+	port   string
+	path   string
+	method string
+}
+
+type latencySeries struct {
+	// These are first so that they are aligned for sync/atomic
+	count    int64
+	sumNanos int64
+	// buckets has one more entry than the bounds, for the overflow
+	buckets []int64
+}
+
+/*
+requestMetricsSet holds the request metrics for every label and method.
+Once a series exists, recording to it only needs the read lock.
+*/
+type requestMetricsSet struct {
+	lock     *sync.RWMutex
+	series   map[seriesKey]*latencySeries
+	paths    map[string]int
+	maxPaths int
+	bounds   []time.Duration
+}
+
+func newRequestMetricsSet() *requestMetricsSet {
+	return &requestMetricsSet{
+		lock:     &sync.RWMutex{},
+		series:   make(map[seriesKey]*latencySeries),
+		paths:    make(map[string]int),
+		maxPaths: DefaultMetricsPathLimit,
+		bounds:   DefaultLatencyBuckets,
+	}
+}
+
+func (m *requestMetricsSet) record(port, path, method string, latency time.Duration) {
+	if !metricsMethods[method] {
+		method = "OTHER"
+	}
+	key := seriesKey{port: port, path: path, method: method}
+	m.lock.RLock()
+	ls := m.series[key]
+	m.lock.RUnlock()
+	if ls == nil {
+		ls = m.addSeries(key)
+	}
+
+	atomic.AddInt64(&ls.count, 1)
+	atomic.AddInt64(&ls.sumNanos, int64(latency))
+	b := sort.Search(len(m.bounds), func(i int) bool {
+		return latency <= m.bounds[i]
+	})
+	atomic.AddInt64(&ls.buckets[b], 1)
+}
+
+func (m *requestMetricsSet) addSeries(key seriesKey) *latencySeries {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, found := m.paths[key.path]; !found && key.path != OtherPathLabel &&
+		len(m.paths) >= m.maxPaths {
+		key.path = OtherPathLabel
+	}
+	if ls := m.series[key]; ls != nil {
+		return ls
+	}
+	ls := &latencySeries{
+		buckets: make([]int64, len(m.bounds)+1),
+	}
+	m.series[key] = ls
+	m.paths[key.path]++
+	return ls
+}
+
+func (m *requestMetricsSet) snapshot() []RequestMetrics {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	ret := make([]RequestMetrics, 0, len(m.series))
+	for key, ls := range m.series {
+		rm := RequestMetrics{
+			Port:   key.port,
+			Path:   key.path,
+			Method: key.method,
+			Count:  atomic.LoadInt64(&ls.count),
+			Latency: LatencyHistogram{
+				SumSeconds: time.Duration(atomic.LoadInt64(&ls.sumNanos)).Seconds(),
+				Buckets:    make([]HistogramBucket, len(ls.buckets)),
+			},
+		}
+		var total int64
+		for i := range ls.buckets {
+			total += atomic.LoadInt64(&ls.buckets[i])
+			rm.Latency.Buckets[i].Count = total
+			if i < len(m.bounds) {
+				rm.Latency.Buckets[i].UpperBound = m.bounds[i].Seconds()
+			}
+		}
+		ret = append(ret, rm)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Port != ret[j].Port {
+			return ret[i].Port < ret[j].Port
+		}
+		if ret[i].Path != ret[j].Path {
+			return ret[i].Path < ret[j].Path
+		}
+		return ret[i].Method < ret[j].Method
+	})
+	return ret
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Request metrics tests", func() {
+	do := func(h http.Handler, method, path string) {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, path, nil))
+	}
+
+	It("Whole port by default", func() {
+		s := CreateHTTPScaffold()
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+		do(h, "GET", "/one")
+		do(h, "GET", "/two")
+		do(h, "POST", "/two")
+		do(h, "BREW", "/pot")
+
+		m := s.RequestMetrics()
+		Expect(m).Should(HaveLen(3))
+		Expect(m[0].Path).Should(Equal(AllPathsLabel))
+		Expect(m[0].Method).Should(Equal("GET"))
+		Expect(m[0].Count).Should(BeEquivalentTo(2))
+		Expect(m[1].Method).Should(Equal("OTHER"))
+		Expect(m[2].Method).Should(Equal("POST"))
+		Expect(m[2].Count).Should(BeEquivalentTo(1))
+	})
+
+	It("Latency histogram", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			d, _ := time.ParseDuration(strings.TrimPrefix(req.URL.Path, "/"))
+			clk.Advance(d)
+		}))
+		do(h, "GET", "/1ms")
+		do(h, "GET", "/20ms")
+		do(h, "GET", "/20ms")
+		do(h, "GET", "/1m")
+
+		m := s.RequestMetrics()
+		Expect(m).Should(HaveLen(1))
+		lat := m[0].Latency
+		Expect(lat.SumSeconds).Should(BeNumerically("~", 60.041, 0.0001))
+		Expect(lat.Buckets).Should(HaveLen(len(DefaultLatencyBuckets) + 1))
+		Expect(lat.Buckets[0]).Should(Equal(HistogramBucket{UpperBound: 0.005, Count: 1}))
+		Expect(lat.Buckets[1]).Should(Equal(HistogramBucket{UpperBound: 0.01, Count: 1}))
+		Expect(lat.Buckets[2]).Should(Equal(HistogramBucket{UpperBound: 0.025, Count: 3}))
+		Expect(lat.Buckets[len(lat.Buckets)-2].Count).Should(BeEquivalentTo(3))
+		Expect(lat.Buckets[len(lat.Buckets)-1]).Should(Equal(HistogramBucket{Count: 4}))
+	})
+
+	It("Normalizer and path limit", func() {
+		s := CreateHTTPScaffold()
+		s.SetMetricsPathLimit(2)
+		s.SetMetricsPathNormalizer(func(req *http.Request) string {
+			if req.URL.Path == "/panic" {
+				panic("normalizer")
+			}
+			return strings.Split(req.URL.Path, "/")[1]
+		})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+		do(h, "GET", "/users/1")
+		do(h, "GET", "/users/2")
+		do(h, "GET", "/orders/1")
+		do(h, "GET", "/items/1")
+		do(h, "GET", "/widgets/1")
+		do(h, "POST", "/orders/1")
+		do(h, "GET", "/panic")
+
+		counts := make(map[string]int64)
+		for _, m := range s.RequestMetrics() {
+			counts[m.Method+" "+m.Path] = m.Count
+		}
+		Expect(counts).Should(Equal(map[string]int64{
+			"GET users":   2,
+			"GET orders":  1,
+			"POST orders": 1,
+			"GET other":   3,
+		}))
+	})
+
+	It("Metrics document", func() {
+		s := CreateHTTPScaffold()
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+		do(h, "GET", "/")
+
+		rec := httptest.NewRecorder()
+		s.handleMetrics(rec, httptest.NewRequest("GET", "/metrics", nil))
+		var doc struct {
+			Requests []RequestMetrics `json:"requests"`
+		}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &doc)).Should(Succeed())
+		Expect(doc.Requests).Should(HaveLen(1))
+		Expect(doc.Requests[0].Count).Should(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,187 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type originalPathKey struct{}
+
+/*
+TrailingSlash says what path normalization does with a slash at the end
+of the path.
+*/
+type TrailingSlash int
+
+const (
+	// TrailingSlashKeep leaves trailing slashes alone
+	TrailingSlashKeep TrailingSlash = iota
+	// TrailingSlashStrip removes trailing slashes, except from "/"
+	TrailingSlashStrip
+	// TrailingSlashAdd adds a trailing slash if there is none
+	TrailingSlashAdd
+)
+
+/*
+PathNormOptions says how "SetPathNormalization" changes request paths.
+*/
+type PathNormOptions struct {
+	// CollapseSlashes turns each run of slashes into a single one
+	CollapseSlashes bool
+	// TrailingSlash says what to do with a slash at the end
+	TrailingSlash TrailingSlash
+	// CleanDotSegments removes "." and ".." segments as in RFC 3986
+	CleanDotSegments bool
+	// Redirect sends a redirect to the normalized path rather than
+	// passing the rewritten request to the handler
+	Redirect bool
+}
+
+/*
+SetPathNormalization normalizes the paths of requests before they are
+passed to the handler, for instance so that "//v1/users/" reaches the
+same route as "/v1/users." By default the request is passed on with its
+"URL.Path" rewritten, and "OriginalPath" returns what it was before. With
+"Redirect" set, the client is instead sent a 301 to the normalized path,
+or a 308 for methods other than GET and HEAD so that the method and body
+are kept. The management paths, such as health and ready, are always
+matched after normalization, and are always rewritten rather than
+redirected, so that probes work with either form.
+*/
+func (s *HTTPScaffold) SetPathNormalization(opts PathNormOptions) {
+	s.pathNorm = &opts
+}
+
+/*
+OriginalPath returns the path of the request before "SetPathNormalization"
+changed it. If it was not changed, that is "URL.Path." "RequestURI" is
+never changed, so it still has the path exactly as the client sent it.
+*/
+func OriginalPath(req *http.Request) string {
+	if p, ok := req.Context().Value(originalPathKey{}).(string); ok {
+		return p
+	}
+	return req.URL.Path
+}
+
+/*
+normalize applies the options to a path. Paths that don't start with a
+slash, like "*," are returned as they are.
+*/
+func (o *PathNormOptions) normalize(p string) string {
+	if !strings.HasPrefix(p, "/") {
+		return p
+	}
+	if o.CollapseSlashes || o.CleanDotSegments {
+		segs := strings.Split(p, "/")
+		last := len(segs) - 1
+		out := make([]string, 1, len(segs))
+		for i := 1; i <= last; i++ {
+			seg := segs[i]
+			switch {
+			case seg == "" && o.CollapseSlashes && i < last:
+				// An empty segment at the end is the trailing slash
+			case (seg == "." || seg == "..") && o.CleanDotSegments:
+				if seg == ".." && len(out) > 1 {
+					out = out[:len(out)-1]
+				}
+				if i == last {
+					// "/a/." and "/a/b/.." both mean "/a/"
+					out = append(out, "")
+				}
+			default:
+				out = append(out, seg)
+			}
+		}
+		if len(out) == 1 {
+			out = append(out, "")
+		}
+		p = strings.Join(out, "/")
+	}
+	switch o.TrailingSlash {
+	case TrailingSlashStrip:
+		if t := strings.TrimRight(p, "/"); t != "" {
+			p = t
+		} else {
+			p = "/"
+		}
+	case TrailingSlashAdd:
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+	}
+	return p
+}
+
+/*
+normalizedRequest returns a copy of the request with its path normalized,
+or the same request if normalization did not change it.
+*/
+func (s *HTTPScaffold) normalizedRequest(req *http.Request) *http.Request {
+	if s.pathNorm == nil {
+		return req
+	}
+	escaped := req.URL.EscapedPath()
+	norm := s.pathNorm.normalize(escaped)
+	if norm == escaped {
+		return req
+	}
+	// Work on the escaped form so that "%2F" is not mistaken for a slash
+	p, err := url.PathUnescape(norm)
+	if err != nil {
+		return req
+	}
+	nr := req.WithContext(context.WithValue(req.Context(), originalPathKey{}, OriginalPath(req)))
+	u := *req.URL
+	u.Path = p
+	u.RawPath = ""
+	if u.EscapedPath() != norm {
+		u.RawPath = norm
+	}
+	nr.URL = &u
+	return nr
+}
+
+/*
+normalizePath normalizes the path of an application request. In redirect
+mode it responds itself and returns nil.
+*/
+func (s *HTTPScaffold) normalizePath(resp http.ResponseWriter, req *http.Request) *http.Request {
+	nr := s.normalizedRequest(req)
+	if nr == req || !s.pathNorm.Redirect {
+		return nr
+	}
+
+	target := nr.URL.EscapedPath()
+	if strings.HasPrefix(target, "//") {
+		// That would be a redirect to another host
+		target = "/" + strings.TrimLeft(target, "/")
+	}
+	if req.URL.RawQuery != "" {
+		target += "?" + req.URL.RawQuery
+	}
+	code := http.StatusMovedPermanently
+	if req.Method != "GET" && req.Method != "HEAD" {
+		code = http.StatusPermanentRedirect
+	}
+	s.discardBody(resp, req)
+	resp.Header().Set("Location", target)
+	resp.WriteHeader(code)
+	return nil
+}
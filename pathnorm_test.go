@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Path normalization tests", func() {
+	It("Normalize paths", func() {
+		all := &PathNormOptions{
+			CollapseSlashes:  true,
+			CleanDotSegments: true,
+			TrailingSlash:    TrailingSlashStrip,
+		}
+		Expect(all.normalize("//v1/users/")).Should(Equal("/v1/users"))
+		Expect(all.normalize("/v1///users//")).Should(Equal("/v1/users"))
+		Expect(all.normalize("/v1/./users/../groups")).Should(Equal("/v1/groups"))
+		Expect(all.normalize("/../../etc")).Should(Equal("/etc"))
+		Expect(all.normalize("/")).Should(Equal("/"))
+		Expect(all.normalize("//")).Should(Equal("/"))
+		Expect(all.normalize("*")).Should(Equal("*"))
+
+		collapse := &PathNormOptions{CollapseSlashes: true}
+		Expect(collapse.normalize("//v1//users/")).Should(Equal("/v1/users/"))
+		Expect(collapse.normalize("/v1/../users")).Should(Equal("/v1/../users"))
+
+		dots := &PathNormOptions{CleanDotSegments: true}
+		Expect(dots.normalize("/a//b/./c")).Should(Equal("/a//b/c"))
+		Expect(dots.normalize("/a/b/..")).Should(Equal("/a/"))
+		Expect(dots.normalize("/a/.")).Should(Equal("/a/"))
+		Expect(dots.normalize("/..")).Should(Equal("/"))
+
+		add := &PathNormOptions{TrailingSlash: TrailingSlashAdd}
+		Expect(add.normalize("/v1/users")).Should(Equal("/v1/users/"))
+		Expect(add.normalize("/")).Should(Equal("/"))
+	})
+
+	It("Rewrite mode", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetPathNormalization(PathNormOptions{
+			CollapseSlashes: true,
+			TrailingSlash:   TrailingSlashStrip,
+		})
+		var path, raw, original string
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			path = req.URL.Path
+			raw = req.URL.EscapedPath()
+			original = OriginalPath(req)
+		}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "//v1/users/?x=1", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(path).Should(Equal("/v1/users"))
+		Expect(original).Should(Equal("//v1/users/"))
+
+		// Escaped slashes are not collapsed
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/a%2F%2Fb//", nil))
+		Expect(path).Should(Equal("/v1/a//b"))
+		Expect(raw).Should(Equal("/v1/a%2F%2Fb"))
+
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/users", nil))
+		Expect(path).Should(Equal("/v1/users"))
+		Expect(original).Should(Equal("/v1/users"))
+
+		// Probes with a trailing slash
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health/", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Header().Get("Content-Type")).Should(Equal("text/plain"))
+	})
+
+	It("Redirect mode", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetPathNormalization(PathNormOptions{
+			CollapseSlashes: true,
+			TrailingSlash:   TrailingSlashStrip,
+			Redirect:        true,
+		})
+		called := false
+		h, mh := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			called = true
+		}))
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1//users/?x=1", nil))
+		Expect(rec.Code).Should(Equal(301))
+		Expect(rec.Header().Get("Location")).Should(Equal("/v1/users?x=1"))
+		Expect(called).Should(BeFalse())
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/v1/users/", strings.NewReader("x")))
+		Expect(rec.Code).Should(Equal(308))
+		Expect(rec.Header().Get("Location")).Should(Equal("/v1/users"))
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/v1/users", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(called).Should(BeTrue())
+
+		// Probes on the management port are rewritten, not redirected
+		rec = httptest.NewRecorder()
+		mh.ServeHTTP(rec, httptest.NewRequest("GET", "//health/", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Header().Get("Content-Type")).Should(Equal("text/plain"))
+	})
+
+	It("Redirect stays on this host", func() {
+		s := CreateHTTPScaffold()
+		s.SetPathNormalization(PathNormOptions{
+			TrailingSlash: TrailingSlashStrip,
+			Redirect:      true,
+		})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "//evil.example.com/", nil))
+		Expect(rec.Code).Should(Equal(301))
+		Expect(rec.Header().Get("Location")).Should(Equal("/evil.example.com"))
+	})
+})
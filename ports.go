@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// portRolePrefix starts the role of each port from "AddPort"
+const portRolePrefix = "port:"
+
+/*
+namedPort is an additional application port added using "AddPort."
+*/
+type namedPort struct {
+	name     string
+	port     int
+	listener net.Listener
+}
+
+func portRole(name string) string {
+	return portRolePrefix + name
+}
+
+/*
+AddPort adds another application port, such as one for a private API that
+must be on a different port than the public one. It must be called before
+"Open." Like the insecure port, a port of zero picks an ephemeral port.
+Each port needs its own handler, which is passed using "ListenRoutes" or
+"StartListenRoutes," and which is wrapped by the scaffold in the same way
+as the main handler, so it is tracked, marked down, and drained along with
+it. Request metrics for the port are tagged with "name," which must not be
+one of the names of the main ports, such as "InsecurePortName." The
+management paths are not served on these ports.
+*/
+func (s *HTTPScaffold) AddPort(name string, port int) error {
+	if name == "" {
+		return errors.New("port name must not be empty")
+	}
+	if name == InsecurePortName || name == SecurePortName || name == ManagementPortName {
+		return fmt.Errorf("port name %q is reserved", name)
+	}
+	if s.open {
+		return errors.New("ports must be added before Open")
+	}
+	if s.namedPort(name) != nil {
+		return fmt.Errorf("port %q was already added", name)
+	}
+	s.ports = append(s.ports, &namedPort{name: name, port: port})
+	return nil
+}
+
+/*
+Address returns the actual address where we are listening on the port
+that was added using "AddPort" with "name," or, if "name" is empty, the
+same as "InsecureAddress." It returns the empty string if there is no
+such port or if it is not yet open.
+*/
+func (s *HTTPScaffold) Address(name string) string {
+	if name == "" {
+		return s.InsecureAddress()
+	}
+	p := s.namedPort(name)
+	if p == nil || p.listener == nil {
+		return ""
+	}
+	return p.listener.Addr().String()
+}
+
+/*
+StartListenRoutes is like "StartListen," but takes a handler for each port
+that was added using "AddPort," by name. The handler for the empty name
+is used for the insecure and secure ports, and is required unless both of
+those are disabled. It is an error to leave out a port or to name one that
+was not added.
+*/
+func (s *HTTPScaffold) StartListenRoutes(routes map[string]http.Handler) error {
+	for name := range routes {
+		if name != "" && s.namedPort(name) == nil {
+			return fmt.Errorf("no port named %q", name)
+		}
+	}
+	return s.startListen(routes[""], nil, routes)
+}
+
+/*
+ListenRoutes is a convenience function that first calls
+"StartListenRoutes" and then calls "WaitForShutdown."
+*/
+func (s *HTTPScaffold) ListenRoutes(routes map[string]http.Handler) error {
+	err := s.StartListenRoutes(routes)
+	if err != nil {
+		return err
+	}
+
+	return s.WaitForShutdown()
+}
+
+func (s *HTTPScaffold) namedPort(name string) *namedPort {
+	for _, p := range s.ports {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+/*
+checkRoutes makes sure that there is a handler for every port.
+*/
+func (s *HTTPScaffold) checkRoutes(baseHandler http.Handler, routes map[string]http.Handler) error {
+	if baseHandler == nil && (s.insecurePort >= 0 || s.securePort >= 0) {
+		return errors.New("no handler for the main port")
+	}
+	for _, p := range s.ports {
+		if routes[p.name] == nil {
+			return fmt.Errorf("no handler for port %q", p.name)
+		}
+	}
+	return nil
+}
+
+/*
+openPorts opens the ports that were added using "AddPort." It returns the
+listeners that it opened so that "Open" can close them if it fails.
+*/
+func (s *HTTPScaffold) openPorts() ([]net.Listener, error) {
+	var opened []net.Listener
+	for _, p := range s.ports {
+		l, err := s.listenTCP(portRole(p.name), p.port)
+		if err != nil {
+			return opened, err
+		}
+		p.listener = l
+		opened = append(opened, l)
+	}
+	return opened, nil
+}
+
+/*
+servePorts starts serving the ports that were added using "AddPort."
+*/
+func (s *HTTPScaffold) servePorts(routes map[string]http.Handler) {
+	for _, p := range s.ports {
+		h := &requestHandler{
+			s:     s,
+			child: routes[p.name],
+			port:  p.name,
+		}
+		s.serve(portRole(p.name), p.listener, h, s.appConns)
+	}
+}
+
+/*
+closePorts closes the listeners for the ports that were added using
+"AddPort."
+*/
+func (s *HTTPScaffold) closePorts() {
+	for _, p := range s.ports {
+		if p.listener != nil {
+			p.listener.Close()
+		}
+	}
+}
+
+func isPortRole(role string) bool {
+	return strings.HasPrefix(role, portRolePrefix) && len(role) > len(portRolePrefix)
+}
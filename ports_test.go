@@ -0,0 +1,127 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Named port tests", func() {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if d := req.URL.Query().Get("delay"); d != "" {
+				delay, _ := time.ParseDuration(d)
+				time.Sleep(delay)
+			}
+			resp.Write([]byte(name))
+		})
+	}
+
+	It("Routes to each port", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		Expect(s.AddPort("private", 0)).Should(Succeed())
+		Expect(s.AddPort("private", 0)).ShouldNot(Succeed())
+		Expect(s.AddPort("", 0)).ShouldNot(Succeed())
+		Expect(s.Address("private")).Should(BeEmpty())
+		Expect(s.Open()).Should(Succeed())
+		Expect(s.AddPort("late", 0)).ShouldNot(Succeed())
+		Expect(s.Address("private")).ShouldNot(BeEmpty())
+		Expect(s.Address("private")).ShouldNot(Equal(s.Address("")))
+		Expect(s.Address("")).Should(Equal(s.InsecureAddress()))
+		Expect(s.Address("nope")).Should(BeEmpty())
+
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.ListenRoutes(map[string]http.Handler{
+				"":        named("public"),
+				"private": named("private"),
+			})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		code, body := getText(fmt.Sprintf("http://%s", s.Address("")))
+		Expect(code).Should(Equal(200))
+		Expect(body).Should(Equal("public"))
+		code, body = getText(fmt.Sprintf("http://%s", s.Address("private")))
+		Expect(code).Should(Equal(200))
+		Expect(body).Should(Equal("private"))
+
+		// Management paths are only on the main port
+		code, _ = getText(fmt.Sprintf("http://%s/health", s.Address("")))
+		Expect(code).Should(Equal(200))
+		code, body = getText(fmt.Sprintf("http://%s/health", s.Address("private")))
+		Expect(body).Should(Equal("private"))
+
+		ports := make(map[string]int64)
+		for _, m := range s.RequestMetrics() {
+			ports[m.Port] += m.Count
+		}
+		Expect(ports).Should(HaveKeyWithValue("private", BeEquivalentTo(2)))
+		Expect(ports).Should(HaveKey(""))
+
+		// Shutdown waits for requests on every port
+		done := make(chan int)
+		go func() {
+			code, _ := getText(fmt.Sprintf("http://%s?delay=500ms", s.Address("private")))
+			done <- code
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		stopErr := errors.New("Stop")
+		s.Shutdown(stopErr)
+		code, _ = getText(fmt.Sprintf("http://%s", s.Address("private")))
+		Expect(code).Should(Equal(503))
+		Consistently(stopChan, 250*time.Millisecond).ShouldNot(Receive())
+		Eventually(done).Should(Receive(Equal(200)))
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+	})
+
+	It("Routes must match ports", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.AddPort("private", 0)).Should(Succeed())
+		Expect(s.StartListen(named("public"))).Should(MatchError(`no handler for port "private"`))
+		Expect(s.StartListenRoutes(map[string]http.Handler{
+			"":        named("public"),
+			"private": named("private"),
+			"other":   named("other"),
+		})).Should(MatchError(`no port named "other"`))
+		Expect(s.StartListenRoutes(map[string]http.Handler{
+			"private": named("private"),
+		})).Should(MatchError("no handler for the main port"))
+
+		s = CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		Expect(s.AddPort("private", 0)).Should(Succeed())
+		Expect(s.StartListenRoutes(map[string]http.Handler{
+			"private": named("private"),
+		})).Should(Succeed())
+		Expect(s.Address("")).Should(BeEmpty())
+		code, body := getText(fmt.Sprintf("http://%s", s.Address("private")))
+		Expect(code).Should(Equal(200))
+		Expect(body).Should(Equal("private"))
+		s.Shutdown(nil)
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+	})
+})
@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+MatchALBProbe matches the health checks from AWS load balancers, which
+send a "User-Agent" of "ELB-HealthChecker/2.0."
+*/
+func MatchALBProbe(r *http.Request) bool {
+	return strings.HasPrefix(r.UserAgent(), "ELB-HealthChecker/")
+}
+
+/*
+MatchGoogleProbe matches the health checks from Google Cloud load
+balancers, which send a "User-Agent" of "GoogleHC/1.0."
+*/
+func MatchGoogleProbe(r *http.Request) bool {
+	return strings.HasPrefix(r.UserAgent(), "GoogleHC/")
+}
+
+/*
+MatchLoadBalancerProbe matches the health checks from both AWS and Google
+Cloud load balancers.
+*/
+func MatchLoadBalancerProbe(r *http.Request) bool {
+	return MatchALBProbe(r) || MatchGoogleProbe(r)
+}
+
+/*
+SetProbeFastPath answers GET and HEAD requests for the health and ready
+paths, and their aliases, that "match" returns true for straight away
+with the last result of the health checkers, as "HealthStatus" or
+"ReadyStatus" returns it. They get a 503 when the health or ready path
+would. Other requests are never affected, whatever "match" says, so a
+client can't use it to get around the rest of the scaffold or the
+application handler.
+
+The checkers are never called while such a request waits, even if the
+cached result has expired, and it never waits for a probe that is already
+calling them. Instead, the checkers are then called in the background, so
+that the next request sees a newer result. Until the checkers have run
+once, the status is "NotReady" with "ErrHealthUnknown." This suits load
+balancers that give up on slow health checks. The responses are never
+verbose and are not cached by the client. Addresses that
+"SetManagementAllowedCIDRs" does not allow get a 403. The requests are not
+access logged unless "SetProbeFastPathLogging" says so. Passing nil
+turns the fast path off, which is the default.
+*/
+func (s *HTTPScaffold) SetProbeFastPath(match func(r *http.Request) bool) {
+	s.probeMatch = match
+}
+
+/*
+SetProbeFastPathLogging sets whether the requests answered by
+"SetProbeFastPath" are passed to the access logger.
+*/
+func (s *HTTPScaffold) SetProbeFastPathLogging(log bool) {
+	s.probeLogging = log
+}
+
+/*
+fastProbe answers the request if it matches the fast path, and returns
+true if it did.
+*/
+func (s *HTTPScaffold) fastProbe(resp http.ResponseWriter, req *http.Request) bool {
+	if s.probeMatch == nil || !methodAllowed(req, managementMethods) {
+		return false
+	}
+	nr := s.normalizedRequest(req)
+	if !containsPath(s.healthPaths(), nr.URL.Path) &&
+		!containsPath(s.readyPaths(), nr.URL.Path) {
+		return false
+	}
+	if !s.probeMatch(req) {
+		return false
+	}
+	req = s.resolveClient(nr)
+	if !s.probeLogging || s.accessLogger == nil {
+		s.serveFastProbe(resp, req)
+		return true
+	}
+	start := s.clock.Now()
+	rw := newRecordingWriter(resp)
+	s.serveFastProbe(rw, req)
+	s.logAccess(req, rw, start, RejectionNone, 0)
+	return true
+}
+
+func (s *HTTPScaffold) serveFastProbe(resp http.ResponseWriter, req *http.Request) {
+	s.addInstanceHeaders(resp)
+	resp.Header().Set("Cache-Control", "no-store")
+	if !s.managementAllowedFrom(req) {
+		resp.WriteHeader(http.StatusForbidden)
+		return
+	}
+	s.refreshHealthInBackground()
+
+	status, reason := s.HealthStatus()
+	code := http.StatusOK
+	var doc *healthDocument
+	if containsPath(s.healthPaths(), req.URL.Path) {
+		if status == Failed {
+			code = http.StatusServiceUnavailable
+		}
+		doc = s.newHealthResponse(status, reason)
+	} else {
+		var override bool
+		status, reason, override = s.readiness(status, reason)
+		if !status.ready() {
+			code = http.StatusServiceUnavailable
+		}
+		doc = s.newHealthResponse(status, reason)
+		doc.Override = override
+	}
+	writeHealth(resp, req, code, doc)
+}
+
+/*
+refreshHealthInBackground calls the health checkers in another goroutine
+if the cached result is missing or has expired, unless that is already
+happening.
+*/
+func (s *HTTPScaffold) refreshHealthInBackground() {
+	if s.healthCheck == nil && len(s.healthChecks) == 0 ||
+		atomic.LoadInt32(&s.notListening) != 0 {
+		return
+	}
+	s.healthLock.Lock()
+	fresh := s.lastHealth != nil && s.healthCacheInterval > 0 &&
+		s.since(s.lastHealth.at) < s.healthCacheInterval
+	busy := s.healthWait != nil
+	s.healthLock.Unlock()
+	if fresh || busy || !atomic.CompareAndSwapInt32(&s.probeRefreshing, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.probeRefreshing, 0)
+		s.currentHealth()
+	}()
+}
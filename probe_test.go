@@ -0,0 +1,229 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+slowChecker returns a checker that counts its calls and does not return
+until "release" is closed.
+*/
+func slowChecker(release <-chan struct{}, calls *int32) HealthChecker {
+	return func() (HealthStatus, error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		return OK, nil
+	}
+}
+
+func probeRequest(path, agent string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	if agent != "" {
+		req.Header.Set("User-Agent", agent)
+	}
+	return req
+}
+
+var _ = Describe("Probe fast path tests", func() {
+	It("Matches load balancer user agents", func() {
+		alb := probeRequest("/", "ELB-HealthChecker/2.0")
+		google := probeRequest("/", "GoogleHC/1.0")
+		curl := probeRequest("/", "curl/7.68.0")
+		Expect(MatchALBProbe(alb)).Should(BeTrue())
+		Expect(MatchALBProbe(google)).Should(BeFalse())
+		Expect(MatchGoogleProbe(google)).Should(BeTrue())
+		Expect(MatchGoogleProbe(alb)).Should(BeFalse())
+		Expect(MatchLoadBalancerProbe(alb)).Should(BeTrue())
+		Expect(MatchLoadBalancerProbe(google)).Should(BeTrue())
+		Expect(MatchLoadBalancerProbe(curl)).Should(BeFalse())
+		Expect(MatchLoadBalancerProbe(probeRequest("/", ""))).Should(BeFalse())
+	})
+
+	It("Answers without waiting for a slow checker", func() {
+		release := make(chan struct{})
+		var calls int32
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetHealthCacheInterval(time.Minute)
+		s.AddHealthCheck("slow", slowChecker(release, &calls))
+		s.SetProbeFastPath(MatchLoadBalancerProbe)
+		h, _ := s.Handlers(&testHandler{})
+
+		// A normal probe calls the checker and waits for it
+		normal := httptest.NewRecorder()
+		normalDone := make(chan struct{})
+		go func() {
+			h.ServeHTTP(normal, probeRequest("/ready", ""))
+			close(normalDone)
+		}()
+		Eventually(func() int32 { return atomic.LoadInt32(&calls) }).Should(BeEquivalentTo(1))
+
+		// The fast path neither calls it nor waits for the normal probe
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rec, probeRequest("/ready", "ELB-HealthChecker/2.0"))
+		elapsed := time.Since(start)
+		Expect(elapsed).Should(BeNumerically("<", 20*time.Millisecond))
+		Expect(rec.Code).Should(Equal(503))
+		Expect(rec.Body.String()).Should(Equal(ErrHealthUnknown.Error()))
+		Expect(rec.Header().Get("Cache-Control")).Should(Equal("no-store"))
+		Consistently(normalDone, 100*time.Millisecond).ShouldNot(BeClosed())
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(1))
+
+		close(release)
+		Eventually(normalDone).Should(BeClosed())
+		Expect(normal.Code).Should(Equal(200))
+
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, probeRequest("/ready", "GoogleHC/1.0"))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Body.String()).Should(BeEmpty())
+		Expect(atomic.LoadInt32(&calls)).Should(BeEquivalentTo(1))
+	})
+
+	It("Refreshes the cache in the background", func() {
+		var status int32
+		var calls int32
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.AddHealthCheck("flip", func() (HealthStatus, error) {
+			atomic.AddInt32(&calls, 1)
+			return HealthStatus(atomic.LoadInt32(&status)), nil
+		})
+		s.SetProbeFastPath(MatchLoadBalancerProbe)
+		h, _ := s.Handlers(&testHandler{})
+
+		probe := func(path string) int {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, probeRequest(path, "ELB-HealthChecker/2.0"))
+			return rec.Code
+		}
+
+		Expect(probe("/ready")).Should(Equal(503))
+		Eventually(func() int { return probe("/ready") }).Should(Equal(200))
+		Expect(atomic.LoadInt32(&calls)).Should(BeNumerically(">=", 1))
+
+		atomic.StoreInt32(&status, int32(Failed))
+		Eventually(func() int { return probe("/health") }).Should(Equal(503))
+		st, _ := s.HealthStatus()
+		Expect(st).Should(Equal(Failed))
+		Expect(probe("/ready")).Should(Equal(503))
+	})
+
+	It("Reports markdown and checks management addresses", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetProbeFastPath(MatchALBProbe)
+		Expect(s.SetManagementAllowedCIDRs([]string{"10.0.0.0/8"})).Should(Succeed())
+		h, _ := s.Handlers(&testHandler{})
+
+		probe := func(path, addr string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			req := probeRequest(path, "ELB-HealthChecker/2.0")
+			req.RemoteAddr = addr
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Expect(probe("/ready", "10.1.2.3:1234").Code).Should(Equal(200))
+		Expect(probe("/ready", "192.168.1.1:1234").Code).Should(Equal(403))
+
+		s.markDown()
+		rec := probe("/ready", "10.1.2.3:1234")
+		Expect(rec.Code).Should(Equal(503))
+		Expect(rec.Body.String()).Should(Equal(ErrMarkedDown.Error()))
+		Expect(probe("/health", "10.1.2.3:1234").Code).Should(Equal(200))
+	})
+
+	It("Leaves fast probes out of the access log", func() {
+		s := CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		var records []AccessRecord
+		s.SetAccessLogger(func(r AccessRecord) {
+			records = append(records, r)
+		})
+		s.SetProbeFastPath(MatchLoadBalancerProbe)
+		h, _ := s.Handlers(&testHandler{})
+
+		h.ServeHTTP(httptest.NewRecorder(), probeRequest("/ready", "GoogleHC/1.0"))
+		h.ServeHTTP(httptest.NewRecorder(), probeRequest("/", "curl/7.68.0"))
+		Expect(records).Should(HaveLen(1))
+		Expect(records[0].Path).Should(Equal("/"))
+
+		s.SetProbeFastPathLogging(true)
+		h.ServeHTTP(httptest.NewRecorder(), probeRequest("/ready", "GoogleHC/1.0"))
+		Expect(records).Should(HaveLen(2))
+		Expect(records[1].Path).Should(Equal("/ready"))
+		Expect(records[1].Status).Should(Equal(200))
+	})
+
+	It("Leaves other paths to the handler", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.EnableBearerAuth("/private")
+		s.SetProbeFastPath(MatchLoadBalancerProbe)
+		var paths []string
+		app := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			paths = append(paths, req.URL.Path)
+			resp.Write([]byte("app"))
+		})
+		h, _ := s.Handlers(app)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, probeRequest("/api/ping", "ELB-HealthChecker/2.0"))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Body.String()).Should(Equal("app"))
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, probeRequest("/private", "GoogleHC/1.0"))
+		Expect(rec.Code).Should(Equal(401))
+		Expect(paths).Should(Equal([]string{"/api/ping"}))
+
+		// Other methods get the usual 405
+		rec = httptest.NewRecorder()
+		req := probeRequest("/ready", "GoogleHC/1.0")
+		req.Method = "POST"
+		h.ServeHTTP(rec, req)
+		Expect(rec.Code).Should(Equal(405))
+
+		// The application port does not serve the probes when management
+		// has its own port
+		s = CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		s.SetManagementPort(0)
+		s.SetProbeFastPath(MatchLoadBalancerProbe)
+		paths = nil
+		h, mh := s.Handlers(app)
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, probeRequest("/ready", "GoogleHC/1.0"))
+		Expect(rec.Body.String()).Should(Equal("app"))
+		Expect(paths).Should(Equal([]string{"/ready"}))
+		rec = httptest.NewRecorder()
+		mh.ServeHTTP(rec, probeRequest("/ready", "GoogleHC/1.0"))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(rec.Header().Get("Cache-Control")).Should(Equal("no-store"))
+	})
+})
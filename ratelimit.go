@@ -0,0 +1,163 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+RateLimitFunc decides whether a request may proceed. If it may not, it
+also returns how long the client should wait before trying again.
+*/
+type RateLimitFunc func(req *http.Request) (allowed bool, retryAfter time.Duration)
+
+/*
+SetRateLimiter sets a function that is called for every application
+request before it reaches the handler. Requests that it does not allow
+get a 429 with a "Retry-After" header, and are counted in the
+"rateLimited" metric. The health, ready, markdown, and other management
+paths are never rate limited. The client address has already been
+resolved when the function is called, so it may use "ClientIP."
+*/
+func (s *HTTPScaffold) SetRateLimiter(f RateLimitFunc) {
+	s.rateLimiter = f
+}
+
+/*
+checkRateLimit returns true if the request may proceed, and otherwise
+responds with a 429.
+*/
+func (s *HTTPScaffold) checkRateLimit(resp http.ResponseWriter, req *http.Request) bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	allowed, retryAfter := s.rateLimiter(req)
+	if allowed {
+		return true
+	}
+	s.discardBody(resp, req)
+	s.markRejected(resp)
+	setRetryAfter(resp, retryAfter)
+	resp.WriteHeader(http.StatusTooManyRequests)
+	return false
+}
+
+/*
+setRetryAfter sets the "Retry-After" header, rounded up to a whole number
+of seconds, unless "d" is zero.
+*/
+func setRetryAfter(resp http.ResponseWriter, d time.Duration) {
+	if d > 0 {
+		secs := int64(math.Ceil(d.Seconds()))
+		resp.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	}
+}
+
+/*
+NewIPRateLimiter returns a rate limiter for "SetRateLimiter" that keeps
+a token bucket for each client address, as returned by "ClientIP." Each
+client may make "rps" requests per second on average, with bursts of up
+to "burst" requests. Clients that have been idle long enough for their
+bucket to fill up again are forgotten, so memory use depends on the
+number of recent clients, and not on every client ever seen.
+*/
+func NewIPRateLimiter(rps float64, burst int) RateLimitFunc {
+	return newIPRateLimiter(rps, burst, time.Now).allow
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type ipRateLimiter struct {
+	rps       float64
+	burst     float64
+	now       func() time.Time
+	idle      time.Duration
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newIPRateLimiter(rps float64, burst int, now func() time.Time) *ipRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	idle := time.Duration(float64(burst) / rps * float64(time.Second))
+	if idle < time.Second {
+		idle = time.Second
+	}
+	return &ipRateLimiter{
+		rps:       rps,
+		burst:     float64(burst),
+		now:       now,
+		idle:      idle,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: now(),
+	}
+}
+
+func (l *ipRateLimiter) allow(req *http.Request) (bool, time.Duration) {
+	client := ClientIP(req)
+	now := l.now()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if now.Sub(l.lastSweep) >= l.idle {
+		l.sweep(now)
+	}
+
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst}
+		l.buckets[client] = b
+	} else {
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rps)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := (1 - b.tokens) / l.rps
+	return false, time.Duration(wait * float64(time.Second))
+}
+
+/*
+sweep forgets every client whose bucket would be full by now, since a new
+bucket would behave exactly the same.
+*/
+func (l *ipRateLimiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= l.idle {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+func (l *ipRateLimiter) size() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.buckets)
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rate limit tests", func() {
+	var now time.Time
+	clock := func() time.Time {
+		return now
+	}
+
+	BeforeEach(func() {
+		now = time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	})
+
+	fromClient := func(peer string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = peer + ":1234"
+		return req
+	}
+
+	It("Token bucket", func() {
+		l := newIPRateLimiter(2, 3, clock)
+		for i := 0; i < 3; i++ {
+			ok, _ := l.allow(fromClient("1.2.3.4"))
+			Expect(ok).Should(BeTrue())
+		}
+		ok, retry := l.allow(fromClient("1.2.3.4"))
+		Expect(ok).Should(BeFalse())
+		Expect(retry).Should(Equal(500 * time.Millisecond))
+
+		// Other clients have their own bucket
+		ok, _ = l.allow(fromClient("5.6.7.8"))
+		Expect(ok).Should(BeTrue())
+
+		now = now.Add(500 * time.Millisecond)
+		ok, _ = l.allow(fromClient("1.2.3.4"))
+		Expect(ok).Should(BeTrue())
+		ok, _ = l.allow(fromClient("1.2.3.4"))
+		Expect(ok).Should(BeFalse())
+
+		// Never more than the burst
+		now = now.Add(time.Hour)
+		for i := 0; i < 3; i++ {
+			ok, _ = l.allow(fromClient("1.2.3.4"))
+			Expect(ok).Should(BeTrue())
+		}
+		ok, _ = l.allow(fromClient("1.2.3.4"))
+		Expect(ok).Should(BeFalse())
+	})
+
+	It("Idle clients evicted", func() {
+		l := newIPRateLimiter(1, 5, clock)
+		l.allow(fromClient("1.1.1.1"))
+		l.allow(fromClient("2.2.2.2"))
+		Expect(l.size()).Should(Equal(2))
+
+		now = now.Add(3 * time.Second)
+		l.allow(fromClient("3.3.3.3"))
+		Expect(l.size()).Should(Equal(3))
+
+		// The first two have been idle long enough to refill
+		now = now.Add(3 * time.Second)
+		l.allow(fromClient("3.3.3.3"))
+		Expect(l.size()).Should(Equal(1))
+	})
+
+	It("Scaffold rate limit", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetMetricsPath("/metrics")
+		Expect(s.SetTrustedProxies([]string{"10.0.0.0/8"})).Should(Succeed())
+		s.SetRateLimiter(newIPRateLimiter(0.5, 1, clock).allow)
+		h, _ := s.Handlers(&testHandler{})
+
+		try := func(path, xff string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-Forwarded-For", xff)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+
+		Expect(try("/", "1.2.3.4").Code).Should(Equal(http.StatusOK))
+		rec := try("/", "1.2.3.4")
+		Expect(rec.Code).Should(Equal(http.StatusTooManyRequests))
+		Expect(rec.Header().Get("Retry-After")).Should(Equal("2"))
+		// Keyed on the resolved client, not the proxy
+		Expect(try("/", "5.6.7.8").Code).Should(Equal(http.StatusOK))
+		Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+		for i := 0; i < 3; i++ {
+			Expect(try("/health", "1.2.3.4").Code).Should(Equal(http.StatusOK))
+			Expect(try("/ready", "1.2.3.4").Code).Should(Equal(http.StatusOK))
+		}
+
+		rec = try("/metrics", "1.2.3.4")
+		Expect(rec.Code).Should(Equal(http.StatusOK))
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &doc)).Should(Succeed())
+		Expect(doc["rateLimited"]).Should(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,112 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+/*
+InsecureBehavior says what the insecure port does with application requests.
+*/
+type InsecureBehavior int
+
+const (
+	// ServeApplication means that the insecure port serves the application,
+	// just like the secure port. This is the default.
+	ServeApplication InsecureBehavior = iota
+	// RedirectToSecure means that the insecure port redirects to the
+	// secure port.
+	RedirectToSecure
+)
+
+/*
+SetInsecureBehavior sets what the insecure port does with application
+requests. With "RedirectToSecure," every request gets a permanent redirect
+to the same path and query on the secure port, except for the health,
+ready, and other management paths when they are served on the insecure
+port, so that probes get an answer right away. It is an error to redirect
+if "SetSecurePort" was not called.
+*/
+func (s *HTTPScaffold) SetInsecureBehavior(b InsecureBehavior) {
+	s.insecureBehavior = b
+}
+
+/*
+SetRedirectHost sets the host, including a port if one is needed, to use in
+redirects to the secure port. By default, the redirect uses the host name
+from the request and the port that the secure port is listening on, which
+is wrong if there is a proxy or a port mapping in the way.
+*/
+func (s *HTTPScaffold) SetRedirectHost(host string) {
+	s.redirectHost = host
+}
+
+/*
+redirectHandler wraps the handler for the insecure port. If the management
+paths are served on the same port, then they are passed through.
+*/
+func (s *HTTPScaffold) redirectHandler(next http.Handler) http.Handler {
+	var mgmt *managementHandler
+	if mh, ok := next.(*managementHandler); ok && mh.child != nil {
+		mgmt = mh
+	}
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if mgmt != nil {
+			if _, pattern := mgmt.mux.Handler(req); pattern != "" {
+				next.ServeHTTP(resp, req)
+				return
+			}
+		}
+
+		u := url.URL{
+			Scheme:   "https",
+			Host:     s.secureHost(req),
+			Path:     req.URL.Path,
+			RawPath:  req.URL.RawPath,
+			RawQuery: req.URL.RawQuery,
+		}
+		code := http.StatusMovedPermanently
+		if req.Method != "GET" && req.Method != "HEAD" {
+			// Unlike 301, this tells the client to keep the method and body
+			code = http.StatusPermanentRedirect
+		}
+		s.discardBody(resp, req)
+		http.Redirect(resp, req, u.String(), code)
+	})
+}
+
+func (s *HTTPScaffold) secureHost(req *http.Request) string {
+	if s.redirectHost != "" {
+		return s.redirectHost
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	port := ""
+	if su := s.SecureURL(); su != nil {
+		port = su.Port()
+	}
+	if port == "" || port == "443" {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Redirect tests", func() {
+	noFollow := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	It("Redirect to secure", func() {
+		s := CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetInsecureBehavior(RedirectToSecure)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		insecure := "http://127.0.0.1:" + s.InsecureURL().Port()
+		resp, err := noFollow.Get(insecure + "/foo/bar?baz=1&x=y")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(301))
+		Expect(resp.Header.Get("Location")).Should(Equal(
+			"https://127.0.0.1:" + s.SecureURL().Port() + "/foo/bar?baz=1&x=y"))
+
+		resp, err = noFollow.Post(s.InsecureURL().String()+"/foo", "text/plain", strings.NewReader("hi"))
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(308))
+
+		// Probes are answered on the insecure port
+		code, _ := getText(s.InsecureURL().String() + "/health")
+		Expect(code).Should(Equal(200))
+		code, _ = getText(s.InsecureURL().String() + "/ready")
+		Expect(code).Should(Equal(200))
+
+		// Following the redirect gets to the application
+		resp, err = insecureClient.Get(s.InsecureURL().String() + "/foo")
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.TLS).ShouldNot(BeNil())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Redirect host", func() {
+		s := CreateHTTPScaffold()
+		s.SetRedirectHost("api.example.com")
+		h := s.redirectHandler(http.NotFoundHandler())
+		resp := httptest.NewRecorder()
+		h.ServeHTTP(resp, httptest.NewRequest("GET", "http://localhost:8080/a%2Fb?q=1", nil))
+		Expect(resp.Code).Should(Equal(301))
+		Expect(resp.Header().Get("Location")).Should(Equal("https://api.example.com/a%2Fb?q=1"))
+	})
+
+	It("Redirect requires secure port", func() {
+		s := CreateHTTPScaffold()
+		s.SetInsecureBehavior(RedirectToSecure)
+		Expect(s.Open()).Should(MatchError(ContainSubstring("secure port")))
+	})
+})
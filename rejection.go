@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+/*
+RejectionReason says why the scaffold rejected a request itself, without
+passing it to the application handler.
+*/
+type RejectionReason int
+
+//go:generate stringer -type RejectionReason -trimprefix Rejection .
+
+/*
+Values of RejectionReason. "RejectionNone" means that the request reached
+the application handler.
+*/
+const (
+	RejectionNone RejectionReason = iota
+	// The server was marked down or shutting down
+	RejectionMarkdown
+	// Bearer token authentication failed
+	RejectionUnauthorized
+	// The function set by "SetRateLimiter" did not allow the request
+	RejectionRateLimited
+	// The body was larger than the limit set by "SetMaxRequestBody"
+	RejectionBodyTooLarge
+	// The method was not one of those set by "SetAllowedMethods"
+	RejectionMethodNotAllowed
+	// Too many requests were running, as set by "SetMaxInflightRequests"
+	RejectionShed
+	// The function set by "SetRequestValidator" returned an error
+	RejectionInvalid
+	numRejectionReasons
+)
+
+/*
+DefaultRejectedHeader is the header that marks responses to requests that
+the scaffold rejected itself.
+*/
+const DefaultRejectedHeader = "X-Scaffold-Rejected"
+
+/*
+RejectedPreHandler is the value of the header set by "SetRejectedHeader."
+*/
+const RejectedPreHandler = "pre-handler"
+
+/*
+SetRejectedHeader sets the header that the scaffold adds, with the value
+"pre-handler," to every response for a request that it rejected itself,
+for any of the reasons in "RejectionReason," such as markdown, load
+shedding, rate limits, or authentication. The application handler is
+never called for those requests, so a client or gateway that sees the
+header knows that the request had no effect and is always safe to retry,
+even if it is not idempotent. The header is "DefaultRejectedHeader"
+unless this is called, and the empty string turns it off. Requests that
+the handler rejects itself, such as with a 503 of its own, never have it.
+"RejectionCounts" counts the responses that had it.
+*/
+func (s *HTTPScaffold) SetRejectedHeader(name string) {
+	s.rejectedHeader = name
+}
+
+/*
+markRejected adds the header from "SetRejectedHeader." It must be called
+before the rejection is written.
+*/
+func (s *HTTPScaffold) markRejected(resp http.ResponseWriter) {
+	if s.rejectedHeader != "" {
+		resp.Header().Set(s.rejectedHeader, RejectedPreHandler)
+	}
+}
+
+/*
+SetMaxRequestBody rejects application requests with a 413 if they declare
+a "Content-Length" larger than "n" bytes. Bodies that are sent without a
+length are cut off once they reach the limit, so reading them fails. If
+"n" is zero, which is the default, there is no limit.
+*/
+func (s *HTTPScaffold) SetMaxRequestBody(n int64) {
+	s.maxRequestBody = n
+}
+
+/*
+checkBodySize returns true if the request may proceed, and otherwise
+responds with a 413.
+*/
+func (s *HTTPScaffold) checkBodySize(resp http.ResponseWriter, req *http.Request) bool {
+	if s.maxRequestBody <= 0 || req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.ContentLength > s.maxRequestBody {
+		// We are not going to read it, so don't leave it on the connection.
+		// A client that sent "Expect: 100-continue" never sends it at all.
+		resp.Header().Set("Connection", "close")
+		s.markRejected(resp)
+		WriteErrorResponse(http.StatusRequestEntityTooLarge, "Request body too large", resp)
+		return false
+	}
+	req.Body = http.MaxBytesReader(resp, req.Body, s.maxRequestBody)
+	return true
+}
+
+/*
+countRejection adds one to the metric for "reason."
+*/
+func (s *HTTPScaffold) countRejection(reason RejectionReason) {
+	if reason != RejectionNone {
+		atomic.AddInt64(&s.rejections[reason], 1)
+	}
+}
+
+/*
+RejectionCounts returns the number of requests that the scaffold rejected
+itself for each reason since it was created, keyed by the name of the
+reason, such as "Markdown." They are the same as "rejected" in the
+metrics.
+*/
+func (s *HTTPScaffold) RejectionCounts() map[string]int64 {
+	counts := make(map[string]int64, numRejectionReasons-1)
+	for r := RejectionNone + 1; r < numRejectionReasons; r++ {
+		counts[r.String()] = atomic.LoadInt64(&s.rejections[r])
+	}
+	return counts
+}
@@ -0,0 +1,389 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rejection tests", func() {
+	It("Rejected requests are logged", func() {
+		s := CreateHTTPScaffold()
+		s.SetAllowedMethods([]string{"GET", "POST"})
+		s.SetRateLimiter(func(req *http.Request) (bool, time.Duration) {
+			return req.Header.Get("X-Limit") == "", time.Second
+		})
+		s.SetMaxRequestBody(10)
+		s.SetTokenValidator(func(ctx context.Context, token string) (TokenClaims, error) {
+			return nil, errors.New("bad token")
+		})
+		s.EnableBearerAuth("/secure")
+		s.SetMaxInflightRequests(1, time.Second)
+
+		recLock := &sync.Mutex{}
+		var records []AccessRecord
+		s.SetAccessLogger(func(r AccessRecord) {
+			recLock.Lock()
+			records = append(records, r)
+			recLock.Unlock()
+		})
+		lastRecord := func() AccessRecord {
+			recLock.Lock()
+			defer recLock.Unlock()
+			Expect(records).ShouldNot(BeEmpty())
+			return records[len(records)-1]
+		}
+
+		block := make(chan struct{})
+		var bodyErr error
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/block" {
+				<-block
+			}
+			_, bodyErr = ioutil.ReadAll(req.Body)
+		}))
+
+		do := func(req *http.Request) int {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		Expect(do(httptest.NewRequest("GET", "/", nil))).Should(Equal(200))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionNone))
+
+		Expect(do(httptest.NewRequest("DELETE", "/", nil))).Should(Equal(405))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionMethodNotAllowed))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Limit", "true")
+		Expect(do(req)).Should(Equal(429))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionRateLimited))
+
+		Expect(do(httptest.NewRequest("POST", "/", strings.NewReader("This is too long")))).Should(Equal(413))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionBodyTooLarge))
+		Expect(lastRecord().Status).Should(Equal(413))
+
+		// Without a length the body is cut off instead
+		req = httptest.NewRequest("POST", "/", ioutil.NopCloser(strings.NewReader("This is too long")))
+		req.ContentLength = -1
+		Expect(do(req)).Should(Equal(200))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionNone))
+		Expect(bodyErr).ShouldNot(Succeed())
+
+		Expect(do(httptest.NewRequest("GET", "/secure", nil))).Should(Equal(401))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionUnauthorized))
+
+		blocked := make(chan int)
+		go func() {
+			blocked <- do(httptest.NewRequest("GET", "/block", nil))
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		Expect(do(httptest.NewRequest("GET", "/", nil))).Should(Equal(503))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionShed))
+		close(block)
+		Eventually(blocked).Should(Receive(Equal(200)))
+		Expect(lastRecord().Path).Should(Equal("/block"))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionNone))
+
+		s.markDown()
+		Expect(do(httptest.NewRequest("GET", "/", nil))).Should(Equal(503))
+		Expect(lastRecord().Rejection).Should(Equal(RejectionMarkdown))
+
+		m := s.metrics()
+		Expect(m.Rejected).Should(Equal(map[string]int64{
+			"Markdown":         1,
+			"Unauthorized":     1,
+			"RateLimited":      1,
+			"BodyTooLarge":     1,
+			"MethodNotAllowed": 1,
+			"Shed":             1,
+			"Invalid":          0,
+		}))
+		Expect(m.RateLimited).Should(BeEquivalentTo(1))
+		Expect(m.Shed).Should(BeEquivalentTo(1))
+		recLock.Lock()
+		Expect(records).Should(HaveLen(9))
+		recLock.Unlock()
+	})
+
+	It("Rejections are marked as pre-handler", func() {
+		s := CreateHTTPScaffold()
+		s.SetAllowedMethods([]string{"GET", "POST"})
+		s.SetRateLimiter(func(req *http.Request) (bool, time.Duration) {
+			return req.Header.Get("X-Limit") == "", time.Second
+		})
+		s.SetMaxRequestBody(10)
+		s.SetRequestValidator(func(req *http.Request) error {
+			if req.Header.Get("X-Invalid") != "" {
+				return errors.New("invalid")
+			}
+			return nil
+		})
+		s.EnableBearerAuth("/secure")
+		s.SetHealthPath("/health")
+		calls := 0
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			calls++
+			if req.URL.Path == "/busy" {
+				// The handler's own 503 is not marked
+				resp.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+
+		do := func(req *http.Request) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec
+		}
+		marked := func(rec *httptest.ResponseRecorder) string {
+			return rec.Header().Get(DefaultRejectedHeader)
+		}
+
+		rec := do(httptest.NewRequest("GET", "/", nil))
+		Expect(rec.Code).Should(Equal(200))
+		Expect(marked(rec)).Should(BeEmpty())
+		rec = do(httptest.NewRequest("GET", "/busy", nil))
+		Expect(rec.Code).Should(Equal(503))
+		Expect(marked(rec)).Should(BeEmpty())
+		Expect(calls).Should(Equal(2))
+
+		rejected := []*http.Request{
+			httptest.NewRequest("DELETE", "/", nil),
+			httptest.NewRequest("POST", "/", strings.NewReader("This is too long")),
+			httptest.NewRequest("GET", "/secure", nil),
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Limit", "true")
+		rejected = append(rejected, req)
+		req = httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Invalid", "true")
+		rejected = append(rejected, req)
+		for _, req := range rejected {
+			rec = do(req)
+			Expect(rec.Code).Should(BeNumerically(">=", 400), req.URL.Path)
+			Expect(marked(rec)).Should(Equal(RejectedPreHandler), req.Method)
+		}
+
+		s.markDown()
+		rec = do(httptest.NewRequest("GET", "/", nil))
+		Expect(rec.Code).Should(Equal(503))
+		Expect(marked(rec)).Should(Equal(RejectedPreHandler))
+		// Management paths are not rejections
+		rec = do(httptest.NewRequest("GET", "/health", nil))
+		Expect(marked(rec)).Should(BeEmpty())
+		Expect(calls).Should(Equal(2))
+
+		Expect(s.RejectionCounts()).Should(Equal(map[string]int64{
+			"Markdown":         1,
+			"Unauthorized":     1,
+			"RateLimited":      1,
+			"BodyTooLarge":     1,
+			"MethodNotAllowed": 1,
+			"Shed":             0,
+			"Invalid":          1,
+		}))
+
+		// The header may be renamed or turned off
+		s.SetRejectedHeader("X-Rejected")
+		rec = do(httptest.NewRequest("GET", "/", nil))
+		Expect(rec.Header().Get("X-Rejected")).Should(Equal(RejectedPreHandler))
+		Expect(marked(rec)).Should(BeEmpty())
+		s.SetRejectedHeader("")
+		rec = do(httptest.NewRequest("GET", "/", nil))
+		Expect(rec.Code).Should(Equal(503))
+		Expect(rec.Header().Get("X-Rejected")).Should(BeEmpty())
+	})
+
+	It("Rejection reason names", func() {
+		Expect(RejectionNone.String()).Should(Equal("None"))
+		Expect(RejectionShed.String()).Should(Equal("Shed"))
+		Expect(RejectionInvalid.String()).Should(Equal("Invalid"))
+	})
+
+	It("Request validator", func() {
+		s := CreateHTTPScaffold()
+		s.SetRequestValidator(CombineValidators(
+			MaxURILength(20),
+			MaxHeaderCount(3),
+			RequireHost("example.com", "api.example.com:8443"),
+		))
+		var records []AccessRecord
+		s.SetAccessLogger(func(r AccessRecord) {
+			records = append(records, r)
+		})
+		var bodyRead bool
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			bodyRead = true
+		}))
+		do := func(req *http.Request) (int, string) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			return rec.Code, rec.Body.String()
+		}
+		request := func(host, uri string) *http.Request {
+			req := httptest.NewRequest("POST", uri, strings.NewReader("body"))
+			req.Host = host
+			return req
+		}
+
+		code, _ := do(request("example.com", "/"))
+		Expect(code).Should(Equal(200))
+		Expect(bodyRead).Should(BeTrue())
+		code, _ = do(request("EXAMPLE.com:80", "/"))
+		Expect(code).Should(Equal(200))
+		code, _ = do(request("api.example.com:8443", "/"))
+		Expect(code).Should(Equal(200))
+
+		bodyRead = false
+		code, body := do(request("api.example.com:80", "/"))
+		Expect(code).Should(Equal(400))
+		Expect(body).Should(ContainSubstring(`host \"api.example.com:80\" is not allowed`))
+		code, body = do(request("example.com", "/this/is/too/long/for/us"))
+		Expect(code).Should(Equal(400))
+		Expect(body).Should(ContainSubstring("URI is longer than 20 bytes"))
+		req := request("example.com", "/")
+		for _, n := range []string{"A", "B", "C", "D"} {
+			req.Header.Set("X-"+n, n)
+		}
+		code, body = do(req)
+		Expect(code).Should(Equal(400))
+		Expect(body).Should(ContainSubstring("more than 3 headers"))
+		Expect(bodyRead).Should(BeFalse())
+
+		Expect(records).Should(HaveLen(6))
+		Expect(records[5].Rejection).Should(Equal(RejectionInvalid))
+		Expect(s.RejectionCounts()["Invalid"]).Should(BeEquivalentTo(3))
+	})
+
+	It("Validation messages are sanitized", func() {
+		Expect(sanitizeMessage("bad\r\nheader\x00")).Should(Equal("badheader"))
+		long := sanitizeMessage(strings.Repeat("\u00e9", 150))
+		Expect(long).Should(HaveSuffix("..."))
+		Expect(len(long)).Should(BeNumerically("<=", maxValidationMessage+3))
+		Expect(utf8.ValidString(long)).Should(BeTrue())
+	})
+
+	It("Expect 100-continue", func() {
+		s := CreateHTTPScaffold()
+		s.SetMaxRequestBody(100 * 1024)
+		s.SetTokenValidator(func(ctx context.Context, token string) (TokenClaims, error) {
+			return nil, errors.New("bad token")
+		})
+		s.EnableBearerAuth("/secure")
+		s.SetMaxInflightRequests(1, time.Second)
+		s.SetMarkdownResponseHandler(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			// Reading the body must not ask the client for it
+			ioutil.ReadAll(req.Body)
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		block := make(chan struct{})
+		var bodies []string
+		bodyLock := &sync.Mutex{}
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/block" {
+					<-block
+					return
+				}
+				if req.Method != "POST" {
+					return
+				}
+				bod, _ := ioutil.ReadAll(req.Body)
+				bodyLock.Lock()
+				bodies = append(bodies, string(bod))
+				bodyLock.Unlock()
+			}))
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// sendHeaders sends a request that waits for "100 Continue" and
+		// returns the first status line that comes back.
+		sendHeaders := func(path string, length int) (net.Conn, *bufio.Reader, string) {
+			conn, err := net.Dial("tcp", s.InsecureAddress())
+			Expect(err).Should(Succeed())
+			fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: test\r\n"+
+				"Content-Length: %d\r\nExpect: 100-continue\r\n\r\n", path, length)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+			line, err := r.ReadString('\n')
+			Expect(err).Should(Succeed())
+			return conn, r, strings.TrimSpace(line)
+		}
+		rejected := func(path string, length int, status string) {
+			conn, _, line := sendHeaders(path, length)
+			defer conn.Close()
+			Expect(line).Should(Equal("HTTP/1.1 " + status))
+		}
+
+		// Accepted requests get the continue and then the response
+		conn, r, line := sendHeaders("/upload", 5)
+		Expect(line).Should(Equal("HTTP/1.1 100 Continue"))
+		r.ReadString('\n')
+		conn.Write([]byte("Hello"))
+		line, err = r.ReadString('\n')
+		Expect(err).Should(Succeed())
+		Expect(strings.TrimSpace(line)).Should(Equal("HTTP/1.1 200 OK"))
+		conn.Close()
+		bodyLock.Lock()
+		Expect(bodies).Should(Equal([]string{"Hello"}))
+		bodyLock.Unlock()
+
+		rejected("/upload", 1024*1024, "413 Request Entity Too Large")
+		rejected("/secure", 5, "401 Unauthorized")
+
+		blocked := make(chan struct{})
+		go func() {
+			defer close(blocked)
+			getText(s.InsecureURL().String() + "/block")
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		rejected("/upload", 5, "503 Service Unavailable")
+		close(block)
+		Eventually(blocked).Should(BeClosed())
+
+		s.markDown()
+		rejected("/upload", 5, "503 Service Unavailable")
+		bodyLock.Lock()
+		Expect(bodies).Should(HaveLen(1))
+		bodyLock.Unlock()
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
@@ -0,0 +1,105 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+/*
+OnReload registers a function that is called when the server is asked to
+reload, either by calling "Reload" or by the signal set using
+"SetReloadSignal." Functions are called one at a time in the order that
+they were registered. The server keeps serving while they run.
+*/
+func (s *HTTPScaffold) OnReload(hook func() error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	s.reloadHooks = append(s.reloadHooks, hook)
+}
+
+/*
+SetReloadSignal sets a signal that causes the server to reload. It is
+usually syscall.SIGHUP, which is what tools like logrotate send. If it is
+SIGHUP, then it replaces the stack dump that "CatchSignals" normally does
+for that signal. It only takes effect if "CatchSignals" is called
+afterwards.
+*/
+func (s *HTTPScaffold) SetReloadSignal(sig os.Signal) {
+	s.reloadSignal = sig
+}
+
+/*
+Reload re-reads the TLS certificate and key, if the secure port is in use,
+and then calls every function registered using "OnReload." Errors are
+logged, and a function that panics is treated as if it returned an error.
+A failure does not stop the rest of the functions from being called, and
+a certificate that fails to load leaves the current one in place. It
+returns the first error.
+*/
+func (s *HTTPScaffold) Reload() error {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+
+	var firstErr error
+	if s.certificate.Load() != nil {
+		err := s.ReloadCertificate()
+		if err != nil {
+			s.logError("Error reloading TLS certificate: %s", err)
+			firstErr = err
+		}
+	}
+	for i, hook := range s.reloadHooks {
+		err := runReloadHook(hook)
+		if err != nil {
+			s.logError("Error from reload hook %d: %s", i, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func runReloadHook(hook func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("reload hook panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return hook()
+}
+
+/*
+ReloadCertificate reads the files set using "SetCertFile" and "SetKeyFile"
+again. New TLS connections use the new certificate, and existing ones are
+not affected. If the files can't be loaded, then the current certificate
+stays in use. It is called automatically by "Reload."
+*/
+func (s *HTTPScaffold) ReloadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	s.certificate.Store(&cert)
+	return nil
+}
+
+func (s *HTTPScaffold) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.certificate.Load().(*tls.Certificate), nil
+}
@@ -0,0 +1,155 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reload tests", func() {
+	It("Reload hooks", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		var calls []string
+		s.OnReload(func() error {
+			calls = append(calls, "first")
+			return errors.New("first failed")
+		})
+		s.OnReload(func() error {
+			calls = append(calls, "second")
+			panic("second panicked")
+		})
+		s.OnReload(func() error {
+			calls = append(calls, "third")
+			return nil
+		})
+
+		err := s.Reload()
+		Expect(err).Should(MatchError("first failed"))
+		Expect(calls).Should(Equal([]string{"first", "second", "third"}))
+		errs := logger.allErrors()
+		Expect(errs).Should(HaveLen(2))
+		Expect(errs[0]).Should(ContainSubstring("first failed"))
+		Expect(errs[1]).Should(ContainSubstring("reload hook panicked: second panicked"))
+	})
+
+	It("Reload signal", func() {
+		s := CreateHTTPScaffold()
+		s.SetReloadSignal(syscall.SIGHUP)
+		s.SetMarkdownSignal(syscall.SIGUSR1)
+		reloaded := make(chan bool, 1)
+		s.OnReload(func() error {
+			reloaded <- true
+			return nil
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		sigChan := make(chan os.Signal, 2)
+		go s.handleSignals(sigChan, GinkgoWriter)
+		sigChan <- syscall.SIGHUP
+		Eventually(reloaded).Should(Receive())
+		Expect(s.tracker.markedDown()).Should(Succeed())
+		Consistently(stopChan, 100*time.Millisecond).ShouldNot(Receive())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Certificate reload", func() {
+		dir, err := ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+		defer os.RemoveAll(dir)
+		certFile := filepath.Join(dir, "cert.pem")
+		keyFile := filepath.Join(dir, "key.pem")
+		writeTestCert(certFile, keyFile, "first")
+
+		s := CreateHTTPScaffold()
+		s.SetInsecurePort(-1)
+		s.SetSecurePort(0)
+		s.SetCertFile(certFile)
+		s.SetKeyFile(keyFile)
+		stopChan := make(chan error)
+		err = s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		serverName := func() string {
+			conn, err := tls.Dial("tcp", s.SecureAddress(), &tls.Config{InsecureSkipVerify: true})
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		}
+		Expect(serverName()).Should(Equal("first"))
+
+		writeTestCert(certFile, keyFile, "second")
+		Expect(s.Reload()).Should(Succeed())
+		Expect(serverName()).Should(Equal("second"))
+
+		// A bad file leaves the current certificate in place
+		Expect(ioutil.WriteFile(certFile, []byte("garbage"), 0600)).Should(Succeed())
+		Expect(s.Reload()).ShouldNot(Succeed())
+		Expect(serverName()).Should(Equal("second"))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+})
+
+func writeTestCert(certFile, keyFile, name string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).Should(Succeed())
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	Expect(err).Should(Succeed())
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	Expect(ioutil.WriteFile(certFile, certPEM, 0600)).Should(Succeed())
+	Expect(ioutil.WriteFile(keyFile, keyPEM, 0600)).Should(Succeed())
+}
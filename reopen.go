@@ -0,0 +1,110 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+reset puts the scaffold back the way it was before it was opened, apart
+from what "Open" says is kept, so that it can be opened again. It is only
+called once "WaitForShutdown" has returned.
+*/
+func (s *HTTPScaffold) reset() {
+	s.serverLock.Lock()
+	servers := s.servers
+	s.servers = nil
+	muxes := s.muxes
+	s.muxes = nil
+	s.keepAlivesDisabled = false
+	s.startTime = time.Time{}
+	s.serverLock.Unlock()
+	for _, srv := range servers {
+		srv.Close()
+	}
+	for _, m := range muxes {
+		m.close()
+	}
+	// The old accept loops look at the state that we are about to replace
+	s.serveGroup.Wait()
+
+	s.open = false
+	atomic.StoreInt32(&s.shutdownDone, 0)
+	s.serverLock.Lock()
+	s.tracker = startRequestTrackerWithClock(DefaultGraceTimeout, s.clock)
+	s.inflight = newInflightSet()
+	s.serverLock.Unlock()
+	s.insecureListener = nil
+	s.secureListener = nil
+	s.secureTCP = nil
+	s.managementListener = nil
+	s.mgmtSwitch = nil
+	for _, p := range s.ports {
+		p.listener = nil
+	}
+	s.grpcServer = nil
+	s.grpcStopOnce = nil
+	s.grpcStopped = nil
+	atomic.StoreInt32(&s.notListening, 0)
+	atomic.StoreInt32(&s.acceptStopped, 0)
+	s.listenerFailure.Store((*ErrListenerFailed)(nil))
+
+	s.drainLock.Lock()
+	s.drainStart = time.Time{}
+	s.hookCancel = nil
+	s.hookReason = nil
+	s.hookResults = nil
+	s.hookTime = 0
+	s.hooksDone = false
+	s.drainLock.Unlock()
+
+	s.healthLock.Lock()
+	s.lastHealth = nil
+	s.latestHealth.Store((*healthEvaluation)(nil))
+	s.healthLock.Unlock()
+
+	for _, uc := range s.upstreams {
+		uc.lock.Lock()
+		uc.once = &sync.Once{}
+		uc.status = NotReady
+		uc.reason = ErrUpstreamNotChecked
+		uc.detail = UpstreamDetail{URL: uc.url}
+		uc.lock.Unlock()
+	}
+}
+
+/*
+requestState returns the tracker and the set of running requests. "reset"
+replaces both, so code that may run on another goroutine, or that outlives
+one cycle, like a request that was abandoned by a forced shutdown, reads
+them here once and keeps using what it got. The tracker is nil until
+"Open" or "Handlers" has been called.
+*/
+func (s *HTTPScaffold) requestState() (*requestTracker, *inflightSet) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	return s.tracker, s.inflight
+}
+
+/*
+currentTracker is the tracker part of "requestState."
+*/
+func (s *HTTPScaffold) currentTracker() *requestTracker {
+	t, _ := s.requestState()
+	return t
+}
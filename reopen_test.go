@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Reopen tests", func() {
+	named := func(name string) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte(name))
+		})
+	}
+
+	It("Open is idempotent", func() {
+		s := CreateHTTPScaffold()
+		Expect(s.Open()).Should(Succeed())
+		addr := s.InsecureAddress()
+		Expect(s.Open()).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(Equal(addr))
+		Expect(s.StartListen(named("one"))).Should(Succeed())
+		Expect(s.Open()).Should(Succeed())
+		Expect(s.InsecureAddress()).Should(Equal(addr))
+		s.Shutdown(nil)
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+	})
+
+	It("Open, listen, and shut down twice", func() {
+		var checks int32
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetMarkdown("POST", "/markdown", nil)
+		s.SetHealthCacheInterval(time.Hour)
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			atomic.AddInt32(&checks, 1)
+			return OK, nil
+		})
+
+		cycle := func(name string) {
+			Expect(s.Open()).Should(Succeed())
+			stopped := make(chan error)
+			go func() {
+				stopped <- s.Listen(named(name))
+			}()
+
+			code, body := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			Expect(code).Should(Equal(200))
+			Expect(body).Should(Equal(name))
+			code, _ = getText(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+			Expect(code).Should(Equal(200))
+			Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+			resp, err := http.Post(fmt.Sprintf("http://%s/markdown", s.ManagementAddress()), "text/plain", nil)
+			Expect(err).Should(Succeed())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(200))
+			code, _ = getText(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+			Expect(code).Should(Equal(503))
+			code, _ = getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			Expect(code).Should(Equal(503))
+
+			s.Shutdown(nil)
+			Eventually(stopped).Should(Receive(Equal(ErrManualStop)))
+		}
+
+		cycle("one")
+		Expect(atomic.LoadInt32(&checks)).Should(Equal(int32(1)))
+		cycle("two")
+		// The cached health result was thrown away
+		Expect(atomic.LoadInt32(&checks)).Should(Equal(int32(2)))
+		Expect(s.HealthStats().Overall.Evaluations).Should(BeEquivalentTo(2))
+	})
+
+	It("Request left over from the last cycle", func() {
+		// Every request waits until the test closes the channel it sends
+		started := make(chan chan struct{}, 2)
+		handler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			release := make(chan struct{})
+			started <- release
+			<-release
+			resp.Write([]byte("ok"))
+		})
+		get := func(s *HTTPScaffold) chan struct{} {
+			go http.Get(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			var release chan struct{}
+			Eventually(started).Should(Receive(&release))
+			return release
+		}
+		s := CreateHTTPScaffold()
+
+		Expect(s.Open()).Should(Succeed())
+		stopped := make(chan error)
+		go func() {
+			stopped <- s.Listen(handler)
+		}()
+		old := get(s)
+		s.ForceShutdown(nil)
+		Eventually(stopped).Should(Receive(Equal(ErrForcedShutdown)))
+
+		// The old request is still running when the scaffold is opened again
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopped <- s.Listen(handler)
+		}()
+		second := get(s)
+		Expect(s.DrainStatus().InFlight).Should(Equal(1))
+		close(old)
+		close(second)
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(BeZero())
+
+		// The old request did not count against the new cycle, so the drain
+		// waits for this one
+		third := get(s)
+		s.Shutdown(nil)
+		Consistently(stopped, 200*time.Millisecond).ShouldNot(Receive())
+		Expect(s.DrainStatus().InFlight).Should(Equal(1))
+		close(third)
+		Eventually(stopped).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Status while reopening", func() {
+		s := CreateHTTPScaffold()
+		done := make(chan struct{})
+		checks := make(chan struct{})
+		go func() {
+			defer close(checks)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					s.IsReady()
+					s.ReadyStatus()
+					s.DrainStatus()
+				}
+			}
+		}()
+
+		for round := 0; round < 3; round++ {
+			ready := s.AddressesReady()
+			stopped := make(chan error)
+			go func() {
+				stopped <- s.Listen(named("ok"))
+			}()
+			Eventually(ready, 5*time.Second).Should(BeClosed())
+			s.Shutdown(nil)
+			Eventually(stopped).Should(Receive(Equal(ErrManualStop)))
+		}
+		close(done)
+		<-checks
+	})
+})
@@ -0,0 +1,304 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ResponseLimitScope says which responses share a response rate limit.
+*/
+type ResponseLimitScope int
+
+const (
+	// LimitPerResponse gives each response its own limit, which is the
+	// default
+	LimitPerResponse ResponseLimitScope = iota
+	// LimitPerConnection shares the limit between the responses on a
+	// connection, such as the streams of an HTTP/2 connection
+	LimitPerConnection
+	// LimitPerClient shares the limit between all the responses to a
+	// client address, as returned by "ClientIP"
+	LimitPerClient
+)
+
+/*
+SetResponseRateLimit limits how fast application responses are sent, so
+that one client downloading something huge can't use up all of the
+bandwidth. Each response body may be sent at "bytesPerSec" on average,
+with bursts of up to "burst" bytes, using a token bucket. A handler that
+writes faster than that just blocks in "Write" until it may send more, so
+handlers don't need to change, unless the client goes away, in which case
+"Write" returns an error. "Flush" works as usual, and a connection that
+is hijacked is no longer limited. The health, ready, and other management
+paths are never limited. If "burst" is less than one, it is set to one
+second's worth. If "bytesPerSec" is zero, which is the default, there is
+no limit.
+*/
+func (s *HTTPScaffold) SetResponseRateLimit(bytesPerSec int64, burst int64) {
+	if bytesPerSec <= 0 {
+		s.responseLimit = nil
+		return
+	}
+	if burst < 1 {
+		burst = bytesPerSec
+	}
+	scope := LimitPerResponse
+	if s.responseLimit != nil {
+		scope = s.responseLimit.scope
+	}
+	s.responseLimit = &responseLimiter{
+		rate:    float64(bytesPerSec),
+		burst:   burst,
+		scope:   scope,
+		buckets: make(map[string]*byteBucket),
+	}
+}
+
+/*
+SetResponseRateLimitScope sets which responses share the limit set by
+"SetResponseRateLimit." It must be called after it.
+*/
+func (s *HTTPScaffold) SetResponseRateLimitScope(scope ResponseLimitScope) {
+	if s.responseLimit != nil {
+		s.responseLimit.scope = scope
+	}
+}
+
+/*
+throttledResponses returns the number of responses that are running and
+have had to wait for the response rate limit.
+*/
+func (s *HTTPScaffold) throttledResponses() int32 {
+	if s.responseLimit == nil {
+		return 0
+	}
+	return atomic.LoadInt32(&s.responseLimit.throttled)
+}
+
+/*
+responseLimiter keeps the buckets that are shared between responses.
+*/
+type responseLimiter struct {
+	// throttled counts the running responses that have had to wait
+	throttled int32
+	rate      float64
+	burst     int64
+	scope     ResponseLimitScope
+	lock      sync.Mutex
+	buckets   map[string]*byteBucket
+}
+
+/*
+byteBucket is a token bucket of bytes. Unlike the one for requests, its
+tokens may go below zero, which is how long the writer has to wait.
+*/
+type byteBucket struct {
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+	// users is guarded by the lock of the responseLimiter
+	users int
+}
+
+/*
+acquire returns the bucket for a response, which is only shared if the
+scope says so.
+*/
+func (l *responseLimiter) acquire(key string) *byteBucket {
+	if l.scope == LimitPerResponse {
+		return &byteBucket{tokens: float64(l.burst)}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b := l.buckets[key]
+	if b == nil {
+		b = &byteBucket{tokens: float64(l.burst)}
+		l.buckets[key] = b
+	}
+	b.users++
+	return b
+}
+
+/*
+release forgets a shared bucket once no response is using it. A new one
+starts full, which is a little generous, but means that there is nothing
+to clean up later.
+*/
+func (l *responseLimiter) release(key string, b *byteBucket) {
+	if l.scope == LimitPerResponse {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	b.users--
+	if b.users == 0 && l.buckets[key] == b {
+		delete(l.buckets, key)
+	}
+}
+
+/*
+reserve takes "n" bytes from the bucket and returns how long the writer
+must wait before it sends them.
+*/
+func (l *responseLimiter) reserve(b *byteBucket, n int, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.last.IsZero() {
+		b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / l.rate * float64(time.Second))
+}
+
+/*
+limitResponse wraps the response in the rate limit, or returns nil if
+there is none.
+*/
+func (s *HTTPScaffold) limitResponse(resp http.ResponseWriter, req *http.Request) *limitWriter {
+	l := s.responseLimit
+	if l == nil {
+		return nil
+	}
+	var key string
+	switch l.scope {
+	case LimitPerConnection:
+		key = req.RemoteAddr
+	case LimitPerClient:
+		key = ClientIP(req)
+	}
+	return &limitWriter{
+		ResponseWriter: resp,
+		s:              s,
+		l:              l,
+		key:            key,
+		b:              l.acquire(key),
+		ctx:            req.Context(),
+	}
+}
+
+/*
+limitWriter sends the body no faster than the limit allows, in pieces of
+at most the burst size so that each one waits its turn.
+*/
+type limitWriter struct {
+	http.ResponseWriter
+	s         *HTTPScaffold
+	l         *responseLimiter
+	key       string
+	b         *byteBucket
+	ctx       context.Context
+	throttled bool
+}
+
+func (w *limitWriter) Write(buf []byte) (int, error) {
+	written := 0
+	for len(buf) > 0 && w.b != nil {
+		n := len(buf)
+		if int64(n) > w.l.burst {
+			n = int(w.l.burst)
+		}
+		if wait := w.l.reserve(w.b, n, w.s.clock.Now()); wait > 0 {
+			if err := w.wait(wait); err != nil {
+				return written, err
+			}
+		}
+		m, err := w.ResponseWriter.Write(buf[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		buf = buf[n:]
+	}
+	if len(buf) == 0 {
+		return written, nil
+	}
+	m, err := w.ResponseWriter.Write(buf)
+	return written + m, err
+}
+
+/*
+wait blocks until it is time to send more, or until the client goes away.
+*/
+func (w *limitWriter) wait(d time.Duration) error {
+	if !w.throttled {
+		w.throttled = true
+		atomic.AddInt32(&w.l.throttled, 1)
+	}
+	t := w.s.clock.NewTimer(d)
+	select {
+	case <-t.C():
+		return nil
+	case <-w.ctx.Done():
+		t.Stop()
+		return w.ctx.Err()
+	}
+}
+
+/*
+finish is called once the response is done. It does nothing if "w" is nil.
+*/
+func (w *limitWriter) finish() {
+	if w == nil {
+		return
+	}
+	if w.throttled {
+		w.throttled = false
+		atomic.AddInt32(&w.l.throttled, -1)
+	}
+	if w.b != nil {
+		w.l.release(w.key, w.b)
+		w.b = nil
+	}
+}
+
+func (w *limitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *limitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	c, rw, err := h.Hijack()
+	if err == nil {
+		// The connection is the handler's now, so it is not limited
+		w.finish()
+	}
+	return c, rw, err
+}
+
+/*
+Unwrap lets http.ResponseController find the original writer.
+*/
+func (w *limitWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,175 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Response rate limit tests", func() {
+	It("Bounds the transfer time of a big response", func() {
+		const size = 160 * 1024
+		s := CreateHTTPScaffold()
+		s.SetResponseRateLimit(256*1024, 32*1024)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			resp.Write([]byte(strings.Repeat("x", size)))
+		}))
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		start := time.Now()
+		resp, err := http.Get(ts.URL)
+		Expect(err).Should(Succeed())
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		elapsed := time.Since(start)
+		Expect(body).Should(HaveLen(size))
+		// The first 32K is the burst, and the rest goes at 256K a second
+		Expect(elapsed).Should(BeNumerically(">=", 450*time.Millisecond))
+		Expect(elapsed).Should(BeNumerically("<", 3*time.Second))
+		Expect(s.throttledResponses()).Should(BeZero())
+	})
+
+	It("Blocks writes and counts throttled responses", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetHealthPath("/health")
+		s.SetResponseRateLimit(1000, 500)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			n, err := resp.Write(make([]byte, 1500))
+			Expect(err).Should(Succeed())
+			Expect(n).Should(Equal(1500))
+		}))
+
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			done <- rec
+		}()
+		Eventually(clk.Timers).Should(Equal(1))
+		Expect(s.metrics().ThrottledResponses).Should(BeEquivalentTo(1))
+
+		// Management paths are never limited
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		Expect(rec.Code).Should(Equal(200))
+
+		clk.Advance(500 * time.Millisecond)
+		Eventually(clk.Timers).Should(Equal(1))
+		Consistently(done, 50*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(500 * time.Millisecond)
+		Eventually(done).Should(Receive(&rec))
+		Expect(rec.Body.Len()).Should(Equal(1500))
+		Expect(s.metrics().ThrottledResponses).Should(BeZero())
+	})
+
+	It("Stops waiting when the client goes away", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetResponseRateLimit(100, 100)
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		w := s.limitResponse(httptest.NewRecorder(), req)
+
+		errs := make(chan error)
+		go func() {
+			_, err := w.Write(make([]byte, 200))
+			errs <- err
+		}()
+		Eventually(clk.Timers).Should(Equal(1))
+		cancel()
+		Eventually(errs).Should(Receive(Equal(context.Canceled)))
+		Expect(clk.Timers()).Should(BeZero())
+		w.finish()
+		Expect(s.throttledResponses()).Should(BeZero())
+	})
+
+	It("Shares the limit by client", func() {
+		s := CreateHTTPScaffold()
+		s.SetResponseRateLimit(1000, 1000)
+		s.SetResponseRateLimitScope(LimitPerClient)
+		r1 := httptest.NewRequest("GET", "/", nil)
+		r1.RemoteAddr = "10.0.0.1:1000"
+		r2 := httptest.NewRequest("GET", "/", nil)
+		r2.RemoteAddr = "10.0.0.1:2000"
+		r3 := httptest.NewRequest("GET", "/", nil)
+		r3.RemoteAddr = "10.0.0.2:1000"
+
+		w1 := s.limitResponse(httptest.NewRecorder(), r1)
+		w2 := s.limitResponse(httptest.NewRecorder(), r2)
+		w3 := s.limitResponse(httptest.NewRecorder(), r3)
+		Expect(w1.b).Should(BeIdenticalTo(w2.b))
+		Expect(w1.b).ShouldNot(BeIdenticalTo(w3.b))
+
+		now := time.Now()
+		Expect(s.responseLimit.reserve(w1.b, 800, now)).Should(BeZero())
+		Expect(s.responseLimit.reserve(w2.b, 400, now)).Should(Equal(200 * time.Millisecond))
+		Expect(s.responseLimit.reserve(w3.b, 400, now)).Should(BeZero())
+
+		w1.finish()
+		w2.finish()
+		w3.finish()
+		Expect(s.responseLimit.buckets).Should(BeEmpty())
+
+		// Each response gets its own bucket by default
+		s.SetResponseRateLimitScope(LimitPerResponse)
+		w1 = s.limitResponse(httptest.NewRecorder(), r1)
+		w2 = s.limitResponse(httptest.NewRecorder(), r2)
+		Expect(w1.b).ShouldNot(BeIdenticalTo(w2.b))
+	})
+
+	It("Hijacked connections are not limited", func() {
+		const size = 64 * 1024
+		s := CreateHTTPScaffold()
+		s.SetResponseRateLimit(1024, 1024)
+		s.SetResponseRateLimitScope(LimitPerConnection)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			Expect(s.responseLimit.buckets).Should(HaveLen(1))
+			conn, bw, err := resp.(http.Hijacker).Hijack()
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			Expect(s.responseLimit.buckets).Should(BeEmpty())
+			bw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n")
+			bw.WriteString(strings.Repeat("x", size))
+			bw.Flush()
+		}))
+		ts := httptest.NewServer(h)
+		defer ts.Close()
+
+		start := time.Now()
+		resp, err := http.Get(ts.URL)
+		Expect(err).Should(Succeed())
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		Expect(err).Should(Succeed())
+		Expect(body).Should(HaveLen(size))
+		Expect(time.Since(start)).Should(BeNumerically("<", 5*time.Second))
+	})
+})
@@ -0,0 +1,179 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	// RuntimeCheckName is the name of the check from "AddRuntimeHealthCheck"
+	RuntimeCheckName = "runtime"
+	// DefaultRuntimeFailMultiplier is how far over its limit a value must
+	// be for the runtime check to report "Failed" rather than "Degraded."
+	DefaultRuntimeFailMultiplier = 2.0
+	// minRuntimeSampleInterval is how often we sample the runtime if the
+	// health cache interval is shorter, since "ReadMemStats" stops the world.
+	minRuntimeSampleInterval = time.Second
+)
+
+/*
+runtimeSample is what the runtime check reads from the runtime.
+*/
+type runtimeSample struct {
+	goroutines int
+	heapBytes  uint64
+	at         time.Time
+}
+
+/*
+RuntimeDetail is the detail of the runtime check in the verbose health
+output. The limits are zero for values that are not checked.
+*/
+type RuntimeDetail struct {
+	Goroutines     int       `json:"goroutines" yaml:"goroutines"`
+	MaxGoroutines  int       `json:"maxGoroutines,omitempty" yaml:"maxGoroutines,omitempty"`
+	FailGoroutines int       `json:"failGoroutines,omitempty" yaml:"failGoroutines,omitempty"`
+	HeapBytes      uint64    `json:"heapBytes" yaml:"heapBytes"`
+	MaxHeapBytes   uint64    `json:"maxHeapBytes,omitempty" yaml:"maxHeapBytes,omitempty"`
+	FailHeapBytes  uint64    `json:"failHeapBytes,omitempty" yaml:"failHeapBytes,omitempty"`
+	SampledAt      time.Time `json:"sampledAt" yaml:"sampledAt"`
+}
+
+type runtimeCheck struct {
+	s             *HTTPScaffold
+	maxGoroutines int
+	maxHeapBytes  uint64
+	lock          *sync.Mutex
+	last          *runtimeSample
+	read          func() runtimeSample
+}
+
+/*
+AddRuntimeHealthCheck registers a health check, named "RuntimeCheckName,"
+that reports "Degraded" when there are more than "maxGoroutines"
+goroutines or more than "maxHeapBytes" bytes of heap in use, and "Failed"
+when either is over its limit times the multiplier set by
+"SetRuntimeFailMultiplier." A limit of zero is not checked. The runtime is
+sampled at most once per health cache interval, and at most once a second,
+because reading the heap size briefly stops the program. The verbose
+health output includes a "RuntimeDetail" for the check.
+*/
+func (s *HTTPScaffold) AddRuntimeHealthCheck(maxGoroutines int, maxHeapBytes uint64) {
+	rc := &runtimeCheck{
+		s:             s,
+		maxGoroutines: maxGoroutines,
+		maxHeapBytes:  maxHeapBytes,
+		lock:          &sync.Mutex{},
+		read:          readRuntime,
+	}
+	s.healthChecks = append(s.healthChecks, namedCheck{
+		name:     RuntimeCheckName,
+		detailed: rc.check,
+		checker: func() (HealthStatus, error) {
+			status, _, err := rc.check()
+			return status, err
+		},
+	})
+}
+
+/*
+SetRuntimeFailMultiplier sets how far over its limit a value must be for
+the check from "AddRuntimeHealthCheck" to report "Failed." The default is
+"DefaultRuntimeFailMultiplier."
+*/
+func (s *HTTPScaffold) SetRuntimeFailMultiplier(m float64) {
+	s.runtimeFailMult = m
+}
+
+func (s *HTTPScaffold) runtimeFailMultiplier() float64 {
+	if s.runtimeFailMult <= 0 {
+		return DefaultRuntimeFailMultiplier
+	}
+	return s.runtimeFailMult
+}
+
+func readRuntime() runtimeSample {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return runtimeSample{
+		goroutines: runtime.NumGoroutine(),
+		heapBytes:  ms.HeapAlloc,
+	}
+}
+
+/*
+sample returns a recent reading of the runtime, taking a new one if the
+last one is too old.
+*/
+func (rc *runtimeCheck) sample() runtimeSample {
+	interval := rc.s.healthCacheInterval
+	if interval < minRuntimeSampleInterval {
+		interval = minRuntimeSampleInterval
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.last == nil || rc.s.since(rc.last.at) >= interval {
+		rs := rc.read()
+		rs.at = rc.s.clock.Now()
+		rc.last = &rs
+	}
+	return *rc.last
+}
+
+func (rc *runtimeCheck) check() (HealthStatus, interface{}, error) {
+	rs := rc.sample()
+	mult := rc.s.runtimeFailMultiplier()
+	detail := &RuntimeDetail{
+		Goroutines: rs.goroutines,
+		HeapBytes:  rs.heapBytes,
+		SampledAt:  rs.at,
+	}
+
+	status := OK
+	var err error
+	report := func(s HealthStatus, e error) {
+		if s.worseThan(status) {
+			status = s
+			err = e
+		}
+	}
+	if rc.maxGoroutines > 0 {
+		detail.MaxGoroutines = rc.maxGoroutines
+		detail.FailGoroutines = int(float64(rc.maxGoroutines) * mult)
+		if rs.goroutines > detail.FailGoroutines {
+			report(Failed, fmt.Errorf("%d goroutines is over the limit of %d",
+				rs.goroutines, detail.FailGoroutines))
+		} else if rs.goroutines > rc.maxGoroutines {
+			report(Degraded, fmt.Errorf("%d goroutines is over the limit of %d",
+				rs.goroutines, rc.maxGoroutines))
+		}
+	}
+	if rc.maxHeapBytes > 0 {
+		detail.MaxHeapBytes = rc.maxHeapBytes
+		detail.FailHeapBytes = uint64(float64(rc.maxHeapBytes) * mult)
+		if rs.heapBytes > detail.FailHeapBytes {
+			report(Failed, fmt.Errorf("%d heap bytes is over the limit of %d",
+				rs.heapBytes, detail.FailHeapBytes))
+		} else if rs.heapBytes > rc.maxHeapBytes {
+			report(Degraded, fmt.Errorf("%d heap bytes is over the limit of %d",
+				rs.heapBytes, rc.maxHeapBytes))
+		}
+	}
+	return status, detail, err
+}
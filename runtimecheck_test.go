@@ -0,0 +1,141 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Runtime health check tests", func() {
+	fakeCheck := func(s *HTTPScaffold, maxGoroutines int, maxHeap uint64) (*runtimeCheck, *runtimeSample, *int) {
+		current := &runtimeSample{}
+		reads := new(int)
+		rc := &runtimeCheck{
+			s:             s,
+			maxGoroutines: maxGoroutines,
+			maxHeapBytes:  maxHeap,
+			lock:          &sync.Mutex{},
+			read: func() runtimeSample {
+				*reads++
+				return *current
+			},
+		}
+		return rc, current, reads
+	}
+
+	It("Runtime thresholds", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		rc, current, _ := fakeCheck(s, 100, 1000)
+
+		next := func(goroutines int, heap uint64) (HealthStatus, *RuntimeDetail, error) {
+			current.goroutines = goroutines
+			current.heapBytes = heap
+			clk.Advance(time.Minute)
+			status, detail, err := rc.check()
+			return status, detail.(*RuntimeDetail), err
+		}
+
+		status, detail, err := next(10, 10)
+		Expect(status).Should(Equal(OK))
+		Expect(err).Should(Succeed())
+		Expect(*detail).Should(Equal(RuntimeDetail{
+			Goroutines:     10,
+			MaxGoroutines:  100,
+			FailGoroutines: 200,
+			HeapBytes:      10,
+			MaxHeapBytes:   1000,
+			FailHeapBytes:  2000,
+			SampledAt:      clk.Now(),
+		}))
+
+		status, _, err = next(101, 10)
+		Expect(status).Should(Equal(Degraded))
+		Expect(err).Should(MatchError("101 goroutines is over the limit of 100"))
+		status, _, err = next(201, 1001)
+		Expect(status).Should(Equal(Failed))
+		Expect(err).Should(MatchError("201 goroutines is over the limit of 200"))
+		status, _, err = next(150, 2001)
+		Expect(status).Should(Equal(Failed))
+		Expect(err).Should(MatchError("2001 heap bytes is over the limit of 2000"))
+
+		s.SetRuntimeFailMultiplier(10)
+		status, _, _ = next(201, 1001)
+		Expect(status).Should(Equal(Degraded))
+
+		// Zero disables a dimension
+		rc, current, _ = fakeCheck(s, 0, 1000)
+		status, detail, _ = next(1000000, 10)
+		Expect(status).Should(Equal(OK))
+		Expect(detail.MaxGoroutines).Should(BeZero())
+	})
+
+	It("Runtime sampling", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		rc, _, reads := fakeCheck(s, 100, 0)
+		rc.check()
+		rc.check()
+		Expect(*reads).Should(Equal(1))
+		clk.Advance(minRuntimeSampleInterval)
+		rc.check()
+		Expect(*reads).Should(Equal(2))
+
+		s.SetHealthCacheInterval(time.Minute)
+		clk.Advance(30 * time.Second)
+		rc.check()
+		Expect(*reads).Should(Equal(2))
+		clk.Advance(30 * time.Second)
+		rc.check()
+		Expect(*reads).Should(Equal(3))
+	})
+
+	It("Runtime check in verbose health", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.AddRuntimeHealthCheck(1, 0)
+		s.SetRuntimeFailMultiplier(1000000)
+		rec := httptest.NewRecorder()
+		s.handleHealth(rec, httptest.NewRequest("GET", "/health?verbose=true", nil))
+		Expect(rec.Code).Should(Equal(200))
+
+		var doc struct {
+			Status string `json:"status"`
+			Checks []struct {
+				Name   string        `json:"name"`
+				Status string        `json:"status"`
+				Detail RuntimeDetail `json:"detail"`
+			} `json:"checks"`
+		}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &doc)).Should(Succeed())
+		Expect(doc.Status).Should(Equal("Degraded"))
+		Expect(doc.Checks).Should(HaveLen(1))
+		Expect(doc.Checks[0].Name).Should(Equal(RuntimeCheckName))
+		Expect(doc.Checks[0].Detail.Goroutines).Should(BeNumerically(">", 2))
+		Expect(doc.Checks[0].Detail.MaxGoroutines).Should(Equal(1))
+		Expect(doc.Checks[0].Detail.HeapBytes).Should(BeNumerically(">", 0))
+		Expect(doc.Checks[0].Detail.MaxHeapBytes).Should(BeZero())
+	})
+})
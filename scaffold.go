@@ -15,6 +15,7 @@
 package goscaffold
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -24,8 +25,14 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+	"golang.org/x/net/http2"
 )
 
 const (
@@ -33,6 +40,13 @@ const (
 	// to complete. Default is 30 seconds, which is also the default grace period
 	// in Kubernetes.
 	DefaultGraceTimeout = 30 * time.Second
+	// DefaultRejectedBodyLimit is the default number of bytes that we will
+	// read and discard from the body of a request that we reject.
+	DefaultRejectedBodyLimit = 4 * 1024 * 1024
+	// DefaultManagementLinger is the default amount of time that the
+	// management port keeps serving after the drain completes, if
+	// "SetManagementStopsLast" is used.
+	DefaultManagementLinger = 2 * time.Second
 )
 
 /*
@@ -42,7 +56,8 @@ caused by a SIGINT or SIGTERM.
 var ErrSignalCaught = errors.New("Caught shutdown signal")
 
 /*
-ErrManualStop is used when the user doesn't have a reason.
+ErrManualStop is used when the user doesn't have a reason. It is returned
+as is, so it may be compared directly or using "errors.Is."
 */
 var ErrManualStop = errors.New("Shutdown called")
 
@@ -51,6 +66,90 @@ ErrMarkedDown is used after being marked down but before being shut down.
 */
 var ErrMarkedDown = errors.New("Marked down")
 
+/*
+ErrForcedShutdown is used when "ForceShutdown" was called without a reason.
+Errors that result from escalating a graceful shutdown also match it when
+compared using "errors.Is."
+*/
+var ErrForcedShutdown = errors.New("Forced shutdown")
+
+/*
+EscalatedShutdownError is returned by "Listen" when a graceful shutdown was
+cut short, such as by a second termination signal. It matches both the
+original reason and "ErrForcedShutdown" when compared using "errors.Is."
+*/
+type EscalatedShutdownError struct {
+	// Reason is the reason for the original graceful shutdown
+	Reason error
+}
+
+func (e *EscalatedShutdownError) Error() string {
+	return fmt.Sprintf("Forced shutdown after: %s", e.Reason)
+}
+
+/*
+Is makes the error match "ErrForcedShutdown."
+*/
+func (e *EscalatedShutdownError) Is(target error) bool {
+	return target == ErrForcedShutdown
+}
+
+/*
+Unwrap returns the original reason.
+*/
+func (e *EscalatedShutdownError) Unwrap() error {
+	return e.Reason
+}
+
+/*
+ErrDrainTimeout is returned by "Listen" when the grace timeout expired
+before all the requests completed. It matches the original reason for the
+shutdown when compared using "errors.Is," so a program that only cares
+why it was stopped does not need to handle it specially.
+*/
+type ErrDrainTimeout struct {
+	// Reason is the reason for the shutdown
+	Reason error
+	// Abandoned is the number of requests that were still running
+	Abandoned int
+	// Elapsed is how long the drain ran for
+	Elapsed time.Duration
+}
+
+func (e *ErrDrainTimeout) Error() string {
+	msg := fmt.Sprintf("Drain timed out after %s with %d requests abandoned",
+		e.Elapsed, e.Abandoned)
+	if e.Reason == nil {
+		return msg
+	}
+	return msg + ": " + e.Reason.Error()
+}
+
+/*
+Unwrap returns the reason for the shutdown.
+*/
+func (e *ErrDrainTimeout) Unwrap() error {
+	return e.Reason
+}
+
+/*
+ErrNotReady is used when "SetNotReady" was called without a reason.
+*/
+var ErrNotReady = errors.New("Set not ready")
+
+/*
+ErrHealthUnknown is returned by "HealthStatus" if there are health checkers
+but none of the health or ready paths have been called yet.
+*/
+var ErrHealthUnknown = errors.New("Health not evaluated yet")
+
+/*
+ErrNotListening is the reason that the health and ready paths report
+between "Open" and "StartListen," while the management port is already
+being served but the application handler is not attached yet.
+*/
+var ErrNotListening = errors.New("not yet listening")
+
 /*
 HealthStatus is a type of response from a health check.
 */
@@ -65,13 +164,47 @@ const (
 	NotReady HealthStatus = iota
 	// Failed denotes that the server is bad
 	Failed HealthStatus = iota
+	// Degraded denotes that the server can process requests, but something
+	// is wrong that someone should look at. It was added after the others,
+	// so that their values did not change, but it is better than
+	// "NotReady."
+	Degraded HealthStatus = iota
 )
 
+/*
+ready returns true for the statuses that pass the ready check.
+*/
+func (h HealthStatus) ready() bool {
+	return h == OK || h == Degraded
+}
+
+/*
+worseThan returns true if "h" is a worse status than "o." Values that are
+not one of the constants count as "Failed."
+*/
+func (h HealthStatus) worseThan(o HealthStatus) bool {
+	return h.rank() > o.rank()
+}
+
+func (h HealthStatus) rank() int {
+	switch h {
+	case OK:
+		return 0
+	case Degraded:
+		return 1
+	case NotReady:
+		return 2
+	default:
+		return 3
+	}
+}
+
 /*
 HealthChecker is a type of function that an implementer may
 implement in order to customize what we return from the "health"
 and "ready" URLs. It must return either "OK", which means that everything
-is fine, "not ready," which means that the "ready" check will fail but
+is fine, "degraded," which means that both checks pass but the reason is
+reported, "not ready," which means that the "ready" check will fail but
 the health check is OK, and "failed," which means that both are bad.
 The function may return an optional error, which will be returned as
 a reason for the status and will be placed in responses.
@@ -94,23 +227,157 @@ standard Go HTTP server. It is intended to be placed before any other
 handlers.
 */
 type HTTPScaffold struct {
-	insecurePort       int
-	securePort         int
-	managementPort     int
-	open               bool
-	ipAddr             net.IP
-	tracker            *requestTracker
-	insecureListener   net.Listener
-	secureListener     net.Listener
-	managementListener net.Listener
-	healthCheck        HealthChecker
-	healthPath         string
-	readyPath          string
-	markdownPath       string
-	markdownMethod     string
-	markdownHandler    MarkdownHandler
-	certFile           string
-	keyFile            string
+	// Counters updated using sync/atomic go first so that they are aligned
+	rejections          [numRejectionReasons]int64
+	insecurePort        int
+	securePort          int
+	managementPort      int
+	open                bool
+	shutdownDone        int32
+	serveGroup          *sync.WaitGroup
+	ipAddr              net.IP
+	tracker             *requestTracker
+	insecureListener    net.Listener
+	secureListener      net.Listener
+	managementListener  net.Listener
+	mgmtSwitch          *switchHandler
+	notListening        int32
+	healthCheck         HealthChecker
+	healthChecks        []namedCheck
+	healthPath          string
+	readyPath           string
+	markdownPath        string
+	markdownMethod      string
+	markdownHandler     MarkdownHandler
+	certFile            string
+	keyFile             string
+	allowedMethods      []string
+	markdownSignal      os.Signal
+	markupSignal        os.Signal
+	logger              Logger
+	drainLogInterval    time.Duration
+	drainIdleTimeout    time.Duration
+	inflight            *inflightSet
+	appConns            *connTracker
+	mgmtConns           *connTracker
+	drainLock           *sync.Mutex
+	drainStart          time.Time
+	shutdownHooks       []shutdownHook
+	hookCancel          context.CancelFunc
+	hookReason          error
+	hookResults         []ShutdownHookResult
+	hookTime            time.Duration
+	hooksDone           bool
+	shutdownReport      *ShutdownReport
+	serverLock          *sync.Mutex
+	servers             []*http.Server
+	muxes               []*protocolMux
+	addrReady           chan struct{}
+	addrIndex           map[string]string
+	openListeners       []net.Listener
+	keepAlivesDisabled  bool
+	startTime           time.Time
+	clock               Clock
+	infoPath            string
+	accessLogger        AccessLogger
+	tracer              ScaffoldTracer
+	traceManagement     bool
+	tokenValidator      TokenValidator
+	bearerAuth          bool
+	bearerPaths         []string
+	managementAllowed   ipList
+	managementCORS      []string
+	corsPolicy          *CORSPolicy
+	requestValidator    RequestValidator
+	pathNormalizer      func(*http.Request) string
+	pathNorm            *PathNormOptions
+	requestMetrics      *requestMetricsSet
+	ports               []*namedPort
+	startupPath         string
+	startupUngated      bool
+	started             int32
+	trustedProxies      ipList
+	managementHandlers  []pathHandler
+	markdownExempt      []string
+	markdownUpgrades    bool
+	healthAliases       []string
+	readyAliases        []string
+	managementInFlight  int32
+	markdownQueued      int32
+	markdownQueueLimit  int32
+	markdownMode        MarkdownMode
+	markdownMaxWait     time.Duration
+	defaultShutdownErr  error
+	mgmtNotFound        http.Handler
+	markdownResponse    http.Handler
+	shutdownStateFile   string
+	prevShutdown        *ShutdownRecord
+	rejectedBodyLimit   int64
+	rejectedHeader      string
+	maxRequestBody      int64
+	compression         bool
+	compressMin         int
+	compressTypes       []string
+	tlsConfig           *tls.Config
+	ticketRotation      time.Duration
+	ticketLock          *sync.Mutex
+	ticketKeys          [][32]byte
+	externalTickets     bool
+	healthCacheInterval time.Duration
+	runtimeFailMult     float64
+	upstreams           []*upstreamCheck
+	healthLock          *sync.Mutex
+	healthWait          chan struct{}
+	lastHealth          *healthEvaluation
+	latestHealth        atomic.Value
+	healthChange        HealthChangeFunc
+	notifyLock          *sync.Mutex
+	reportedHealth      HealthStatus
+	listenerFailure     atomic.Value
+	acceptStopped       int32
+	failFastListener    bool
+	healthStats         HealthStats
+	healthPanicPolicy   HealthPanicPolicy
+	probeMatch          func(r *http.Request) bool
+	probeLogging        bool
+	probeRefreshing     int32
+	metricsPath         string
+	deepHealthPath      string
+	readyOverride       atomic.Value
+	certificate         atomic.Value
+	reloadSignal        os.Signal
+	reloadHooks         []func() error
+	reloadLock          *sync.Mutex
+	insecureBehavior    InsecureBehavior
+	redirectHost        string
+	securityHeaders     http.Header
+	hsts                string
+	rateLimiter         RateLimitFunc
+	responseLimit       *responseLimiter
+	maxInflight         int64
+	shedRetryAfter      time.Duration
+	shedExempt          bool
+	grpcServer          GRPCServer
+	grpcStopOnce        *sync.Once
+	grpcStopped         chan struct{}
+	secureTCP           net.Listener
+	inherited           map[string]*os.File
+	upgradeReady        *os.File
+	managementStopsLast bool
+	managementLinger    time.Duration
+	group               *ScaffoldGroup
+	serverIdentity      string
+	hostname            string
+	instanceHeader      string
+	uptimeHeader        string
+}
+
+/*
+pathHandler is a handler that was added for a particular path.
+*/
+type pathHandler struct {
+	path    string
+	handler http.Handler
 }
 
 /*
@@ -119,11 +386,33 @@ do nothing.
 */
 func CreateHTTPScaffold() *HTTPScaffold {
 	return &HTTPScaffold{
-		insecurePort:   0,
-		securePort:     -1,
-		managementPort: -1,
-		ipAddr:         []byte{0, 0, 0, 0},
-		open:           false,
+		insecurePort:       0,
+		securePort:         -1,
+		managementPort:     -1,
+		ipAddr:             []byte{0, 0, 0, 0},
+		open:               false,
+		drainLogInterval:   DefaultDrainLogInterval,
+		rejectedHeader:     DefaultRejectedHeader,
+		drainIdleTimeout:   DefaultDrainIdleTimeout,
+		inflight:           newInflightSet(),
+		drainLock:          &sync.Mutex{},
+		serverLock:         &sync.Mutex{},
+		serveGroup:         &sync.WaitGroup{},
+		addrReady:          make(chan struct{}),
+		defaultShutdownErr: ErrManualStop,
+		rejectedBodyLimit:  DefaultRejectedBodyLimit,
+		ticketRotation:     DefaultSessionTicketRotation,
+		ticketLock:         &sync.Mutex{},
+		healthLock:         &sync.Mutex{},
+		notifyLock:         &sync.Mutex{},
+		reloadLock:         &sync.Mutex{},
+		managementLinger:   DefaultManagementLinger,
+		markdownQueueLimit: DefaultMarkdownQueueLimit,
+		appConns:           newConnTracker(),
+		mgmtConns:          newConnTracker(),
+		clock:              clock.Real{},
+		requestMetrics:     newRequestMetricsSet(),
+		hostname:           defaultHostname(),
 	}
 }
 
@@ -157,8 +446,10 @@ func (s *HTTPScaffold) SetSecurePort(port int) {
 
 /*
 InsecureAddress returns the actual address (including the port if an
-ephemeral port was used) where we are listening. It must only be
-called after "Listen."
+ephemeral port was used) where we are listening. It returns an empty
+string until "Open" has been called, so other goroutines should wait for
+"AddressesReady" when "Listen" is called in the background.
+"LookupAddress" says explicitly whether the port is open.
 */
 func (s *HTTPScaffold) InsecureAddress() string {
 	if s.insecureListener == nil {
@@ -169,8 +460,8 @@ func (s *HTTPScaffold) InsecureAddress() string {
 
 /*
 SecureAddress returns the actual address (including the port if an
-ephemeral port was used) where we are listening on HTTPS. It must only be
-called after "Listen."
+ephemeral port was used) where we are listening on HTTPS. Like
+"InsecureAddress," it returns an empty string until "Open" has been called.
 */
 func (s *HTTPScaffold) SecureAddress() string {
 	if s.secureListener == nil {
@@ -191,7 +482,8 @@ func (s *HTTPScaffold) SetManagementPort(p int) {
 /*
 ManagementAddress returns the actual address (including the port if an
 ephemeral port was used) where we are listening for management
-operations. If "SetManagementPort" was not set, then it returns null.
+operations. If "SetManagementPort" was not set, then it returns an empty
+string, as it does until "Open" has been called.
 */
 func (s *HTTPScaffold) ManagementAddress() string {
 	if s.managementListener == nil {
@@ -243,6 +535,87 @@ func (s *HTTPScaffold) SetReadyPath(p string) {
 	s.readyPath = p
 }
 
+/*
+AddHealthAlias adds another path that is served by the health check, so
+that systems that expect different paths, like "/health" and "/healthz,"
+may all probe the same server. It returns an error if the path is already
+used for the ready check.
+*/
+func (s *HTTPScaffold) AddHealthAlias(p string) error {
+	if containsPath(s.readyPaths(), p) {
+		return fmt.Errorf("path %s is already used for the ready check", p)
+	}
+	if !containsPath(s.healthPaths(), p) {
+		s.healthAliases = append(s.healthAliases, p)
+	}
+	return nil
+}
+
+/*
+AddReadyAlias adds another path that is served by the ready check. It
+returns an error if the path is already used for the health check.
+*/
+func (s *HTTPScaffold) AddReadyAlias(p string) error {
+	if containsPath(s.healthPaths(), p) {
+		return fmt.Errorf("path %s is already used for the health check", p)
+	}
+	if !containsPath(s.readyPaths(), p) {
+		s.readyAliases = append(s.readyAliases, p)
+	}
+	return nil
+}
+
+/*
+healthPaths returns the health path, if set, followed by its aliases.
+*/
+func (s *HTTPScaffold) healthPaths() []string {
+	return probePaths(s.healthPath, s.healthAliases)
+}
+
+/*
+readyPaths returns the ready path, if set, followed by its aliases.
+*/
+func (s *HTTPScaffold) readyPaths() []string {
+	return probePaths(s.readyPath, s.readyAliases)
+}
+
+func probePaths(p string, aliases []string) []string {
+	var paths []string
+	if p != "" {
+		paths = append(paths, p)
+	}
+	return append(paths, aliases...)
+}
+
+func containsPath(paths []string, p string) bool {
+	for _, cp := range paths {
+		if cp == p {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+checkProbePaths returns an error if any path is used for more than one of
+the health, ready, and startup checks, since "SetHealthPath,"
+"SetReadyPath," and "SetStartupPath" can't check that by themselves.
+*/
+func (s *HTTPScaffold) checkProbePaths() error {
+	ready := s.readyPaths()
+	health := s.healthPaths()
+	for _, p := range health {
+		if containsPath(ready, p) {
+			return fmt.Errorf("path %s is used for both the health and ready checks", p)
+		}
+	}
+	if s.startupPath != "" &&
+		(containsPath(ready, s.startupPath) || containsPath(health, s.startupPath)) {
+		return fmt.Errorf("path %s is used for both the startup check and another check", s.startupPath)
+	}
+	return nil
+}
+
 /*
 SetMarkdown sets up a URI that will cause the server to mark it
 self down. However, this URI will not cause the server to actually shut
@@ -265,6 +638,190 @@ func (s *HTTPScaffold) SetMarkdown(method, path string, handler MarkdownHandler)
 	s.markdownHandler = handler
 }
 
+/*
+SetAllowedMethods restricts the HTTP methods that will be passed to the
+application handler. Requests with any other method are rejected with 405
+and an "Allow" header before they reach the handler. This makes it possible
+to block methods like TRACE and CONNECT without changing application code.
+If never called, or called with nil, then every method is passed through.
+The scaffold's own health and ready paths always accept only GET and HEAD.
+*/
+func (s *HTTPScaffold) SetAllowedMethods(methods []string) {
+	if methods == nil {
+		s.allowedMethods = nil
+		return
+	}
+	s.allowedMethods = make([]string, len(methods))
+	for i, m := range methods {
+		s.allowedMethods[i] = strings.ToUpper(m)
+	}
+}
+
+/*
+SetMarkdownExemptPaths lists paths that keep being passed to the application
+handler after the server has been marked down or has started to shut down.
+This is useful for things like token endpoints and webhook acknowledgements
+that other systems will retry aggressively if they fail during a deploy.
+A path that ends in "/" matches every path that starts with it, and any
+other path must match exactly. Requests to these paths are still tracked,
+so shutdown waits for them, but no longer than the grace timeout.
+Requests to upgrade the connection, such as WebSocket handshakes, and
+CONNECT requests are rejected even on these paths, unless
+"SetMarkdownAllowUpgrades" is used.
+*/
+func (s *HTTPScaffold) SetMarkdownExemptPaths(paths ...string) {
+	s.markdownExempt = paths
+}
+
+/*
+SetMarkdownAllowUpgrades lets requests to the paths set by
+"SetMarkdownExemptPaths" upgrade the connection, or open a CONNECT tunnel,
+after the server has been marked down. They are rejected by default
+because the resulting connection may outlast the drain and be cut off when
+the process exits. Connections that were upgraded before markdown are not
+affected either way; once hijacked, the scaffold no longer tracks them.
+*/
+func (s *HTTPScaffold) SetMarkdownAllowUpgrades(allow bool) {
+	s.markdownUpgrades = allow
+}
+
+/*
+SetManagementStopsLast makes the management port keep serving for a little
+while after the drain has completed and the other ports have closed, so
+that monitoring can see the final state: the health path returns 200 with
+"draining" set and no requests in flight, and the ready path returns 503.
+The management port always stays up while the drain is in progress. The
+amount of time defaults to "DefaultManagementLinger," and may be changed
+using "SetManagementLinger." "Listen" does not return until it is over.
+*/
+func (s *HTTPScaffold) SetManagementStopsLast(enabled bool) {
+	s.managementStopsLast = enabled
+}
+
+/*
+SetManagementLinger sets how long the management port keeps serving after
+the drain, if "SetManagementStopsLast" is used.
+*/
+func (s *HTTPScaffold) SetManagementLinger(d time.Duration) {
+	s.managementLinger = d
+}
+
+/*
+SetManagementNotFoundHandler sets the handler for requests to the
+management port that are not for one of the scaffold's paths, a handler
+added by "AddManagementHandler," or the handler passed to
+"ListenWithManagement." By default they get the standard Go 404 response.
+*/
+func (s *HTTPScaffold) SetManagementNotFoundHandler(h http.Handler) {
+	s.mgmtNotFound = h
+}
+
+/*
+SetMarkdownResponseHandler sets a handler that writes the response to
+application requests that are rejected because the server has been marked
+down or is shutting down. It replaces the default 503 response and its
+body. The "Connection: close" header is set before it is called. It is
+up to the handler to set the status code, which should normally be 503.
+*/
+func (s *HTTPScaffold) SetMarkdownResponseHandler(h http.Handler) {
+	s.markdownResponse = h
+}
+
+/*
+SetRejectedBodyLimit sets how many bytes of the request body the scaffold
+reads and discards before it rejects a request, such as with a 503 during
+markdown or a 405 for a method that is not allowed. Without this, a client
+that is still sending a large body may see the connection reset instead of
+the response. If the body is larger than this, the connection is closed
+after the response. If set to zero, bodies are not read.
+The default is "DefaultRejectedBodyLimit."
+*/
+func (s *HTTPScaffold) SetRejectedBodyLimit(n int64) {
+	s.rejectedBodyLimit = n
+}
+
+/*
+SetNotReady makes the ready path return 503 with the given reason, whatever
+the health checkers say, until "SetReady" is called. The application may
+use it to stop taking traffic for a while, for instance while it holds a
+migration lock. Unlike markdown, requests are still passed to the
+handler. If the server is marked down or shutting down, that is reported
+instead. The ready response includes "override": true while it is in
+effect.
+*/
+func (s *HTTPScaffold) SetNotReady(reason error) {
+	if reason == nil {
+		reason = ErrNotReady
+	}
+	s.readyOverride.Store(&reason)
+}
+
+/*
+SetReady clears the effect of "SetNotReady" so that the health checkers
+decide readiness again.
+*/
+func (s *HTTPScaffold) SetReady() {
+	s.readyOverride.Store((*error)(nil))
+}
+
+/*
+notReadyOverride returns the reason passed to "SetNotReady," or nil.
+*/
+func (s *HTTPScaffold) notReadyOverride() error {
+	reason, _ := s.readyOverride.Load().(*error)
+	if reason == nil {
+		return nil
+	}
+	return *reason
+}
+
+/*
+SetDefaultShutdownError sets the error that "Listen" returns when
+"Shutdown" is called with a nil reason. The default is "ErrManualStop."
+If it is set to nil, then "Listen" returns nil after a manual stop, which
+suits supervisors that treat any error as a crash. A reason passed to
+"Shutdown" always takes precedence.
+*/
+func (s *HTTPScaffold) SetDefaultShutdownError(err error) {
+	s.defaultShutdownErr = err
+}
+
+/*
+AddManagementHandler adds a handler on the management port (if set) or
+otherwise the main port, alongside the health and ready paths. The path
+is interpreted in the same way as for http.ServeMux. Unlike the scaffold's
+own paths, it is up to the handler to decide which methods to accept.
+It must be called before "Listen."
+*/
+func (s *HTTPScaffold) AddManagementHandler(path string, h http.Handler) {
+	s.managementHandlers = append(s.managementHandlers, pathHandler{
+		path:    path,
+		handler: h,
+	})
+}
+
+/*
+SetMarkdownSignal sets a signal that, when caught by "CatchSignals," marks
+the server down exactly as the markdown URI does: the "readyPath" responds
+with 503 and so do all other calls, but the server keeps running until
+"Shutdown" is called or a shutdown signal is caught. Unless a separate
+signal was set using "SetMarkupSignal," receiving the same signal a second
+time marks the server back up. It must be called before "CatchSignals."
+*/
+func (s *HTTPScaffold) SetMarkdownSignal(sig os.Signal) {
+	s.markdownSignal = sig
+}
+
+/*
+SetMarkupSignal sets a signal that, when caught by "CatchSignals," reverses
+the effect of the markdown signal or markdown URI and returns the server to
+service. It has no effect once "Shutdown" has been called. It must be called
+before "CatchSignals."
+*/
+func (s *HTTPScaffold) SetMarkupSignal(sig os.Signal) {
+	s.markupSignal = sig
+}
+
 /*
 SetHealthChecker specifies a function that the scaffold will call every time
 "HealthPath" or "ReadyPath" is invoked.
@@ -277,16 +834,45 @@ func (s *HTTPScaffold) SetHealthChecker(c HealthChecker) {
 Open opens up the ports that were created when the scaffold was set up.
 This method is optional. It may be called before Listen so that we can
 retrieve the actual address where the server is listening before we actually
-start to listen.
+start to listen. If there is a separate management port, Open starts serving
+the scaffold's own management paths on it right away. Until "StartListen"
+attaches the application handler, the health path reports "NotReady" with
+"ErrNotListening" as the reason, and the ready path returns 503, without
+calling the health checkers. If "Shutdown" is called before "StartListen,"
+the management port is closed once the scaffold stops.
+
+Calling "Open" again while the scaffold is open does nothing. Once
+"WaitForShutdown" or "Listen" has returned, though, it starts over, so that
+a test can stop a scaffold and then start it again with a new handler. The
+ports are opened again, which gives new addresses if they were dynamic,
+and any connections left from before are closed. The markdown and shutdown
+state, the drain, the health cache, and listener failures are cleared, and
+a gRPC server must be passed again since it can't be restarted. Everything
+that was set up using the "Set" and "Add" methods stays as it was,
+including the health checkers, paths, and logger, as do the shutdown
+hooks, "SetNotReady," "MarkStarted," the counters in the metrics, and the
+last "ShutdownReport" until the next shutdown. "StartListen" and "Listen"
+call "Open" too, so they can simply be called again.
 */
 func (s *HTTPScaffold) Open() error {
-	s.tracker = startRequestTracker(DefaultGraceTimeout)
+	if s.open {
+		if atomic.LoadInt32(&s.shutdownDone) == 0 {
+			return nil
+		}
+		s.reset()
+	}
+	err := s.checkProbePaths()
+	if err != nil {
+		return err
+	}
+	if s.insecureBehavior == RedirectToSecure && s.securePort < 0 {
+		return errors.New("redirecting to the secure port requires a secure port")
+	}
+	s.ensureTracker()
+	s.readShutdownState()
 
 	if s.insecurePort >= 0 {
-		il, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.insecurePort,
-		})
+		il, err := s.listenTCP(insecureRole, s.insecurePort)
 		if err != nil {
 			return err
 		}
@@ -302,17 +888,18 @@ func (s *HTTPScaffold) Open() error {
 		if s.keyFile == "" || s.certFile == "" {
 			return errors.New("key and certificate files must be set")
 		}
-		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		err := s.ReloadCertificate()
 		if err != nil {
 			return err
 		}
 		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: s.getCertificate,
 		}
-		sl, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.securePort,
-		})
+		err = s.initSessionTickets(tlsConfig)
+		if err != nil {
+			return err
+		}
+		sl, err := s.listenTCP(secureRole, s.securePort)
 		if err != nil {
 			return err
 		}
@@ -321,14 +908,12 @@ func (s *HTTPScaffold) Open() error {
 				sl.Close()
 			}
 		}()
+		s.secureTCP = sl
 		s.secureListener = tls.NewListener(sl, tlsConfig)
 	}
 
 	if s.managementPort >= 0 {
-		ml, err := net.ListenTCP("tcp", &net.TCPAddr{
-			IP:   s.ipAddr,
-			Port: s.managementPort,
-		})
+		ml, err := s.listenTCP(managementRole, s.managementPort)
 		if err != nil {
 			return err
 		}
@@ -340,7 +925,27 @@ func (s *HTTPScaffold) Open() error {
 		}()
 	}
 
+	opened, err := s.openPorts()
+	defer func() {
+		if !s.open {
+			for _, l := range opened {
+				l.Close()
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+
 	s.open = true
+	s.recordAddresses()
+	if s.managementListener != nil {
+		s.serveManagementEarly()
+	}
+	if s.tlsConfig != nil && s.ticketRotation > 0 {
+		go s.rotateSessionTickets(s.currentTracker().done)
+	}
+	s.startUpstreamChecks()
 	return nil
 }
 
@@ -350,13 +955,112 @@ libraries. It will open a port (or ports) and begin listening for
 HTTP traffic.
 */
 func (s *HTTPScaffold) StartListen(baseHandler http.Handler) error {
-	if !s.open {
-		err := s.Open()
-		if err != nil {
-			return err
+	return s.StartListenWithManagement(baseHandler, nil)
+}
+
+/*
+StartListenWithManagement is like "StartListen," but also takes a handler
+for the management port. It receives every management request that is not
+for one of the scaffold's own paths, such as health, ready, and markdown,
+which always take precedence. Like those paths, it keeps serving while the
+server drains. If "mgmtHandler" is nil, those requests get a 404 as usual.
+It is an error to pass a management handler if "SetManagementPort" was not
+called.
+*/
+func (s *HTTPScaffold) StartListenWithManagement(baseHandler, mgmtHandler http.Handler) error {
+	return s.startListen(baseHandler, mgmtHandler, nil)
+}
+
+func (s *HTTPScaffold) startListen(baseHandler, mgmtHandler http.Handler, routes map[string]http.Handler) error {
+	if mgmtHandler != nil && s.managementPort < 0 {
+		return errors.New("a management handler requires a management port")
+	}
+	err := s.checkRoutes(baseHandler, routes)
+	if err != nil {
+		return err
+	}
+	err = s.Open()
+	if err != nil {
+		return err
+	}
+
+	mainHandler, mgmtMain := s.handlers(baseHandler, mgmtHandler)
+	if mgmtMain != nil {
+		// Open is already serving the port, so just attach the full handler
+		s.mgmtSwitch.set(mgmtMain)
+	}
+	atomic.StoreInt32(&s.notListening, 0)
+
+	if s.grpcServer != nil && s.tlsConfig != nil {
+		s.tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+	}
+	if s.insecureListener != nil {
+		h := mainHandler
+		if s.insecureBehavior == RedirectToSecure {
+			h = s.redirectHandler(mainHandler)
+		}
+		if s.grpcServer != nil {
+			s.serveMulti(insecureRole, s.insecureListener, h)
+		} else {
+			s.serve(insecureRole, s.insecureListener, h, s.appConns)
+		}
+	}
+	if s.secureListener != nil {
+		if s.grpcServer != nil {
+			s.serveMulti(secureRole, s.secureListener, mainHandler)
+		} else {
+			s.serve(secureRole, s.secureListener, mainHandler, s.appConns)
 		}
-		s.open = true
 	}
+	s.servePorts(routes)
+
+	s.serverLock.Lock()
+	s.startTime = s.clock.Now()
+	s.signalAddressesReady()
+	s.serverLock.Unlock()
+	s.signalUpgradeReady()
+	return nil
+}
+
+/*
+serveManagementEarly serves the management port with only the scaffold's
+own paths until "StartListen" replaces the handler. If the scaffold stops
+before that happens, nobody will call "WaitForShutdown," so the port is
+closed here instead.
+*/
+func (s *HTTPScaffold) serveManagementEarly() {
+	atomic.StoreInt32(&s.notListening, 1)
+	s.mgmtSwitch = &switchHandler{}
+	s.mgmtSwitch.set(s.createManagementHandler())
+	s.serve(managementRole, s.managementListener, s.mgmtSwitch, s.mgmtConns)
+
+	s.serveGroup.Add(1)
+	go func(ml net.Listener, done chan struct{}) {
+		defer s.serveGroup.Done()
+		<-done
+		if atomic.LoadInt32(&s.notListening) != 0 {
+			s.stopAccepting()
+			ml.Close()
+		}
+	}(s.managementListener, s.currentTracker().done)
+}
+
+/*
+Handlers returns the handlers that the scaffold uses to serve its ports,
+with "baseHandler" wrapped in the scaffold's tracking, markdown, and other
+logic. The second handler serves the management port, and is nil if
+"SetManagementPort" was not called, in which case the management paths
+are served by the first one. "Listen" uses this method, so most programs
+do not need to call it, but it is useful for testing or for embedding the
+scaffold in another server. It does not open any ports, but "Shutdown" and
+"WaitForShutdown" work as usual once it has been called.
+*/
+func (s *HTTPScaffold) Handlers(baseHandler http.Handler) (http.Handler, http.Handler) {
+	return s.handlers(baseHandler, nil)
+}
+
+func (s *HTTPScaffold) handlers(baseHandler, fallback http.Handler) (http.Handler, http.Handler) {
+	s.ensureTracker()
 
 	// This is the handler that wraps customer API calls with tracking
 	trackingHandler := &requestHandler{
@@ -365,24 +1069,71 @@ func (s *HTTPScaffold) StartListen(baseHandler http.Handler) error {
 	}
 	mgmtHandler := s.createManagementHandler()
 
-	var mainHandler http.Handler
 	if s.managementPort >= 0 {
 		// Management on separate port
-		mainHandler = trackingHandler
-		go http.Serve(s.managementListener, mgmtHandler)
-	} else {
-		// Management on same port
-		mgmtHandler.child = trackingHandler
-		mainHandler = mgmtHandler
+		mgmtHandler.fallback = fallback
+		return trackingHandler, mgmtHandler
 	}
+	// Management on same port
+	mgmtHandler.child = trackingHandler
+	return mgmtHandler, nil
+}
 
-	if s.insecureListener != nil {
-		go http.Serve(s.insecureListener, mainHandler)
+/*
+ensureTracker creates the tracker if "Open" or "Handlers" has not done so
+yet, so that a scaffold can be shut down before it is started. It returns
+the tracker, which is safe to use from goroutines, like the one that
+handles signals, that may run while "Open" replaces it.
+*/
+func (s *HTTPScaffold) ensureTracker() *requestTracker {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	if s.tracker == nil {
+		s.tracker = startRequestTrackerWithClock(DefaultGraceTimeout, s.clock)
 	}
-	if s.secureListener != nil {
-		go http.Serve(s.secureListener, mainHandler)
+	return s.tracker
+}
+
+/*
+serve starts serving a listener. If "role" is set, then the accept loop
+stopping is reported as a listener failure.
+*/
+func (s *HTTPScaffold) serve(role string, l net.Listener, h http.Handler, conns *connTracker) *http.Server {
+	srv := &http.Server{
+		Handler:   h,
+		ErrorLog:  s.serverErrorLog(),
+		ConnState: conns.connState,
+	}
+	s.serverLock.Lock()
+	s.servers = append(s.servers, srv)
+	if s.keepAlivesDisabled {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	s.serverLock.Unlock()
+	s.serveGroup.Add(1)
+	go func() {
+		defer s.serveGroup.Done()
+		s.acceptLoopExited(role, srv.Serve(l))
+	}()
+	return srv
+}
+
+/*
+setKeepAlives turns HTTP keep-alives on or off for all of our servers.
+We turn them off as soon as we are marked down, so that clients with
+pooled connections close them and go elsewhere rather than send more
+requests that will be rejected.
+*/
+func (s *HTTPScaffold) setKeepAlives(enabled bool) {
+	s.serverLock.Lock()
+	defer s.serverLock.Unlock()
+	s.keepAlivesDisabled = !enabled
+	for _, srv := range s.servers {
+		srv.SetKeepAlivesEnabled(enabled)
+	}
+	for _, m := range s.muxes {
+		m.setKeepAlives(enabled)
 	}
-	return nil
 }
 
 /*
@@ -397,10 +1148,16 @@ This method will block until the server is shutdown using "Shutdown" or one of
 the other shutdown mechanisms. It must not be called until after
 "StartListenen"
 When shut down, this method will return the error that was passed to the "shutdown"
-method.
+method. If the grace timeout expired while requests were still running, that
+error is wrapped in an "ErrDrainTimeout."
 */
 func (s *HTTPScaffold) WaitForShutdown() error {
-	err := <-s.tracker.C
+	err := <-s.currentTracker().C
+	stopped := s.clock.Now()
+	if s.grpcStopped != nil {
+		<-s.grpcStopped
+	}
+	s.stopAccepting()
 
 	if s.insecureListener != nil {
 		s.insecureListener.Close()
@@ -408,10 +1165,19 @@ func (s *HTTPScaffold) WaitForShutdown() error {
 	if s.secureListener != nil {
 		s.secureListener.Close()
 	}
+	s.closePorts()
 	if s.managementListener != nil {
+		if s.managementStopsLast && s.managementLinger > 0 {
+			// Give monitoring a chance to see the final state
+			<-s.clock.After(s.managementLinger)
+		}
 		s.managementListener.Close()
 	}
 
+	s.writeShutdownState(err)
+	s.recordShutdownReport(err, stopped)
+	s.clearAddresses()
+	atomic.StoreInt32(&s.shutdownDone, 1)
 	return err
 }
 
@@ -428,17 +1194,114 @@ func (s *HTTPScaffold) Listen(baseHandler http.Handler) error {
 	return s.WaitForShutdown()
 }
 
+/*
+ListenWithManagement is a convenience function that first calls
+"StartListenWithManagement" and then calls "WaitForShutdown."
+*/
+func (s *HTTPScaffold) ListenWithManagement(baseHandler, mgmtHandler http.Handler) error {
+	err := s.StartListenWithManagement(baseHandler, mgmtHandler)
+	if err != nil {
+		return err
+	}
+
+	return s.WaitForShutdown()
+}
+
 /*
 Shutdown indicates that the server should stop handling incoming requests
 and exit from the "Serve" call. This may be called automatically by
 calling "CatchSignals," or automatically using this call. If
-"reason" is nil, a default reason will be assigned.
+"reason" is nil, the reason set by "SetDefaultShutdownError" is used. If
+there are shutdown hooks, new requests are rejected while they run, and
+the drain starts once they are done. See "OnShutdownWithTimeout."
 */
 func (s *HTTPScaffold) Shutdown(reason error) {
+	if s.group != nil {
+		s.group.Shutdown(reason)
+		return
+	}
+	s.shutdownOne(reason)
+}
+
+/*
+shutdownOne shuts down just this scaffold, even if it is in a group.
+*/
+func (s *HTTPScaffold) shutdownOne(reason error) {
+	t := s.ensureTracker()
+	s.beginDrain()
+	s.setKeepAlives(false)
+	if reason == nil {
+		reason = s.defaultShutdownErr
+	}
+	if s.deferShutdown(reason) {
+		return
+	}
+	t.shutdown(reason)
+	s.stopGRPC(false)
+}
+
+/*
+ForceShutdown is like "Shutdown," but the "Listen" call returns right away
+without waiting for running requests to complete. The requests are not
+interrupted, but the process will usually exit soon after. If "reason" is
+nil, then "ErrForcedShutdown" is used.
+*/
+func (s *HTTPScaffold) ForceShutdown(reason error) {
+	if s.group != nil {
+		s.group.ForceShutdown(reason)
+		return
+	}
+	s.forceShutdownOne(reason)
+}
+
+func (s *HTTPScaffold) forceShutdownOne(reason error) {
+	t := s.ensureTracker()
+	s.beginDrain()
+	s.setKeepAlives(false)
 	if reason == nil {
-		s.tracker.shutdown(ErrManualStop)
-	} else {
-		s.tracker.shutdown(reason)
+		reason = ErrForcedShutdown
+	}
+	s.cancelShutdownHooks()
+	t.force(reason)
+	s.stopGRPC(true)
+}
+
+/*
+markDown marks the server down without shutting it down. It is used by
+both the markdown URI and the markdown signal.
+*/
+func (s *HTTPScaffold) markDown() {
+	if s.group != nil {
+		s.group.markDown()
+		return
+	}
+	s.markDownOne()
+}
+
+func (s *HTTPScaffold) markDownOne() {
+	s.ensureTracker().markDown()
+	s.setKeepAlives(false)
+	if s.markdownHandler != nil {
+		s.markdownHandler()
+	}
+}
+
+/*
+markUp returns a marked-down server to service.
+*/
+func (s *HTTPScaffold) markUp() {
+	if s.group != nil {
+		s.group.markUp()
+		return
+	}
+	s.markUpOne()
+}
+
+func (s *HTTPScaffold) markUpOne() {
+	t := s.ensureTracker()
+	t.markUp()
+	if t.markedDown() == nil {
+		s.setKeepAlives(true)
 	}
 }
 
@@ -446,8 +1309,12 @@ func (s *HTTPScaffold) Shutdown(reason error) {
 CatchSignals directs the scaffold to listen for common signals. It catches
 three signals. SIGINT (aka control-C) and SIGTERM (what "kill" sends by default)
 will cause the program to be marked down, and "SignalCaught" will be returned
-by the "Listen" method. SIGHUP ("kill -1" or "kill -HUP") will cause the
+by the "Listen" method. If either one is caught a second time while the
+server is still draining, it calls "ForceShutdown," and "Listen" returns an
+"EscalatedShutdownError." SIGHUP ("kill -1" or "kill -HUP") will cause the
 stack trace of all the threads to be printed to stderr, just like a Java program.
+Signals set using "SetMarkdownSignal," "SetMarkupSignal," and
+"SetReloadSignal" are also caught, and take precedence over these.
 This method is very simplistic -- it starts listening every time that
 you call it. So a program should only call it once.
 */
@@ -464,20 +1331,60 @@ func (s *HTTPScaffold) CatchSignalsTo(out io.Writer) {
 	signal.Notify(sigChan, syscall.SIGINT)
 	signal.Notify(sigChan, syscall.SIGTERM)
 	signal.Notify(sigChan, syscall.SIGHUP)
+	if s.markdownSignal != nil {
+		signal.Notify(sigChan, s.markdownSignal)
+	}
+	if s.markupSignal != nil {
+		signal.Notify(sigChan, s.markupSignal)
+	}
+	if s.reloadSignal != nil {
+		signal.Notify(sigChan, s.reloadSignal)
+	}
 
-	go func() {
-		for {
-			sig := <-sigChan
-			switch sig {
-			case syscall.SIGINT, syscall.SIGTERM:
+	go s.handleSignals(sigChan, out)
+}
+
+/*
+handleSignals acts on signals from the channel until a termination signal
+has been received twice, or the server has been forced to shut down.
+*/
+func (s *HTTPScaffold) handleSignals(sigChan chan os.Signal, out io.Writer) {
+	draining := false
+	for {
+		sig := <-sigChan
+		switch {
+		case s.markdownSignal != nil && sig == s.markdownSignal:
+			if s.markupSignal == nil && s.ensureTracker().isMarkedDown() {
+				s.markUp()
+			} else {
+				s.markDown()
+			}
+			continue
+		case s.markupSignal != nil && sig == s.markupSignal:
+			s.markUp()
+			continue
+		case s.reloadSignal != nil && sig == s.reloadSignal:
+			go s.Reload()
+			continue
+		}
+
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			if !draining {
+				// Keep listening so that a second signal can force an exit
+				draining = true
+				s.logInfo("Caught %s, shutting down gracefully. Send it again to force exit.", sig)
 				s.Shutdown(ErrSignalCaught)
-				signal.Reset()
-				return
-			case syscall.SIGHUP:
-				dumpStack(out)
+				continue
 			}
+			s.logInfo("Caught %s again, forcing exit", sig)
+			s.ForceShutdown(&EscalatedShutdownError{Reason: ErrSignalCaught})
+			signal.Stop(sigChan)
+			return
+		case syscall.SIGHUP:
+			dumpStack(out)
 		}
-	}()
+	}
 }
 
 func dumpStack(out io.Writer) {
@@ -15,21 +15,27 @@
 package goscaffold
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/SermoDigital/jose/crypto"
 	"github.com/SermoDigital/jose/jws"
 	"github.com/julienschmidt/httprouter"
+	"gopkg.in/yaml.v2"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -67,9 +73,8 @@ var _ = Describe("Scaffold Tests", func() {
 			stopChan <- stopErr
 		}()
 
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 		resp, err := http.Get(fmt.Sprintf("http://%s", s.InsecureAddress()))
 		Expect(err).Should(Succeed())
 		resp.Body.Close()
@@ -97,9 +102,8 @@ var _ = Describe("Scaffold Tests", func() {
 		}()
 
 		// Just make sure that it's up
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 		resp, err := http.Get(fmt.Sprintf("http://%s", s.InsecureAddress()))
 		Expect(err).Should(Succeed())
 		resp.Body.Close()
@@ -114,6 +118,106 @@ var _ = Describe("Scaffold Tests", func() {
 		Eventually(stopChan).Should(Receive(Equal(shutdownErr)))
 	})
 
+	It("Management port handler", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		admin := http.NewServeMux()
+		admin.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("admin " + r.URL.Path))
+		})
+		admin.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.ListenWithManagement(&testHandler{}, admin)
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		mgmt := s.ManagementURL().String()
+		code, bod := getText(mgmt + "/admin/users")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("admin /admin/users"))
+		code, _ = getText(mgmt + "/nothing")
+		Expect(code).Should(Equal(404))
+		// The scaffold's own paths win
+		code, _ = getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+		// The admin paths are not on the application port
+		code, bod = getText(s.InsecureURL().String() + "/admin/users")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(BeEmpty())
+		Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+		// Keep the drain going so we can see that admin paths still work
+		go getText(s.InsecureURL().String() + "?delay=500ms")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		s.Shutdown(nil)
+		code, _ = getText(mgmt + "/admin/users")
+		Expect(code).Should(Equal(200))
+		code, _ = getText(mgmt + "/ready")
+		Expect(code).Should(Equal(503))
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Management not found and markdown responses", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		s.SetManagementNotFoundHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+		s.SetMarkdownResponseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		mgmt := s.ManagementURL().String()
+		code, bod := getText(mgmt + "/")
+		Expect(code).Should(Equal(404))
+		Expect(bod).Should(BeEmpty())
+		code, _ = getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+
+		s.markDown()
+		resp, err := http.Get(s.InsecureURL().String())
+		Expect(err).Should(Succeed())
+		bod2, err := ioutil.ReadAll(resp.Body)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(503))
+		Expect(bod2).Should(BeEmpty())
+		Expect(resp.Close).Should(BeTrue())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Management handler requires management port", func() {
+		s := CreateHTTPScaffold()
+		err := s.ListenWithManagement(&testHandler{}, http.NotFoundHandler())
+		Expect(err).Should(MatchError(ContainSubstring("management port")))
+		Expect(s.InsecureURL()).Should(BeNil())
+	})
+
 	It("Shutdown", func() {
 		s := CreateHTTPScaffold()
 		s.SetHealthPath("/health")
@@ -133,9 +237,8 @@ var _ = Describe("Scaffold Tests", func() {
 		}()
 
 		// Just make sure server is listening
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 
 		// Ensure that we are healthy and ready
 		code, _ := getText(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
@@ -173,6 +276,50 @@ var _ = Describe("Scaffold Tests", func() {
 		}, time.Second).Should(BeFalse())
 	})
 
+	It("Default shutdown error", func() {
+		run := func(s *HTTPScaffold, reason error) error {
+			stopChan := make(chan error)
+			err := s.Open()
+			Expect(err).Should(Succeed())
+			go func() {
+				stopChan <- s.Listen(&testHandler{})
+			}()
+			Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+			Expect(testGet(s, "")).Should(BeTrue())
+
+			// Keep one request in flight so we can see what is rejected
+			go getText(fmt.Sprintf("http://%s?delay=250ms", s.InsecureAddress()))
+			Eventually(func() int {
+				return s.DrainStatus().InFlight
+			}).Should(Equal(1))
+			s.Shutdown(reason)
+			code, _ := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			Expect(code).Should(Equal(503))
+
+			var stopErr error
+			Eventually(stopChan, 2*time.Second).Should(Receive(&stopErr))
+			return stopErr
+		}
+
+		err := run(CreateHTTPScaffold(), nil)
+		Expect(err).Should(Equal(ErrManualStop))
+		Expect(errors.Is(fmt.Errorf("serving: %w", err), ErrManualStop)).Should(BeTrue())
+
+		s := CreateHTTPScaffold()
+		s.SetDefaultShutdownError(nil)
+		Expect(run(s, nil)).Should(BeNil())
+
+		stopErr := errors.New("Stop")
+		s = CreateHTTPScaffold()
+		s.SetDefaultShutdownError(nil)
+		Expect(run(s, stopErr)).Should(Equal(stopErr))
+
+		defaultErr := errors.New("Default")
+		s = CreateHTTPScaffold()
+		s.SetDefaultShutdownError(defaultErr)
+		Expect(run(s, nil)).Should(Equal(defaultErr))
+	})
+
 	It("Markdown", func() {
 		var markedDown int32
 
@@ -193,9 +340,8 @@ var _ = Describe("Scaffold Tests", func() {
 		}()
 
 		// Just make sure server is listening
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 
 		// Ensure that we are healthy and ready
 		code, _ := getText(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
@@ -227,6 +373,331 @@ var _ = Describe("Scaffold Tests", func() {
 		Eventually(stopChan).Should(Receive(Equal(stopErr)))
 	})
 
+	It("Keep-alives closed on shutdown", func() {
+		s := CreateHTTPScaffold()
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// A pooled connection that has already been used once
+		conn, err := net.Dial("tcp", s.InsecureAddress())
+		Expect(err).Should(Succeed())
+		defer conn.Close()
+		rdr := bufio.NewReader(conn)
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: test\r\n\r\n")
+		resp, err := http.ReadResponse(rdr, nil)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(200))
+		Expect(resp.Close).Should(BeFalse())
+
+		// Keep the server from exiting
+		go getText(fmt.Sprintf("http://%s?delay=1s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		stopErr := errors.New("Stop")
+		s.Shutdown(stopErr)
+
+		// The server closes the idle connection rather than wait for it
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = rdr.ReadByte()
+		Expect(err).Should(Equal(io.EOF))
+
+		// And new connections are told to close after the 503
+		req, err := http.NewRequest("GET", fmt.Sprintf("http://%s", s.InsecureAddress()), nil)
+		Expect(err).Should(Succeed())
+		resp, err = http.DefaultClient.Do(req)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		Expect(resp.StatusCode).Should(Equal(503))
+		Expect(resp.Close).Should(BeTrue())
+
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+	})
+
+	It("Markdown signal", func() {
+		s := CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		s.SetMarkdownSignal(syscall.SIGUSR1)
+		s.CatchSignalsTo(GinkgoWriter)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// First signal marks us down but doesn't stop us
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		Eventually(func() int {
+			code, _ := getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+			return code
+		}).Should(Equal(503))
+		code, _ := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+		Expect(code).Should(Equal(503))
+		Consistently(stopChan, 250*time.Millisecond).ShouldNot(Receive())
+
+		// Second signal puts us back in service
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		Eventually(func() int {
+			code, _ := getText(fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+			return code
+		}).Should(Equal(200))
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		// Marking down then shutting down
+		syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+		Eventually(func() bool {
+			return testGet(s, "")
+		}).Should(BeFalse())
+		stopErr := errors.New("Marked down then stopped")
+		s.Shutdown(stopErr)
+		Eventually(stopChan).Should(Receive(Equal(stopErr)))
+	})
+
+	It("Markdown signal before open", func() {
+		s := CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		s.SetMarkdownSignal(syscall.SIGUSR1)
+		sigChan := make(chan os.Signal, 1)
+		go s.handleSignals(sigChan, GinkgoWriter)
+
+		sigChan <- syscall.SIGUSR1
+		Eventually(func() bool {
+			return s.ensureTracker().isMarkedDown()
+		}).Should(BeTrue())
+		sigChan <- syscall.SIGUSR1
+		Eventually(func() bool {
+			return s.ensureTracker().isMarkedDown()
+		}).Should(BeFalse())
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		sigChan <- syscall.SIGUSR1
+		Eventually(func() bool {
+			return testGet(s, "")
+		}).Should(BeFalse())
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Second signal forces exit", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		// Ginkgo handles SIGTERM itself, so deliver it directly
+		sigChan := make(chan os.Signal, 2)
+		go s.handleSignals(sigChan, GinkgoWriter)
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		go getText(fmt.Sprintf("http://%s?delay=10s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		sigChan <- syscall.SIGTERM
+		Eventually(func() int {
+			code, _ := getText(fmt.Sprintf("http://%s", s.InsecureAddress()))
+			return code
+		}).Should(Equal(503))
+		Expect(logger.lastInfo()).Should(ContainSubstring("again to force exit"))
+		Consistently(stopChan, 250*time.Millisecond).ShouldNot(Receive())
+
+		sigChan <- syscall.SIGTERM
+		var stopErr error
+		Eventually(stopChan).Should(Receive(&stopErr))
+		Expect(errors.Is(stopErr, ErrForcedShutdown)).Should(BeTrue())
+		Expect(errors.Is(stopErr, ErrSignalCaught)).Should(BeTrue())
+		Expect(stopErr.Error()).Should(ContainSubstring(ErrSignalCaught.Error()))
+	})
+
+	It("Force shutdown", func() {
+		s := CreateHTTPScaffold()
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		go getText(fmt.Sprintf("http://%s?delay=10s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		s.ForceShutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrForcedShutdown)))
+	})
+
+	It("Management method restrictions", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		for _, m := range []string{"POST", "PUT", "DELETE", "TRACE"} {
+			resp := doMethod(m, fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+			Expect(resp.StatusCode).Should(Equal(405))
+			Expect(resp.Header.Get("Allow")).Should(Equal("GET, HEAD"))
+			resp = doMethod(m, fmt.Sprintf("http://%s/ready", s.InsecureAddress()))
+			Expect(resp.StatusCode).Should(Equal(405))
+			resp = doMethod(m, fmt.Sprintf("http://%s/debug/pprof/", s.InsecureAddress()))
+			Expect(resp.StatusCode).Should(Equal(405))
+		}
+		resp := doMethod("HEAD", fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(resp.StatusCode).Should(Equal(200))
+
+		// With no restriction, the application sees every method
+		for _, m := range []string{"POST", "DELETE", "TRACE"} {
+			resp = doMethod(m, fmt.Sprintf("http://%s/", s.InsecureAddress()))
+			Expect(resp.StatusCode).Should(Equal(200))
+		}
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Application allowed methods", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetAllowedMethods([]string{"get", "post"})
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		resp := doMethod("POST", fmt.Sprintf("http://%s/", s.InsecureAddress()))
+		Expect(resp.StatusCode).Should(Equal(200))
+		for _, m := range []string{"TRACE", "DELETE"} {
+			resp = doMethod(m, fmt.Sprintf("http://%s/", s.InsecureAddress()))
+			Expect(resp.StatusCode).Should(Equal(405))
+			Expect(resp.Header.Get("Allow")).Should(Equal("GET, POST"))
+		}
+		code, _ := getText(fmt.Sprintf("http://%s/health", s.InsecureAddress()))
+		Expect(code).Should(Equal(200))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Rejected request bodies", func() {
+		s := CreateHTTPScaffold()
+		s.SetAllowedMethods([]string{"GET", "POST"})
+		s.SetRejectedBodyLimit(1024)
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		send := func(method string, size int) *http.Response {
+			// Hide the length so that the body is sent chunked
+			body := struct{ io.Reader }{bytes.NewReader(make([]byte, size))}
+			req, err := http.NewRequest(method, s.InsecureURL().String(), body)
+			Expect(err).Should(Succeed())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			Expect(req.ContentLength).Should(BeEquivalentTo(0))
+			resp.Body.Close()
+			return resp
+		}
+
+		resp := send("PUT", 512)
+		Expect(resp.StatusCode).Should(Equal(405))
+		Expect(resp.Close).Should(BeFalse())
+		resp = send("PUT", 64*1024)
+		Expect(resp.StatusCode).Should(Equal(405))
+		Expect(resp.Close).Should(BeTrue())
+
+		s.markDown()
+		resp = send("POST", 512)
+		Expect(resp.StatusCode).Should(Equal(503))
+		resp = send("POST", 64*1024)
+		Expect(resp.StatusCode).Should(Equal(503))
+		Expect(resp.Close).Should(BeTrue())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Discard rejected body", func() {
+		s := CreateHTTPScaffold()
+		s.SetRejectedBodyLimit(1024)
+
+		body := bytes.NewReader(make([]byte, 512))
+		resp := httptest.NewRecorder()
+		s.discardBody(resp, httptest.NewRequest("POST", "/", body))
+		Expect(body.Len()).Should(BeZero())
+		Expect(resp.Header().Get("Connection")).Should(BeEmpty())
+
+		body = bytes.NewReader(make([]byte, 4096))
+		resp = httptest.NewRecorder()
+		s.discardBody(resp, httptest.NewRequest("POST", "/", body))
+		Expect(body.Len()).Should(Equal(4096 - 1025))
+		Expect(resp.Header().Get("Connection")).Should(Equal("close"))
+
+		body = bytes.NewReader(make([]byte, 512))
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Expect", "100-continue")
+		s.discardBody(httptest.NewRecorder(), req)
+		Expect(body.Len()).Should(Equal(512))
+
+		s.SetRejectedBodyLimit(0)
+		body = bytes.NewReader(make([]byte, 512))
+		s.discardBody(httptest.NewRecorder(), httptest.NewRequest("POST", "/", body))
+		Expect(body.Len()).Should(Equal(512))
+	})
+
 	It("Health Check Functions", func() {
 		status := int32(OK)
 		var healthErr = &atomic.Value{}
@@ -260,9 +731,8 @@ var _ = Describe("Scaffold Tests", func() {
 		}()
 
 		// Just make sure that it's up
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 
 		// Health should be good
 		code, _ := getText(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
@@ -299,12 +769,32 @@ var _ = Describe("Scaffold Tests", func() {
 		Expect(js["status"]).Should(Equal("NotReady"))
 		Expect(js["reason"]).Should(Equal("Custom"))
 
+		// And in YAML
+		code, ym := getYAML(fmt.Sprintf("http://%s/ready", s.ManagementAddress()),
+			"application/yaml")
+		Expect(code).Should(Equal(503))
+		Expect(ym["status"]).Should(Equal("NotReady"))
+		Expect(ym["reason"]).Should(Equal("Custom"))
+		code, ym = getYAML(fmt.Sprintf("http://%s/health", s.ManagementAddress()),
+			"application/json;q=0.1, application/x-yaml")
+		Expect(code).Should(Equal(200))
+		Expect(ym["status"]).Should(Equal("NotReady"))
+
+		// Unrecognized types get plain text
+		code, bod = getWithAccept(fmt.Sprintf("http://%s/ready", s.ManagementAddress()),
+			"image/png")
+		Expect(code).Should(Equal(503))
+		Expect(bod).Should(Equal("Custom"))
+
 		// Mark back up. Should be all good
 		atomic.StoreInt32(&status, int32(OK))
 		code, _ = getText(fmt.Sprintf("http://%s/health", s.ManagementAddress()))
 		Expect(code).Should(Equal(200))
 		code, _ = getText(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
 		Expect(code).Should(Equal(200))
+		code, js = getJSON(fmt.Sprintf("http://%s/ready", s.ManagementAddress()))
+		Expect(code).Should(Equal(200))
+		Expect(js["status"]).Should(Equal("OK"))
 
 		s.Shutdown(nil)
 		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
@@ -327,9 +817,8 @@ var _ = Describe("Scaffold Tests", func() {
 			stopChan <- stopErr
 		}()
 
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 		Eventually(func() bool {
 			return testGetSecure(s, "")
 		}, time.Second).Should(BeTrue())
@@ -358,9 +847,8 @@ var _ = Describe("Scaffold Tests", func() {
 			stopChan <- stopErr
 		}()
 
-		Eventually(func() bool {
-			return testGetSecure(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
 
 		shutdownErr := errors.New("Validate")
 		s.Shutdown(shutdownErr)
@@ -382,9 +870,8 @@ var _ = Describe("Scaffold Tests", func() {
 			stopChan <- stopErr
 		}()
 
-		Eventually(func() bool {
-			return testGet(s, "")
-		}, 5*time.Second).Should(BeTrue())
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
 		_, err = http.Get(fmt.Sprintf("http://%s:%s", GetLocalIPStr(), "8181"))
 		Expect(err).ShouldNot(Succeed())
 		shutdownErr := errors.New("Validate")
@@ -508,9 +995,13 @@ func buslogicHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func getText(url string) (int, string) {
+	return getWithAccept(url, "text/plain")
+}
+
+func getWithAccept(url, accept string) (int, string) {
 	req, err := http.NewRequest("GET", url, nil)
 	Expect(err).Should(Succeed())
-	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("Accept", accept)
 	resp, err := http.DefaultClient.Do(req)
 	Expect(err).Should(Succeed())
 	defer resp.Body.Close()
@@ -519,7 +1010,7 @@ func getText(url string) (int, string) {
 	return resp.StatusCode, string(bod)
 }
 
-func getJSON(url string) (int, map[string]string) {
+func getJSON(url string) (int, map[string]interface{}) {
 	req, err := http.NewRequest("GET", url, nil)
 	Expect(err).Should(Succeed())
 	req.Header.Set("Accept", "application/json")
@@ -528,12 +1019,29 @@ func getJSON(url string) (int, map[string]string) {
 	defer resp.Body.Close()
 	bod, err := ioutil.ReadAll(resp.Body)
 	Expect(err).Should(Succeed())
-	var vals map[string]string
+	var vals map[string]interface{}
 	err = json.Unmarshal(bod, &vals)
 	Expect(err).Should(Succeed())
 	return resp.StatusCode, vals
 }
 
+func doMethod(method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	Expect(err).Should(Succeed())
+	resp, err := http.DefaultClient.Do(req)
+	Expect(err).Should(Succeed())
+	resp.Body.Close()
+	return resp
+}
+
+func getYAML(url, accept string) (int, map[string]interface{}) {
+	code, bod := getWithAccept(url, accept)
+	var vals map[string]interface{}
+	err := yaml.Unmarshal([]byte(bod), &vals)
+	Expect(err).Should(Succeed())
+	return code, vals
+}
+
 func validatePprof(addr string) {
 	code, _ := getText(fmt.Sprintf("http://%s/debug/pprof/", addr))
 	Expect(code).Should(Equal(200))
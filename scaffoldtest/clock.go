@@ -0,0 +1,37 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scaffoldtest
+
+import (
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+)
+
+/*
+A FakeClock is a "goscaffold.Clock" whose time only moves when "Advance"
+is called. Pass it to "SetClock" before "NewServer" to test the grace
+timeout, drain logging, health cache, and other timing without waiting
+for them. "Timers" returns the number of timers that are waiting for the
+clock, so that a test can wait until the scaffold is ready to be advanced.
+*/
+type FakeClock = clock.Fake
+
+/*
+NewFakeClock returns a fake clock that starts at "start."
+*/
+func NewFakeClock(start time.Time) *FakeClock {
+	return clock.NewFake(start)
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package scaffoldtest makes it easy to test services that are built using
+goscaffold. It runs the scaffold's handlers on httptest servers, so that
+tests don't need to open ports or wait for a listener to come up.
+*/
+package scaffoldtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/apid/goscaffold"
+)
+
+/*
+A Server runs an HTTPScaffold on one or two httptest servers: one for the
+application and one for the management port, if the scaffold was
+configured with one.
+*/
+type Server struct {
+	// Scaffold is the scaffold that is being tested
+	Scaffold   *goscaffold.HTTPScaffold
+	app        *httptest.Server
+	management *httptest.Server
+}
+
+/*
+NewServer starts serving "handler" using the scaffold's wrapping logic.
+The scaffold should already be configured with its health path, markdown
+path, and so on. Its ports are ignored, except that if
+"SetManagementPort" was called then the management paths are served on
+a separate server. If "s" is nil, then a default scaffold is used.
+*/
+func NewServer(s *goscaffold.HTTPScaffold, handler http.Handler) *Server {
+	if s == nil {
+		s = goscaffold.CreateHTTPScaffold()
+	}
+	app, mgmt := s.Handlers(handler)
+	ts := &Server{
+		Scaffold: s,
+		app:      httptest.NewServer(app),
+	}
+	if mgmt != nil {
+		ts.management = httptest.NewServer(mgmt)
+	}
+	return ts
+}
+
+/*
+URL returns the URL of a path on the application server.
+*/
+func (ts *Server) URL(path string) string {
+	return ts.app.URL + path
+}
+
+/*
+ManagementURL returns the URL of a path on the management server, or on
+the application server if there is no separate management port.
+*/
+func (ts *Server) ManagementURL(path string) string {
+	if ts.management == nil {
+		return ts.URL(path)
+	}
+	return ts.management.URL + path
+}
+
+/*
+Client returns an HTTP client that may be used to call the servers.
+*/
+func (ts *Server) Client() *http.Client {
+	return ts.app.Client()
+}
+
+/*
+BeginShutdown calls "Shutdown" on the scaffold. It returns right away, and
+from then on application requests get 503 and the ready path fails, just
+as they would in a real server.
+*/
+func (ts *Server) BeginShutdown(reason error) {
+	ts.Scaffold.Shutdown(reason)
+}
+
+/*
+Wait blocks until the scaffold has finished draining after "BeginShutdown"
+and returns the shutdown reason, just as "Listen" would.
+*/
+func (ts *Server) Wait() error {
+	return ts.Scaffold.WaitForShutdown()
+}
+
+/*
+Close shuts down the servers. It does not wait for the scaffold to drain.
+*/
+func (ts *Server) Close() {
+	ts.app.Close()
+	if ts.management != nil {
+		ts.management.Close()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package scaffoldtest
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apid/goscaffold"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Test server", func() {
+	hello := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello"))
+	})
+
+	get := func(ts *Server, url string) int {
+		resp, err := ts.Client().Get(url)
+		Expect(err).Should(Succeed())
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("Shared port", func() {
+		s := goscaffold.CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		ts := NewServer(s, hello)
+		defer ts.Close()
+
+		Expect(get(ts, ts.URL("/"))).Should(Equal(200))
+		Expect(get(ts, ts.ManagementURL("/ready"))).Should(Equal(200))
+
+		stopErr := errors.New("Stop")
+		ts.BeginShutdown(stopErr)
+		Expect(get(ts, ts.URL("/"))).Should(Equal(503))
+		Expect(get(ts, ts.ManagementURL("/ready"))).Should(Equal(503))
+		Expect(get(ts, ts.ManagementURL("/health"))).Should(Equal(200))
+		Expect(ts.Wait()).Should(Equal(stopErr))
+	})
+
+	It("Management port", func() {
+		s := goscaffold.CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		ts := NewServer(s, hello)
+		defer ts.Close()
+
+		Expect(ts.ManagementURL("/")).ShouldNot(Equal(ts.URL("/")))
+		Expect(get(ts, ts.ManagementURL("/health"))).Should(Equal(200))
+		Expect(get(ts, ts.URL("/health"))).Should(Equal(200))
+		Expect(get(ts, ts.ManagementURL("/"))).Should(Equal(404))
+
+		ts.BeginShutdown(nil)
+		Expect(get(ts, ts.URL("/"))).Should(Equal(503))
+		Expect(ts.Wait()).Should(Equal(goscaffold.ErrManualStop))
+	})
+
+	It("Fake clock", func() {
+		clk := NewFakeClock(time.Now())
+		s := goscaffold.CreateHTTPScaffold()
+		s.SetClock(clk)
+		release := make(chan struct{})
+		started := make(chan struct{})
+		ts := NewServer(s, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+		defer ts.Close()
+		defer close(release)
+
+		go get(ts, ts.URL("/stuck"))
+		Eventually(started).Should(BeClosed())
+
+		ts.BeginShutdown(nil)
+		waitDone := make(chan error, 1)
+		go func() {
+			waitDone <- ts.Wait()
+		}()
+		clk.Advance(goscaffold.DefaultGraceTimeout - time.Second)
+		Consistently(waitDone, 50*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(time.Second)
+
+		var err error
+		Eventually(waitDone).Should(Receive(&err))
+		var timeout *goscaffold.ErrDrainTimeout
+		Expect(errors.As(err, &timeout)).Should(BeTrue())
+		Expect(timeout.Abandoned).Should(Equal(1))
+		Expect(timeout.Elapsed).Should(Equal(goscaffold.DefaultGraceTimeout))
+	})
+
+	It("Default scaffold", func() {
+		ts := NewServer(nil, hello)
+		defer ts.Close()
+		Expect(get(ts, ts.URL("/"))).Should(Equal(200))
+	})
+})
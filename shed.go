@@ -0,0 +1,70 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+/*
+ErrOverloaded is the reason given to requests that were rejected because
+of "SetMaxInflightRequests."
+*/
+var ErrOverloaded = errors.New("Too many requests in flight")
+
+/*
+SetMaxInflightRequests sheds load by rejecting application requests with
+a 503 and a "Retry-After" header as soon as they arrive if "n" requests
+are already running, rather than letting them queue up. Rejected requests
+are counted in the "shed" metric. The health, ready, and other management
+paths are never shed, and neither are the paths set by
+"SetMarkdownExemptPaths" unless "SetShedMarkdownExemptPaths" is used, although
+requests to them still count towards the limit. If "n" is zero, which is
+the default, there is no limit.
+*/
+func (s *HTTPScaffold) SetMaxInflightRequests(n int, retryAfter time.Duration) {
+	s.maxInflight = int64(n)
+	s.shedRetryAfter = retryAfter
+}
+
+/*
+SetShedMarkdownExemptPaths makes the limit set by "SetMaxInflightRequests"
+apply to the paths set by "SetMarkdownExemptPaths" as well, if "shed" is
+true.
+*/
+func (s *HTTPScaffold) SetShedMarkdownExemptPaths(shed bool) {
+	s.shedExempt = shed
+}
+
+/*
+shedLimit returns the number of running requests at which a request is
+shed, or zero if it never is. Requests that are not shed are still counted,
+so they push the others over the limit.
+*/
+func (s *HTTPScaffold) shedLimit(exempt bool) int64 {
+	if exempt && !s.shedExempt {
+		return 0
+	}
+	return s.maxInflight
+}
+
+func (s *HTTPScaffold) shed(resp http.ResponseWriter, req *http.Request) {
+	s.discardBody(resp, req)
+	s.markRejected(resp)
+	setRetryAfter(resp, s.shedRetryAfter)
+	writeUnavailable(resp, req, NotReady, ErrOverloaded)
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Load shedding tests", func() {
+	It("In-flight limit", func() {
+		const limit = 5
+		const clients = 50
+
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetMetricsPath("/metrics")
+		s.SetMaxInflightRequests(limit, 2*time.Second)
+
+		var running, maxRunning int32
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			time.Sleep(200 * time.Millisecond)
+		}))
+
+		// Shed requests are never counted, even for a moment
+		var maxCounted int64
+		sampling := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			for {
+				select {
+				case <-sampling:
+					return
+				default:
+				}
+				if n := atomic.LoadInt64(&s.tracker.active); n > maxCounted {
+					maxCounted = n
+				}
+			}
+		}()
+
+		var ok, shed int32
+		var slowestShed int64
+		wg := &sync.WaitGroup{}
+		for c := 0; c < clients; c++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for r := 0; r < 10; r++ {
+					start := time.Now()
+					rec := httptest.NewRecorder()
+					h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+					switch rec.Code {
+					case http.StatusOK:
+						atomic.AddInt32(&ok, 1)
+					case http.StatusServiceUnavailable:
+						atomic.AddInt32(&shed, 1)
+						Expect(rec.Header().Get("Retry-After")).Should(Equal("2"))
+						Expect(rec.Body.String()).Should(Equal(ErrOverloaded.Error()))
+						took := int64(time.Since(start))
+						for {
+							m := atomic.LoadInt64(&slowestShed)
+							if took <= m || atomic.CompareAndSwapInt64(&slowestShed, m, took) {
+								break
+							}
+						}
+					default:
+						Fail("Unexpected status")
+					}
+				}
+			}()
+		}
+
+		// Probes are never shed
+		for i := 0; i < 20; i++ {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+			Expect(rec.Code).Should(Equal(http.StatusOK))
+		}
+		wg.Wait()
+		close(sampling)
+		<-sampled
+
+		Expect(atomic.LoadInt32(&maxRunning)).Should(BeNumerically("<=", limit))
+		Expect(maxCounted).Should(BeEquivalentTo(limit))
+		Expect(ok).Should(BeNumerically(">", 0))
+		Expect(shed).Should(BeNumerically(">", 0))
+		Expect(ok + shed).Should(BeEquivalentTo(clients * 10))
+		// Shedding does not wait for the running requests
+		Expect(time.Duration(slowestShed)).Should(BeNumerically("<", 100*time.Millisecond))
+		Expect(s.DrainStatus().InFlight).Should(BeZero())
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		var doc map[string]interface{}
+		Expect(json.Unmarshal(rec.Body.Bytes(), &doc)).Should(Succeed())
+		Expect(doc["shed"]).Should(BeEquivalentTo(shed))
+	})
+
+	It("Exempt paths", func() {
+		s := CreateHTTPScaffold()
+		s.SetMarkdownExemptPaths("/token")
+		s.SetMaxInflightRequests(1, 0)
+		block := make(chan struct{})
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/block" {
+				<-block
+			}
+		}))
+		serve := func(path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			return rec
+		}
+
+		go serve("/block")
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		rec := serve("/other")
+		Expect(rec.Code).Should(Equal(http.StatusServiceUnavailable))
+		Expect(rec.Header()).ShouldNot(HaveKey("Retry-After"))
+		Expect(serve("/token").Code).Should(Equal(http.StatusOK))
+
+		s.SetShedMarkdownExemptPaths(true)
+		Expect(serve("/token").Code).Should(Equal(http.StatusServiceUnavailable))
+		close(block)
+	})
+})
@@ -0,0 +1,309 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+shutdownHook is a function registered by "OnShutdownWithTimeout."
+*/
+type shutdownHook struct {
+	fn      func(ctx context.Context) error
+	timeout time.Duration
+}
+
+/*
+ShutdownHookResult describes how one shutdown hook went.
+*/
+type ShutdownHookResult struct {
+	// Index is where the hook comes in the order that it was registered
+	Index int
+	// Duration is how long the hook ran, or how long we waited for it
+	Duration time.Duration
+	// Err is the error that the hook returned, if any. It is
+	// "context.DeadlineExceeded" if the hook was abandoned, and
+	// "context.Canceled" if "ForceShutdown" stopped it.
+	Err error
+	// TimedOut is true if the hook was abandoned because it ran too long
+	TimedOut bool
+}
+
+/*
+ShutdownReport summarizes how the scaffold shut down.
+*/
+type ShutdownReport struct {
+	// Reason is the error that "WaitForShutdown" returned
+	Reason error
+	// Hooks has one entry for every shutdown hook that ran, in order
+	Hooks []ShutdownHookResult
+	// HookDuration is the total time spent in the shutdown hooks
+	HookDuration time.Duration
+	// DrainDuration is how long it took from "Shutdown" until the last
+	// request completed or was abandoned, including the shutdown hooks
+	DrainDuration time.Duration
+	// Abandoned is the number of requests still running when the grace
+	// timeout cut the drain short
+	Abandoned int
+}
+
+/*
+OnShutdown is like "OnShutdownWithTimeout," but the hook has no timeout of
+its own. It may still run no longer than what is left of the grace
+timeout.
+*/
+func (s *HTTPScaffold) OnShutdown(fn func(ctx context.Context) error) {
+	s.OnShutdownWithTimeout(fn, 0)
+}
+
+/*
+OnShutdownWithTimeout adds a hook that is called when "Shutdown" is
+called, for instance to deregister from service discovery, flush a cache,
+or push final metrics. The hooks are called one at a time, in the order
+that they were added, before the scaffold starts to count down the grace
+timeout for running requests. While they run, new requests are rejected
+with the reason for the shutdown, and the ones that are running may
+complete. Unlike a markdown, this can't be undone by marking up.
+
+Each hook gets a context that is done once "timeout" has passed, or once
+the grace timeout would expire if that is sooner. A hook that runs longer
+than that is abandoned: its context is done with
+"context.DeadlineExceeded," an error is logged, and the next hook is
+called without waiting for it. Errors from hooks are
+logged too. The time spent in hooks is taken out of the grace timeout, so
+shutting down takes no longer than it would without them. "ForceShutdown"
+cancels the hook that is running and skips the rest. A timeout of zero or
+less means that the hook only has the grace timeout.
+*/
+func (s *HTTPScaffold) OnShutdownWithTimeout(
+	fn func(ctx context.Context) error, timeout time.Duration) {
+	s.shutdownHooks = append(s.shutdownHooks, shutdownHook{
+		fn:      fn,
+		timeout: timeout,
+	})
+}
+
+/*
+ShutdownReport returns a summary of the last shutdown, including what
+happened to every shutdown hook, or nil if "WaitForShutdown" has not
+returned yet. It stays the same after "Open" is called again, until the
+next shutdown.
+*/
+func (s *HTTPScaffold) ShutdownReport() *ShutdownReport {
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	return s.shutdownReport
+}
+
+/*
+deferShutdown starts the shutdown hooks, if there are any and they have
+not run yet, and returns true if they will finish the shutdown. If they
+are already running, the reason that they will use is replaced.
+*/
+func (s *HTTPScaffold) deferShutdown(reason error) bool {
+	tracker := s.currentTracker()
+	s.drainLock.Lock()
+	if len(s.shutdownHooks) == 0 || s.hooksDone {
+		s.drainLock.Unlock()
+		return false
+	}
+	s.hookReason = reason
+	tracker.stopSoon(reason)
+	if s.hookCancel != nil {
+		s.drainLock.Unlock()
+		return true
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.hookCancel = cancel
+	began := s.drainStart
+	s.drainLock.Unlock()
+
+	go s.runShutdownHooks(ctx, began)
+	return true
+}
+
+/*
+cancelShutdownHooks stops the shutdown hooks, if they are running.
+*/
+func (s *HTTPScaffold) cancelShutdownHooks() {
+	s.drainLock.Lock()
+	cancel := s.hookCancel
+	s.drainLock.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+/*
+runShutdownHooks calls every shutdown hook and then lets the tracker count
+down what is left of the grace timeout.
+*/
+func (s *HTTPScaffold) runShutdownHooks(ctx context.Context, began time.Time) {
+	for i, h := range s.shutdownHooks {
+		if ctx.Err() != nil {
+			break
+		}
+		res := s.runShutdownHook(ctx, i, h, began)
+		s.drainLock.Lock()
+		s.hookResults = append(s.hookResults, res)
+		s.drainLock.Unlock()
+	}
+	forced := ctx.Err() != nil
+	elapsed := s.since(began)
+
+	s.logInfo("Shutdown hooks finished in %s", elapsed)
+
+	// Hold the lock so that a "Shutdown" call from now on goes straight to
+	// the tracker, after this one
+	tracker := s.currentTracker()
+	s.drainLock.Lock()
+	s.hookTime = elapsed
+	if !forced {
+		tracker.shutdownFrom(s.hookReason, began)
+	}
+	s.hooksDone = true
+	cancel := s.hookCancel
+	s.drainLock.Unlock()
+	cancel()
+	if !forced {
+		s.stopGRPC(false)
+	}
+}
+
+/*
+runShutdownHook calls one hook and waits until it returns or its time is
+up.
+*/
+func (s *HTTPScaffold) runShutdownHook(
+	ctx context.Context, i int, h shutdownHook, began time.Time) ShutdownHookResult {
+
+	res := ShutdownHookResult{Index: i}
+	start := s.clock.Now()
+	timeout := s.currentTracker().shutdownWait - s.since(began)
+	if h.timeout > 0 && h.timeout < timeout {
+		timeout = h.timeout
+	}
+	if timeout <= 0 {
+		res.Err = context.DeadlineExceeded
+		res.TimedOut = true
+		s.logError("Shutdown hook %d skipped because the grace timeout expired", i)
+		return res
+	}
+
+	hctx := newHookContext(ctx, start.Add(timeout))
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("shutdown hook panicked: %v", r)
+			}
+		}()
+		done <- h.fn(hctx)
+	}()
+	timer := s.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res.Err = <-done:
+		hctx.end(context.Canceled)
+	case <-timer.C():
+		res.Err = context.DeadlineExceeded
+		hctx.end(res.Err)
+	case <-ctx.Done():
+		res.Err = ctx.Err()
+		hctx.end(res.Err)
+	}
+	res.Duration = s.since(start)
+	if errors.Is(res.Err, context.DeadlineExceeded) {
+		res.TimedOut = true
+		s.logError("Shutdown hook %d abandoned after %s", i, res.Duration)
+	} else if res.Err != nil {
+		s.logError("Shutdown hook %d failed: %s", i, res.Err)
+	}
+	return res
+}
+
+/*
+hookContext is the context that a shutdown hook gets. Its deadline is kept
+by the scaffold's clock rather than by a timer of its own, so it ends at
+the moment that the hook is abandoned, with "context.DeadlineExceeded."
+*/
+type hookContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+	lock     sync.Mutex
+	err      error
+}
+
+func newHookContext(parent context.Context, deadline time.Time) *hookContext {
+	return &hookContext{
+		Context:  parent,
+		deadline: deadline,
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *hookContext) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *hookContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *hookContext) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+/*
+end ends the context with "err," unless it has already ended.
+*/
+func (c *hookContext) end(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+/*
+recordShutdownReport saves the summary that "ShutdownReport" returns.
+"stopped" is when the tracker signalled that the drain was over.
+*/
+func (s *HTTPScaffold) recordShutdownReport(reason error, stopped time.Time) {
+	rep := &ShutdownReport{Reason: reason}
+	var timeout *ErrDrainTimeout
+	if errors.As(reason, &timeout) {
+		rep.Abandoned = timeout.Abandoned
+	}
+
+	s.drainLock.Lock()
+	defer s.drainLock.Unlock()
+	rep.Hooks = append([]ShutdownHookResult(nil), s.hookResults...)
+	rep.HookDuration = s.hookTime
+	if !s.drainStart.IsZero() {
+		rep.DrainDuration = stopped.Sub(s.drainStart)
+	}
+	s.shutdownReport = rep
+}
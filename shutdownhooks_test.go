@@ -0,0 +1,282 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown hook tests", func() {
+	It("Runs hooks in order before the drain", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+		s.SetDrainLogInterval(50 * time.Millisecond)
+
+		var lock sync.Mutex
+		var order []int
+		called := func(n int) {
+			lock.Lock()
+			order = append(order, n)
+			lock.Unlock()
+		}
+		hookErr := errors.New("Flush failed")
+		s.OnShutdown(func(ctx context.Context) error {
+			called(0)
+			// The server is marked down while the hooks run
+			Expect(s.IsReady()).Should(BeFalse())
+			_, hasDeadline := ctx.Deadline()
+			Expect(hasDeadline).Should(BeTrue())
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		})
+		s.OnShutdownWithTimeout(func(ctx context.Context) error {
+			called(1)
+			return hookErr
+		}, time.Second)
+		s.OnShutdown(func(ctx context.Context) error {
+			called(2)
+			return nil
+		})
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		Expect(s.ShutdownReport()).Should(BeNil())
+
+		go getText(fmt.Sprintf("http://%s/slow?delay=1s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		stopErr := errors.New("Hooks")
+		s.Shutdown(stopErr)
+		Expect(s.DrainStatus().HooksRunning).Should(BeTrue())
+		Expect(testGet(s, "")).Should(BeFalse())
+		Eventually(logger.lastInfo).Should(ContainSubstring("shutdown hooks running for"))
+		Eventually(func() bool {
+			return s.DrainStatus().HooksRunning
+		}).Should(BeFalse())
+		Eventually(logger.lastInfo).Should(ContainSubstring("spent in shutdown hooks"))
+
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(stopErr)))
+		lock.Lock()
+		Expect(order).Should(Equal([]int{0, 1, 2}))
+		lock.Unlock()
+		Expect(logger.allErrors()).Should(ContainElement("Shutdown hook 1 failed: Flush failed"))
+
+		rep := s.ShutdownReport()
+		Expect(rep).ShouldNot(BeNil())
+		Expect(rep.Reason).Should(Equal(stopErr))
+		Expect(rep.Hooks).Should(HaveLen(3))
+		for i, h := range rep.Hooks {
+			Expect(h.Index).Should(Equal(i))
+			Expect(h.TimedOut).Should(BeFalse())
+		}
+		Expect(rep.Hooks[0].Duration).Should(BeNumerically(">=", 200*time.Millisecond))
+		Expect(rep.Hooks[1].Err).Should(Equal(hookErr))
+		Expect(rep.HookDuration).Should(BeNumerically(">=", 200*time.Millisecond))
+		Expect(rep.DrainDuration).Should(BeNumerically(">=", rep.HookDuration))
+		Expect(rep.Abandoned).Should(BeZero())
+	})
+
+	It("Abandons hooks that run too long", func() {
+		logger := &testLogger{}
+		s := CreateHTTPScaffold()
+		s.SetLogger(logger)
+
+		ctxErr := make(chan error, 1)
+		s.OnShutdownWithTimeout(func(ctx context.Context) error {
+			<-ctx.Done()
+			ctxErr <- ctx.Err()
+			return ctx.Err()
+		}, 50*time.Millisecond)
+		s.OnShutdownWithTimeout(func(ctx context.Context) error {
+			var m map[string]int
+			m["boom"] = 1
+			return nil
+		}, time.Second)
+		ran := make(chan struct{})
+		s.OnShutdown(func(ctx context.Context) error {
+			close(ran)
+			return nil
+		})
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+
+		s.Shutdown(nil)
+		Eventually(stopChan, 2*time.Second).Should(Receive(Equal(ErrManualStop)))
+		Expect(ran).Should(BeClosed())
+
+		rep := s.ShutdownReport()
+		Expect(rep.Hooks).Should(HaveLen(3))
+		Expect(rep.Hooks[0].TimedOut).Should(BeTrue())
+		Expect(rep.Hooks[0].Err).Should(Equal(context.DeadlineExceeded))
+		Expect(rep.Hooks[1].TimedOut).Should(BeFalse())
+		Expect(rep.Hooks[1].Err).Should(MatchError(HavePrefix("shutdown hook panicked")))
+		Expect(rep.Hooks[2].Err).Should(BeNil())
+		Eventually(ctxErr).Should(Receive(Equal(context.DeadlineExceeded)))
+
+		errs := logger.allErrors()
+		Expect(errs).Should(HaveLen(2))
+		Expect(errs[0]).Should(HavePrefix("Shutdown hook 0 abandoned after"))
+		Expect(errs[1]).Should(HavePrefix("Shutdown hook 1 failed: shutdown hook panicked"))
+	})
+
+	It("Takes hook time out of the grace timeout", func() {
+		clk := clock.NewFake(time.Now())
+		s := CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetDrainIdleTimeout(0)
+		release := make(chan struct{})
+		defer close(release)
+		deadline := make(chan time.Time, 1)
+		ctxErr := make(chan error, 1)
+		s.OnShutdownWithTimeout(func(ctx context.Context) error {
+			d, _ := ctx.Deadline()
+			deadline <- d
+			select {
+			case <-ctx.Done():
+				ctxErr <- ctx.Err()
+			case <-release:
+			}
+			<-release
+			return nil
+		}, 10*time.Second)
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		go getText(fmt.Sprintf("http://%s/stuck?delay=3s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		s.Shutdown(nil)
+		Eventually(clk.Timers).Should(Equal(1))
+		Eventually(deadline).Should(Receive(Equal(clk.Now().Add(10 * time.Second))))
+		clk.Advance(10 * time.Second)
+		Eventually(func() bool {
+			return s.DrainStatus().HooksRunning
+		}).Should(BeFalse())
+		Expect(s.DrainStatus().HookTime).Should(Equal(10 * time.Second))
+		// The abandoned hook is told right away, by the same clock
+		Eventually(ctxErr).Should(Receive(Equal(context.DeadlineExceeded)))
+
+		clk.Advance(DefaultGraceTimeout - 11*time.Second)
+		Consistently(stopChan, 50*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(time.Second)
+		var stopErr error
+		Eventually(stopChan).Should(Receive(&stopErr))
+		var timeout *ErrDrainTimeout
+		Expect(errors.As(stopErr, &timeout)).Should(BeTrue())
+		Expect(timeout.Abandoned).Should(Equal(1))
+		Expect(timeout.Elapsed).Should(Equal(DefaultGraceTimeout))
+
+		rep := s.ShutdownReport()
+		Expect(rep.HookDuration).Should(Equal(10 * time.Second))
+		Expect(rep.DrainDuration).Should(Equal(DefaultGraceTimeout))
+		Expect(rep.Abandoned).Should(Equal(1))
+		Expect(rep.Hooks[0].TimedOut).Should(BeTrue())
+	})
+
+	It("Marking up does not undo a shutdown", func() {
+		release := make(chan struct{})
+		s := CreateHTTPScaffold()
+		s.SetReadyPath("/ready")
+		s.OnShutdown(func(ctx context.Context) error {
+			<-release
+			return nil
+		})
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+
+		stopErr := errors.New("Hooks")
+		s.Shutdown(stopErr)
+		Expect(s.DrainStatus().HooksRunning).Should(BeTrue())
+		s.markUp()
+		Expect(s.tracker.start()).Should(Equal(stopErr))
+		s.markDown()
+		s.markUp()
+		Expect(s.tracker.start()).Should(Equal(stopErr))
+		Expect(testGet(s, "")).Should(BeFalse())
+		status, reason := s.ReadyStatus()
+		Expect(status).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(stopErr))
+
+		close(release)
+		Eventually(stopChan).Should(Receive(Equal(stopErr)))
+	})
+
+	It("Force shutdown cancels hooks", func() {
+		canceled := make(chan error, 1)
+		s := CreateHTTPScaffold()
+		s.OnShutdown(func(ctx context.Context) error {
+			<-ctx.Done()
+			canceled <- ctx.Err()
+			return ctx.Err()
+		})
+		skipped := true
+		s.OnShutdown(func(ctx context.Context) error {
+			skipped = false
+			return nil
+		})
+
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+
+		s.Shutdown(nil)
+		Consistently(stopChan, 100*time.Millisecond).ShouldNot(Receive())
+		s.ForceShutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrForcedShutdown)))
+		Eventually(canceled).Should(Receive(Equal(context.Canceled)))
+		Eventually(func() bool {
+			return s.DrainStatus().HooksRunning
+		}).Should(BeFalse())
+		Expect(skipped).Should(BeTrue())
+	})
+})
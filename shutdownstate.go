@@ -0,0 +1,152 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+/*
+DefaultShutdownStateTimeout is how long shutdown waits for the state file
+set by "SetShutdownStateFile" to be written before giving up on it.
+*/
+const DefaultShutdownStateTimeout = time.Second
+
+/*
+ShutdownRecord describes how a previous run of the scaffold shut down.
+*/
+type ShutdownRecord struct {
+	// Time is when the shutdown finished
+	Time time.Time `json:"time" yaml:"time"`
+	// Reason is the error that "Listen" returned, if any
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	// Abandoned is the number of requests still running when the grace
+	// timeout cut the drain short
+	Abandoned int `json:"abandoned" yaml:"abandoned"`
+	// UptimeSeconds is how long the scaffold had been running
+	UptimeSeconds float64 `json:"uptimeSeconds" yaml:"uptimeSeconds"`
+}
+
+/*
+SetShutdownStateFile sets a file where the scaffold records how it shut
+down, so that the next run can tell. When "WaitForShutdown" returns, it
+writes a "ShutdownRecord" to the file as JSON. "Open" reads the file,
+makes the record available from "PreviousShutdown" and the info path, and
+then empties the file. Problems with the file are logged but never stop
+the scaffold from opening or shutting down, and shutdown waits no more
+than "DefaultShutdownStateTimeout" for the write.
+*/
+func (s *HTTPScaffold) SetShutdownStateFile(path string) {
+	s.shutdownStateFile = path
+}
+
+/*
+PreviousShutdown returns the record that the last run wrote to the file
+set by "SetShutdownStateFile," or nil if there was none. It is read by
+"Open."
+*/
+func (s *HTTPScaffold) PreviousShutdown() *ShutdownRecord {
+	return s.prevShutdown
+}
+
+/*
+readShutdownState reads the record left by the last run, if any, and
+empties the file so that it is not reported twice.
+*/
+func (s *HTTPScaffold) readShutdownState() {
+	if s.shutdownStateFile == "" {
+		return
+	}
+	buf, err := ioutil.ReadFile(s.shutdownStateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logError("Error reading shutdown state: %s", err)
+		}
+		return
+	}
+	if len(buf) == 0 {
+		return
+	}
+	rec := &ShutdownRecord{}
+	if err := json.Unmarshal(buf, rec); err != nil {
+		s.logError("Invalid shutdown state in %s: %s", s.shutdownStateFile, err)
+	} else {
+		s.prevShutdown = rec
+	}
+	if err := os.Truncate(s.shutdownStateFile, 0); err != nil {
+		s.logError("Error clearing shutdown state: %s", err)
+	}
+}
+
+/*
+writeShutdownState records the result of the shutdown, giving up if it
+takes too long, for instance because the file is on a hung network disk.
+*/
+func (s *HTTPScaffold) writeShutdownState(reason error) {
+	if s.shutdownStateFile == "" {
+		return
+	}
+	rec := &ShutdownRecord{
+		Time:          s.clock.Now(),
+		UptimeSeconds: s.Uptime().Seconds(),
+	}
+	if reason != nil {
+		rec.Reason = reason.Error()
+	}
+	var timeout *ErrDrainTimeout
+	if errors.As(reason, &timeout) {
+		rec.Abandoned = timeout.Abandoned
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- writeFileAtomic(s.shutdownStateFile, rec)
+	}()
+	timer := s.clock.NewTimer(DefaultShutdownStateTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			s.logError("Error writing shutdown state: %s", err)
+		}
+	case <-timer.C():
+		s.logError("Timed out writing shutdown state to %s", s.shutdownStateFile)
+	}
+}
+
+/*
+writeFileAtomic writes a value as JSON to a temporary file and then renames
+it, so that a crash part way through does not leave half a record.
+*/
+func writeFileAtomic(path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,153 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apid/goscaffold/internal/clock"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Shutdown state tests", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "goscaffold")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Shutdown state across runs", func() {
+		stateFile := filepath.Join(dir, "shutdown.json")
+
+		// The first run has nothing to report
+		s := CreateHTTPScaffold()
+		s.SetShutdownStateFile(stateFile)
+		s.SetInfoPath("/info")
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.PreviousShutdown()).Should(BeNil())
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		_, info := getJSON(s.InsecureURL().String() + "/info")
+		Expect(info).ShouldNot(HaveKey("previousShutdown"))
+
+		stopErr := errors.New("First run")
+		s.Shutdown(stopErr)
+		Eventually(stopChan).Should(Receive(Equal(stopErr)))
+
+		// The second run sees how the first one ended
+		clk := clock.NewFake(time.Now())
+		s = CreateHTTPScaffold()
+		s.SetClock(clk)
+		s.SetShutdownStateFile(stateFile)
+		s.SetInfoPath("/info")
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		prev := s.PreviousShutdown()
+		Expect(prev).ShouldNot(BeNil())
+		Expect(prev.Reason).Should(Equal("First run"))
+		Expect(prev.Abandoned).Should(BeZero())
+		Expect(prev.UptimeSeconds).Should(BeNumerically(">", 0))
+		Expect(time.Since(prev.Time)).Should(BeNumerically("<", time.Minute))
+		fi, err := os.Stat(stateFile)
+		Expect(err).Should(Succeed())
+		Expect(fi.Size()).Should(BeZero())
+
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		_, info = getJSON(s.InsecureURL().String() + "/info")
+		Expect(info["previousShutdown"]).Should(HaveKeyWithValue("reason", "First run"))
+
+		// This one ends with a request stuck
+		go getText(fmt.Sprintf("http://%s/stuck?delay=2s", s.InsecureAddress()))
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+		Eventually(func() bool {
+			return s.StartTime().IsZero()
+		}).Should(BeFalse())
+		clk.Advance(time.Hour)
+		s.Shutdown(nil)
+		clk.Advance(DefaultGraceTimeout)
+		Eventually(stopChan).Should(Receive(HaveOccurred()))
+
+		s = CreateHTTPScaffold()
+		s.SetShutdownStateFile(stateFile)
+		err = s.Open()
+		Expect(err).Should(Succeed())
+		prev = s.PreviousShutdown()
+		Expect(prev).ShouldNot(BeNil())
+		Expect(prev.Abandoned).Should(Equal(1))
+		Expect(prev.Reason).Should(ContainSubstring(ErrManualStop.Error()))
+		Expect(prev.UptimeSeconds).Should(BeNumerically(">=", time.Hour.Seconds()))
+		s.Shutdown(nil)
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+	})
+
+	It("Shutdown state write failure", func() {
+		s := CreateHTTPScaffold()
+		s.SetShutdownStateFile(filepath.Join(dir, "missing", "shutdown.json"))
+		logger := &testLogger{}
+		s.SetLogger(logger)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.PreviousShutdown()).Should(BeNil())
+		stopChan := make(chan error)
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+		Expect(logger.allErrors()).Should(ContainElement(ContainSubstring("Error writing shutdown state")))
+	})
+
+	It("Invalid shutdown state", func() {
+		stateFile := filepath.Join(dir, "shutdown.json")
+		Expect(ioutil.WriteFile(stateFile, []byte("garbage"), 0644)).Should(Succeed())
+		s := CreateHTTPScaffold()
+		s.SetShutdownStateFile(stateFile)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		Expect(s.PreviousShutdown()).Should(BeNil())
+		fi, err := os.Stat(stateFile)
+		Expect(err).Should(Succeed())
+		Expect(fi.Size()).Should(BeZero())
+		s.Shutdown(nil)
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+	})
+})
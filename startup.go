@@ -0,0 +1,99 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+/*
+ErrNotStarted is the reason that the startup path, and the ready path
+unless "SetStartupGatesReadiness" turned that off, report until
+"MarkStarted" is called.
+*/
+var ErrNotStarted = errors.New("not yet started")
+
+/*
+SetStartupPath sets up a startup check on the management port (if set) or
+otherwise the main port, such as for a Kubernetes "startupProbe." It
+returns 503 until "MarkStarted" is called, and 200 from then on no matter
+what the health checkers say, so that the startup probe passes once and
+the other probes take over. While it is set, the ready path also returns
+503 until "MarkStarted" is called, unless "SetStartupGatesReadiness" is
+used to turn that off.
+*/
+func (s *HTTPScaffold) SetStartupPath(p string) {
+	s.startupPath = p
+}
+
+/*
+SetStartupGatesReadiness sets whether the ready path waits for
+"MarkStarted" when a startup path is set. The default is true.
+*/
+func (s *HTTPScaffold) SetStartupGatesReadiness(gates bool) {
+	s.startupUngated = !gates
+}
+
+/*
+MarkStarted tells the scaffold that the application has finished
+initializing. It cannot be undone.
+*/
+func (s *HTTPScaffold) MarkStarted() {
+	atomic.StoreInt32(&s.started, 1)
+}
+
+/*
+Started returns true once "MarkStarted" has been called.
+*/
+func (s *HTTPScaffold) Started() bool {
+	return atomic.LoadInt32(&s.started) != 0
+}
+
+/*
+notStarted returns "ErrNotStarted" if readiness should wait for
+"MarkStarted," and nil otherwise.
+*/
+func (s *HTTPScaffold) notStarted() error {
+	if s.startupPath == "" || s.startupUngated || s.Started() {
+		return nil
+	}
+	return ErrNotStarted
+}
+
+/*
+startedFlag returns whether we have started, for the health documents, or
+nil if there is no startup path.
+*/
+func (s *HTTPScaffold) startedFlag() *bool {
+	if s.startupPath == "" {
+		return nil
+	}
+	started := s.Started()
+	return &started
+}
+
+/*
+handleStartup does not consult the health checkers at all.
+*/
+func (s *HTTPScaffold) handleStartup(resp http.ResponseWriter, req *http.Request) {
+	if !s.Started() {
+		s.writeHealthResponse(resp, req, http.StatusServiceUnavailable,
+			s.newHealthResponse(NotReady, ErrNotStarted), nil)
+		return
+	}
+	s.writeHealthResponse(resp, req, http.StatusOK, s.newHealthResponse(OK, nil), nil)
+}
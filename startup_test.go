@@ -0,0 +1,111 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Startup tests", func() {
+	It("Startup path", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetReadyPath("/ready")
+		s.SetStartupPath("/startup")
+		s.SetInfoPath("/info")
+		var failing int32
+		s.SetHealthChecker(func() (HealthStatus, error) {
+			if atomic.LoadInt32(&failing) != 0 {
+				return Failed, errors.New("checker says no")
+			}
+			return OK, nil
+		})
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		base := s.InsecureURL().String()
+		code, doc := getJSON(base + "/startup")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal(ErrNotStarted.Error()))
+		Expect(doc["started"]).Should(Equal(false))
+		code, doc = getJSON(base + "/ready")
+		Expect(code).Should(Equal(503))
+		Expect(doc["reason"]).Should(Equal(ErrNotStarted.Error()))
+		code, doc = getJSON(base + "/health")
+		Expect(code).Should(Equal(200))
+		Expect(doc["started"]).Should(Equal(false))
+		Expect(s.IsReady()).Should(BeFalse())
+		_, doc = getJSON(base + "/info")
+		Expect(doc["started"]).Should(Equal(false))
+		Expect(doc["startupPath"]).Should(Equal("/startup"))
+
+		s.MarkStarted()
+		Expect(s.Started()).Should(BeTrue())
+		code, doc = getJSON(base + "/startup")
+		Expect(code).Should(Equal(200))
+		Expect(doc["started"]).Should(Equal(true))
+		code, _ = getText(base + "/ready")
+		Expect(code).Should(Equal(200))
+		_, doc = getJSON(base + "/info")
+		Expect(doc["started"]).Should(Equal(true))
+
+		// Later failures do not affect the startup path
+		atomic.StoreInt32(&failing, 1)
+		code, _ = getText(base + "/health")
+		Expect(code).Should(Equal(503))
+		code, _ = getText(base + "/startup")
+		Expect(code).Should(Equal(200))
+		s.markDown()
+		code, _ = getText(base + "/startup")
+		Expect(code).Should(Equal(200))
+
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("Startup does not gate readiness", func() {
+		s := CreateHTTPScaffold()
+		s.SetStartupPath("/startup")
+		s.SetStartupGatesReadiness(false)
+		Expect(s.IsReady()).Should(BeTrue())
+
+		s = CreateHTTPScaffold()
+		Expect(s.IsReady()).Should(BeTrue())
+		s.SetStartupPath("/startup")
+		Expect(s.IsReady()).Should(BeFalse())
+		status, reason := s.ReadyStatus()
+		Expect(status).Should(Equal(NotReady))
+		Expect(reason).Should(Equal(ErrNotStarted))
+		s.MarkStarted()
+		Expect(s.IsReady()).Should(BeTrue())
+	})
+
+	It("Conflicting startup path", func() {
+		s := CreateHTTPScaffold()
+		s.SetHealthPath("/health")
+		s.SetStartupPath("/health")
+		Expect(s.Open()).ShouldNot(Succeed())
+	})
+})
@@ -0,0 +1,133 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"time"
+)
+
+const (
+	// DefaultSessionTicketRotation is the default amount of time between
+	// rotations of the key used to encrypt TLS session tickets.
+	DefaultSessionTicketRotation = 24 * time.Hour
+)
+
+/*
+SetSessionTicketRotation sets how often the scaffold generates a new key for
+encrypting TLS session tickets on the secure port. The previous key is
+still accepted for one more period so that clients can resume sessions
+across a rotation, which means that a ticket is good for at most two
+periods. If set to zero, the scaffold does not manage ticket keys and
+leaves it to the "crypto/tls" package. The default is
+"DefaultSessionTicketRotation." It must be called before "Open."
+*/
+func (s *HTTPScaffold) SetSessionTicketRotation(d time.Duration) {
+	s.ticketRotation = d
+}
+
+/*
+SetSessionTicketKeys sets the keys used to encrypt TLS session tickets,
+for deployments in which several servers must accept each other's tickets.
+The first key is used to create new tickets, and all of them are accepted.
+Once this is called, the scaffold no longer rotates keys itself, so it is up
+to the caller to call it again with new keys. It may be called before or
+after "Open." Calling it with no keys restores automatic rotation.
+*/
+func (s *HTTPScaffold) SetSessionTicketKeys(keys [][32]byte) {
+	s.ticketLock.Lock()
+	defer s.ticketLock.Unlock()
+	if len(keys) == 0 {
+		s.externalTickets = false
+		return
+	}
+	s.externalTickets = true
+	s.ticketKeys = append([][32]byte(nil), keys...)
+	if s.tlsConfig != nil {
+		s.tlsConfig.SetSessionTicketKeys(s.ticketKeys)
+	}
+}
+
+/*
+initSessionTickets installs the first ticket key in the TLS configuration.
+*/
+func (s *HTTPScaffold) initSessionTickets(cfg *tls.Config) error {
+	s.ticketLock.Lock()
+	defer s.ticketLock.Unlock()
+	s.tlsConfig = cfg
+	if s.externalTickets {
+		cfg.SetSessionTicketKeys(s.ticketKeys)
+		return nil
+	}
+	if s.ticketRotation <= 0 {
+		return nil
+	}
+	key, err := newTicketKey()
+	if err != nil {
+		return err
+	}
+	s.ticketKeys = [][32]byte{key}
+	cfg.SetSessionTicketKeys(s.ticketKeys)
+	return nil
+}
+
+func (s *HTTPScaffold) rotateSessionTickets(done <-chan struct{}) {
+	timer := s.clock.NewTimer(s.ticketRotation)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C():
+			timer.Reset(s.ticketRotation)
+			err := s.rotateTicketKey()
+			if err != nil {
+				s.logError("Error rotating TLS session ticket key: %s", err)
+			}
+		}
+	}
+}
+
+/*
+rotateTicketKey makes a new key the current one and keeps the previous
+current key. "SetSessionTicketKeys" is safe to call while handshakes are
+in progress.
+*/
+func (s *HTTPScaffold) rotateTicketKey() error {
+	s.ticketLock.Lock()
+	defer s.ticketLock.Unlock()
+	if s.externalTickets || s.tlsConfig == nil {
+		return nil
+	}
+	key, err := newTicketKey()
+	if err != nil {
+		return err
+	}
+	keys := [][32]byte{key}
+	if len(s.ticketKeys) > 0 {
+		keys = append(keys, s.ticketKeys[0])
+	}
+	s.ticketKeys = keys
+	s.tlsConfig.SetSessionTicketKeys(keys)
+	return nil
+}
+
+func newTicketKey() ([32]byte, error) {
+	var key [32]byte
+	_, err := rand.Read(key[:])
+	return key, err
+}
@@ -0,0 +1,143 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Session ticket tests", func() {
+	var s *HTTPScaffold
+	var stopChan chan error
+
+	startSecure := func(configure func(*HTTPScaffold)) {
+		s = CreateHTTPScaffold()
+		s.SetSecurePort(0)
+		s.SetInsecurePort(-1)
+		s.SetKeyFile("./testkeys/clearkey.pem")
+		s.SetCertFile("./testkeys/clearcert.pem")
+		// Long enough that only the test rotates keys
+		s.SetSessionTicketRotation(time.Hour)
+		configure(s)
+		stopChan = make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&testHandler{})
+		}()
+	}
+
+	AfterEach(func() {
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	// Every call makes a new connection, resuming if it can
+	newClient := func() func() bool {
+		client := &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					InsecureSkipVerify: true,
+					ClientSessionCache: tls.NewLRUClientSessionCache(1),
+				},
+				DisableKeepAlives: true,
+			},
+		}
+		return func() bool {
+			resp, err := client.Get(s.SecureURL().String())
+			Expect(err).Should(Succeed())
+			resp.Body.Close()
+			Expect(resp.StatusCode).Should(Equal(200))
+			return resp.TLS.DidResume
+		}
+	}
+
+	It("Rotation", func() {
+		startSecure(func(*HTTPScaffold) {})
+		get := newClient()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		Expect(get()).Should(BeFalse())
+		Expect(get()).Should(BeTrue())
+
+		// The previous key is still good
+		Expect(s.rotateTicketKey()).Should(Succeed())
+		Expect(get()).Should(BeTrue())
+
+		// But not after two more rotations
+		Expect(s.rotateTicketKey()).Should(Succeed())
+		Expect(s.rotateTicketKey()).Should(Succeed())
+		Expect(get()).Should(BeFalse())
+		Expect(get()).Should(BeTrue())
+	})
+
+	It("Concurrent rotation", func() {
+		startSecure(func(*HTTPScaffold) {})
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					s.rotateTicketKey()
+				}
+			}
+		}()
+		get := newClient()
+		for i := 0; i < 20; i++ {
+			get()
+		}
+		close(stop)
+		wg.Wait()
+	})
+
+	It("External keys", func() {
+		var key [32]byte
+		key[0] = 1
+		startSecure(func(s *HTTPScaffold) {
+			s.SetSessionTicketKeys([][32]byte{key})
+		})
+		get := newClient()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGetSecure(s, "")).Should(BeTrue())
+
+		Expect(get()).Should(BeFalse())
+		Expect(get()).Should(BeTrue())
+
+		// Rotation is up to the caller now
+		Expect(s.rotateTicketKey()).Should(Succeed())
+		Expect(s.rotateTicketKey()).Should(Succeed())
+		Expect(get()).Should(BeTrue())
+
+		var newKey [32]byte
+		newKey[0] = 2
+		s.SetSessionTicketKeys([][32]byte{newKey})
+		Expect(get()).Should(BeFalse())
+	})
+})
@@ -0,0 +1,118 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"net/http"
+)
+
+/*
+An EndFunc is returned by a ScaffoldTracer when a request starts, and is
+called once the request is done with the status code that was sent and the
+reason that the scaffold rejected it, if it did.
+*/
+type EndFunc func(status int, rejection RejectionReason)
+
+/*
+A ScaffoldTracer starts a trace span for each request. "StartRequest" is
+called before the scaffold does anything else with the request, so that
+requests that the scaffold rejects itself are traced too. The context that
+it returns is passed to the application handler. The "otelscaffold"
+package has one that uses OpenTelemetry.
+*/
+type ScaffoldTracer interface {
+	StartRequest(r *http.Request) (context.Context, EndFunc)
+}
+
+/*
+NoopTracer is a ScaffoldTracer that does nothing. It is the default.
+*/
+var NoopTracer ScaffoldTracer = noopTracer{}
+
+type noopTracer struct{}
+
+func (noopTracer) StartRequest(r *http.Request) (context.Context, EndFunc) {
+	return r.Context(), func(int, RejectionReason) {}
+}
+
+/*
+SetTracer sets the tracer that is called for every application request,
+whether or not the scaffold rejects it. Passing nil or "NoopTracer" turns
+tracing off.
+*/
+func (s *HTTPScaffold) SetTracer(t ScaffoldTracer) {
+	if t == NoopTracer {
+		t = nil
+	}
+	s.tracer = t
+}
+
+/*
+SetTraceManagement controls whether the tracer is also called for the
+health checks and the other management paths. They are not traced by
+default, since probes would otherwise fill up the traces.
+*/
+func (s *HTTPScaffold) SetTraceManagement(include bool) {
+	s.traceManagement = include
+}
+
+/*
+requestTrace holds what we need to end the span for one request.
+*/
+type requestTrace struct {
+	rw        *recordingWriter
+	end       EndFunc
+	rejection RejectionReason
+}
+
+/*
+startTrace starts a span if there is a tracer, and returns the writer and
+request that the rest of the scaffold should use. The trace is nil if
+there is no tracer.
+*/
+func (s *HTTPScaffold) startTrace(
+	resp http.ResponseWriter, req *http.Request) (*requestTrace, http.ResponseWriter, *http.Request) {
+	if s.tracer == nil {
+		return nil, resp, req
+	}
+	ctx, end := s.tracer.StartRequest(req)
+	t := &requestTrace{
+		rw:  newRecordingWriter(resp),
+		end: end,
+	}
+	return t, t.rw, req.WithContext(ctx)
+}
+
+func (t *requestTrace) setRejection(r RejectionReason) {
+	if t != nil {
+		t.rejection = r
+	}
+}
+
+/*
+finish ends the span. It must be deferred, so that the span also ends when
+the handler panics, in which case it reports a 500 and keeps panicking.
+*/
+func (t *requestTrace) finish() {
+	if t == nil {
+		return
+	}
+	if p := recover(); p != nil {
+		t.end(http.StatusInternalServerError, t.rejection)
+		panic(p)
+	}
+	t.end(t.rw.statusCode(), t.rejection)
+}
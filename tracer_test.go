@@ -0,0 +1,151 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type testSpan struct {
+	path      string
+	status    int
+	rejection RejectionReason
+	ended     bool
+}
+
+type spanKey struct{}
+
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) StartRequest(r *http.Request) (context.Context, EndFunc) {
+	span := &testSpan{path: r.URL.Path}
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+	return context.WithValue(r.Context(), spanKey{}, span), func(status int, rejection RejectionReason) {
+		span.status = status
+		span.rejection = rejection
+		span.ended = true
+	}
+}
+
+func (t *testTracer) take() []*testSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	spans := t.spans
+	t.spans = nil
+	return spans
+}
+
+var _ = Describe("Tracer tests", func() {
+	It("Traces accepted and rejected requests", func() {
+		tracer := &testTracer{}
+		s := CreateHTTPScaffold()
+		s.SetTracer(tracer)
+		s.SetHealthPath("/health")
+		s.SetAllowedMethods([]string{"GET"})
+		var handlerSpan interface{}
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			handlerSpan = req.Context().Value(spanKey{})
+			resp.WriteHeader(http.StatusCreated)
+		}))
+
+		do := func(method, path string) int {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			return rec.Code
+		}
+
+		Expect(do("GET", "/")).Should(Equal(201))
+		spans := tracer.take()
+		Expect(spans).Should(HaveLen(1))
+		Expect(handlerSpan).Should(BeIdenticalTo(spans[0]))
+		Expect(*spans[0]).Should(Equal(testSpan{path: "/", status: 201, ended: true}))
+
+		Expect(do("POST", "/")).Should(Equal(405))
+		spans = tracer.take()
+		Expect(spans).Should(HaveLen(1))
+		Expect(spans[0].status).Should(Equal(405))
+		Expect(spans[0].rejection).Should(Equal(RejectionMethodNotAllowed))
+
+		s.markDown()
+		Expect(do("GET", "/")).Should(Equal(503))
+		spans = tracer.take()
+		Expect(spans).Should(HaveLen(1))
+		Expect(spans[0].status).Should(Equal(503))
+		Expect(spans[0].rejection).Should(Equal(RejectionMarkdown))
+
+		// Probes are not traced unless asked for
+		Expect(do("GET", "/health")).Should(Equal(200))
+		Expect(tracer.take()).Should(BeEmpty())
+	})
+
+	It("Traces management paths", func() {
+		tracer := &testTracer{}
+		s := CreateHTTPScaffold()
+		s.SetTracer(tracer)
+		s.SetTraceManagement(true)
+		s.SetHealthPath("/health")
+		h, _ := s.Handlers(http.NotFoundHandler())
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+		Expect(rec.Code).Should(Equal(200))
+		spans := tracer.take()
+		Expect(spans).Should(HaveLen(1))
+		Expect(*spans[0]).Should(Equal(testSpan{path: "/health", status: 200, ended: true}))
+
+		// Application requests are only traced once
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/foo", nil))
+		Expect(rec.Code).Should(Equal(404))
+		Expect(tracer.take()).Should(HaveLen(1))
+	})
+
+	It("Ends the span on panic", func() {
+		tracer := &testTracer{}
+		s := CreateHTTPScaffold()
+		s.SetTracer(tracer)
+		h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			panic(http.ErrAbortHandler)
+		}))
+		Expect(func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}).Should(PanicWith(http.ErrAbortHandler))
+		spans := tracer.take()
+		Expect(spans).Should(HaveLen(1))
+		Expect(spans[0].status).Should(Equal(500))
+		Expect(spans[0].ended).Should(BeTrue())
+	})
+
+	It("No-op tracer", func() {
+		s := CreateHTTPScaffold()
+		s.SetTracer(&testTracer{})
+		s.SetTracer(NoopTracer)
+		Expect(s.tracer).Should(BeNil())
+		ctx, end := NoopTracer.StartRequest(httptest.NewRequest("GET", "/", nil))
+		Expect(ctx).ShouldNot(BeNil())
+		end(200, RejectionNone)
+	})
+})
@@ -15,26 +15,21 @@
 package goscaffold
 
 import (
-	"math"
+	"sync"
 	"sync/atomic"
 	"time"
-)
 
-/*
-values for the command channel.
-*/
-const (
-	startRequest = iota
-	endRequest
-	shutdown
+	"github.com/apid/goscaffold/internal/clock"
 )
 
 /*
-values for the shutdown state
+values for the shutdown state. The state is "stopping" while the shutdown
+hooks run, before the countdown starts.
 */
 const (
 	running    int32 = iota
 	markedDown int32 = iota
+	stopping   int32 = iota
 	shutDown   int32 = iota
 )
 
@@ -43,15 +38,31 @@ The requestTracker keeps track of HTTP requests. In normal operations it
 just counts. Once the server has been marked for shutdown, however, it
 counts down to zero and returns a shutdown indication when that
 happens.
+
+Starting and ending a request only touches atomic values, so requests do
+not contend with each other. A request first adds itself to the count and
+then checks the state, while "shutdown" first sets the state and then
+checks the count. So when the two race, either the request sees the new
+state and backs out, or "shutdown" sees the request and waits for it.
 */
 type requestTracker struct {
+	// This is first so that it is aligned for sync/atomic.
+	active int64
 	// A value will be delivered to this channel when the server can stop.
 	// If "shutdown" is never called then this will never happen.
-	C              chan error
+	C chan error
+	// This channel is closed at the same time as a value is delivered to C.
+	done           chan struct{}
 	shutdownWait   time.Duration
 	shutdownState  int32
 	shutdownReason *atomic.Value
-	commandChan    chan int
+	stateLock      *sync.Mutex
+	stopOnce       *sync.Once
+	graceTimer     clock.Timer
+	stopStart      time.Time
+	clock          clock.Clock
+	// This is closed and replaced whenever the state changes
+	changed chan struct{}
 }
 
 /*
@@ -60,28 +71,89 @@ maximum amount of time that we should wait for shutdown in case some
 do not complete in a timely way.
 */
 func startRequestTracker(shutdownWait time.Duration) *requestTracker {
-	rt := &requestTracker{
+	return startRequestTrackerWithClock(shutdownWait, clock.Real{})
+}
+
+func startRequestTrackerWithClock(shutdownWait time.Duration, c clock.Clock) *requestTracker {
+	return &requestTracker{
 		C:              make(chan error, 1),
-		commandChan:    make(chan int, 100),
+		done:           make(chan struct{}),
 		shutdownState:  running,
 		shutdownWait:   shutdownWait,
 		shutdownReason: &atomic.Value{},
+		stateLock:      &sync.Mutex{},
+		stopOnce:       &sync.Once{},
+		clock:          c,
+		changed:        make(chan struct{}),
 	}
-	go rt.trackerLoop()
-	return rt
 }
 
 /*
-start indicates that a request started. It returns true if the request
-should proceed, and false if the request should fail because the server is
-shutting down.
+start indicates that a request started. It returns nil if the request
+should proceed, and an error if the request should fail because the server
+is shutting down.
 */
 func (t *requestTracker) start() error {
-	md := t.markedDown()
-	if md == nil {
-		t.commandChan <- startRequest
+	return t.startLimited(0)
+}
+
+/*
+startLimited is like "start," but if "limit" is set and that many requests
+are already running, the request is not counted at all, and
+"ErrOverloaded" is returned.
+*/
+func (t *requestTracker) startLimited(limit int64) error {
+	if md := t.markedDown(); md != nil {
+		return md
+	}
+	if !t.add(limit) {
+		return ErrOverloaded
+	}
+	if md := t.markedDown(); md != nil {
+		t.end()
+		return md
+	}
+	return nil
+}
+
+/*
+startExempt is like "start," but is for requests that should proceed even
+after the server has been marked down. They are still counted, so shutdown
+waits for them as usual, up to the grace timeout. It only fails once the
+tracker has already signalled that the server can stop.
+*/
+func (t *requestTracker) startExempt() error {
+	return t.startExemptLimited(0)
+}
+
+func (t *requestTracker) startExemptLimited(limit int64) error {
+	if t.stopped() {
+		return t.reason()
+	}
+	if !t.add(limit) {
+		return ErrOverloaded
+	}
+	if t.stopped() {
+		t.end()
+		return t.reason()
+	}
+	return nil
+}
+
+/*
+add counts a new request, unless "limit" is set and that many requests are
+already running.
+*/
+func (t *requestTracker) add(limit int64) bool {
+	for {
+		active := atomic.LoadInt64(&t.active)
+		if limit > 0 && active >= limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&t.active, active, active+1) {
+			return true
+		}
 	}
-	return md
 }
 
 /*
@@ -89,83 +161,219 @@ end indicates that a request ended. In order for this thing to work, the
 caller needs to ensure that start and end are always paired.
 */
 func (t *requestTracker) end() {
-	t.commandChan <- endRequest
+	if atomic.AddInt64(&t.active, -1) == 0 &&
+		atomic.LoadInt32(&t.shutdownState) == shutDown {
+		t.stop(t.stopReason())
+	}
 }
 
 /*
 markedDown returns nil if everything is good, and an error if the server
 has been marked down. The error is the one that was sent to the
-"Shutdown" method.
+"Shutdown" method, or "ErrManualStop" if that was nil.
 */
 func (t *requestTracker) markedDown() error {
 	ss := atomic.LoadInt32(&t.shutdownState)
 	if ss != running {
-		reason := t.shutdownReason.Load().(*error)
-		if reason == nil {
-			return nil
-		}
-		return *reason
+		return t.reason()
 	}
 	return nil
 }
 
+/*
+reason returns the reason for the markdown or shutdown, or
+"ErrManualStop" if that was nil.
+*/
+func (t *requestTracker) reason() error {
+	reason, _ := t.shutdownReason.Load().(*error)
+	if reason == nil || *reason == nil {
+		return ErrManualStop
+	}
+	return *reason
+}
+
+/*
+stopReason is the reason exactly as it was passed to "shutdown," even if
+it was nil.
+*/
+func (t *requestTracker) stopReason() error {
+	reason, _ := t.shutdownReason.Load().(*error)
+	if reason == nil {
+		return nil
+	}
+	return *reason
+}
+
 /*
 shutdown indicates that the tracker should start counting down until
 the number of running requests reaches zero. The "reason" will be returned
 as the result of the "start" call.
 */
 func (t *requestTracker) shutdown(reason error) {
+	t.shutdownFrom(reason, t.clock.Now())
+}
+
+/*
+shutdownFrom is like "shutdown," but the grace timeout counts from
+"began" rather than from now, so that time already spent shutting down is
+taken out of it.
+*/
+func (t *requestTracker) shutdownFrom(reason error, began time.Time) {
+	t.stateLock.Lock()
+	t.shutdownReason.Store(&reason)
+	atomic.StoreInt32(&t.shutdownState, shutDown)
+	t.notifyChange()
+	if t.stopStart.IsZero() {
+		t.stopStart = began
+	}
+	if t.graceTimer != nil {
+		t.graceTimer.Stop()
+	}
+	wait := t.shutdownWait - clock.Since(t.clock, began)
+	if wait < 0 {
+		wait = 0
+	}
+	timer := t.clock.NewTimer(wait)
+	t.graceTimer = timer
+	go t.waitForTimeout(timer, t.stopStart)
+	t.stateLock.Unlock()
+
+	if atomic.LoadInt64(&t.active) <= 0 {
+		t.stop(t.stopReason())
+	}
+}
+
+/*
+stopSoon rejects new requests with "reason," like "shutdown," but does not
+start counting down yet, and unlike "markDown," "markUp" can't undo it.
+It has no effect once "shutdown" has been called.
+*/
+func (t *requestTracker) stopSoon(reason error) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if atomic.LoadInt32(&t.shutdownState) != shutDown {
+		t.shutdownReason.Store(&reason)
+		atomic.StoreInt32(&t.shutdownState, stopping)
+		t.notifyChange()
+	}
+}
+
+/*
+force is like "shutdown," but signals that the server can stop right away
+without waiting for running requests.
+*/
+func (t *requestTracker) force(reason error) {
+	t.stateLock.Lock()
 	t.shutdownReason.Store(&reason)
-	t.commandChan <- shutdown
+	atomic.StoreInt32(&t.shutdownState, shutDown)
+	t.notifyChange()
+	t.stateLock.Unlock()
+	t.stop(t.stopReason())
 }
 
+/*
+markDown causes new requests to be rejected without starting the countdown
+to shutdown. It has no effect once "shutdown" has been called.
+*/
 func (t *requestTracker) markDown() {
-	t.shutdownReason.Store(&ErrMarkedDown)
-	atomic.StoreInt32(&t.shutdownState, markedDown)
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if atomic.LoadInt32(&t.shutdownState) == running {
+		t.shutdownReason.Store(&ErrMarkedDown)
+		atomic.StoreInt32(&t.shutdownState, markedDown)
+		t.notifyChange()
+	}
 }
 
-func (t *requestTracker) sendStop(sent bool) bool {
-	if !sent {
-		reason := t.shutdownReason.Load().(*error)
-		if reason == nil {
-			return false
+/*
+markUp reverses "markDown" so that requests are accepted again. It has
+no effect once "stopSoon" or "shutdown" has been called.
+*/
+func (t *requestTracker) markUp() {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	if atomic.LoadInt32(&t.shutdownState) == markedDown {
+		atomic.StoreInt32(&t.shutdownState, running)
+		t.notifyChange()
+	}
+}
+
+/*
+isMarkedDown returns true if "markDown" was called and the tracker has
+not yet been shut down.
+*/
+func (t *requestTracker) isMarkedDown() bool {
+	return atomic.LoadInt32(&t.shutdownState) == markedDown
+}
+
+/*
+stateChanged returns a channel that is closed the next time that the
+state changes. Callers should get it before they look at the state, so
+that they don't miss a change.
+*/
+func (t *requestTracker) stateChanged() <-chan struct{} {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.changed
+}
+
+/*
+notifyChange wakes up everyone waiting in "stateChanged." It must be
+called with the lock held.
+*/
+func (t *requestTracker) notifyChange() {
+	close(t.changed)
+	t.changed = make(chan struct{})
+}
+
+func (t *requestTracker) stopped() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+stop signals that the server can stop. Only the first call has any effect.
+*/
+func (t *requestTracker) stop(reason error) {
+	t.stopOnce.Do(func() {
+		t.stateLock.Lock()
+		if t.graceTimer != nil {
+			t.graceTimer.Stop()
 		}
-		t.C <- *reason
-	}
-	return true
-}
-
-/*
-trackerLoop runs all day and manages stuff.
-*/
-func (t *requestTracker) trackerLoop() {
-	activeRequests := 0
-	stopping := false
-	sentStop := false
-	graceTimer := time.NewTimer(time.Duration(math.MaxInt64))
-
-	for !sentStop {
-		select {
-		case cmd := <-t.commandChan:
-			switch cmd {
-			case startRequest:
-				activeRequests++
-			case endRequest:
-				activeRequests--
-				if stopping && activeRequests == 0 {
-					sentStop = t.sendStop(sentStop)
-				}
-			case shutdown:
-				stopping = true
-				atomic.StoreInt32(&t.shutdownState, shutDown)
-				if activeRequests <= 0 {
-					sentStop = t.sendStop(sentStop)
-				} else {
-					graceTimer.Reset(t.shutdownWait)
-				}
-			}
-		case <-graceTimer.C:
-			sentStop = t.sendStop(sentStop)
+		t.stateLock.Unlock()
+		t.C <- reason
+		close(t.done)
+	})
+}
+
+/*
+waitForTimeout calls "timeout" when the timer fires, unless the tracker
+stops first.
+*/
+func (t *requestTracker) waitForTimeout(timer clock.Timer, began time.Time) {
+	select {
+	case <-timer.C():
+		t.timeout(began)
+	case <-t.done:
+	}
+}
+
+/*
+timeout is called when the grace timeout expires, and reports that it cut
+the drain short if there are still requests running.
+*/
+func (t *requestTracker) timeout(began time.Time) {
+	reason := t.stopReason()
+	if active := atomic.LoadInt64(&t.active); active > 0 {
+		reason = &ErrDrainTimeout{
+			Reason:    reason,
+			Abandoned: int(active),
+			Elapsed:   clock.Since(t.clock, began),
 		}
 	}
+	t.stop(reason)
 }
@@ -16,8 +16,16 @@ package goscaffold
 
 import (
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
+	"github.com/apid/goscaffold/internal/clock"
+
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -40,9 +48,185 @@ var _ = Describe("Tracker tests", func() {
 	})
 
 	It("Tracker grace timeout", func() {
+		clk := clock.NewFake(time.Now())
+		t := startRequestTrackerWithClock(time.Second, clk)
+		t.start()
+		stopErr := errors.New("Stop")
+		t.shutdown(stopErr)
+		Expect(clk.Timers()).Should(Equal(1))
+		clk.Advance(999 * time.Millisecond)
+		Consistently(t.C, 10*time.Millisecond).ShouldNot(Receive())
+		clk.Advance(time.Millisecond)
+		var err error
+		Eventually(t.C).Should(Receive(&err))
+		Expect(errors.Is(err, stopErr)).Should(BeTrue())
+		var timeout *ErrDrainTimeout
+		Expect(errors.As(err, &timeout)).Should(BeTrue())
+		Expect(timeout.Abandoned).Should(Equal(1))
+		Expect(timeout.Elapsed).Should(Equal(time.Second))
+	})
+
+	It("Tracker grace timeout with nil reason", func() {
+		clk := clock.NewFake(time.Now())
+		t := startRequestTrackerWithClock(time.Second, clk)
+		t.start()
+		t.shutdown(nil)
+		clk.Advance(time.Second)
+		var err error
+		Eventually(t.C).Should(Receive(&err))
+		Expect(err).Should(MatchError("Drain timed out after 1s with 1 requests abandoned"))
+		Expect(errors.Unwrap(err)).Should(BeNil())
+	})
+
+	It("Tracker exempt requests", func() {
+		t := startRequestTracker(10 * time.Second)
+		Expect(t.start()).Should(Succeed())
+		t.shutdown(errors.New("Exempt"))
+		Expect(t.start()).Should(MatchError("Exempt"))
+		Expect(t.startExempt()).Should(Succeed())
+		t.end()
+		Consistently(t.C, 100*time.Millisecond).ShouldNot(Receive())
+		t.end()
+		Eventually(t.C).Should(Receive(MatchError("Exempt")))
+		Eventually(t.done).Should(BeClosed())
+		Expect(t.startExempt()).Should(MatchError("Exempt"))
+	})
+
+	It("Tracker exempt grace timeout", func() {
 		t := startRequestTracker(time.Second)
+		t.shutdown(errors.New("Stop"))
+		Eventually(t.C).Should(Receive())
+		Eventually(t.done).Should(BeClosed())
+		Expect(t.startExempt()).Should(MatchError("Stop"))
+
+		clk := clock.NewFake(time.Now())
+		t = startRequestTrackerWithClock(time.Second, clk)
 		t.start()
+		stopErr := errors.New("Stop")
+		t.shutdown(stopErr)
+		Expect(t.startExempt()).Should(Succeed())
+		clk.Advance(time.Second)
+		var err error
+		Eventually(t.C).Should(Receive(&err))
+		Expect(errors.Is(err, stopErr)).Should(BeTrue())
+		Expect(err.(*ErrDrainTimeout).Abandoned).Should(Equal(2))
+		Expect(t.startExempt()).Should(MatchError("Stop"))
+	})
+
+	It("Tracker nil reason", func() {
+		t := startRequestTracker(10 * time.Second)
+		Expect(t.start()).Should(Succeed())
+		t.shutdown(nil)
+		Expect(t.start()).Should(MatchError(ErrManualStop))
+		t.end()
+		Eventually(t.C).Should(Receive(BeNil()))
+		Eventually(t.done).Should(BeClosed())
+		Expect(t.startExempt()).Should(MatchError(ErrManualStop))
+	})
+
+	It("Tracker force", func() {
+		t := startRequestTracker(10 * time.Second)
+		t.start()
+		t.shutdown(errors.New("Graceful"))
+		Consistently(t.C, 100*time.Millisecond).ShouldNot(Receive())
+		t.force(errors.New("Forced"))
+		Eventually(t.C).Should(Receive(MatchError("Forced")))
+		t.end()
+	})
+
+	It("Tracker markdown and markup", func() {
+		t := startRequestTracker(10 * time.Second)
+		Expect(t.start()).Should(Succeed())
+		t.end()
+		t.markDown()
+		Expect(t.isMarkedDown()).Should(BeTrue())
+		Expect(t.start()).Should(MatchError(ErrMarkedDown))
+		t.markUp()
+		Expect(t.isMarkedDown()).Should(BeFalse())
+		Expect(t.start()).Should(Succeed())
+		t.end()
+		Consistently(t.C, 100*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("Tracker shutdown race", func() {
+		const workers = 50
+		for round := 0; round < 50; round++ {
+			t := startRequestTracker(10 * time.Second)
+			stopErr := errors.New("Race")
+			var accepted, ended, rejected int32
+			ready := &sync.WaitGroup{}
+			ready.Add(workers)
+			finished := &sync.WaitGroup{}
+			finished.Add(workers)
+			begin := make(chan struct{})
+
+			for w := 0; w < workers; w++ {
+				go func() {
+					defer GinkgoRecover()
+					defer finished.Done()
+					ready.Done()
+					<-begin
+					for n := 0; n < 20; n++ {
+						err := t.start()
+						if err != nil {
+							Expect(err).Should(Equal(stopErr))
+							atomic.AddInt32(&rejected, 1)
+							return
+						}
+						atomic.AddInt32(&accepted, 1)
+						runtime.Gosched()
+						atomic.AddInt32(&ended, 1)
+						t.end()
+					}
+				}()
+			}
+
+			ready.Wait()
+			close(begin)
+			runtime.Gosched()
+			t.shutdown(stopErr)
+
+			// Every request that was let in finished before the stop
+			Eventually(t.C).Should(Receive(Equal(stopErr)))
+			Expect(atomic.LoadInt32(&ended)).Should(Equal(atomic.LoadInt32(&accepted)))
+			finished.Wait()
+			Expect(atomic.LoadInt32(&ended)).Should(Equal(atomic.LoadInt32(&accepted)))
+			Expect(t.start()).Should(Equal(stopErr))
+			Expect(atomic.LoadInt64(&t.active)).Should(BeZero())
+		}
+	})
+
+	It("Tracker markup after shutdown", func() {
+		t := startRequestTracker(10 * time.Second)
+		t.markDown()
 		t.shutdown(errors.New("Stop"))
-		Eventually(t.C, 2*time.Second).Should(Receive(MatchError("Stop")))
+		t.markUp()
+		t.markDown()
+		Expect(t.start()).Should(MatchError("Stop"))
+		Eventually(t.C).Should(Receive(MatchError("Stop")))
 	})
 })
+
+func BenchmarkTrackerStartEnd(b *testing.B) {
+	t := startRequestTracker(DefaultGraceTimeout)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if t.start() == nil {
+				t.end()
+			}
+		}
+	})
+}
+
+func BenchmarkRequestTracking(b *testing.B) {
+	s := CreateHTTPScaffold()
+	h, _ := s.Handlers(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {}))
+	req := httptest.NewRequest("GET", "/", nil)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		resp := httptest.NewRecorder()
+		for pb.Next() {
+			h.ServeHTTP(resp, req)
+		}
+	})
+}
@@ -0,0 +1,258 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	// upgradeListenersEnv tells the new process which of its files are
+	// which listener, as a comma-separated list of "role=fd."
+	upgradeListenersEnv = "GOSCAFFOLD_UPGRADE_LISTENERS"
+	// upgradeReadyEnv is the file that the new process writes to when it
+	// is ready to take over.
+	upgradeReadyEnv = "GOSCAFFOLD_UPGRADE_READY"
+
+	insecureRole   = "insecure"
+	secureRole     = "secure"
+	managementRole = "management"
+
+	// The files passed using "ExtraFiles" start after stdin, stdout, and stderr
+	firstExtraFile = 3
+)
+
+/*
+ErrUpgraded is returned by "Listen" when the server shut down because a new
+process took over its ports. See "PrepareUpgrade."
+*/
+var ErrUpgraded = errors.New("Upgraded to new process")
+
+/*
+Upgrade describes how to start a new process that takes over the ports of
+this one. The new process should be started with "Files" as its extra
+files (like "ExtraFiles" in "os/exec") and with "Env" as its environment,
+and it should call "CreateHTTPScaffoldFromUpgrade."
+*/
+type Upgrade struct {
+	Files []*os.File
+	Env   []string
+}
+
+/*
+Close closes this process's copies of the files. It should be called once
+the new process has started, or if it could not be started.
+*/
+func (u *Upgrade) Close() {
+	for _, f := range u.Files {
+		f.Close()
+	}
+}
+
+/*
+PrepareUpgrade gets ready to hand the insecure, secure, and management
+ports, and any from "AddPort," over to a new process, for instance a new version of the same
+program, so that it can take over without refusing any connections. The
+ports must already be open. Once the new process has started listening,
+this process closes its own listeners, marks itself down, and shuts down
+with the reason "ErrUpgraded," draining the requests that it already has
+as usual. If the new process exits without ever listening, this process
+keeps running, and the error is logged.
+*/
+func (s *HTTPScaffold) PrepareUpgrade() (*Upgrade, error) {
+	if !s.open {
+		return nil, errors.New("the scaffold must be open to upgrade")
+	}
+
+	u := &Upgrade{}
+	var roles []string
+	listeners := []struct {
+		role string
+		l    net.Listener
+	}{
+		{insecureRole, s.insecureListener},
+		{secureRole, s.secureTCP},
+		{managementRole, s.managementListener},
+	}
+	for _, p := range s.ports {
+		listeners = append(listeners, struct {
+			role string
+			l    net.Listener
+		}{portRole(p.name), p.listener})
+	}
+	for _, l := range listeners {
+		if l.l == nil {
+			continue
+		}
+		f, err := listenerFile(l.l)
+		if err != nil {
+			u.Close()
+			return nil, err
+		}
+		roles = append(roles, fmt.Sprintf("%s=%d", l.role, firstExtraFile+len(u.Files)))
+		u.Files = append(u.Files, f)
+	}
+
+	ready, readyChild, err := os.Pipe()
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+	readyFD := firstExtraFile + len(u.Files)
+	u.Files = append(u.Files, readyChild)
+
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, upgradeListenersEnv+"=") &&
+			!strings.HasPrefix(e, upgradeReadyEnv+"=") {
+			u.Env = append(u.Env, e)
+		}
+	}
+	u.Env = append(u.Env,
+		upgradeListenersEnv+"="+strings.Join(roles, ","),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, readyFD))
+
+	go s.waitForUpgrade(ready)
+	return u, nil
+}
+
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot pass listener of type %T", l)
+	}
+	return fl.File()
+}
+
+/*
+waitForUpgrade waits for the new process to write to the pipe. If it
+exits first, we just get EOF.
+*/
+func (s *HTTPScaffold) waitForUpgrade(ready *os.File) {
+	defer ready.Close()
+	buf := make([]byte, 1)
+	n, _ := ready.Read(buf)
+	if n == 0 {
+		s.logError("New process exited before taking over")
+		return
+	}
+
+	s.logInfo("New process has taken over, shutting down")
+	// Stop accepting connections, so that all new ones go to the new
+	// process, but finish the requests that we already have.
+	s.stopAccepting()
+	s.serverLock.Lock()
+	listeners := s.openListeners
+	s.serverLock.Unlock()
+	for _, l := range listeners {
+		l.Close()
+	}
+	s.markDown()
+	s.Shutdown(ErrUpgraded)
+}
+
+/*
+CreateHTTPScaffoldFromUpgrade is like "CreateHTTPScaffold," but if this
+process was started using the result of "PrepareUpgrade," then "Open" uses
+the ports that were passed to it rather than opening new ones, and the
+old process is told to shut down once "StartListen" has been called. The
+other settings, such as the key and certificate for the secure port, must
+be set as usual. If this process was not started that way, it is the same
+as "CreateHTTPScaffold."
+*/
+func CreateHTTPScaffoldFromUpgrade() (*HTTPScaffold, error) {
+	s := CreateHTTPScaffold()
+	listeners := os.Getenv(upgradeListenersEnv)
+	readyStr := os.Getenv(upgradeReadyEnv)
+	if listeners == "" && readyStr == "" {
+		return s, nil
+	}
+	// Do not confuse any processes that we start
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+
+	s.inherited = make(map[string]*os.File)
+	for _, l := range strings.Split(listeners, ",") {
+		if l == "" {
+			continue
+		}
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid inherited listener %q", l)
+		}
+		fd, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid inherited listener %q", l)
+		}
+		s.inherited[parts[0]] = os.NewFile(uintptr(fd), parts[0])
+		switch parts[0] {
+		case insecureRole:
+			s.insecurePort = 0
+		case secureRole:
+			s.securePort = 0
+		case managementRole:
+			s.managementPort = 0
+		default:
+			if isPortRole(parts[0]) {
+				// The port is opened when "AddPort" is called with its name
+				break
+			}
+			return nil, fmt.Errorf("invalid inherited listener %q", l)
+		}
+	}
+
+	if readyStr != "" {
+		fd, err := strconv.Atoi(readyStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upgrade file %q", readyStr)
+		}
+		s.upgradeReady = os.NewFile(uintptr(fd), "upgrade")
+	}
+	return s, nil
+}
+
+/*
+listenTCP returns the listener that we inherited for the role, or else
+opens a new one.
+*/
+func (s *HTTPScaffold) listenTCP(role string, port int) (net.Listener, error) {
+	if f := s.inherited[role]; f != nil {
+		delete(s.inherited, role)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return net.ListenTCP("tcp", &net.TCPAddr{
+		IP:   s.ipAddr,
+		Port: port,
+	})
+}
+
+/*
+signalUpgradeReady tells the old process that we have taken over.
+*/
+func (s *HTTPScaffold) signalUpgradeReady() {
+	if s.upgradeReady == nil {
+		return
+	}
+	s.upgradeReady.Write([]byte{1})
+	s.upgradeReady.Close()
+	s.upgradeReady = nil
+}
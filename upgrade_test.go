@@ -0,0 +1,192 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+/*
+upgradeChildEnv makes the test binary act as the new process in the
+upgrade test.
+*/
+const upgradeChildEnv = "GOSCAFFOLD_TEST_UPGRADE_CHILD"
+
+var _ = Describe("Upgrade tests", func() {
+	It("Hand over ports", func() {
+		s := CreateHTTPScaffold()
+		s.SetManagementPort(0)
+		s.SetHealthPath("/health")
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&namedHandler{name: "old"})
+		}()
+
+		base := s.InsecureURL().String()
+		mgmt := s.ManagementURL().String()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+		code, bod := getText(base + "/")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("old"))
+
+		slowDone := make(chan string, 1)
+		go func() {
+			_, bod := getText(base + "/?delay=1s")
+			slowDone <- bod
+		}()
+		Eventually(func() int {
+			return s.DrainStatus().InFlight
+		}).Should(Equal(1))
+
+		up, err := s.PrepareUpgrade()
+		Expect(err).Should(Succeed())
+		child := exec.Command(os.Args[0], "-test.run=^TestUpgradeChild$")
+		child.Env = append(up.Env, upgradeChildEnv+"=1")
+		child.ExtraFiles = up.Files
+		child.Stdout = GinkgoWriter
+		child.Stderr = GinkgoWriter
+		err = child.Start()
+		up.Close()
+		Expect(err).Should(Succeed())
+		defer child.Process.Kill()
+
+		// The old process drains its request and exits once the new one
+		// has taken over
+		Eventually(stopChan, 10*time.Second).Should(Receive(Equal(ErrUpgraded)))
+		Eventually(slowDone).Should(Receive(Equal("old")))
+
+		// Make sure that we do not reuse a connection to the old process
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
+		code, bod = getText(base + "/")
+		Expect(code).Should(Equal(200))
+		Expect(bod).Should(Equal("new"))
+		code, _ = getText(mgmt + "/health")
+		Expect(code).Should(Equal(200))
+
+		Expect(child.Process.Signal(syscall.SIGTERM)).Should(Succeed())
+		Expect(child.Wait()).Should(Succeed())
+	})
+
+	It("New process fails", func() {
+		s := CreateHTTPScaffold()
+		stopChan := make(chan error)
+		err := s.Open()
+		Expect(err).Should(Succeed())
+
+		go func() {
+			stopChan <- s.Listen(&namedHandler{name: "old"})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		Expect(testGet(s, "")).Should(BeTrue())
+
+		up, err := s.PrepareUpgrade()
+		Expect(err).Should(Succeed())
+		child := exec.Command("false")
+		child.Env = up.Env
+		child.ExtraFiles = up.Files
+		err = child.Start()
+		up.Close()
+		Expect(err).Should(Succeed())
+		child.Wait()
+
+		Consistently(stopChan, 500*time.Millisecond).ShouldNot(Receive())
+		Expect(testGet(s, "")).Should(BeTrue())
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+	})
+
+	It("New process takes over after reopening", func() {
+		s := CreateHTTPScaffold()
+		stopChan := make(chan error)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&namedHandler{name: "old"})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		s.Shutdown(nil)
+		Eventually(stopChan).Should(Receive(Equal(ErrManualStop)))
+
+		// The new process only says that it is ready once the scaffold has
+		// been opened again
+		ready, readyChild, err := os.Pipe()
+		Expect(err).Should(Succeed())
+		defer readyChild.Close()
+		go s.waitForUpgrade(ready)
+		Expect(s.Open()).Should(Succeed())
+		go func() {
+			stopChan <- s.Listen(&namedHandler{name: "old"})
+		}()
+		Eventually(s.AddressesReady(), 5*time.Second).Should(BeClosed())
+		addr := s.InsecureAddress()
+
+		_, err = readyChild.Write([]byte{1})
+		Expect(err).Should(Succeed())
+		Eventually(stopChan).Should(Receive(Equal(ErrUpgraded)))
+		_, err = net.Dial("tcp", addr)
+		Expect(err).ShouldNot(Succeed())
+	})
+})
+
+/*
+TestUpgradeChild is the new process in the upgrade test. It does nothing
+unless the test binary was started by that test.
+*/
+func TestUpgradeChild(t *testing.T) {
+	if os.Getenv(upgradeChildEnv) == "" {
+		return
+	}
+	s, err := CreateHTTPScaffoldFromUpgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetHealthPath("/health")
+	err = s.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.CatchSignals()
+	err = s.Listen(&namedHandler{name: "new"})
+	if err != ErrSignalCaught {
+		t.Fatal(err)
+	}
+}
+
+/*
+namedHandler says which process answered.
+*/
+type namedHandler struct {
+	name string
+}
+
+func (h *namedHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if d, err := time.ParseDuration(req.URL.Query().Get("delay")); err == nil {
+		time.Sleep(d)
+	}
+	fmt.Fprint(resp, h.name)
+}
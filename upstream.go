@@ -0,0 +1,187 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxUpstreamBody is how much of the upstream's response becomes the reason
+const maxUpstreamBody = 512
+
+/*
+ErrUpstreamNotChecked is the reason that an upstream check reports until
+its first request to the upstream completes.
+*/
+var ErrUpstreamNotChecked = errors.New("upstream not checked yet")
+
+/*
+UpstreamDetail is the detail of an upstream check in the verbose health
+output.
+*/
+type UpstreamDetail struct {
+	URL         string    `json:"url" yaml:"url"`
+	StatusCode  int       `json:"statusCode,omitempty" yaml:"statusCode,omitempty"`
+	LastChecked time.Time `json:"lastChecked,omitempty" yaml:"lastChecked,omitempty"`
+	Latency     string    `json:"latency,omitempty" yaml:"latency,omitempty"`
+}
+
+type upstreamCheck struct {
+	s        *HTTPScaffold
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	client   *http.Client
+	once     *sync.Once
+	lock     *sync.Mutex
+	status   HealthStatus
+	reason   error
+	detail   UpstreamDetail
+}
+
+/*
+AddUpstreamCheck registers a health check that is ready only when another
+service is. Every "interval," starting when the scaffold is opened, it
+sends a GET to "url," which would normally be the other service's ready
+path, and it fails if there is no response within "timeout." The check
+reports the result of the last request: "OK" for a 2xx response, and
+otherwise "NotReady," with the body of the response, or the error, as the
+reason. It never reports "Failed," so an upstream that is down makes this
+server not ready without making a liveness probe kill it. The requests
+stop when the scaffold shuts down. The verbose health output includes an
+"UpstreamDetail" for the check.
+*/
+func (s *HTTPScaffold) AddUpstreamCheck(name, url string, interval, timeout time.Duration) {
+	uc := &upstreamCheck{
+		s:        s,
+		url:      url,
+		interval: interval,
+		timeout:  timeout,
+		client:   &http.Client{},
+		once:     &sync.Once{},
+		lock:     &sync.Mutex{},
+		status:   NotReady,
+		reason:   ErrUpstreamNotChecked,
+		detail:   UpstreamDetail{URL: url},
+	}
+	s.upstreams = append(s.upstreams, uc)
+	s.healthChecks = append(s.healthChecks, namedCheck{
+		name:     name,
+		detailed: uc.check,
+		checker: func() (HealthStatus, error) {
+			status, _, err := uc.check()
+			return status, err
+		},
+	})
+}
+
+/*
+startUpstreamChecks starts checking the upstreams in the background. It
+is called by "Open," and otherwise the first time each check is used.
+*/
+func (s *HTTPScaffold) startUpstreamChecks() {
+	for _, uc := range s.upstreams {
+		uc.start()
+	}
+}
+
+func (uc *upstreamCheck) start() {
+	uc.once.Do(func() {
+		go uc.run(uc.s.ensureTracker().done)
+	})
+}
+
+func (uc *upstreamCheck) check() (HealthStatus, interface{}, error) {
+	uc.start()
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	detail := uc.detail
+	return uc.status, &detail, uc.reason
+}
+
+func (uc *upstreamCheck) run(done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Cancel any request that is running when we stop
+		<-done
+		cancel()
+	}()
+
+	for {
+		uc.poll(ctx)
+		select {
+		case <-uc.s.clock.After(uc.interval):
+		case <-done:
+			return
+		}
+	}
+}
+
+func (uc *upstreamCheck) poll(ctx context.Context) {
+	start := uc.s.clock.Now()
+	code, err := uc.get(ctx)
+	if ctx.Err() == context.Canceled {
+		// We are shutting down, so the result means nothing
+		return
+	}
+	status := OK
+	if err != nil {
+		status = NotReady
+	}
+
+	uc.lock.Lock()
+	defer uc.lock.Unlock()
+	uc.status = status
+	uc.reason = err
+	uc.detail.StatusCode = code
+	uc.detail.LastChecked = start
+	uc.detail.Latency = uc.s.since(start).String()
+}
+
+/*
+get returns the status code, and an error unless it was 2xx.
+*/
+func (uc *upstreamCheck) get(ctx context.Context) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, uc.timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", uc.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "text/plain")
+	resp, err := uc.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxUpstreamBody))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, nil
+	}
+	msg := sanitizeMessage(strings.TrimSpace(string(body)))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return resp.StatusCode, fmt.Errorf("upstream returned %d: %s", resp.StatusCode, msg)
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upstream check tests", func() {
+	It("Upstream readiness", func() {
+		var code int32 = 503
+		var requests int32
+		block := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if c := atomic.LoadInt32(&code); c == 0 {
+				<-block
+			} else {
+				resp.WriteHeader(int(c))
+				resp.Write([]byte("database down\n"))
+			}
+		}))
+		defer upstream.Close()
+		defer close(block)
+
+		s := CreateHTTPScaffold()
+		s.AddUpstreamCheck("orders", upstream.URL+"/ready", 10*time.Millisecond, 50*time.Millisecond)
+		status, _, _ := s.evaluateHealth()
+		Expect(status).Should(Equal(NotReady))
+		Expect(s.Open()).Should(Succeed())
+
+		readyStatus := func() HealthStatus {
+			st, _, _ := s.evaluateHealth()
+			return st
+		}
+		Eventually(func() error {
+			_, _, err := s.evaluateHealth()
+			return err
+		}).Should(MatchError("upstream returned 503: database down"))
+
+		atomic.StoreInt32(&code, 200)
+		Eventually(readyStatus).Should(Equal(OK))
+
+		// Timeouts are only NotReady
+		atomic.StoreInt32(&code, 0)
+		Eventually(readyStatus).Should(Equal(NotReady))
+		Consistently(readyStatus, 100*time.Millisecond).Should(Equal(NotReady))
+
+		atomic.StoreInt32(&code, 200)
+		Eventually(readyStatus).Should(Equal(OK))
+		_, results, _ := s.evaluateHealth()
+		Expect(results).Should(HaveLen(1))
+		detail := results[0].Detail.(*UpstreamDetail)
+		Expect(detail.URL).Should(Equal(upstream.URL + "/ready"))
+		Expect(detail.StatusCode).Should(Equal(200))
+		Expect(detail.LastChecked).Should(BeTemporally("~", time.Now(), time.Second))
+
+		// Stops when the scaffold does
+		s.Shutdown(nil)
+		Expect(s.WaitForShutdown()).Should(Equal(ErrManualStop))
+		time.Sleep(50 * time.Millisecond)
+		count := atomic.LoadInt32(&requests)
+		Consistently(func() int32 {
+			return atomic.LoadInt32(&requests)
+		}, 100*time.Millisecond).Should(Equal(count))
+	})
+
+	It("Unreachable upstream", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).Should(Succeed())
+		addr := l.Addr().String()
+		l.Close()
+
+		s := CreateHTTPScaffold()
+		s.AddUpstreamCheck("gone", "http://"+addr+"/ready", 10*time.Millisecond, time.Second)
+		s.Handlers(&testHandler{})
+		Eventually(func() string {
+			_, _, err := s.evaluateHealth()
+			if err == nil {
+				return ""
+			}
+			return err.Error()
+		}).Should(ContainSubstring("refused"))
+		st, _, _ := s.evaluateHealth()
+		Expect(st).Should(Equal(NotReady))
+		s.Shutdown(nil)
+	})
+})
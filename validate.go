@@ -0,0 +1,154 @@
+// Copyright 2017 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package goscaffold
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxValidationMessage is the most of a validation error that is sent back
+const maxValidationMessage = 200
+
+/*
+RequestValidator checks an application request before anything else
+happens to it. If it returns an error, the request is rejected with a 400.
+It must not read the body.
+*/
+type RequestValidator func(req *http.Request) error
+
+/*
+SetRequestValidator sets a function that is called for every application
+request before it is passed to the handler, and before its body is read.
+If it returns an error, the request is rejected with a 400 whose message
+is the text of the error, with control characters removed and cut short
+if it is long, and it is counted and logged as "RejectionInvalid." Use
+"CombineValidators" to set more than one.
+*/
+func (s *HTTPScaffold) SetRequestValidator(v RequestValidator) {
+	s.requestValidator = v
+}
+
+/*
+CombineValidators returns a validator that calls each of the validators
+in turn and returns the first error.
+*/
+func CombineValidators(validators ...RequestValidator) RequestValidator {
+	return func(req *http.Request) error {
+		for _, v := range validators {
+			if err := v(req); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+/*
+MaxURILength returns a validator that rejects requests whose URI, as sent
+by the client, is longer than "n" bytes.
+*/
+func MaxURILength(n int) RequestValidator {
+	return func(req *http.Request) error {
+		uri := req.RequestURI
+		if uri == "" {
+			uri = req.URL.RequestURI()
+		}
+		if len(uri) > n {
+			return fmt.Errorf("URI is longer than %d bytes", n)
+		}
+		return nil
+	}
+}
+
+/*
+MaxHeaderCount returns a validator that rejects requests with more than
+"n" header lines. A header with more than one value counts once for each.
+*/
+func MaxHeaderCount(n int) RequestValidator {
+	return func(req *http.Request) error {
+		count := 0
+		for _, values := range req.Header {
+			count += len(values)
+		}
+		if count > n {
+			return fmt.Errorf("more than %d headers", n)
+		}
+		return nil
+	}
+}
+
+/*
+RequireHost returns a validator that rejects requests unless their "Host"
+header is one of "hosts." The comparison ignores case, and a host without
+a port matches the header with any port.
+*/
+func RequireHost(hosts ...string) RequestValidator {
+	return func(req *http.Request) error {
+		name := req.Host
+		if h, _, err := net.SplitHostPort(req.Host); err == nil {
+			name = h
+		}
+		for _, h := range hosts {
+			if strings.EqualFold(h, req.Host) || strings.EqualFold(h, name) {
+				return nil
+			}
+		}
+		return fmt.Errorf("host %q is not allowed", req.Host)
+	}
+}
+
+/*
+checkValid returns true if the request may proceed, and otherwise responds
+with a 400.
+*/
+func (s *HTTPScaffold) checkValid(resp http.ResponseWriter, req *http.Request) bool {
+	if s.requestValidator == nil {
+		return true
+	}
+	err := s.requestValidator(req)
+	if err == nil {
+		return true
+	}
+	s.discardBody(resp, req)
+	s.markRejected(resp)
+	WriteErrorResponse(http.StatusBadRequest, sanitizeMessage(err.Error()), resp)
+	return false
+}
+
+/*
+sanitizeMessage makes an error safe to send back, since validators may
+quote whatever the client sent.
+*/
+func sanitizeMessage(msg string) string {
+	msg = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return -1
+		}
+		return r
+	}, msg)
+	if len(msg) > maxValidationMessage {
+		cut := maxValidationMessage
+		for cut > 0 && !utf8.RuneStart(msg[cut]) {
+			cut--
+		}
+		msg = msg[:cut] + "..."
+	}
+	return msg
+}